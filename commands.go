@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"sync-and-transcode-music-files/engine"
+)
+
+// profileFromFlag loads the profile at the path given with -profile, or
+// returns the default profile if no path was given.
+func profileFromFlag(path string) (engine.Profile, error) {
+	if path == "" {
+		return engine.DefaultProfile(), nil
+	}
+	return engine.LoadProfile(path)
+}
+
+// interruptContext returns a context that is cancelled when the process is
+// interrupted or terminated.
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// commands maps subcommand names to their implementations. Running the tool
+// without a subcommand syncs the source directory to the destination.
+var commands = map[string]func(args []string) error{
+	"dedupe": runDedupeCommand,
+	"undo":   runUndoCommand,
+	"trash":  runTrashCommand,
+	"watch":  runWatchCommand,
+	"daemon": runDaemonCommand,
+}
+
+// runSyncCommand syncs the source directory to the destination, then removes
+// duplicate files from the destination. It runs when no subcommand is given.
+//
+// Example usage:
+//
+//	sync-and-transcode-music-files -source ~/Music -destination /media/usb -profile car.yaml
+func runSyncCommand(args []string) error {
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	sourcePtr := flags.String("source", "source", "Directory in which to find original music files")
+	destinationPtr := flags.String("destination", "destination", "Output directory for transcoded files, or an sftp://, webdav://, webdavs:// or mtp:// URL")
+	dryRunPtr := flags.Bool("dry-run", false, "Show which files would be synced and which duplicates would be deleted, without changing the destination")
+	profilePtr := flags.String("profile", "", "YAML profile with device settings such as folder limits")
+	interactivePtr := flags.Bool("interactive", false, "Review each group of duplicates and choose which file to keep")
+	trashPtr := flags.String("trash", "", "Directory to move deleted duplicates to (default: "+engine.TrashDirName+" in the destination)")
+	outputPtr := flags.String("output", "human", "Output format: human, or json for one JSON event per line")
+	verbosePtr := flags.Bool("v", false, "Show debug messages")
+	quietPtr := flags.Bool("q", false, "Only show warnings and errors")
+	waitPtr := flags.Bool("wait", false, "Wait for another run that is syncing to the destination to finish")
+	jobsPtr := flags.Int("jobs", runtime.NumCPU(), "Number of files to transcode at the same time")
+	transcoderPtr := flags.String("transcoder", "goffmpeg", "How to run ffmpeg: goffmpeg, or ffmpeg to run the command directly")
+	logFilePtr := flags.String("log-file", "", "Log file (default: "+engine.LogDirName+"/"+engine.LogFileName+" in the destination)")
+	followSymlinksPtr := flags.Bool("follow-symlinks", false, "Also sync the files in symlinked folders of the source")
+	skipLinkedPtr := flags.Bool("skip-linked-duplicates", false, "Sync a file that is in the source more than once, as hard links or through symlinks, only once")
+	caseInsensitivePtr := flags.Bool("case-insensitive", false, "Compare destination file names regardless of case, for FAT32 and exFAT devices")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	printer, err := outputFromFlags(*outputPtr, *interactivePtr, *verbosePtr, *quietPtr)
+	if err != nil {
+		return err
+	}
+	if *outputPtr == "human" && !*quietPtr && !*dryRunPtr {
+		printer.progress = newProgressDisplay(os.Stdout, isTerminal(os.Stdout), time.Now)
+	}
+	trans, err := engine.NewTranscoder(*transcoderPtr)
+	if err != nil {
+		return err
+	}
+
+	log := &engine.LogOptions{Path: *logFilePtr, Verbose: *verbosePtr, Attrs: []any{"version", version}}
+	prof, err := profileFromFlag(*profilePtr)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	_, err = engine.Sync(ctx, engine.Options{
+		Sources:              []string{*sourcePtr},
+		Destination:          *destinationPtr,
+		Profile:              &prof,
+		Jobs:                 *jobsPtr,
+		Wait:                 *waitPtr,
+		FollowSymlinks:       *followSymlinksPtr,
+		SkipLinkedDuplicates: *skipLinkedPtr,
+		CaseInsensitive:      *caseInsensitivePtr,
+		Transcoder:           trans,
+		OnEvent:              printer.handle,
+		DryRun:               *dryRunPtr,
+		Log:                  log,
+	})
+	if err != nil {
+		return err
+	}
+	// A dry run doesn't create a new destination, which has no duplicates
+	if _, err := os.Stat(*destinationPtr); *dryRunPtr && !engine.IsRemote(*destinationPtr) && os.IsNotExist(err) {
+		return nil
+	}
+
+	opts := engine.DedupeOptions{
+		Dir:        *destinationPtr,
+		DryRun:     *dryRunPtr,
+		TrashDir:   *trashPtr,
+		Profile:    &prof,
+		Wait:       *waitPtr,
+		Transcoder: trans,
+		OnEvent:    printer.handle,
+		Log:        log,
+	}
+	if *interactivePtr {
+		opts.ReviewInput, opts.ReviewOutput = os.Stdin, os.Stdout
+	}
+	_, err = engine.Dedupe(ctx, opts)
+	return err
+}
+
+// runDedupeCommand removes duplicate files from a directory without syncing.
+//
+// Example usage:
+//
+//	sync-and-transcode-music-files dedupe -dir /media/usb -content -dry-run
+//	sync-and-transcode-music-files dedupe -dir /media/usb -acoustic -threshold 0.8
+func runDedupeCommand(args []string) error {
+	flags := flag.NewFlagSet("dedupe", flag.ExitOnError)
+	dirPtr := flags.String("dir", "destination", "Directory in which to find duplicate files, or an sftp://, webdav://, webdavs:// or mtp:// URL")
+	dryRunPtr := flags.Bool("dry-run", false, "Show which duplicate files would be deleted without deleting them")
+	contentPtr := flags.Bool("content", false, "Find files with identical audio in any folder, ignoring names and tags")
+	acousticPtr := flags.Bool("acoustic", false, "Find files that sound like the same recording in any folder, e.g. at different bit rates")
+	thresholdPtr := flags.Float64("threshold", engine.DefaultSimilarityThreshold, "Fraction of matching fingerprint bits for -acoustic (0.5 to 1)")
+	profilePtr := flags.String("profile", "", "YAML profile with the quality ranking for choosing which copy to keep")
+	trashPtr := flags.String("trash", "", "Directory to move deleted duplicates to (default: "+engine.TrashDirName+" in -dir)")
+	interactivePtr := flags.Bool("interactive", false, "Review each group of duplicates and choose which file to keep")
+	waitPtr := flags.Bool("wait", false, "Wait for another run that is changing -dir to finish")
+	transcoderPtr := flags.String("transcoder", "goffmpeg", "How to run ffprobe: goffmpeg, or ffmpeg to run the command directly")
+	outputPtr := flags.String("output", "human", "Output format: human, or json for one JSON event per line")
+	verbosePtr := flags.Bool("v", false, "Show debug messages")
+	quietPtr := flags.Bool("q", false, "Only show warnings and errors")
+	logFilePtr := flags.String("log-file", "", "Log file (default: "+engine.LogDirName+"/"+engine.LogFileName+" in -dir)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	printer, err := outputFromFlags(*outputPtr, *interactivePtr, *verbosePtr, *quietPtr)
+	if err != nil {
+		return err
+	}
+	trans, err := engine.NewTranscoder(*transcoderPtr)
+	if err != nil {
+		return err
+	}
+
+	log := &engine.LogOptions{Path: *logFilePtr, Verbose: *verbosePtr, Attrs: []any{"version", version}}
+	prof, err := profileFromFlag(*profilePtr)
+	if err != nil {
+		return err
+	}
+
+	opts := engine.DedupeOptions{
+		Dir:                 *dirPtr,
+		DryRun:              *dryRunPtr,
+		TrashDir:            *trashPtr,
+		ByContent:           *contentPtr,
+		Acoustic:            *acousticPtr,
+		SimilarityThreshold: *thresholdPtr,
+		Profile:             &prof,
+		Wait:                *waitPtr,
+		Transcoder:          trans,
+		OnEvent:             printer.handle,
+		Log:                 log,
+	}
+	if *interactivePtr {
+		opts.ReviewInput, opts.ReviewOutput = os.Stdin, os.Stdout
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	_, err = engine.Dedupe(ctx, opts)
+	return err
+}
+
+// runUndoCommand restores the files moved to the trash by the most recent
+// run, or by the run given with -session.
+//
+// Example usage:
+//
+//	sync-and-transcode-music-files undo -dir /media/usb
+func runUndoCommand(args []string) error {
+	flags := flag.NewFlagSet("undo", flag.ExitOnError)
+	dirPtr := flags.String("dir", "destination", "Directory whose deleted files should be restored")
+	trashPtr := flags.String("trash", "", "Directory deleted files were moved to (default: "+engine.TrashDirName+" in -dir)")
+	sessionPtr := flags.String("session", "", "Trash session to restore, e.g. 2024-05-01T18-30-00 (default: most recent)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	printer := newEventPrinter("human", os.Stdout, os.Stderr)
+	restored, err := engine.RestoreTrash(*dirPtr, *trashPtr, *sessionPtr, printer.handle)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("♻️  Restored %d files\n", restored)
+	return nil
+}
+
+// runTrashCommand manages the trash. The only subcommand is "purge", which
+// permanently deletes trash sessions older than --older-than.
+//
+// Example usage:
+//
+//	sync-and-transcode-music-files trash purge -dir /media/usb --older-than 30d
+func runTrashCommand(args []string) error {
+	if len(args) == 0 || args[0] != "purge" {
+		return fmt.Errorf("usage: trash purge [-dir directory] [-trash directory] --older-than age")
+	}
+
+	flags := flag.NewFlagSet("trash purge", flag.ExitOnError)
+	dirPtr := flags.String("dir", "destination", "Directory whose trash should be purged")
+	trashPtr := flags.String("trash", "", "Trash directory (default: "+engine.TrashDirName+" in -dir)")
+	olderThanPtr := flags.String("older-than", "30d", "Purge trash sessions older than this age, e.g. 30d or 12h")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	olderThan, err := engine.ParseAge(*olderThanPtr)
+	if err != nil {
+		return err
+	}
+
+	printer := newEventPrinter("human", os.Stdout, os.Stderr)
+	purged, err := engine.PurgeTrash(*dirPtr, *trashPtr, olderThan, printer.handle)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("🔥 Purged %d trash sessions\n", len(purged))
+	return nil
+}
+
+// runWatchCommand syncs the source directory, then keeps watching it and
+// syncs new files as soon as they are completely written, until interrupted.
+//
+// Example usage:
+//
+//	sync-and-transcode-music-files watch -source ~/Music -destination /media/usb -profile car.yaml
+func runWatchCommand(args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ExitOnError)
+	sourcePtr := flags.String("source", "source", "Directory in which to find original music files")
+	destinationPtr := flags.String("destination", "destination", "Output directory for transcoded files, or an sftp://, webdav://, webdavs:// or mtp:// URL")
+	profilePtr := flags.String("profile", "", "YAML profile with device settings such as folder limits")
+	jobsPtr := flags.Int("jobs", runtime.NumCPU(), "Number of files to transcode at the same time")
+	transcoderPtr := flags.String("transcoder", "goffmpeg", "How to run ffmpeg: goffmpeg, or ffmpeg to run the command directly")
+	waitPtr := flags.Bool("wait", false, "Wait for another run that is syncing to the destination to finish")
+	settlePtr := flags.Duration("settle", engine.DefaultSettleTime, "How long a new file's size has to stay the same before it is synced")
+	outputPtr := flags.String("output", "human", "Output format: human, or json for one JSON event per line")
+	verbosePtr := flags.Bool("v", false, "Show debug messages")
+	quietPtr := flags.Bool("q", false, "Only show warnings and errors")
+	logFilePtr := flags.String("log-file", "", "Log file (default: "+engine.LogDirName+"/"+engine.LogFileName+" in the destination)")
+	followSymlinksPtr := flags.Bool("follow-symlinks", false, "Also sync the files in symlinked folders of the source")
+	skipLinkedPtr := flags.Bool("skip-linked-duplicates", false, "Sync a file that is in the source more than once, as hard links or through symlinks, only once")
+	caseInsensitivePtr := flags.Bool("case-insensitive", false, "Compare destination file names regardless of case, for FAT32 and exFAT devices")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	printer, err := outputFromFlags(*outputPtr, false, *verbosePtr, *quietPtr)
+	if err != nil {
+		return err
+	}
+	trans, err := engine.NewTranscoder(*transcoderPtr)
+	if err != nil {
+		return err
+	}
+
+	log := &engine.LogOptions{Path: *logFilePtr, Verbose: *verbosePtr, Attrs: []any{"version", version}}
+	prof, err := profileFromFlag(*profilePtr)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	return engine.Watch(ctx, engine.Options{
+		Sources:              []string{*sourcePtr},
+		Destination:          *destinationPtr,
+		Profile:              &prof,
+		Jobs:                 *jobsPtr,
+		Wait:                 *waitPtr,
+		FollowSymlinks:       *followSymlinksPtr,
+		SkipLinkedDuplicates: *skipLinkedPtr,
+		CaseInsensitive:      *caseInsensitivePtr,
+		Transcoder:           trans,
+		OnEvent:              printer.handle,
+		Log:                  log,
+	}, *settlePtr)
+}
+
+// runDaemonCommand waits for volumes to be mounted and syncs each volume that
+// has a .sync-profile.yaml at its root, or whose label matches the
+// volume_label of a profile in -profiles.
+//
+// Example usage:
+//
+//	sync-and-transcode-music-files daemon -source ~/Music -profiles ~/.config/music-profiles
+func runDaemonCommand(args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ExitOnError)
+	sourcePtr := flags.String("source", "source", "Directory in which to find original music files")
+	profilesPtr := flags.String("profiles", "", "Directory of YAML profiles with a volume_label")
+	mountsPtr := flags.String("mounts", "", "Directory whose subdirectories are mounted volumes, e.g. /media/username (default: read "+engine.MountInfoPath+")")
+	intervalPtr := flags.Duration("interval", engine.DefaultMountPollInterval, "How often to check for new volumes")
+	jobsPtr := flags.Int("jobs", runtime.NumCPU(), "Number of files to transcode at the same time")
+	transcoderPtr := flags.String("transcoder", "goffmpeg", "How to run ffmpeg: goffmpeg, or ffmpeg to run the command directly")
+	outputPtr := flags.String("output", "human", "Output format: human, or json for one JSON event per line")
+	verbosePtr := flags.Bool("v", false, "Show debug messages")
+	quietPtr := flags.Bool("q", false, "Only show warnings and errors")
+	logFilePtr := flags.String("log-file", "", "Log file (default: daemon.log in the user cache directory)")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	printer, err := outputFromFlags(*outputPtr, false, *verbosePtr, *quietPtr)
+	if err != nil {
+		return err
+	}
+	trans, err := engine.NewTranscoder(*transcoderPtr)
+	if err != nil {
+		return err
+	}
+
+	logPath := *logFilePtr
+	if logPath == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		logPath = filepath.Join(cacheDir, "sync-and-transcode-music-files", "daemon.log")
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+	return engine.RunDaemon(ctx, engine.DaemonOptions{
+		Source:      *sourcePtr,
+		ProfilesDir: *profilesPtr,
+		MountsDir:   *mountsPtr,
+		Interval:    *intervalPtr,
+		Jobs:        *jobsPtr,
+		Transcoder:  trans,
+		OnEvent:     printer.handle,
+		Log:         &engine.LogOptions{Path: logPath, Verbose: *verbosePtr, Attrs: []any{"version", version}},
+	})
+}
@@ -0,0 +1,445 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/cmplx"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// fingerprintSampleRate is the rate audio is decoded at before
+	// fingerprinting. Only frequencies below 2 kHz are used.
+	fingerprintSampleRate = 11025
+
+	// fingerprintSeconds limits how much of each track is decoded.
+	fingerprintSeconds = 120
+
+	fingerprintFrameSize = 4096
+	fingerprintHopSize   = fingerprintFrameSize / 3
+
+	// fingerprintBands is the number of frequency bands whose energy
+	// differences make up the 32 bits of each sub-fingerprint.
+	fingerprintBands    = 33
+	fingerprintMinFreq  = 300.0
+	fingerprintMaxFreq  = 2000.0
+	fingerprintMaxShift = 30
+
+	// fingerprintSilence is the RMS level below which a frame is left out of
+	// the fingerprint, about -60 dBFS. Silence has no spectrum to compare,
+	// so a silent track has an empty fingerprint and matches nothing.
+	fingerprintSilence = 0.001
+
+	// DefaultSimilarityThreshold is the fraction of matching fingerprint bits
+	// at which two tracks are considered the same recording. Unrelated
+	// tracks match about half of the bits.
+	DefaultSimilarityThreshold = 0.75
+)
+
+// decodePCM decodes up to seconds of a music file to mono samples at
+// sampleRate using ffmpeg.
+func decodePCM(path string, sampleRate, seconds int) ([]float64, error) {
+	return decodePCMWith("ffmpeg", path, sampleRate, seconds)
+}
+
+// decodePCMWith is decodePCM using the ffmpeg executable at ffmpegPath.
+func decodePCMWith(ffmpegPath, path string, sampleRate, seconds int) ([]float64, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(ffmpegPath, "-v", "error", "-i", path,
+		"-t", strconv.Itoa(seconds), "-ac", "1", "-ar", strconv.Itoa(sampleRate),
+		"-f", "s16le", "-")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, newFFmpegError(fmt.Errorf("failed to decode %s: %v", path, err), stderr.String())
+	}
+
+	raw := stdout.Bytes()
+	samples := make([]float64, len(raw)/2)
+	for i := range samples {
+		samples[i] = float64(int16(binary.LittleEndian.Uint16(raw[i*2:]))) / math.MaxInt16
+	}
+	return samples, nil
+}
+
+// computeFingerprint computes an acoustic fingerprint of mono samples. Each
+// overlapping frame yields a 32-bit sub-fingerprint; bit m is set when the
+// energy difference between frequency bands m and m+1 increased compared to
+// the previous frame. Because only the shape of the spectrum over time is
+// used, the fingerprint survives re-encoding at a different bit rate, volume
+// changes and small amounts of noise. Silent frames are skipped.
+func computeFingerprint(samples []float64, sampleRate int) []uint32 {
+	if len(samples) < fingerprintFrameSize {
+		return nil
+	}
+
+	// Hann window
+	window := make([]float64, fingerprintFrameSize)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(fingerprintFrameSize-1))
+	}
+
+	// Logarithmically spaced band edges, as FFT bin indexes
+	edges := make([]int, fingerprintBands+1)
+	for i := range edges {
+		freq := fingerprintMinFreq * math.Pow(fingerprintMaxFreq/fingerprintMinFreq, float64(i)/fingerprintBands)
+		edges[i] = int(freq * fingerprintFrameSize / float64(sampleRate))
+	}
+
+	var fingerprint []uint32
+	var previous []float64
+	frame := make([]complex128, fingerprintFrameSize)
+	for start := 0; start+fingerprintFrameSize <= len(samples); start += fingerprintHopSize {
+		power := 0.0
+		for _, sample := range samples[start : start+fingerprintFrameSize] {
+			power += sample * sample
+		}
+		if math.Sqrt(power/fingerprintFrameSize) < fingerprintSilence {
+			continue
+		}
+
+		for i := range frame {
+			frame[i] = complex(samples[start+i]*window[i], 0)
+		}
+		spectrum := fft(frame)
+
+		energies := make([]float64, fingerprintBands)
+		for band := range energies {
+			for bin := edges[band]; bin < edges[band+1] || bin == edges[band]; bin++ {
+				magnitude := cmplx.Abs(spectrum[bin])
+				energies[band] += magnitude * magnitude
+			}
+		}
+
+		if previous != nil {
+			var subFingerprint uint32
+			for m := 0; m < 32; m++ {
+				difference := (energies[m] - energies[m+1]) - (previous[m] - previous[m+1])
+				if difference > 0 {
+					subFingerprint |= 1 << m
+				}
+			}
+			fingerprint = append(fingerprint, subFingerprint)
+		}
+		previous = energies
+	}
+
+	return fingerprint
+}
+
+// fft computes the discrete Fourier transform of a slice whose length is a
+// power of two, using the iterative radix-2 Cooley-Tukey algorithm.
+func fft(input []complex128) []complex128 {
+	n := len(input)
+	output := make([]complex128, n)
+	shift := 64 - bits.Len(uint(n-1))
+	for i := range input {
+		output[bits.Reverse64(uint64(i))>>shift] = input[i]
+	}
+
+	for size := 2; size <= n; size <<= 1 {
+		step := cmplx.Exp(complex(0, -2*math.Pi/float64(size)))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				even := output[start+k]
+				odd := w * output[start+k+size/2]
+				output[start+k] = even + odd
+				output[start+k+size/2] = even - odd
+				w *= step
+			}
+		}
+	}
+
+	return output
+}
+
+// fingerprintSimilarity returns the fraction of matching bits between two
+// fingerprints at the best alignment within fingerprintMaxShift frames, so
+// that rips with slightly different leading silence still match. At least
+// half of the shorter fingerprint has to overlap.
+func fingerprintSimilarity(a, b []uint32) float64 {
+	shorter := min(len(a), len(b))
+	if shorter == 0 {
+		return 0
+	}
+
+	best := 0.0
+	for shift := -fingerprintMaxShift; shift <= fingerprintMaxShift; shift++ {
+		differentBits, compared := 0, 0
+		for i := range a {
+			j := i + shift
+			if j < 0 || j >= len(b) {
+				continue
+			}
+			differentBits += bits.OnesCount32(a[i] ^ b[j])
+			compared++
+		}
+		if compared*2 < shorter {
+			continue
+		}
+		best = math.Max(best, 1-float64(differentBits)/float64(compared*32))
+	}
+	return best
+}
+
+// cachedFingerprint is a fingerprint stored in the fingerprint cache, along
+// with the file size and modification time used to detect changed files.
+type cachedFingerprint struct {
+	Size        int64    `json:"size"`
+	ModTime     int64    `json:"mod_time"`
+	Fingerprint []uint32 `json:"fingerprint"`
+}
+
+// fingerprintCache stores acoustic fingerprints in a JSON file so that
+// unchanged files don't have to be decoded again. Files are keyed by their
+// absolute path.
+type fingerprintCache struct {
+	path    string
+	entries map[string]cachedFingerprint
+	changed bool
+}
+
+// defaultFingerprintCachePath returns the file in the user cache directory in
+// which fingerprints are cached, outside of any scanned directory so that the
+// cache isn't synced or deduplicated itself. Returns "" if there is no user
+// cache directory.
+func (r *run) defaultFingerprintCachePath() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		r.logger.Debug("not caching fingerprints", "error", err)
+		return ""
+	}
+	return filepath.Join(cacheDir, "sync-and-transcode-music-files", "acoustic-fingerprints.json")
+}
+
+// loadFingerprintCache reads the cache at the specified path. A missing or
+// unreadable cache starts out empty, and one without a path is only kept in
+// memory.
+func (r *run) loadFingerprintCache(path string) *fingerprintCache {
+	cache := &fingerprintCache{path: path, entries: make(map[string]cachedFingerprint)}
+	if path == "" {
+		return cache
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &cache.entries); err != nil {
+			r.reporter.warn("fingerprint", path, fmt.Sprintf("Ignoring unreadable fingerprint cache (%v)", err))
+			cache.entries = make(map[string]cachedFingerprint)
+		}
+	}
+	return cache
+}
+
+// fingerprint returns the fingerprint of the file at the specified path from
+// the cache, or computes it with compute if the file is new or changed.
+func (c *fingerprintCache) fingerprint(path string, compute func(string) ([]uint32, error)) ([]uint32, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry, ok := c.entries[key]; ok && entry.Size == info.Size() && entry.ModTime == info.ModTime().UnixNano() {
+		return entry.Fingerprint, nil
+	}
+
+	fingerprint, err := compute(path)
+	if err != nil {
+		return nil, err
+	}
+	c.entries[key] = cachedFingerprint{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Fingerprint: fingerprint}
+	c.changed = true
+	return fingerprint, nil
+}
+
+// save writes the cache to disk if any fingerprints were added.
+func (c *fingerprintCache) save() error {
+	if !c.changed || c.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, data, 0644)
+}
+
+// fingerprintFile decodes a music file with trans and computes its acoustic
+// fingerprint.
+func fingerprintFile(trans Transcoder, path string) ([]uint32, error) {
+	samples, err := trans.DecodePCM(path, fingerprintSampleRate, fingerprintSeconds)
+	if err != nil {
+		return nil, err
+	}
+	return computeFingerprint(samples, fingerprintSampleRate), nil
+}
+
+// findAcousticDuplicates scans a directory and returns groups of music files
+// that sound like the same recording, such as the same song ripped twice or
+// encoded at different bit rates.
+//
+// Files that may be similar are first collected through the pairs of files
+// with a similarity of at least threshold. Of those, keep chooses the file to
+// keep, and only the files that are at least as similar to it form its group,
+// since similarity isn't transitive; the rest are grouped again around the
+// next file to keep. Files without a fingerprint, e.g. silent tracks, are
+// never grouped.
+//
+// Fingerprints are cached in the file at cachePath, if it isn't empty. The
+// key of each group is the first file of the group in sorted order.
+func (r *run) findAcousticDuplicates(dir string, threshold float64, cachePath string, compute func(string) ([]uint32, error), keep func([]string) string) (map[string][]string, error) {
+	relPaths, err := getFilenames(newOSFS(dir), ".")
+	if err != nil {
+		return nil, err
+	}
+
+	cache := r.loadFingerprintCache(cachePath)
+	var paths []string
+	var fingerprints [][]uint32
+	for _, rel := range relPaths {
+		if strings.HasPrefix(filepath.Base(rel), "._") || !isMusicFile(rel) {
+			continue
+		}
+
+		path := filepath.Join(dir, rel)
+		fingerprint, err := cache.fingerprint(path, compute)
+		if err != nil {
+			r.reporter.fail("fingerprint", path, err)
+			continue
+		}
+		if len(fingerprint) == 0 {
+			r.logger.Debug("skipping file without audible audio", "path", path)
+			continue
+		}
+		paths = append(paths, path)
+		fingerprints = append(fingerprints, fingerprint)
+	}
+
+	if err := cache.save(); err != nil {
+		r.reporter.fail("fingerprint", cache.path, err)
+	}
+
+	// Collect possibly similar files with a union-find over the candidate
+	// pairs
+	parent := make([]int, len(paths))
+	for i := range parent {
+		parent[i] = i
+	}
+	var root func(int) int
+	root = func(i int) int {
+		if parent[i] != i {
+			parent[i] = root(parent[i])
+		}
+		return parent[i]
+	}
+
+	for _, pair := range fingerprintCandidatePairs(fingerprints) {
+		a, b := pair[0], pair[1]
+		if root(a) == root(b) {
+			continue
+		}
+		if fingerprintSimilarity(fingerprints[a], fingerprints[b]) >= threshold {
+			parent[root(a)] = root(b)
+		}
+	}
+
+	components := make(map[int][]int)
+	for i := range paths {
+		components[root(i)] = append(components[root(i)], i)
+	}
+
+	duplicates := make(map[string][]string)
+	for _, remaining := range components {
+		for len(remaining) > 1 {
+			candidates := make([]string, len(remaining))
+			for n, i := range remaining {
+				candidates[n] = paths[i]
+			}
+			kept := remaining[0]
+			if keptPath := keep(candidates); keptPath != "" {
+				for _, i := range remaining {
+					if paths[i] == keptPath {
+						kept = i
+					}
+				}
+			}
+
+			group := []string{paths[kept]}
+			var rest []int
+			for _, i := range remaining {
+				switch {
+				case i == kept:
+				case fingerprintSimilarity(fingerprints[kept], fingerprints[i]) >= threshold:
+					group = append(group, paths[i])
+				default:
+					rest = append(rest, i)
+				}
+			}
+			if len(group) > 1 {
+				sort.Strings(group)
+				duplicates[group[0]] = group
+			}
+			remaining = rest
+		}
+	}
+	return duplicates, nil
+}
+
+// fingerprintCandidatePairs returns the pairs of fingerprints that share at
+// least one identical sub-fingerprint, which recordings of the same audio
+// almost always do. This avoids comparing every pair of files in large
+// libraries. Sub-fingerprints that occur in many files, such as those of
+// silence, are ignored.
+func fingerprintCandidatePairs(fingerprints [][]uint32) [][2]int {
+	index := make(map[uint32][]int)
+	for i, fingerprint := range fingerprints {
+		seen := make(map[uint32]bool)
+		for _, subFingerprint := range fingerprint {
+			if !seen[subFingerprint] {
+				seen[subFingerprint] = true
+				index[subFingerprint] = append(index[subFingerprint], i)
+			}
+		}
+	}
+
+	maxFilesPerValue := max(10, len(fingerprints)/20)
+	pairs := make(map[[2]int]bool)
+	for _, files := range index {
+		if len(files) > maxFilesPerValue {
+			continue
+		}
+		for x := 0; x < len(files); x++ {
+			for y := x + 1; y < len(files); y++ {
+				pairs[[2]int{files[x], files[y]}] = true
+			}
+		}
+	}
+
+	result := make([][2]int, 0, len(pairs))
+	for pair := range pairs {
+		result = append(result, pair)
+	}
+	sort.Slice(result, func(a, b int) bool {
+		if result[a][0] != result[b][0] {
+			return result[a][0] < result[b][0]
+		}
+		return result[a][1] < result[b][1]
+	})
+	return result
+}
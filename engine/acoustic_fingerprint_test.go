@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// synthesizeMelody returns samples of a sequence of notes, each a mix of a
+// fundamental and two harmonics, lasting half a second.
+func synthesizeMelody(notes []float64, gain, noise float64, seed int64) []float64 {
+	random := rand.New(rand.NewSource(seed))
+	noteLength := fingerprintSampleRate / 2
+	samples := make([]float64, len(notes)*noteLength)
+	for i := range samples {
+		freq := notes[i/noteLength]
+		t := float64(i) / fingerprintSampleRate
+		value := math.Sin(2*math.Pi*freq*t) + 0.5*math.Sin(4*math.Pi*freq*t) + 0.25*math.Sin(6*math.Pi*freq*t)
+		samples[i] = gain*value/2 + noise*(random.Float64()*2-1)
+	}
+	return samples
+}
+
+var (
+	melodyA = []float64{330, 392, 440, 494, 523, 440, 392, 349, 330, 294, 330, 392, 440, 587, 523, 494, 440, 392, 349, 330}
+	melodyB = []float64{262, 294, 262, 349, 330, 262, 294, 262, 392, 349, 262, 523, 440, 349, 330, 294, 466, 440, 349, 392}
+)
+
+func TestFFT(t *testing.T) {
+	// A cosine at bin 2 of an 8-point FFT has energy only in bins 2 and 6
+	input := make([]complex128, 8)
+	for i := range input {
+		input[i] = complex(math.Cos(2*math.Pi*2*float64(i)/8), 0)
+	}
+
+	output := fft(input)
+	for bin, value := range output {
+		if bin == 2 || bin == 6 {
+			assert.InDelta(t, 4.0, cmplx.Abs(value), 1e-9)
+		} else {
+			assert.InDelta(t, 0.0, cmplx.Abs(value), 1e-9)
+		}
+	}
+}
+
+func TestFingerprintSimilarity(t *testing.T) {
+	original := computeFingerprint(synthesizeMelody(melodyA, 1, 0, 1), fingerprintSampleRate)
+	quieterAndNoisy := computeFingerprint(synthesizeMelody(melodyA, 0.6, 0.02, 2), fingerprintSampleRate)
+	delayed := computeFingerprint(append(make([]float64, fingerprintSampleRate), synthesizeMelody(melodyA, 1, 0, 3)...), fingerprintSampleRate)
+	different := computeFingerprint(synthesizeMelody(melodyB, 1, 0, 4), fingerprintSampleRate)
+
+	assert.NotEmpty(t, original)
+	assert.Equal(t, 1.0, fingerprintSimilarity(original, original))
+	assert.Greater(t, fingerprintSimilarity(original, quieterAndNoisy), DefaultSimilarityThreshold)
+	assert.Greater(t, fingerprintSimilarity(original, delayed), DefaultSimilarityThreshold)
+	assert.Less(t, fingerprintSimilarity(original, different), DefaultSimilarityThreshold)
+}
+
+func TestFingerprintSimilarity_Empty(t *testing.T) {
+	assert.Equal(t, 0.0, fingerprintSimilarity(nil, []uint32{1, 2, 3}))
+}
+
+func TestFindAcousticDuplicates(t *testing.T) {
+	r := newRun(nil, nil)
+	tempDir, err := os.MkdirTemp("", "test-acoustic-duplicates")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	lowBitrate := filepath.Join(tempDir, "Artist", "Album", "01 - Song.mp3")
+	otherRip := filepath.Join(tempDir, "Compilations", "Song (Remastered).m4a")
+	different := filepath.Join(tempDir, "Artist", "Album", "02 - Other.mp3")
+	for _, path := range []string{lowBitrate, otherRip, different} {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(filepath.Base(path)), 0644)
+	}
+	os.WriteFile(filepath.Join(tempDir, "notes.txt"), []byte{}, 0644)
+
+	samples := map[string][]float64{
+		lowBitrate: synthesizeMelody(melodyA, 1, 0.01, 1),
+		otherRip:   synthesizeMelody(melodyA, 0.8, 0.01, 2),
+		different:  synthesizeMelody(melodyB, 1, 0.01, 3),
+	}
+	computed := 0
+	compute := func(path string) ([]uint32, error) {
+		computed++
+		return computeFingerprint(samples[path], fingerprintSampleRate), nil
+	}
+
+	cachePath := filepath.Join(tempDir, "cache", "fingerprints.json")
+	duplicates, err := r.findAcousticDuplicates(tempDir, DefaultSimilarityThreshold, cachePath, compute, keepFirst)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{lowBitrate: {lowBitrate, otherRip}}, duplicates)
+	assert.Equal(t, 3, computed)
+	assert.FileExists(t, cachePath)
+
+	// Unchanged files are read from the cache
+	duplicates, err = r.findAcousticDuplicates(tempDir, DefaultSimilarityThreshold, cachePath, compute, keepFirst)
+	assert.NoError(t, err)
+	assert.Len(t, duplicates, 1)
+	assert.Equal(t, 3, computed)
+}
+
+func TestFindAcousticDuplicates_SilentTracks(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-acoustic-silence")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, name := range []string{"silence.mp3", "more silence.mp3", "quiet.m4a"} {
+		os.WriteFile(filepath.Join(tempDir, name), []byte(name), 0644)
+	}
+	compute := func(path string) ([]uint32, error) {
+		samples := make([]float64, fingerprintSampleRate*5)
+		if filepath.Base(path) == "quiet.m4a" {
+			samples = synthesizeMelody(melodyA, 0.0001, 0.0001, 1)
+		}
+		return computeFingerprint(samples, fingerprintSampleRate), nil
+	}
+
+	duplicates, err := newRun(nil, nil).findAcousticDuplicates(tempDir, DefaultSimilarityThreshold, "", compute, keepFirst)
+	assert.NoError(t, err)
+	assert.Empty(t, duplicates)
+}
+
+func TestFindAcousticDuplicates_SimilarToKeptFile(t *testing.T) {
+	r := newRun(nil, nil)
+	tempDir, err := os.MkdirTemp("", "test-acoustic-kept")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	random := rand.New(rand.NewSource(1))
+	original := make([]uint32, 200)
+	for i := range original {
+		original[i] = random.Uint32()
+	}
+	// Each step changes a fifth of the bits, so the first and last file are
+	// only similar through the one in between
+	step := func(fingerprint []uint32, mask uint32, unchanged int) []uint32 {
+		changed := make([]uint32, len(fingerprint))
+		for i, sub := range fingerprint {
+			if i%5 != unchanged {
+				sub ^= mask
+			}
+			changed[i] = sub
+		}
+		return changed
+	}
+	fingerprints := map[string][]uint32{"a.mp3": original}
+	fingerprints["b.mp3"] = step(fingerprints["a.mp3"], 0xff, 0)
+	fingerprints["c.mp3"] = step(fingerprints["b.mp3"], 0xff00, 1)
+	for name := range fingerprints {
+		os.WriteFile(filepath.Join(tempDir, name), []byte(name), 0644)
+	}
+	compute := func(path string) ([]uint32, error) {
+		return fingerprints[filepath.Base(path)], nil
+	}
+	a, b, c := filepath.Join(tempDir, "a.mp3"), filepath.Join(tempDir, "b.mp3"), filepath.Join(tempDir, "c.mp3")
+
+	duplicates, err := r.findAcousticDuplicates(tempDir, DefaultSimilarityThreshold, "", compute, keepFirst)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{a: {a, b}}, duplicates)
+
+	// Keeping the file in between groups all of them
+	duplicates, err = r.findAcousticDuplicates(tempDir, DefaultSimilarityThreshold, "", compute, func([]string) string { return b })
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{a: {a, b, c}}, duplicates)
+}
+
+// keepFirst keeps the first file of a group of duplicates in sorted order.
+func keepFirst(candidates []string) string {
+	return slices.Min(candidates)
+}
@@ -0,0 +1,247 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	id3v2HeaderSize = 10
+	id3v1TagSize    = 128
+	apeFooterSize   = 32
+)
+
+// hashAudioPayload returns a SHA-256 hash of the audio in a music file.
+// ID3v2 tags at the start of the file and APEv2 and ID3v1 tags at the end are
+// skipped, as are the metadata blocks of FLAC files and everything but the
+// media data of MP4 (M4A) files, so copies of the same track with different
+// tags have the same hash. A file without any audio, e.g. an empty file or
+// one that only has tags, has an empty hash.
+func hashAudioPayload(fsys fs.FS, path string) (string, error) {
+	file, err := fsys.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	readerAt, ok := file.(io.ReaderAt)
+	if !ok {
+		return "", fmt.Errorf("%s does not support random access", path)
+	}
+
+	sections, err := audioPayloadSections(readerAt, info.Size())
+	if err != nil {
+		return "", fmt.Errorf("failed to read tags of %s: %v", path, err)
+	}
+
+	hash := sha256.New()
+	var size int64
+	for _, section := range sections {
+		if _, err := io.Copy(hash, io.NewSectionReader(readerAt, section[0], section[1]-section[0])); err != nil {
+			return "", err
+		}
+		size += section[1] - section[0]
+	}
+	if size == 0 {
+		return "", nil
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// audioPayloadSections returns the start and end offsets of the audio in a
+// music file of the specified size: the range between the tags of an MP3
+// file, see audioPayloadRange, the frames after the metadata blocks of a FLAC
+// file, or the "mdat" boxes of an MP4 file.
+func audioPayloadSections(file io.ReaderAt, size int64) ([][2]int64, error) {
+	start, end, err := audioPayloadRange(file, size)
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, 8)
+	if end-start >= 8 {
+		if _, err := file.ReadAt(magic, start); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	case string(magic[0:4]) == "fLaC":
+		start, err = flacFramesStart(file, start+4, end)
+		if err != nil {
+			return nil, err
+		}
+		return [][2]int64{{start, end}}, nil
+	case string(magic[4:8]) == "ftyp":
+		// MP4 boxes fill the whole file, so trailing tags aren't looked for
+		return mp4MediaData(file, size)
+	}
+	return [][2]int64{{start, end}}, nil
+}
+
+// flacFramesStart returns the offset of the first audio frame of a FLAC
+// file, by skipping the metadata blocks, such as Vorbis comments and
+// pictures, that start at offset.
+func flacFramesStart(file io.ReaderAt, offset, end int64) (int64, error) {
+	header := make([]byte, 4)
+	for offset+4 <= end {
+		if _, err := file.ReadAt(header, offset); err != nil {
+			return 0, err
+		}
+		offset += 4 + (int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3]))
+		if header[0]&0x80 != 0 {
+			// Last metadata block
+			break
+		}
+	}
+	return min(offset, end), nil
+}
+
+// mp4MediaData returns the ranges of the contents of the top-level "mdat"
+// boxes of an MP4 file, which hold the audio. Tags are in the "moov" box.
+func mp4MediaData(file io.ReaderAt, size int64) ([][2]int64, error) {
+	var sections [][2]int64
+	header := make([]byte, 16)
+	for offset := int64(0); offset+8 <= size; {
+		if _, err := file.ReadAt(header[:8], offset); err != nil {
+			return nil, err
+		}
+		boxSize := int64(binary.BigEndian.Uint32(header[0:4]))
+		headerSize := int64(8)
+		switch boxSize {
+		case 0:
+			// The box extends to the end of the file
+			boxSize = size - offset
+		case 1:
+			if _, err := file.ReadAt(header[8:16], offset+8); err != nil {
+				return nil, err
+			}
+			boxSize = int64(binary.BigEndian.Uint64(header[8:16]))
+			headerSize = 16
+		}
+		if boxSize < headerSize {
+			return nil, fmt.Errorf("invalid size of MP4 box %q at offset %d", header[4:8], offset)
+		}
+
+		end := min(offset+boxSize, size)
+		if string(header[4:8]) == "mdat" {
+			sections = append(sections, [2]int64{offset + headerSize, end})
+		}
+		offset = end
+	}
+	return sections, nil
+}
+
+// audioPayloadRange returns the byte offsets of the audio between any tag
+// blocks at the start and end of a file of the specified size.
+func audioPayloadRange(file io.ReaderAt, size int64) (int64, int64, error) {
+	start := int64(0)
+	end := size
+
+	// One or more ID3v2 tags at the start of the file
+	header := make([]byte, id3v2HeaderSize)
+	for end-start >= id3v2HeaderSize {
+		if _, err := file.ReadAt(header, start); err != nil {
+			return 0, 0, err
+		}
+		if string(header[0:3]) != "ID3" {
+			break
+		}
+		tagSize := int64(syncsafeInt(header[6:10])) + id3v2HeaderSize
+		if header[5]&0x10 != 0 {
+			// Footer present
+			tagSize += id3v2HeaderSize
+		}
+		start = min(start+tagSize, end)
+	}
+
+	// ID3v1 and APEv2 tags at the end of the file. APEv2 tags usually come
+	// before an ID3v1 tag, but either order is handled.
+	for {
+		if end-start >= id3v1TagSize {
+			tag := make([]byte, 3)
+			if _, err := file.ReadAt(tag, end-id3v1TagSize); err != nil {
+				return 0, 0, err
+			}
+			if string(tag) == "TAG" {
+				end -= id3v1TagSize
+				continue
+			}
+		}
+
+		if end-start >= apeFooterSize {
+			footer := make([]byte, apeFooterSize)
+			if _, err := file.ReadAt(footer, end-apeFooterSize); err != nil {
+				return 0, 0, err
+			}
+			if string(footer[0:8]) == "APETAGEX" {
+				// The size includes the footer but not the optional header
+				tagSize := int64(binary.LittleEndian.Uint32(footer[12:16]))
+				if binary.LittleEndian.Uint32(footer[20:24])&(1<<31) != 0 {
+					tagSize += apeFooterSize
+				}
+				end = max(end-tagSize, start)
+				continue
+			}
+		}
+
+		break
+	}
+
+	return start, end, nil
+}
+
+// syncsafeInt decodes the 28-bit "syncsafe" integers used in ID3v2 headers,
+// where the high bit of each byte is always zero.
+func syncsafeInt(b []byte) uint32 {
+	return uint32(b[0]&0x7f)<<21 | uint32(b[1]&0x7f)<<14 | uint32(b[2]&0x7f)<<7 | uint32(b[3]&0x7f)
+}
+
+// findContentDuplicates scans fsys, which is rooted at dir, and returns
+// groups of music files in dir whose audio is byte-for-byte identical,
+// regardless of their names, folders or tags. The key of each group is the
+// hash of the audio.
+func (r *run) findContentDuplicates(fsys fs.FS, dir string) (map[string][]string, error) {
+	relPaths, err := getFilenames(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]string)
+	for _, rel := range relPaths {
+		if strings.HasPrefix(filepath.Base(rel), "._") || !isMusicFile(rel) {
+			continue
+		}
+
+		path := filepath.Join(dir, rel)
+		hash, err := hashAudioPayload(fsys, fsName(rel))
+		if err != nil {
+			r.reporter.fail("hash", path, err)
+			continue
+		}
+		if hash == "" {
+			// Files without audio would all be duplicates of each other
+			r.logger.Debug("skipping file without audio", "path", path)
+			continue
+		}
+		groups[hash] = append(groups[hash], path)
+	}
+
+	duplicates := make(map[string][]string)
+	for hash, group := range groups {
+		if len(group) > 1 {
+			duplicates[hash] = group
+		}
+	}
+	return duplicates, nil
+}
@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// id3v2Tag returns an ID3v2 tag whose body is the specified text.
+func id3v2Tag(body string) []byte {
+	size := len(body)
+	tag := []byte{'I', 'D', '3', 3, 0, 0,
+		byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)}
+	return append(tag, body...)
+}
+
+// id3v1Tag returns a 128-byte ID3v1 tag with the specified title.
+func id3v1Tag(title string) []byte {
+	tag := make([]byte, id3v1TagSize)
+	copy(tag, "TAG")
+	copy(tag[3:], title)
+	return tag
+}
+
+// apeTag returns an APEv2 tag with a header, the specified body and a footer.
+func apeTag(body string) []byte {
+	block := func() []byte {
+		b := make([]byte, apeFooterSize)
+		copy(b, "APETAGEX")
+		binary.LittleEndian.PutUint32(b[8:12], 2000)
+		binary.LittleEndian.PutUint32(b[12:16], uint32(len(body)+apeFooterSize))
+		binary.LittleEndian.PutUint32(b[20:24], 1<<31)
+		return b
+	}
+	tag := append(block(), body...)
+	return append(tag, block()...)
+}
+
+// flacFile returns a FLAC file with a metadata block of the specified
+// comment followed by the audio frames.
+func flacFile(comment string, frames []byte) []byte {
+	streamInfo := concat([]byte{0, 0, 0, 34}, make([]byte, 34))
+	vorbisComment := concat([]byte{0x80 | 4, 0, byte(len(comment) >> 8), byte(len(comment))}, []byte(comment))
+	return concat([]byte("fLaC"), streamInfo, vorbisComment, frames)
+}
+
+// mp4Box returns an MP4 box of the specified type and contents.
+func mp4Box(boxType string, contents []byte) []byte {
+	box := make([]byte, 8)
+	binary.BigEndian.PutUint32(box, uint32(len(contents)+8))
+	copy(box[4:], boxType)
+	return append(box, contents...)
+}
+
+func concat(parts ...[]byte) []byte {
+	var result []byte
+	for _, part := range parts {
+		result = append(result, part...)
+	}
+	return result
+}
+
+func TestHashAudioPayload_IgnoresTags(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-hash-payload")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	audio := []byte("\xff\xfbaudio frames")
+	untagged := filepath.Join(tempDir, "untagged.mp3")
+	tagged := filepath.Join(tempDir, "tagged.mp3")
+	different := filepath.Join(tempDir, "different.mp3")
+	os.WriteFile(untagged, audio, 0644)
+	os.WriteFile(tagged, concat(id3v2Tag("TIT2 Song"), id3v2Tag("second tag"), audio, apeTag("REPLAYGAIN"), id3v1Tag("Song")), 0644)
+	os.WriteFile(different, concat(id3v2Tag("TIT2 Song"), []byte("\xff\xfbother frames")), 0644)
+
+	fsys := newOSFS(tempDir)
+	untaggedHash, err := hashAudioPayload(fsys, filepath.Base(untagged))
+	assert.NoError(t, err)
+	taggedHash, err := hashAudioPayload(fsys, filepath.Base(tagged))
+	assert.NoError(t, err)
+	differentHash, err := hashAudioPayload(fsys, filepath.Base(different))
+	assert.NoError(t, err)
+
+	assert.Equal(t, untaggedHash, taggedHash)
+	assert.NotEqual(t, untaggedHash, differentHash)
+}
+
+func TestHashAudioPayload_IgnoresContainerMetadata(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-hash-containers")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	hash := func(name string, data []byte) string {
+		path := filepath.Join(tempDir, name)
+		os.WriteFile(path, data, 0644)
+		hash, err := hashAudioPayload(newOSFS(tempDir), name)
+		assert.NoError(t, err)
+		return hash
+	}
+
+	frames := []byte("\xff\xf8flac frames")
+	assert.Equal(t, hash("a.flac", flacFile("TITLE=Song", frames)), hash("b.flac", concat(id3v2Tag("TIT2 Song"), flacFile("TITLE=Other title, longer", frames))))
+	assert.NotEqual(t, hash("a.flac", flacFile("TITLE=Song", frames)), hash("c.flac", flacFile("TITLE=Song", []byte("\xff\xf8other"))))
+
+	ftyp := mp4Box("ftyp", []byte("M4A \x00\x00\x00\x00"))
+	mdat := mp4Box("mdat", []byte("aac frames"))
+	moov := func(title string) []byte { return mp4Box("moov", mp4Box("udta", []byte(title))) }
+	assert.Equal(t, hash("a.m4a", concat(ftyp, moov("Song"), mdat)), hash("b.m4a", concat(ftyp, mdat, moov("Other title, longer"))))
+	assert.NotEqual(t, hash("a.m4a", concat(ftyp, moov("Song"), mdat)), hash("c.m4a", concat(ftyp, moov("Song"), mp4Box("mdat", []byte("other")))))
+
+	// Files without audio have no hash
+	assert.Equal(t, "", hash("empty.mp3", nil))
+	assert.Equal(t, "", hash("tags.mp3", concat(id3v2Tag("TIT2 Song"), id3v1Tag("Song"))))
+	assert.Equal(t, "", hash("tags.flac", flacFile("TITLE=Song", nil)))
+	assert.Equal(t, "", hash("tags.m4a", concat(ftyp, moov("Song"))))
+}
+
+func TestHashAudioPayload_NonExistentFile(t *testing.T) {
+	_, err := hashAudioPayload(newOSFS("/nonexistent"), "file.mp3")
+	assert.Error(t, err)
+}
+
+func TestFindContentDuplicates(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-content-duplicates")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	audio := []byte("\xff\xfbaudio frames")
+	albumCopy := filepath.Join(tempDir, "Artist", "Album", "01 - Song.mp3")
+	compilationCopy := filepath.Join(tempDir, "Compilations", "Hits", "07 - Song.mp3")
+	other := filepath.Join(tempDir, "Artist", "Album", "02 - Other.mp3")
+	os.MkdirAll(filepath.Dir(albumCopy), 0755)
+	os.MkdirAll(filepath.Dir(compilationCopy), 0755)
+	os.WriteFile(albumCopy, concat(id3v2Tag("Album tags"), audio), 0644)
+	os.WriteFile(compilationCopy, concat(id3v2Tag("Compilation tags, longer"), audio, id3v1Tag("Song")), 0644)
+	os.WriteFile(other, []byte("\xff\xfbother frames"), 0644)
+
+	// Identical non-music files are not duplicates
+	os.WriteFile(filepath.Join(tempDir, "a.txt"), []byte{}, 0644)
+	os.WriteFile(filepath.Join(tempDir, "b.txt"), []byte{}, 0644)
+
+	// Neither are music files without audio
+	os.WriteFile(filepath.Join(tempDir, "empty.mp3"), []byte{}, 0644)
+	os.WriteFile(filepath.Join(tempDir, "tags only.mp3"), id3v2Tag("TIT2 Song"), 0644)
+
+	duplicates, err := newRun(nil, nil).findContentDuplicates(newOSFS(tempDir), tempDir)
+	assert.NoError(t, err)
+	assert.Len(t, duplicates, 1)
+	for _, group := range duplicates {
+		assert.ElementsMatch(t, []string{albumCopy, compilationCopy}, group)
+	}
+}
+
+func TestRemoveDuplicateFiles_ByContent(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-remove-content-duplicates")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	audio := []byte("\xff\xfbaudio frames")
+	smallerTags := filepath.Join(tempDir, "Compilations", "Song.mp3")
+	largerTags := filepath.Join(tempDir, "Artist", "Song.mp3")
+	os.MkdirAll(filepath.Dir(smallerTags), 0755)
+	os.MkdirAll(filepath.Dir(largerTags), 0755)
+	os.WriteFile(smallerTags, audio, 0644)
+	os.WriteFile(largerTags, concat(id3v2Tag("Full tags"), audio), 0644)
+
+	err = newRun(nil, nil).removeDuplicateFiles(tempDir, dedupeOptions{byContent: true})
+	assert.NoError(t, err)
+
+	assert.FileExists(t, largerTags)
+	assert.NoFileExists(t, smallerTags)
+}
@@ -0,0 +1,39 @@
+package engine
+
+import "strings"
+
+// destinationNames is a set of file names on a destination, relative to it.
+// When foldCase is set, names that only differ in case are the same name,
+// like on FAT32 and exFAT devices, where Song.mp3 and song.mp3 are the same
+// file.
+type destinationNames struct {
+	foldCase bool
+	names    map[string]bool
+}
+
+// newDestinationNames returns the set of the given names.
+func newDestinationNames(names []string, foldCase bool) *destinationNames {
+	d := &destinationNames{foldCase: foldCase, names: make(map[string]bool, len(names))}
+	for _, name := range names {
+		d.add(name)
+	}
+	return d
+}
+
+// key returns the name that a name is kept under.
+func (d *destinationNames) key(name string) string {
+	if d.foldCase {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// contains reports whether the set has a name.
+func (d *destinationNames) contains(name string) bool {
+	return d.names[d.key(name)]
+}
+
+// add adds a name to the set.
+func (d *destinationNames) add(name string) {
+	d.names[d.key(name)] = true
+}
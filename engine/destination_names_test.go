@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDestinationNames(t *testing.T) {
+	names := newDestinationNames([]string{"/Artist/Song.mp3"}, false)
+	assert.True(t, names.contains("/Artist/Song.mp3"))
+	assert.False(t, names.contains("/artist/song.MP3"))
+
+	names = newDestinationNames([]string{"/Artist/Song.mp3"}, true)
+	assert.True(t, names.contains("/artist/song.MP3"))
+	names.add("/Other/Ärger.mp3")
+	assert.True(t, names.contains("/other/ärger.mp3"))
+}
+
+func TestFilesToSync_CaseInsensitive(t *testing.T) {
+	planned := []fileToTranscode{{"/Song.m4a", "/Song.mp3"}, {"/song.mp3", "/song.mp3"}, {"/New.mp3", "/New.mp3"}}
+
+	// Files that only differ in case are the same file on the device, and
+	// only the first one is synced
+	existing := newDestinationNames([]string{"/NEW.MP3"}, true)
+	assert.Equal(t, []fileToTranscode{{"/Song.m4a", "/Song.mp3"}}, filesToSync(planned, existing, nil))
+
+	existing = newDestinationNames([]string{"/NEW.MP3"}, false)
+	assert.Equal(t, planned, filesToSync(planned, existing, nil))
+}
+
+func TestSync_CaseInsensitive(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-sync-case")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	destinationDir := filepath.Join(tempDir, "destination")
+	for _, path := range []string{"source/Artist/Song.mp3", "source/Artist/TRACK.MP3", "destination/artist/song.mp3"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(tempDir, path)), 0755)
+		os.WriteFile(filepath.Join(tempDir, path), []byte("audio"), 0644)
+	}
+
+	opts := Options{Sources: []string{sourceDir}, Destination: destinationDir, Transcoder: newFakeTranscoder(), CaseInsensitive: true}
+	planned, err := Plan(context.Background(), opts)
+	assert.NoError(t, err)
+	if assert.Len(t, planned, 1) {
+		assert.Equal(t, filepath.Join(destinationDir, "Artist", "TRACK.MP3"), planned[0].Destination)
+	}
+
+	report, err := Sync(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"copied": 1}, report.Counts["sync"])
+}
@@ -0,0 +1,276 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// errFreeSpaceUnknown is returned by devices that can't tell how much space
+// is left on them.
+var errFreeSpaceUnknown = errors.New("free space is unknown")
+
+// errDeviceFull is returned when a file doesn't fit on a device.
+var errDeviceFull = errors.New("not enough free space on the device")
+
+// transcodedBytesPerSecond estimates the size of transcoded files: ffmpeg
+// encodes MP3 at 128 kbit/s by default.
+const transcodedBytesPerSecond = 128000 / 8
+
+// maxTranscodeGrowth is how many times larger than its source a transcoded
+// file can get, for sources of at least 32 kbit/s.
+const maxTranscodeGrowth = 4
+
+// device is where the sync puts files: a directory, a remote share or a phone
+// that is attached over MTP. Names are relative to the root of the sync on
+// the device, with a leading separator, as returned by getFilenames.
+type device interface {
+	// list returns the names of all files on the device.
+	list() ([]string, error)
+
+	// stat returns the file information of the named file.
+	stat(name string) (fs.FileInfo, error)
+
+	// push copies a local file to the named file, creating any missing
+	// directories.
+	push(localPath, name string) error
+
+	// delete removes the named file.
+	delete(name string) error
+
+	// freeSpace returns the number of bytes that can still be written, or
+	// errFreeSpaceUnknown.
+	freeSpace() (int64, error)
+
+	// path returns where the named file is on the device, for messages.
+	path(name string) string
+}
+
+// freeSpacer is implemented by filesystems that can tell how many bytes can
+// still be written to a directory.
+type freeSpacer interface {
+	freeSpace(dir string) (int64, error)
+}
+
+// freeSpace returns the free space of the local disk that dir is on.
+func (f osFS) freeSpace(dir string) (int64, error) {
+	dirPath, err := f.path("freespace", dir)
+	if err != nil {
+		return 0, err
+	}
+	return diskFreeSpace(dirPath)
+}
+
+// freeSpace returns the free space of the underlying filesystem, so that a
+// dry run skips the files that a real run would skip.
+func (d *dryRunFS) freeSpace(dir string) (int64, error) {
+	if fsys, ok := d.base.(freeSpacer); ok {
+		return fsys.freeSpace(dir)
+	}
+	return 0, errFreeSpaceUnknown
+}
+
+// dirDevice is a device that is a writableFS rooted at a local directory, or
+// at the path of a remote URL, which is dir.
+type dirDevice struct {
+	fsys   writableFS
+	dir    string
+	remote bool
+
+	// index caches the file listing of a local directory between runs, or
+	// is nil to list the whole directory
+	index *sourceIndex
+}
+
+// openDevice returns the device of a destination directory or URL.
+func (r *run) openDevice(destination string) (*dirDevice, error) {
+	fsys, dir, err := r.openDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+	dev := &dirDevice{fsys: fsys, dir: dir, remote: IsRemote(destination)}
+	if _, local := fsys.(osFS); local {
+		dev.index = r.loadDestinationIndex(dir)
+	}
+	return dev, nil
+}
+
+// list returns the names of the files below the directory, using the index
+// of a local directory.
+func (d *dirDevice) list() ([]string, error) {
+	if d.index == nil {
+		return getFilenames(d.fsys, ".")
+	}
+	if _, err := d.index.update(context.Background(), nil); err != nil {
+		return nil, err
+	}
+	return d.index.files(), nil
+}
+
+// saveIndex saves the index of the file listing of the device, if it has one.
+func saveIndex(dev device) error {
+	if d, ok := dev.(*dirDevice); ok && d.index != nil {
+		return d.index.save()
+	}
+	return nil
+}
+
+// stat returns the file information of the named file.
+func (d *dirDevice) stat(name string) (fs.FileInfo, error) {
+	return d.fsys.Stat(fsName(name))
+}
+
+// push copies a local file to the named file. Remote files are uploaded under
+// a temporary name first.
+func (d *dirDevice) push(localPath, name string) error {
+	dir := newOSFS(filepath.Dir(localPath))
+	if d.remote {
+		return uploadFile(dir, filepath.Base(localPath), d.fsys, fsName(name))
+	}
+	return copyFile(dir, filepath.Base(localPath), d.fsys, fsName(name))
+}
+
+// delete removes the named file.
+func (d *dirDevice) delete(name string) error {
+	return d.fsys.Remove(fsName(name))
+}
+
+// freeSpace returns the free space of the filesystem, if it can tell.
+func (d *dirDevice) freeSpace() (int64, error) {
+	if fsys, ok := d.fsys.(freeSpacer); ok {
+		return fsys.freeSpace(".")
+	}
+	return 0, errFreeSpaceUnknown
+}
+
+// path returns where the named file is, for messages: its path on the
+// server for a remote URL, or in the local directory.
+func (d *dirDevice) path(name string) string {
+	if d.remote {
+		return path.Join(d.dir, rootedName(name))
+	}
+	return filepath.Join(d.dir, filepath.FromSlash(rootedName(name)))
+}
+
+// localDir returns the directory of a device that is a local directory, so
+// that files can be transcoded straight into it.
+func localDir(dev device) (string, bool) {
+	if d, ok := dev.(*dirDevice); ok {
+		if _, local := d.fsys.(osFS); local {
+			return d.dir, true
+		}
+	}
+	return "", false
+}
+
+// transcodeAndPush transcodes a music file to a local temporary file, then
+// pushes it to the named file on a device.
+//
+// Returns the duration of the audio in seconds.
+func (r *run) transcodeAndPush(sourcePath string, dev device, name string, opts TranscodeOptions, onProgress func(float64)) (float64, error) {
+	tempDir, err := os.MkdirTemp("", "sync-transcode-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	temp := filepath.Join(tempDir, filepath.Base(name))
+	seconds, err := r.transcodeFileAtPath(sourcePath, temp, opts, onProgress)
+	if err != nil {
+		return 0, err
+	}
+	return seconds, dev.push(temp, name)
+}
+
+// estimatedSize returns how many bytes a planned file will take on the
+// device: the size of the source for copies, and for transcodes the size at
+// the default bitrate, if trans knows the duration of the source.
+func estimatedSize(trans Transcoder, sourcePath, operation string, size int64) int64 {
+	if operation != "transcode" {
+		return size
+	}
+	if info, err := trans.Probe(sourcePath); err == nil && info.Duration > 0 {
+		return int64(info.Duration * transcodedBytesPerSecond)
+	}
+	return size
+}
+
+// spaceBudget decides which files fit in the free space of a device, in the
+// order they are planned. A file that doesn't fit is left out, so that
+// smaller files after it can still use the remaining space.
+//
+// Transcoded files are counted at their largest possible size, so that they
+// don't have to be probed for their duration while there is plenty of space.
+// When that no longer fits, the transcodes counted that way are estimated.
+type spaceBudget struct {
+	free  int64
+	known bool
+	used  int64
+
+	// bounded are the sources of transcodes that are counted at their
+	// largest possible size, which adds up to boundedSize
+	bounded     []boundedTranscode
+	boundedSize int64
+
+	// transcoder probes the sources of transcodes for their duration
+	transcoder Transcoder
+}
+
+// boundedTranscode is a transcode that is counted at its largest possible
+// size.
+type boundedTranscode struct {
+	sourcePath string
+	size       int64
+}
+
+// newSpaceBudget returns the budget of the free space of a device, probing
+// transcodes with trans. If the device can't tell its free space, every file
+// fits.
+func newSpaceBudget(dev device, trans Transcoder) *spaceBudget {
+	free, err := dev.freeSpace()
+	return &spaceBudget{free: free, known: err == nil, transcoder: trans}
+}
+
+// fit reports whether a file fits in the remaining space, and takes the
+// space if it does. A file that doesn't fit returns a message saying how much
+// space it needs.
+func (b *spaceBudget) fit(sourcePath, operation string, size int64) (bool, string) {
+	if !b.known {
+		return true, ""
+	}
+
+	largest := size
+	if operation == "transcode" {
+		largest = size * maxTranscodeGrowth
+	}
+	if b.used+b.boundedSize+largest <= b.free {
+		if operation == "transcode" {
+			b.bounded = append(b.bounded, boundedTranscode{sourcePath: sourcePath, size: size})
+			b.boundedSize += largest
+		} else {
+			b.used += size
+		}
+		return true, ""
+	}
+
+	for _, transcode := range b.bounded {
+		b.used += estimatedSize(b.transcoder, transcode.sourcePath, "transcode", transcode.size)
+	}
+	b.bounded, b.boundedSize = nil, 0
+
+	needed := estimatedSize(b.transcoder, sourcePath, operation, size)
+	if b.used+needed <= b.free {
+		b.used += needed
+		return true, ""
+	}
+	return false, describeFreeSpace(needed, b.free-b.used)
+}
+
+// describeFreeSpace returns a message about the space that a file needs.
+func describeFreeSpace(needed, free int64) string {
+	return fmt.Sprintf("Not enough free space on the device, needs about %s of %s free", FormatBytes(needed), FormatBytes(free))
+}
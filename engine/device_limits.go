@@ -0,0 +1,308 @@
+package engine
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// DeviceLimits describes the folder structure a playback device can handle.
+// Many car head units silently ignore files beyond a fixed number of files
+// per folder, folder levels or total folders. A zero value means unlimited.
+type DeviceLimits struct {
+	MaxFilesPerFolder int `yaml:"max_files_per_folder"`
+	MaxFolderDepth    int `yaml:"max_folder_depth"`
+	MaxFolders        int `yaml:"max_folders"`
+
+	// Restructure enables automatic flattening of deep folders and splitting
+	// of large folders so the planned tree fits within the limits.
+	Restructure bool `yaml:"restructure"`
+}
+
+// limitViolation describes a planned destination path that a device with the
+// configured limits would not be able to play.
+type limitViolation struct {
+	path   string
+	reason string
+}
+
+// applyDeviceLimits checks the planned destination tree against the device
+// limits. When limits.Restructure is set, it first rewrites destination paths:
+// folders deeper than the maximum depth are flattened into a single
+// "Artist - Album" style folder, and folders with too many files are split
+// into parts named after the range of file names in them, e.g. "Part A-F".
+//
+// Restructuring is deterministic, so running it on the same source tree
+// always results in the same destination paths and incremental runs can find
+// files that were already synced. It only depends on the planned files.
+//
+// The other music files on the device, which aren't planned, count towards
+// the number of files per folder and the number of folders; deviceFiles may
+// include the planned ones, which are compared regardless of case when
+// foldCase is set.
+//
+// Returns the (possibly rewritten) planned files and anything that still does
+// not fit within the limits.
+func applyDeviceLimits(files []fileToTranscode, deviceFiles []string, foldCase bool, limits DeviceLimits) ([]fileToTranscode, []limitViolation) {
+	planned := make([]fileToTranscode, len(files))
+	copy(planned, files)
+
+	if limits.Restructure && limits.MaxFolderDepth > 0 {
+		for i := range planned {
+			planned[i].destinationPath = flattenPath(planned[i].destinationPath, limits.MaxFolderDepth)
+		}
+	}
+
+	if limits.Restructure && limits.MaxFilesPerFolder > 0 {
+		planned = splitLargeFolders(planned, limits)
+	}
+
+	plannedNames := newDestinationNames(nil, foldCase)
+	for _, file := range planned {
+		plannedNames.add(file.destinationPath)
+	}
+	var others []string
+	for _, name := range deviceFiles {
+		if isMusicFile(name) && !strings.HasPrefix(path.Base(name), "._") && !plannedNames.contains(name) {
+			others = append(others, name)
+		}
+	}
+
+	return planned, checkDeviceLimits(planned, others, limits)
+}
+
+// checkDeviceLimits reports every planned destination path that exceeds the
+// maximum folder depth, and every path that exceeds the maximum number of
+// files in its folder or the maximum number of folders on the device, counting
+// the other files on the device too.
+func checkDeviceLimits(files []fileToTranscode, others []string, limits DeviceLimits) []limitViolation {
+	var violations []limitViolation
+
+	filesPerFolder := make(map[string][]string)
+	folders := make(map[string]bool)
+	addFile := func(name string) []string {
+		dirs := pathFolders(name)
+		dir := strings.Join(dirs, "/")
+		filesPerFolder[dir] = append(filesPerFolder[dir], name)
+
+		for i := range dirs {
+			folders[strings.Join(dirs[:i+1], "/")] = true
+		}
+		return dirs
+	}
+	for _, name := range others {
+		addFile(name)
+	}
+	for _, file := range files {
+		dirs := addFile(file.destinationPath)
+
+		if limits.MaxFolderDepth > 0 && len(dirs) > limits.MaxFolderDepth {
+			violations = append(violations, limitViolation{
+				path:   file.destinationPath,
+				reason: fmt.Sprintf("folder depth %d exceeds limit of %d", len(dirs), limits.MaxFolderDepth),
+			})
+		}
+	}
+
+	if limits.MaxFilesPerFolder > 0 {
+		for _, dir := range sortedKeys(filesPerFolder) {
+			paths := filesPerFolder[dir]
+			if len(paths) <= limits.MaxFilesPerFolder {
+				continue
+			}
+			sort.Strings(paths)
+			for _, name := range paths[limits.MaxFilesPerFolder:] {
+				violations = append(violations, limitViolation{
+					path:   name,
+					reason: fmt.Sprintf("folder has %d files, limit is %d", len(paths), limits.MaxFilesPerFolder),
+				})
+			}
+		}
+	}
+
+	if limits.MaxFolders > 0 && len(folders) > limits.MaxFolders {
+		allFolders := sortedKeys(folders)
+		for _, dir := range allFolders[limits.MaxFolders:] {
+			violations = append(violations, limitViolation{
+				path:   dir,
+				reason: fmt.Sprintf("device has %d folders, limit is %d", len(allFolders), limits.MaxFolders),
+			})
+		}
+	}
+
+	return violations
+}
+
+// flattenPath joins the folders of a relative path that are deeper than
+// maxDepth into a single folder, e.g. with a depth of 2
+// "Genre/Artist/Album/01.mp3" becomes "Genre/Artist - Album/01.mp3".
+func flattenPath(name string, maxDepth int) string {
+	dirs := pathFolders(name)
+	if len(dirs) <= maxDepth {
+		return name
+	}
+
+	kept := append([]string{}, dirs[:maxDepth-1]...)
+	kept = append(kept, strings.Join(dirs[maxDepth-1:], " - "))
+	return joinRelativePath(name, kept, path.Base(name))
+}
+
+// splitLargeFolders moves files from folders that exceed the file limit into
+// "Part" folders named after the range of file names in them, see
+// nameRanges. When the folder is already at the maximum depth, the parts
+// become siblings named "<Folder> - Part A-F" instead of subfolders.
+//
+// Since a part is named after its names rather than numbered, adding a file
+// only moves the files of the ranges that no longer fit, instead of every
+// file after it.
+func splitLargeFolders(files []fileToTranscode, limits DeviceLimits) []fileToTranscode {
+	indexesPerFolder := make(map[string][]int)
+	for i, file := range files {
+		dir := strings.Join(pathFolders(file.destinationPath), "/")
+		indexesPerFolder[dir] = append(indexesPerFolder[dir], i)
+	}
+
+	for _, indexes := range indexesPerFolder {
+		if len(indexes) <= limits.MaxFilesPerFolder {
+			continue
+		}
+
+		names := make([]string, len(indexes))
+		for n, i := range indexes {
+			names[n] = path.Base(files[i].destinationPath)
+		}
+		ranges := nameRanges(names, limits.MaxFilesPerFolder)
+
+		for _, i := range indexes {
+			name := files[i].destinationPath
+			part := "Part " + ranges[path.Base(name)]
+			dirs := pathFolders(name)
+
+			switch {
+			case limits.MaxFolderDepth == 0 || len(dirs) < limits.MaxFolderDepth:
+				dirs = append(dirs, part)
+			case len(dirs) == 0:
+				dirs = []string{part}
+			default:
+				dirs[len(dirs)-1] = dirs[len(dirs)-1] + " - " + part
+			}
+			files[i].destinationPath = joinRelativePath(name, dirs, path.Base(name))
+		}
+	}
+
+	return files
+}
+
+// nameRanges divides the file names of a folder into ranges of at most max
+// names and returns the label of the range of each name, e.g. "A-F", "G" or
+// "Ma-Mo". Names are grouped by their first character, and a group with more
+// than max names by their first two characters, and so on. Neighbouring
+// groups that weren't divided are then joined while they fit, so that a
+// group that is divided further doesn't change the ranges around it. A group
+// of names that only differ in case can't be divided and may exceed max.
+func nameRanges(names []string, max int) map[string]string {
+	labels := make(map[string]string)
+	addNameRanges(labels, names, 1, max)
+	return labels
+}
+
+// addNameRanges adds the labels of names whose first length-1 characters are
+// the same to labels, see nameRanges.
+func addNameRanges(labels map[string]string, names []string, length, max int) {
+	byKey := make(map[string][]string)
+	longer := make(map[string]bool)
+	for _, name := range names {
+		key := nameKey(name, length)
+		byKey[key] = append(byKey[key], name)
+		if len([]rune(name)) > length {
+			longer[key] = true
+		}
+	}
+
+	var run []string
+	joinRun := func() {
+		for start := 0; start < len(run); {
+			end, count := start, len(byKey[run[start]])
+			for end+1 < len(run) && count+len(byKey[run[end+1]]) <= max {
+				end++
+				count += len(byKey[run[end]])
+			}
+
+			label := run[start]
+			if end > start {
+				label += "-" + run[end]
+			}
+			for _, key := range run[start : end+1] {
+				for _, name := range byKey[key] {
+					labels[name] = label
+				}
+			}
+			start = end + 1
+		}
+		run = nil
+	}
+	for _, key := range sortedKeys(byKey) {
+		if len(byKey[key]) > max && longer[key] {
+			joinRun()
+			addNameRanges(labels, byKey[key], length+1, max)
+			continue
+		}
+		run = append(run, key)
+	}
+	joinRun()
+}
+
+// nameKey returns the first length characters of a file name as they are
+// shown in the name of a part folder: the first in upper case and the others
+// in lower case, with any character that isn't a letter or digit replaced by
+// "#", which is valid on every file system.
+func nameKey(name string, length int) string {
+	var key strings.Builder
+	for i, r := range []rune(name) {
+		if i == length {
+			break
+		}
+		switch {
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			r = '#'
+		case i == 0:
+			r = unicode.ToUpper(r)
+		default:
+			r = unicode.ToLower(r)
+		}
+		key.WriteRune(r)
+	}
+	return key.String()
+}
+
+// pathFolders returns the folder names of a slash-separated relative file
+// path, ignoring any leading slash.
+func pathFolders(name string) []string {
+	dir := strings.Trim(path.Dir(name), "/")
+	if dir == "" || dir == "." {
+		return nil
+	}
+	return strings.Split(dir, "/")
+}
+
+// joinRelativePath builds a slash-separated path from folders and a filename,
+// keeping the leading slash of the original path if it had one.
+func joinRelativePath(original string, dirs []string, filename string) string {
+	joined := path.Join(append(dirs, filename)...)
+	if strings.HasPrefix(original, "/") {
+		return "/" + joined
+	}
+	return joined
+}
+
+// sortedKeys returns the keys of a map in sorted order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
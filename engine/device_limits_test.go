@@ -0,0 +1,191 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlattenPath(t *testing.T) {
+	cases := []struct {
+		Name           string
+		Path           string
+		MaxDepth       int
+		ExpectedOutput string
+	}{
+		{
+			Name:           "Path within depth limit is unchanged",
+			Path:           "Artist/Album/01.mp3",
+			MaxDepth:       2,
+			ExpectedOutput: "Artist/Album/01.mp3",
+		},
+		{
+			Name:           "Deep folders are joined into one folder",
+			Path:           "Genre/Artist/Album/01.mp3",
+			MaxDepth:       2,
+			ExpectedOutput: "Genre/Artist - Album/01.mp3",
+		},
+		{
+			Name:           "Depth of one gives Artist - Album",
+			Path:           "Artist/Album/01.mp3",
+			MaxDepth:       1,
+			ExpectedOutput: "Artist - Album/01.mp3",
+		},
+		{
+			Name:           "Leading separator is preserved",
+			Path:           "/Genre/Artist/Album/01.mp3",
+			MaxDepth:       1,
+			ExpectedOutput: "/Genre - Artist - Album/01.mp3",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, c.ExpectedOutput, flattenPath(c.Path, c.MaxDepth))
+		})
+	}
+}
+
+func TestApplyDeviceLimits_SplitsLargeFolders(t *testing.T) {
+	var files []fileToTranscode
+	for i := 1; i <= 5; i++ {
+		name := fmt.Sprintf("/Album/%02d.mp3", i)
+		files = append(files, fileToTranscode{sourcePath: name, destinationPath: name})
+	}
+
+	planned, violations := applyDeviceLimits(files, nil, false, DeviceLimits{MaxFilesPerFolder: 2, Restructure: true})
+
+	assert.Empty(t, violations)
+	assert.Equal(t, []string{
+		"/Album/Part 01-02/01.mp3",
+		"/Album/Part 01-02/02.mp3",
+		"/Album/Part 03-04/03.mp3",
+		"/Album/Part 03-04/04.mp3",
+		"/Album/Part 05/05.mp3",
+	}, getDestinationPaths(planned))
+
+	// The source paths must not be modified by restructuring
+	assert.Equal(t, "/Album/01.mp3", planned[0].sourcePath)
+}
+
+func TestApplyDeviceLimits_SplitsIntoSiblingsAtMaxDepth(t *testing.T) {
+	files := []fileToTranscode{
+		{sourcePath: "Artist/Album/01.m4a", destinationPath: "Artist/Album/01.mp3"},
+		{sourcePath: "Artist/Album/02.m4a", destinationPath: "Artist/Album/02.mp3"},
+	}
+
+	planned, violations := applyDeviceLimits(files, nil, false, DeviceLimits{MaxFilesPerFolder: 1, MaxFolderDepth: 1, Restructure: true})
+
+	assert.Empty(t, violations)
+	assert.Equal(t, []string{
+		"Artist - Album - Part 01/01.mp3",
+		"Artist - Album - Part 02/02.mp3",
+	}, getDestinationPaths(planned))
+}
+
+func TestApplyDeviceLimits_SplitsByNameRanges(t *testing.T) {
+	split := func(names ...string) []string {
+		var files []fileToTranscode
+		for _, name := range names {
+			files = append(files, fileToTranscode{destinationPath: "/Mix/" + name})
+		}
+		planned, _ := applyDeviceLimits(files, nil, false, DeviceLimits{MaxFilesPerFolder: 2, Restructure: true})
+		return getDestinationPaths(planned)
+	}
+
+	assert.Equal(t, []string{
+		"/Mix/Part A/a1.mp3",
+		"/Mix/Part A/A2.mp3",
+		"/Mix/Part B/b1.mp3",
+		"/Mix/Part B/b2.mp3",
+		"/Mix/Part C/c1.mp3",
+		"/Mix/Part #/_1.mp3",
+	}, split("a1.mp3", "A2.mp3", "b1.mp3", "b2.mp3", "c1.mp3", "_1.mp3"))
+
+	// Adding a file only moves the files of its range
+	assert.Equal(t, []string{
+		"/Mix/Part A0-A1/a0.mp3",
+		"/Mix/Part A0-A1/a1.mp3",
+		"/Mix/Part A2/A2.mp3",
+		"/Mix/Part B/b1.mp3",
+		"/Mix/Part B/b2.mp3",
+		"/Mix/Part C/c1.mp3",
+		"/Mix/Part #/_1.mp3",
+	}, split("a0.mp3", "a1.mp3", "A2.mp3", "b1.mp3", "b2.mp3", "c1.mp3", "_1.mp3"))
+}
+
+func TestApplyDeviceLimits_CountsOtherDeviceFiles(t *testing.T) {
+	files := []fileToTranscode{{destinationPath: "/Album/01.mp3"}, {destinationPath: "/Other/01.mp3"}}
+	deviceFiles := []string{"/ALBUM/01.MP3", "/Album/02.mp3", "/Album/cover.jpg", "/Podcasts/01.mp3"}
+
+	_, violations := applyDeviceLimits(files, deviceFiles, true, DeviceLimits{MaxFilesPerFolder: 1, MaxFolders: 2})
+
+	assert.ElementsMatch(t, []string{
+		"/Album/02.mp3", // second file in the folder
+		"Podcasts",      // third folder
+	}, violationPaths(violations))
+}
+
+func TestPlanSources_AppliesLimitsToAllSources(t *testing.T) {
+	prof := DefaultProfile()
+	prof.Limits = DeviceLimits{MaxFilesPerFolder: 2, Restructure: true}
+	files := [][]string{
+		{"/Album/a.mp3", "/Album/b.mp3"},
+		{"/Album/b.mp3", "/Album/c.mp3"},
+	}
+
+	r, events := recordEvents(nil)
+	planned := r.planSources([]*syncSource{{dir: "/first"}, {dir: "/second"}}, files, nil, prof)
+
+	// The second b.mp3 is taken by the first source, and the folder of both
+	// sources has three files
+	assert.Equal(t, []plannedFile{
+		{fileToTranscode{"/Album/a.mp3", "/Album/Part A-B/a.mp3"}, 0},
+		{fileToTranscode{"/Album/b.mp3", "/Album/Part A-B/b.mp3"}, 0},
+		{fileToTranscode{"/Album/c.mp3", "/Album/Part C/c.mp3"}, 1},
+	}, planned)
+	recorded := events()
+	assert.Len(t, recorded, 1)
+	assert.Equal(t, EventWarning, recorded[0].Type)
+	assert.Equal(t, filepath.Join("/second", "/Album/b.mp3"), recorded[0].Path)
+	assert.Equal(t, "Skipping file whose destination path /Album/b.mp3 is taken by another source file", recorded[0].Message)
+}
+
+func TestApplyDeviceLimits_ReportsWithoutRestructure(t *testing.T) {
+	files := []fileToTranscode{
+		{destinationPath: "A/B/C/01.mp3"},
+		{destinationPath: "A/B/C/02.mp3"},
+		{destinationPath: "D/03.mp3"},
+	}
+
+	planned, violations := applyDeviceLimits(files, nil, false, DeviceLimits{MaxFilesPerFolder: 1, MaxFolderDepth: 2, MaxFolders: 3})
+
+	assert.Equal(t, getDestinationPaths(files), getDestinationPaths(planned))
+	assert.ElementsMatch(t, []string{
+		"A/B/C/01.mp3", // too deep
+		"A/B/C/02.mp3", // too deep
+		"A/B/C/02.mp3", // too many files in folder
+		"D",            // fourth folder
+	}, violationPaths(violations))
+}
+
+func TestApplyDeviceLimits_NoLimits(t *testing.T) {
+	files := []fileToTranscode{{destinationPath: "A/B/C/D/E/F/G/H/I/01.mp3"}}
+
+	planned, violations := applyDeviceLimits(files, nil, false, DeviceLimits{Restructure: true})
+
+	assert.Empty(t, violations)
+	assert.Equal(t, files, planned)
+}
+
+// Returns the paths of a list of limit violations.
+func violationPaths(violations []limitViolation) []string {
+	var paths []string
+	for _, violation := range violations {
+		paths = append(paths, violation.path)
+	}
+	return paths
+}
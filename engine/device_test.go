@@ -0,0 +1,183 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpaceBudget(t *testing.T) {
+	budget := newSpaceBudget(newFakeDevice(100), nil)
+	var fits []bool
+	for _, size := range []int64{60, 50, 40, 1} {
+		ok, _ := budget.fit("/song.mp3", "copy", size)
+		fits = append(fits, ok)
+	}
+	assert.Equal(t, []bool{true, false, true, false}, fits)
+
+	// Transcodes are counted at their largest size until that doesn't fit
+	fake := newFakeTranscoder()
+	fake.setMedia("/a.m4a", MediaInfo{Codec: "aac", Duration: 1})
+	fake.setMedia("/b.m4a", MediaInfo{Codec: "aac", Duration: 1})
+
+	budget = newSpaceBudget(newFakeDevice(40000), fake)
+	ok, _ := budget.fit("/a.m4a", "transcode", 5000)
+	assert.True(t, ok)
+	assert.Equal(t, int64(20000), budget.boundedSize)
+	ok, _ = budget.fit("/b.m4a", "transcode", 6000)
+	assert.True(t, ok)
+	assert.Equal(t, int64(32000), budget.used)
+	ok, reason := budget.fit("/c.mp3", "copy", 10000)
+	assert.False(t, ok)
+	assert.Contains(t, reason, "Not enough free space on the device")
+
+	// A device that can't tell its free space takes every file
+	budget = &spaceBudget{}
+	ok, _ = budget.fit("/song.mp3", "copy", 1<<40)
+	assert.True(t, ok)
+}
+
+func TestDirDevice(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-device")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	source := filepath.Join(tempDir, "Song.mp3")
+	os.WriteFile(source, []byte("audio"), 0644)
+	dev, err := newRun(nil, nil).openDevice(filepath.Join(tempDir, "usb"))
+	assert.NoError(t, err)
+
+	name := "/Artist/Song.mp3"
+	assert.NoError(t, dev.push(source, name))
+	assert.Equal(t, filepath.Join(tempDir, "usb", "Artist", "Song.mp3"), dev.path(name))
+	assert.FileExists(t, dev.path(name))
+
+	names, err := dev.list()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{name}, names)
+
+	info, err := dev.stat(name)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	free, err := dev.freeSpace()
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		assert.NoError(t, err)
+		assert.Greater(t, free, int64(0))
+	}
+
+	dir, ok := localDir(dev)
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(tempDir, "usb"), dir)
+
+	assert.NoError(t, dev.delete(name))
+	assert.True(t, os.IsNotExist(dev.delete(name)))
+}
+
+func TestDirDevice_ListIndex(t *testing.T) {
+	r := newRun(nil, nil)
+	tempDir, err := os.MkdirTemp("", "test-device-index")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	usb := filepath.Join(tempDir, "usb")
+	for _, name := range []string{"A/a.mp3", "B/b.mp3"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(usb, name)), 0755)
+		os.WriteFile(filepath.Join(usb, name), []byte("audio"), 0644)
+	}
+	backdate(usb, filepath.Join(usb, "A"), filepath.Join(usb, "B"))
+	dev, err := r.openDevice(usb)
+	assert.NoError(t, err)
+	names, err := dev.list()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/A/a.mp3", "/B/b.mp3"}, names)
+	assert.NoError(t, saveIndex(dev))
+	backdate(usb)
+
+	// The next run only lists the folders whose time changed
+	os.WriteFile(filepath.Join(usb, "A", "new.mp3"), []byte("audio"), 0644)
+	os.WriteFile(filepath.Join(usb, "B", "unseen.mp3"), []byte("audio"), 0644)
+	backdate(filepath.Join(usb, "B"))
+	dev, err = r.openDevice(usb)
+	assert.NoError(t, err)
+	names, err = dev.list()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/A/a.mp3", "/A/new.mp3", "/B/b.mp3"}, names)
+}
+
+func TestFakeDevice(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-fake-device")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	source := filepath.Join(tempDir, "Song.mp3")
+	os.WriteFile(source, []byte("audio"), 0644)
+
+	dev := newFakeDevice(12)
+	dev.addFile("/Old/Song.mp3", 5)
+	assert.NoError(t, dev.push(source, "/Artist/Song.mp3"))
+	free, err := dev.freeSpace()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), free)
+
+	// Replacing a file only needs the difference
+	assert.NoError(t, dev.push(source, "/Artist/Song.mp3"))
+	err = dev.push(source, "/Artist/Other.mp3")
+	assert.True(t, errors.Is(err, errDeviceFull))
+
+	names, err := dev.list()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/Artist/Song.mp3", "/Old/Song.mp3"}, names)
+	_, ok := localDir(dev)
+	assert.False(t, ok)
+}
+
+func TestSyncToDevice_FreeSpace(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-sync-device")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sizes := map[string]int{"a.m4a": 300000, "b.mp3": 20000, "c.m4a": 300000}
+	for name, size := range sizes {
+		os.MkdirAll(filepath.Join(tempDir, "Artist"), 0755)
+		os.WriteFile(filepath.Join(tempDir, "Artist", name), []byte(strings.Repeat("x", size)), 0644)
+	}
+
+	fake := newFakeTranscoder()
+	fake.setMedia(filepath.Join(tempDir, "Artist", "a.m4a"), MediaInfo{Codec: "aac", Duration: 60})
+	fake.setMedia(filepath.Join(tempDir, "Artist", "c.m4a"), MediaInfo{Codec: "aac", Duration: 600})
+	r, events := recordEvents(fake)
+
+	// 990 kB are free: a.mp3 takes about 960 kB at 128 kbit/s, which leaves
+	// space for b.mp3 but not for c.mp3
+	dev := newFakeDevice(1000000)
+	dev.addFile("/Old/x.mp3", 10000)
+	assert.NoError(t, r.syncToDevice(context.Background(), []*syncSource{{dir: tempDir, index: r.loadSourceIndex("", tempDir, LinkSettings{})}}, dev, nil, DefaultProfile(), 1, nil, false))
+	assert.Equal(t, []string{"/Artist/a.mp3", "/Artist/b.mp3"}, dev.pushedFiles())
+	assert.Equal(t, map[string]int{"transcoded": 1, "copied": 1, "skipped": 1}, summaryCounts(events(), "sync"))
+
+	var warnings []Event
+	for _, e := range events() {
+		if e.Type == EventWarning {
+			warnings = append(warnings, e)
+		}
+	}
+	if assert.Len(t, warnings, 1) {
+		assert.Equal(t, filepath.Join(tempDir, "Artist", "c.m4a"), warnings[0].Path)
+		assert.Contains(t, warnings[0].Message, "Not enough free space on the device")
+	}
+}
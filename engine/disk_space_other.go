@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd)
+
+package engine
+
+// diskFreeSpace can't tell the free space on systems without statfs(2), so
+// the sync doesn't check it there.
+func diskFreeSpace(dir string) (int64, error) {
+	return 0, errFreeSpaceUnknown
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package engine
+
+import "syscall"
+
+// diskFreeSpace returns the number of bytes that can still be written to the
+// filesystem of dir by an unprivileged user.
+func diskFreeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
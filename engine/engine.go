@@ -0,0 +1,550 @@
+// Package engine syncs a music library to a destination such as a USB stick:
+// music files that aren't MP3s are transcoded with ffmpeg, MP3s are copied,
+// and duplicates in the destination are reduced to the preferred copy.
+//
+// Example usage:
+//
+//	report, err := engine.Sync(ctx, engine.Options{
+//		Sources:     []string{"/music"},
+//		Destination: "/media/usb",
+//		OnEvent:     func(e engine.Event) { fmt.Println(e.Type, e.Operation, e.Path) },
+//	})
+//
+// Every call has its own events, transcoder and log, so calls can run at the
+// same time, e.g. a Plan while a Watch is running. Calls that change a
+// destination lock it, see Options.Wait.
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Options configures Sync, Plan, Verify and Watch.
+type Options struct {
+	// Sources are the directories with the original music files. A file
+	// whose destination path is already taken by a file from an earlier
+	// source is skipped.
+	Sources []string
+
+	// Destination is the directory the music is synced to, or the URL of a
+	// remote one: sftp://[user@]host[:port]/path, webdav:// or webdavs://
+	// for a WebDAV share, or mtp://device/storage/path for a phone attached
+	// by USB. Remote destinations aren't locked.
+	Destination string
+
+	// Profile holds the device settings. When it is nil, DefaultProfile is
+	// used.
+	Profile *Profile
+
+	// Formats, Include and Exclude are added to the formats and filters of
+	// the profile. See Profile.
+	Formats []string
+	Include []string
+	Exclude []string
+
+	// Mirror moves destination files that no longer have a source file to
+	// the trash, as if it was set in the profile.
+	Mirror bool
+
+	// FollowSymlinks walks into symlinked directories of the sources, and
+	// SkipLinkedDuplicates syncs a file that is in a source more than once
+	// only once, as if they were set in the links of the profile.
+	FollowSymlinks       bool
+	SkipLinkedDuplicates bool
+
+	// CaseInsensitive compares destination file names regardless of case,
+	// as if it was set in the profile.
+	CaseInsensitive bool
+
+	// Jobs is the number of files transcoded at the same time. When it is
+	// zero, one file per CPU is transcoded.
+	Jobs int
+
+	// Wait waits for another run that is syncing to the destination to
+	// finish, instead of failing.
+	Wait bool
+
+	// Transcoder transcodes and probes the music files. When it is nil, the
+	// goffmpeg transcoder is used.
+	Transcoder Transcoder
+
+	// OnEvent, if set, receives every event of the run, one at a time.
+	OnEvent func(Event)
+
+	// DryRun only reports what Sync would transcode, copy and move to the
+	// trash, without changing the destination or saving the indexes. A dry
+	// run doesn't lock the destination, and only writes a log if Log has a
+	// path.
+	DryRun bool
+
+	// Log, if set, writes a log file of Sync and Watch runs.
+	Log *LogOptions
+}
+
+// DedupeOptions configures Dedupe.
+type DedupeOptions struct {
+	// Dir is the directory to remove duplicates from, or the URL of a remote
+	// one as in Options.Destination. Remote directories only support
+	// finding duplicates by name, without review.
+	Dir string
+
+	// DryRun only reports what would be deleted. Like a dry run of Sync, it
+	// doesn't lock Dir, and only writes a log if Log has a path.
+	DryRun bool
+
+	// TrashDir is where removed duplicates are moved to. When it is empty,
+	// they are moved to TrashDirName in Dir.
+	TrashDir string
+
+	// ByContent finds files with identical audio anywhere in Dir, instead of
+	// files that share a name with different extensions.
+	ByContent bool
+
+	// Acoustic finds files that sound like the same recording anywhere in
+	// Dir, with the given fraction of matching fingerprint bits. When
+	// SimilarityThreshold is zero, DefaultSimilarityThreshold is used.
+	Acoustic            bool
+	SimilarityThreshold float64
+
+	// FingerprintCache is the file in which acoustic fingerprints are cached
+	// between runs. When it is empty, they are cached in the user cache
+	// directory.
+	FingerprintCache string
+
+	// Profile holds the quality ranking that decides which copy to keep.
+	// When it is nil, DefaultProfile is used.
+	Profile *Profile
+
+	// Wait waits for another run that is changing Dir to finish, instead of
+	// failing.
+	Wait bool
+
+	// Transcoder probes the duplicates to rank them. When it is nil, the
+	// goffmpeg transcoder is used.
+	Transcoder Transcoder
+
+	// ReviewInput and ReviewOutput, if set, let a person confirm or change
+	// the choice for each group of duplicates, answering prompts written
+	// to ReviewOutput.
+	ReviewInput  io.Reader
+	ReviewOutput io.Writer
+
+	// OnEvent, if set, receives every event of the run, one at a time.
+	OnEvent func(Event)
+
+	// Log, if set, writes a log file of the run.
+	Log *LogOptions
+}
+
+// DaemonOptions configures RunDaemon.
+type DaemonOptions struct {
+	// Source is the directory with the original music files.
+	Source string
+
+	// ProfilesDir is a directory of YAML profiles. A volume whose label
+	// matches the volume_label of a profile is synced with it. Volumes with
+	// a .sync-profile.yaml at their root are synced with that profile.
+	ProfilesDir string
+
+	// MountsDir is a directory whose subdirectories are mounted volumes,
+	// e.g. /media/username. When it is empty, the mount table is read.
+	MountsDir string
+
+	// Interval is how often to check for new volumes. When it is zero,
+	// DefaultMountPollInterval is used.
+	Interval time.Duration
+
+	// Jobs, Transcoder and OnEvent are as in Options.
+	Jobs       int
+	Transcoder Transcoder
+	OnEvent    func(Event)
+
+	// Log, if set, writes a log file of the daemon at its path, which has
+	// to be given.
+	Log *LogOptions
+}
+
+// PlannedFile is a source file that is missing from the destination.
+type PlannedFile struct {
+	Source      string
+	Destination string
+
+	// Operation is "transcode" or "copy".
+	Operation string
+
+	// Bytes is the size of the source file.
+	Bytes int64
+}
+
+// Report summarizes a run.
+type Report struct {
+	// Counts holds the summary counts of each operation of the run, e.g.
+	// Counts["sync"]["transcoded"].
+	Counts map[string]map[string]int
+
+	// Warnings and Errors are the warning and error events of the run.
+	Warnings []Event
+	Errors   []Event
+
+	Started  time.Time
+	Finished time.Time
+}
+
+// run is the state of one call of the package, such as Sync: the handler of
+// its events, its transcoder and its log, the connections to its remote
+// destinations, and the report it returns. Every call has its own run, so
+// calls can run at the same time.
+type run struct {
+	reporter   *eventReporter
+	transcoder Transcoder
+	logger     *slog.Logger
+	report     *Report
+
+	// remotes are the filesystems of the remote destinations of the run, by
+	// URL, so that every operation of the run on a destination uses the same
+	// connection
+	mu      sync.Mutex
+	remotes map[string]writableFS
+}
+
+// newRun returns the run of a call with the event handler and transcoder of
+// its options; without a transcoder, the goffmpeg transcoder is used. Nothing
+// is logged until the log of the run is opened, see openLog.
+func newRun(onEvent func(Event), trans Transcoder) *run {
+	if trans == nil {
+		trans = goffmpegTranscoder{}
+	}
+	report := &Report{Counts: make(map[string]map[string]int), Started: time.Now()}
+	r := &run{transcoder: trans, logger: discardLogger, report: report}
+	r.reporter = newEventReporter(func(e Event) {
+		switch e.Type {
+		case EventWarning:
+			report.Warnings = append(report.Warnings, e)
+		case EventError:
+			report.Errors = append(report.Errors, e)
+		case EventSummary:
+			if report.Counts[e.Operation] == nil {
+				report.Counts[e.Operation] = make(map[string]int)
+			}
+			for name, count := range e.Counts {
+				report.Counts[e.Operation][name] += count
+			}
+		}
+		if onEvent != nil {
+			onEvent(e)
+		}
+	})
+	return r
+}
+
+// end finishes the run and returns its report.
+func (r *run) end() *Report {
+	r.report.Finished = time.Now()
+	return r.report
+}
+
+// close closes the connections to the remote destinations of the run.
+func (r *run) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for destination, fsys := range r.remotes {
+		if closer, ok := fsys.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				r.logger.Debug("failed to close destination", "destination", destination, "error", err)
+			}
+		}
+	}
+	r.remotes = nil
+}
+
+// profile returns the profile of the options with their formats and filters
+// added.
+func (opts Options) profile() Profile {
+	prof := DefaultProfile()
+	if opts.Profile != nil {
+		prof = *opts.Profile
+	}
+	prof.Formats = append(append([]string(nil), prof.Formats...), opts.Formats...)
+	prof.Include = append(append([]string(nil), prof.Include...), opts.Include...)
+	prof.Exclude = append(append([]string(nil), prof.Exclude...), opts.Exclude...)
+	prof.Mirror = prof.Mirror || opts.Mirror
+	prof.Links.FollowDirectories = prof.Links.FollowDirectories || opts.FollowSymlinks
+	prof.Links.SkipDuplicates = prof.Links.SkipDuplicates || opts.SkipLinkedDuplicates
+	prof.CaseInsensitive = prof.CaseInsensitive || opts.CaseInsensitive
+	return prof
+}
+
+// jobs returns the number of files to transcode at the same time.
+func (opts Options) jobs() int {
+	if opts.Jobs > 0 {
+		return opts.Jobs
+	}
+	return runtime.NumCPU()
+}
+
+// validate checks that the options name the directories to sync, and that
+// no source and the destination are inside each other.
+func (opts Options) validate() error {
+	if len(opts.Sources) == 0 {
+		return fmt.Errorf("no source directory given")
+	}
+	if opts.Destination == "" {
+		return fmt.Errorf("no destination directory given")
+	}
+	for _, sourceDir := range opts.Sources {
+		if err := checkSeparateDirectories(sourceDir, opts.Destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync transcodes or copies the music files of the sources that are missing
+// from the destination, while holding the lock on the destination. In mirror
+// mode, destination files that no longer have a source file are then moved to
+// the trash. Errors for single files don't stop the run; they are in the
+// report.
+func Sync(ctx context.Context, opts Options) (*Report, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	r := newRun(opts.OnEvent, opts.Transcoder)
+	defer r.close()
+
+	prof := opts.profile()
+	attrs := []any{"sources", opts.Sources, "destination", opts.Destination}
+	err := r.runOnDestination(opts.Destination, opts.Wait, opts.DryRun, opts.Log, "sync", attrs, func() error {
+		if err := r.syncPaths(ctx, opts.Sources, opts.Destination, prof, opts.jobs(), nil, opts.DryRun); err != nil {
+			return err
+		}
+		if prof.Mirror {
+			return r.removeOrphanedFiles(opts.Sources, opts.Destination, prof, opts.DryRun)
+		}
+		return nil
+	})
+	return r.end(), err
+}
+
+// Plan returns the music files of the sources that are missing from the
+// destination, without changing anything. Like Sync, a file whose destination
+// path is taken by a file from an earlier source is left out.
+func Plan(ctx context.Context, opts Options) ([]PlannedFile, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	r := newRun(opts.OnEvent, opts.Transcoder)
+	defer r.close()
+
+	dev, err := r.openDevice(opts.Destination)
+	if err != nil {
+		return nil, err
+	}
+
+	// The destination doesn't have to exist yet
+	destinationFiles, err := dev.list()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	prof := opts.profile()
+	sources := make([]*syncSource, len(opts.Sources))
+	for i, sourceDir := range opts.Sources {
+		sources[i] = &syncSource{dir: sourceDir, index: r.loadSourceIndex(sourceIndexPath(sourceDir, opts.Destination), sourceDir, prof.Links)}
+	}
+	files, err := r.planChangedFiles(ctx, sources, destinationFiles, prof)
+	if err != nil {
+		return nil, err
+	}
+
+	var planned []PlannedFile
+	for _, file := range files {
+		source := filepath.Join(opts.Sources[file.source], file.sourcePath)
+		operation := "copy"
+		if isUntranscodedMusicFile(file.sourcePath) || prof.Loudness.enabled() {
+			operation = "transcode"
+		}
+		var size int64
+		if info, err := os.Stat(source); err == nil {
+			size = info.Size()
+		}
+		planned = append(planned, PlannedFile{Source: source, Destination: dev.path(file.destinationPath), Operation: operation, Bytes: size})
+	}
+	return planned, nil
+}
+
+// Verify returns the planned destination files of every source that are
+// missing or empty in the destination.
+func Verify(ctx context.Context, opts Options) ([]string, error) {
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	r := newRun(opts.OnEvent, opts.Transcoder)
+	defer r.close()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return r.verifySync(opts.Sources, opts.Destination, opts.profile())
+}
+
+// Dedupe moves duplicate files in a directory to the trash, keeping the
+// preferred copy of each group, while holding the lock on the directory.
+func Dedupe(ctx context.Context, opts DedupeOptions) (*Report, error) {
+	if opts.Dir == "" {
+		return nil, fmt.Errorf("no directory given")
+	}
+	r := newRun(opts.OnEvent, opts.Transcoder)
+	defer r.close()
+	trash, err := r.openTrash(opts.Dir, opts.TrashDir, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if IsRemote(opts.Dir) && (opts.ByContent || opts.Acoustic || opts.ReviewInput != nil) {
+		return nil, fmt.Errorf("only duplicates by name can be removed from remote destinations, without interactive review")
+	}
+
+	prof := DefaultProfile()
+	if opts.Profile != nil {
+		prof = *opts.Profile
+	}
+	dedupe := dedupeOptions{
+		trash:               trash,
+		dryRun:              opts.DryRun,
+		byContent:           opts.ByContent,
+		acoustic:            opts.Acoustic,
+		similarityThreshold: opts.SimilarityThreshold,
+		fingerprintCache:    opts.FingerprintCache,
+		ranking:             prof.Quality,
+		probe:               r.probeWithVBR,
+	}
+	if dedupe.acoustic && dedupe.fingerprintCache == "" {
+		dedupe.fingerprintCache = r.defaultFingerprintCachePath()
+	}
+	if IsRemote(opts.Dir) {
+		// Probing runs ffprobe on local paths
+		dedupe.probe = nil
+	}
+	if opts.ReviewInput != nil && opts.ReviewOutput != nil {
+		dedupe.reviewer = newDedupeReviewer(opts.ReviewInput, opts.ReviewOutput, r.probeWithVBR, prof.Quality)
+	}
+
+	err = ctx.Err()
+	if err == nil {
+		err = r.runOnDestination(opts.Dir, opts.Wait, opts.DryRun, opts.Log, "dedupe", []any{"dir", opts.Dir}, func() error {
+			return r.removeDuplicateFiles(trash.filesDir, dedupe)
+		})
+	}
+	return r.end(), err
+}
+
+// Watch syncs the source to the destination, then keeps syncing new and
+// changed files once their size has stayed the same for settle, until ctx
+// is done. Watching needs inotify, so it is only available on Linux.
+func Watch(ctx context.Context, opts Options, settle time.Duration) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+	if len(opts.Sources) != 1 {
+		return fmt.Errorf("watch mode syncs a single source directory, got %d", len(opts.Sources))
+	}
+	if settle <= 0 {
+		settle = DefaultSettleTime
+	}
+	r := newRun(opts.OnEvent, opts.Transcoder)
+	defer r.close()
+
+	attrs := []any{"source", opts.Sources[0], "destination", opts.Destination}
+	return r.runOnDestination(opts.Destination, opts.Wait, false, opts.Log, "watch", attrs, func() error {
+		return r.watchAndSync(ctx, opts.Sources[0], opts.Destination, opts.profile(), opts.jobs(), settle)
+	})
+}
+
+// RunDaemon waits for volumes to be mounted and syncs each volume that has a
+// matching profile, until ctx is done.
+func RunDaemon(ctx context.Context, opts DaemonOptions) error {
+	if opts.Source == "" {
+		return fmt.Errorf("no source directory given")
+	}
+	r := newRun(opts.OnEvent, opts.Transcoder)
+	defer r.close()
+	closeLog, err := r.openLog(opts.Log, "", "daemon", "source", opts.Source)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	var profiles []Profile
+	if opts.ProfilesDir != "" {
+		if profiles, err = loadProfiles(opts.ProfilesDir); err != nil {
+			return err
+		}
+	}
+
+	list := func() ([]volume, error) { return mountedVolumes(MountInfoPath, byLabelDir) }
+	if opts.MountsDir != "" {
+		list = func() ([]volume, error) { return volumesInDir(opts.MountsDir) }
+	}
+
+	interval := opts.Interval
+	if interval <= 0 {
+		interval = DefaultMountPollInterval
+	}
+	jobs := Options{Jobs: opts.Jobs}.jobs()
+	return r.runVolumeDaemon(ctx, opts.Source, profiles, jobs, list, interval)
+}
+
+// RestoreTrash moves the files removed from dir by the most recent run, or by
+// the given trash session, back to their original paths. trashDir is where
+// they were moved to; when it is empty, that is TrashDirName in dir.
+//
+// Returns the number of restored files.
+func RestoreTrash(dir, trashDir, session string, onEvent func(Event)) (int, error) {
+	r := newRun(onEvent, nil)
+	defer r.close()
+	trash, err := r.openTrash(dir, trashDir, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	var restored int
+	err = r.withDestinationLock(dir, false, func() error {
+		var err error
+		restored, err = r.restoreTrashSession(trash, session)
+		return err
+	})
+	return restored, err
+}
+
+// PurgeTrash permanently deletes the trash sessions of dir that are older
+// than olderThan. trashDir is as in RestoreTrash.
+//
+// Returns the purged sessions.
+func PurgeTrash(dir, trashDir string, olderThan time.Duration, onEvent func(Event)) ([]string, error) {
+	r := newRun(onEvent, nil)
+	defer r.close()
+	trash, err := r.openTrash(dir, trashDir, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []string
+	err = r.withDestinationLock(dir, false, func() error {
+		var err error
+		purged, err = r.purgeTrash(trash, olderThan, time.Now())
+		return err
+	})
+	return purged, err
+}
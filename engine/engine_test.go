@@ -0,0 +1,285 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSync(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-engine-sync")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	music := filepath.Join(tempDir, "music")
+	podcasts := filepath.Join(tempDir, "podcasts")
+	destinationDir := filepath.Join(tempDir, "destination")
+	for _, path := range []string{"music/Artist/a.m4a", "music/Artist/b.mp3", "music/Artist/c.wav", "music/Artist/d.demo.mp3", "podcasts/Show/e.mp3", "podcasts/Artist/b.mp3"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(tempDir, path)), 0755)
+		os.WriteFile(filepath.Join(tempDir, path), []byte("audio"), 0644)
+	}
+
+	fake := newFakeTranscoder()
+	var events []Event
+	opts := Options{
+		Sources:     []string{music, podcasts},
+		Destination: destinationDir,
+		Formats:     []string{"m4a", "mp3"},
+		Exclude:     []string{"*.demo.mp3"},
+		Jobs:        1,
+		Transcoder:  fake,
+		OnEvent:     func(e Event) { events = append(events, e) },
+	}
+
+	// The file of the first source wins
+	planned, err := Plan(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, []PlannedFile{
+		{Source: filepath.Join(music, "Artist", "a.m4a"), Destination: filepath.Join(destinationDir, "Artist", "a.mp3"), Operation: "transcode", Bytes: 5},
+		{Source: filepath.Join(music, "Artist", "b.mp3"), Destination: filepath.Join(destinationDir, "Artist", "b.mp3"), Operation: "copy", Bytes: 5},
+		{Source: filepath.Join(podcasts, "Show", "e.mp3"), Destination: filepath.Join(destinationDir, "Show", "e.mp3"), Operation: "copy", Bytes: 5},
+	}, planned)
+
+	report, err := Sync(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"copied": 2, "transcoded": 1}, report.Counts["sync"])
+	assert.Empty(t, report.Errors)
+	assert.NotEmpty(t, events)
+	assert.Equal(t, []string{filepath.Join(music, "Artist", "a.m4a")}, fake.transcodedFiles())
+
+	assert.FileExists(t, filepath.Join(destinationDir, "Show", "e.mp3"))
+	assert.NoFileExists(t, filepath.Join(destinationDir, "Artist", "c.mp3"))
+	assert.NoFileExists(t, filepath.Join(destinationDir, "Artist", "d.demo.mp3"))
+
+	missing, err := Verify(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	planned, err = Plan(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Empty(t, planned)
+}
+
+func TestSync_Cancelled(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-engine-cancel")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	destinationDir := filepath.Join(tempDir, "destination")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "Song.mp3"), []byte("audio"), 0644)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = Sync(ctx, Options{Sources: []string{sourceDir}, Destination: destinationDir, Transcoder: newFakeTranscoder()})
+	assert.Equal(t, context.Canceled, err)
+	assert.NoFileExists(t, filepath.Join(destinationDir, "Song.mp3"))
+
+	_, err = Sync(context.Background(), Options{Destination: destinationDir})
+	assert.Error(t, err)
+}
+
+func TestPlan_WhileWatching(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-engine-watch")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	destinationDir := filepath.Join(tempDir, "destination")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "Song.mp3"), []byte("audio"), 0644)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watching := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- Watch(ctx, Options{Sources: []string{sourceDir}, Destination: destinationDir, Transcoder: newFakeTranscoder(), OnEvent: func(e Event) {
+			if e.Type == EventStart && e.Operation == "watch" {
+				close(watching)
+			}
+		}}, time.Second)
+	}()
+	<-watching
+
+	// Plan doesn't wait for the watch, and only gets its own events
+	var events []Event
+	os.WriteFile(filepath.Join(sourceDir, "New.mp3"), []byte("audio"), 0644)
+	planned, err := Plan(context.Background(), Options{Sources: []string{sourceDir}, Destination: destinationDir, Transcoder: newFakeTranscoder(), OnEvent: func(e Event) { events = append(events, e) }})
+	assert.NoError(t, err)
+	assert.Len(t, planned, 1)
+	for _, e := range events {
+		assert.NotEqual(t, "watch", e.Operation)
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestSync_DryRun(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-engine-dry-run")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	destinationDir := filepath.Join(tempDir, "destination")
+	os.MkdirAll(filepath.Join(sourceDir, "Artist"), 0755)
+	os.WriteFile(filepath.Join(sourceDir, "Artist", "a.m4a"), []byte("audio"), 0644)
+	os.WriteFile(filepath.Join(sourceDir, "Artist", "b.mp3"), []byte("audio"), 0644)
+
+	// A new destination isn't created
+	fake := newFakeTranscoder()
+	var finished []Event
+	opts := Options{
+		Sources:     []string{sourceDir},
+		Destination: destinationDir,
+		Mirror:      true,
+		DryRun:      true,
+		Transcoder:  fake,
+		Log:         &LogOptions{},
+		OnEvent: func(e Event) {
+			if e.Type == EventFinished {
+				e.Version, e.Time = 0, time.Time{}
+				finished = append(finished, e)
+			}
+		},
+	}
+	report, err := Sync(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"would_copy": 1, "would_transcode": 1}, report.Counts["sync"])
+	assert.NoDirExists(t, destinationDir)
+
+	// Files that no longer have a source file would be moved to the trash
+	os.MkdirAll(destinationDir, 0755)
+	os.WriteFile(filepath.Join(destinationDir, "Old.mp3"), []byte("old audio"), 0644)
+	finished = nil
+	report, err = Sync(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"would_copy": 1, "would_transcode": 1}, report.Counts["sync"])
+	assert.Equal(t, map[string]int{"would_remove": 1}, report.Counts["mirror"])
+	assert.Equal(t, []Event{
+		{Type: EventFinished, Operation: "transcode", Source: filepath.Join(sourceDir, "Artist", "a.m4a"), Destination: filepath.Join(destinationDir, "Artist", "a.mp3"), Bytes: 5, DryRun: true},
+		{Type: EventFinished, Operation: "copy", Source: filepath.Join(sourceDir, "Artist", "b.mp3"), Destination: filepath.Join(destinationDir, "Artist", "b.mp3"), Bytes: 5, DryRun: true},
+		{Type: EventFinished, Operation: "remove-orphan", Path: filepath.Join(destinationDir, "Old.mp3"), Destination: finished[2].Destination, DryRun: true},
+	}, finished)
+	assert.Empty(t, fake.transcodedFiles())
+
+	// Nothing was changed, so a real run still syncs every file
+	entries, err := os.ReadDir(destinationDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	opts.DryRun = false
+	opts.Log = nil
+	report, err = Sync(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"copied": 1, "transcoded": 1}, report.Counts["sync"])
+	assert.Equal(t, map[string]int{"removed": 1}, report.Counts["mirror"])
+}
+
+func TestDedupe(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-engine-dedupe")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "Song.mp3"), []byte("mp3 audio"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "Song.m4a"), []byte("m4a audio"), 0644)
+
+	report, err := Dedupe(context.Background(), DedupeOptions{Dir: tempDir})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"kept": 1, "deleted": 1}, report.Counts["dedupe"])
+	assert.FileExists(t, filepath.Join(tempDir, "Song.mp3"))
+	assert.NoFileExists(t, filepath.Join(tempDir, "Song.m4a"))
+
+	restored, err := RestoreTrash(tempDir, "", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored)
+	assert.FileExists(t, filepath.Join(tempDir, "Song.m4a"))
+}
+
+func TestDedupe_Transcoder(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-engine-dedupe-transcoder")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "Song.mp3"), []byte("mp3 audio"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "Song.flac"), []byte("flac audio"), 0644)
+
+	// The duplicates are probed with the transcoder of the options, which
+	// finds the lossless copy
+	prof := DefaultProfile()
+	prof.Quality.Tiers = []string{"lossless", "mp3"}
+	report, err := Dedupe(context.Background(), DedupeOptions{Dir: tempDir, Profile: &prof, Transcoder: newFakeTranscoder()})
+	assert.NoError(t, err)
+	assert.Empty(t, report.Warnings)
+	assert.Equal(t, map[string]int{"kept": 1, "deleted": 1}, report.Counts["dedupe"])
+	assert.FileExists(t, filepath.Join(tempDir, "Song.flac"))
+	assert.NoFileExists(t, filepath.Join(tempDir, "Song.mp3"))
+}
+
+func TestDedupe_AcousticTranscoder(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-engine-dedupe-acoustic")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	musicDir := filepath.Join(tempDir, "music")
+	song := filepath.Join(musicDir, "Artist", "Song.mp3")
+	otherRip := filepath.Join(musicDir, "Compilations", "Song (Remastered).mp3")
+	different := filepath.Join(musicDir, "Artist", "Other.mp3")
+	for _, path := range []string{song, otherRip, different} {
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte("audio"), 0644)
+	}
+
+	// The files are decoded with the transcoder of the options
+	fake := newFakeTranscoder()
+	fake.setSamples(song, synthesizeMelody(melodyA, 1, 0.01, 1))
+	fake.setSamples(otherRip, synthesizeMelody(melodyA, 0.8, 0.01, 2))
+	fake.setSamples(different, synthesizeMelody(melodyB, 1, 0.01, 3))
+	report, err := Dedupe(context.Background(), DedupeOptions{Dir: musicDir, Acoustic: true, FingerprintCache: filepath.Join(tempDir, "fingerprints.json"), Transcoder: fake})
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, map[string]int{"kept": 1, "deleted": 1}, report.Counts["dedupe"])
+	assert.FileExists(t, different)
+}
+
+func TestSync_LoudnessTranscoder(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-engine-loudness")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	song := filepath.Join(sourceDir, "Album", "01.m4a")
+	os.MkdirAll(filepath.Dir(song), 0755)
+	os.WriteFile(song, []byte("audio"), 0644)
+
+	// The files are measured with the transcoder of the options
+	fake := newFakeTranscoder()
+	fake.setLoudness(song, LoudnessMeasurement{Integrated: -14, TruePeak: -1, Duration: 60})
+	prof := DefaultProfile()
+	prof.Loudness = LoudnessSettings{Mode: "tags"}
+	report, err := Sync(context.Background(), Options{Sources: []string{sourceDir}, Destination: filepath.Join(tempDir, "destination"), Profile: &prof, Transcoder: fake})
+	assert.NoError(t, err)
+	assert.Empty(t, report.Errors)
+	assert.Equal(t, []string{song}, fake.measuredFiles())
+	assert.Equal(t, "-4.00 dB", fake.options[song].Tags["REPLAYGAIN_TRACK_GAIN"])
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// EventSchemaVersion is incremented whenever a field of Event is renamed or
+// removed, or its meaning changes. Adding fields or event types doesn't
+// change the version.
+const EventSchemaVersion = 1
+
+// Event types. See the README for the documented schema.
+const (
+	EventPlan     = "plan"
+	EventStart    = "start"
+	EventProgress = "progress"
+	EventFinished = "finished"
+	EventWarning  = "warning"
+	EventError    = "error"
+	EventSummary  = "summary"
+)
+
+// Event is a structured record of something that happened during a run.
+// In the command's JSON output mode each event is written as one line of
+// NDJSON.
+type Event struct {
+	Version     int            `json:"v"`
+	Time        time.Time      `json:"time"`
+	Type        string         `json:"type"`
+	Operation   string         `json:"operation"`
+	Path        string         `json:"path,omitempty"`
+	Source      string         `json:"source,omitempty"`
+	Destination string         `json:"destination,omitempty"`
+	DryRun      bool           `json:"dry_run,omitempty"`
+	Worker      int            `json:"worker,omitempty"`
+	Done        int            `json:"done,omitempty"`
+	Total       int            `json:"total,omitempty"`
+	Percent     float64        `json:"percent,omitempty"`
+	Bytes       int64          `json:"bytes,omitempty"`
+	Seconds     float64        `json:"seconds,omitempty"`
+	Message     string         `json:"message,omitempty"`
+	Error       string         `json:"error,omitempty"`
+	Counts      map[string]int `json:"counts,omitempty"`
+
+	// ffmpegStderr is what ffmpeg printed for a failed file. It is only
+	// written to the log file.
+	ffmpegStderr string
+}
+
+// eventReporter passes the events of a run to the handler set in its
+// Options. Every event is also recorded in the log file of the run.
+type eventReporter struct {
+	mu      sync.Mutex
+	handler func(Event)
+
+	// logger records the events in the log file only, since the handler
+	// already shows them on the console
+	logger *slog.Logger
+}
+
+// newEventReporter returns a reporter that passes events to handler. A nil
+// handler drops events after logging them.
+func newEventReporter(handler func(Event)) *eventReporter {
+	return &eventReporter{handler: handler, logger: discardLogger}
+}
+
+// setLogger sets the logger that records the events in the log file.
+func (r *eventReporter) setLogger(logger *slog.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logger = logger
+}
+
+// emit sends an event to the handler. Events are delivered one at a time,
+// even when they come from several workers.
+func (r *eventReporter) emit(e Event) {
+	e.Version = EventSchemaVersion
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	logEvent(r.logger, e)
+	if r.handler != nil {
+		r.handler(e)
+	}
+}
+
+// warn reports a problem that doesn't stop the current operation.
+func (r *eventReporter) warn(operation, path, message string) {
+	r.emit(Event{Type: EventWarning, Operation: operation, Path: path, Message: message})
+}
+
+// fail reports an error for a single file or step of an operation.
+func (r *eventReporter) fail(operation, path string, err error) {
+	r.emit(Event{Type: EventError, Operation: operation, Path: path, Error: err.Error(), ffmpegStderr: ffmpegStderr(err)})
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordEvents returns a run that records its events, with the transcoder
+// trans, or the default one if it's nil, and a function that returns the
+// recorded events.
+func recordEvents(trans Transcoder) (*run, func() []Event) {
+	var mu sync.Mutex
+	var events []Event
+	r := newRun(func(e Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, e)
+	}, trans)
+	return r, func() []Event {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]Event(nil), events...)
+	}
+}
+
+// summaryCounts returns the counts of the last summary event of the
+// operation.
+func summaryCounts(events []Event, operation string) map[string]int {
+	var counts map[string]int
+	for _, e := range events {
+		if e.Type == EventSummary && e.Operation == operation {
+			counts = e.Counts
+		}
+	}
+	return counts
+}
+
+func TestEventReporter_Emit(t *testing.T) {
+	r, events := recordEvents(nil)
+
+	r.reporter.emit(Event{Type: EventFinished, Operation: "transcode", Source: "/music/Song.m4a", Destination: "/usb/Song.mp3"})
+	r.reporter.warn("plan", "/usb/Artist", "Exceeds device limits, too many files")
+	r.reporter.fail("copy", "/music/Other.mp3", fmt.Errorf("disk full"))
+
+	recorded := events()
+	assert.Len(t, recorded, 3)
+	for _, e := range recorded {
+		assert.Equal(t, EventSchemaVersion, e.Version)
+		assert.False(t, e.Time.IsZero())
+	}
+	assert.Equal(t, "/usb/Song.mp3", recorded[0].Destination)
+	assert.Equal(t, EventWarning, recorded[1].Type)
+	assert.Equal(t, "Exceeds device limits, too many files", recorded[1].Message)
+	assert.Equal(t, EventError, recorded[2].Type)
+	assert.Equal(t, "disk full", recorded[2].Error)
+}
+
+func TestNewRun_SeparateEvents(t *testing.T) {
+	first, firstEvents := recordEvents(nil)
+	second, secondEvents := recordEvents(nil)
+
+	first.reporter.emit(Event{Type: EventStart, Operation: "scan"})
+	first.reporter.emit(Event{Type: EventSummary, Operation: "sync", Counts: map[string]int{"copied": 2}})
+	second.reporter.warn("plan", "/usb/Artist", "Exceeds device limits, too many files")
+	assert.Len(t, firstEvents(), 2)
+	assert.Len(t, secondEvents(), 1)
+
+	// Each run reports its own events
+	assert.Equal(t, map[string]map[string]int{"sync": {"copied": 2}}, first.end().Counts)
+	assert.Empty(t, first.report.Warnings)
+	assert.Empty(t, second.end().Counts)
+	assert.Len(t, second.report.Warnings, 1)
+
+	// Without a handler, events are only collected in the report
+	third := newRun(nil, nil)
+	third.reporter.fail("copy", "/music/Other.mp3", fmt.Errorf("disk full"))
+	assert.Len(t, third.end().Errors, 1)
+}
+
+func TestRemoveDuplicateFiles_Events(t *testing.T) {
+	r, events := recordEvents(nil)
+
+	tempDir, err := os.MkdirTemp("", "test-dedupe-events")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "Song.mp3"), []byte("mp3 audio"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "Song.m4a"), []byte("m4a audio"), 0644)
+
+	err = r.removeDuplicateFiles(tempDir, dedupeOptions{dryRun: true})
+	assert.NoError(t, err)
+
+	var types []string
+	for _, e := range events() {
+		types = append(types, e.Type+":"+e.Operation)
+	}
+	assert.Contains(t, types, "finished:keep")
+	assert.Contains(t, types, "finished:delete")
+	assert.Equal(t, "summary:dedupe", types[len(types)-1])
+	assert.Equal(t, map[string]int{"kept": 1, "would_delete": 1}, summaryCounts(events(), "dedupe"))
+}
@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// fakeDevice is a device in memory with a fixed capacity, so that the sync
+// planner and the free space checks can be tested without hardware. Only the
+// sizes of files are kept.
+type fakeDevice struct {
+	mu       sync.Mutex
+	capacity int64
+	files    map[string]int64
+
+	// pushed lists the names of the files pushed so far, in order
+	pushed []string
+}
+
+// newFakeDevice returns an empty fake device of the given capacity in bytes.
+func newFakeDevice(capacity int64) *fakeDevice {
+	return &fakeDevice{capacity: capacity, files: make(map[string]int64)}
+}
+
+// addFile puts a file of the given size on the device.
+func (d *fakeDevice) addFile(name string, size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.files[d.path(name)] = size
+}
+
+// pushedFiles returns the names of the files pushed so far.
+func (d *fakeDevice) pushedFiles() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.pushed...)
+}
+
+// used returns the number of bytes taken by the files. The caller holds mu.
+func (d *fakeDevice) used() int64 {
+	var used int64
+	for _, size := range d.files {
+		used += size
+	}
+	return used
+}
+
+// list returns the names of the files, sorted.
+func (d *fakeDevice) list() ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.files))
+	for name := range d.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// stat returns the size of the named file.
+func (d *fakeDevice) stat(name string) (fs.FileInfo, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	size, ok := d.files[d.path(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return remoteFileInfo{name: path.Base(d.path(name)), size: size}, nil
+}
+
+// push records a file with the size of the local file, failing with
+// errDeviceFull if it doesn't fit.
+func (d *fakeDevice) push(localPath, name string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.used()-d.files[d.path(name)]+info.Size() > d.capacity {
+		return fmt.Errorf("failed to push %s: %w", name, errDeviceFull)
+	}
+	d.files[d.path(name)] = info.Size()
+	d.pushed = append(d.pushed, d.path(name))
+	return nil
+}
+
+// delete removes the named file.
+func (d *fakeDevice) delete(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.files[d.path(name)]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(d.files, d.path(name))
+	return nil
+}
+
+// freeSpace returns the capacity that isn't used by files.
+func (d *fakeDevice) freeSpace() (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.capacity - d.used(), nil
+}
+
+// path returns the name as a clean slash-separated path.
+func (d *fakeDevice) path(name string) string {
+	return rootedName(name)
+}
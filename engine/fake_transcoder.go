@@ -0,0 +1,181 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// fakeTranscoder is a Transcoder that doesn't need ffmpeg. Probe results come
+// from a table of files, and a transcode writes a small placeholder file and
+// records the file it was made from, so the whole sync can be tested
+// deterministically.
+type fakeTranscoder struct {
+	mu sync.Mutex
+
+	// media holds the probe results by path. Outputs are added as they are
+	// written, with the properties of their source.
+	media map[string]MediaInfo
+
+	// failures makes transcoding the given source paths fail.
+	failures map[string]error
+
+	// transcoded lists the source paths in the order they were transcoded.
+	transcoded []string
+
+	// options holds the options each source path was transcoded with.
+	options map[string]TranscodeOptions
+
+	// loudness and samples hold the loudness measurements and decoded
+	// samples by path.
+	loudness map[string]LoudnessMeasurement
+	samples  map[string][]float64
+
+	// measured lists the paths in the order their loudness was measured.
+	measured []string
+}
+
+// newFakeTranscoder returns a fake transcoder with no known files.
+func newFakeTranscoder() *fakeTranscoder {
+	return &fakeTranscoder{
+		media:    make(map[string]MediaInfo),
+		failures: make(map[string]error),
+		options:  make(map[string]TranscodeOptions),
+		loudness: make(map[string]LoudnessMeasurement),
+		samples:  make(map[string][]float64),
+	}
+}
+
+// setMedia sets the probe result for the file at path.
+func (t *fakeTranscoder) setMedia(path string, info MediaInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.media[path] = info
+}
+
+// setLoudness sets the loudness measurement of the file at path.
+func (t *fakeTranscoder) setLoudness(path string, measurement LoudnessMeasurement) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.loudness[path] = measurement
+}
+
+// setSamples sets the decoded samples of the file at path.
+func (t *fakeTranscoder) setSamples(path string, samples []float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples[path] = samples
+}
+
+// measuredFiles returns the paths whose loudness was measured so far.
+func (t *fakeTranscoder) measuredFiles() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.measured...)
+}
+
+// fail makes transcoding the file at sourcePath fail with err.
+func (t *fakeTranscoder) fail(sourcePath string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures[sourcePath] = err
+}
+
+// transcodedFiles returns the source paths transcoded so far.
+func (t *fakeTranscoder) transcodedFiles() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.transcoded...)
+}
+
+// Probe returns the media set for path. Other existing files are reported as
+// untagged audio with the codec named by their extension.
+func (t *fakeTranscoder) Probe(path string) (MediaInfo, error) {
+	t.mu.Lock()
+	info, ok := t.media[path]
+	t.mu.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return MediaInfo{}, fmt.Errorf("failed to probe %s: %v", path, err)
+	}
+	return MediaInfo{Codec: strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), "."), Tags: make(map[string]string)}, nil
+}
+
+// Transcode writes a placeholder naming the source file to destinationPath,
+// reporting progress at half way and at the end.
+func (t *fakeTranscoder) Transcode(sourcePath, destinationPath string, opts TranscodeOptions, onProgress func(float64)) (float64, error) {
+	source, err := t.Probe(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+
+	t.mu.Lock()
+	failure := t.failures[sourcePath]
+	t.transcoded = append(t.transcoded, sourcePath)
+	t.options[sourcePath] = opts
+	t.mu.Unlock()
+	if failure != nil {
+		return source.Duration, failure
+	}
+
+	if onProgress != nil {
+		onProgress(50)
+	}
+	if err := os.WriteFile(destinationPath, []byte("transcoded from "+filepath.Base(sourcePath)+"\n"), 0644); err != nil {
+		return source.Duration, err
+	}
+	if onProgress != nil {
+		onProgress(100)
+	}
+
+	output := source
+	output.Codec = "mp3"
+	output.Tags = make(map[string]string)
+	for name, value := range source.Tags {
+		output.Tags[name] = value
+	}
+	for name, value := range opts.Tags {
+		output.Tags[name] = value
+	}
+	t.setMedia(destinationPath, output)
+	return source.Duration, nil
+}
+
+// MeasureLoudness returns the measurement set for path. Other music files
+// that can be probed are at the target loudness with a true peak of -1 dBTP.
+func (t *fakeTranscoder) MeasureLoudness(path string) (LoudnessMeasurement, error) {
+	t.mu.Lock()
+	t.measured = append(t.measured, path)
+	measurement, ok := t.loudness[path]
+	t.mu.Unlock()
+	if ok {
+		return measurement, nil
+	}
+
+	info, err := t.Probe(path)
+	if err != nil {
+		return LoudnessMeasurement{}, err
+	}
+	return LoudnessMeasurement{Integrated: defaultTargetLoudness, TruePeak: -1, Duration: info.Duration}, nil
+}
+
+// DecodePCM returns the samples set for path, up to seconds of them at
+// sampleRate. Other files that can be probed are silent.
+func (t *fakeTranscoder) DecodePCM(path string, sampleRate, seconds int) ([]float64, error) {
+	t.mu.Lock()
+	samples, ok := t.samples[path]
+	t.mu.Unlock()
+	if !ok {
+		_, err := t.Probe(path)
+		return nil, err
+	}
+	if limit := sampleRate * seconds; len(samples) > limit {
+		samples = samples[:limit]
+	}
+	return append([]float64(nil), samples...), nil
+}
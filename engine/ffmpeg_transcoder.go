@@ -0,0 +1,114 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ffmpegTranscoder runs the ffmpeg and ffprobe commands directly, building
+// the ffmpeg arguments itself instead of with goffmpeg.
+type ffmpegTranscoder struct {
+	ffmpegPath  string
+	ffprobePath string
+}
+
+// newFFmpegTranscoder returns a transcoder that runs ffmpeg and ffprobe from
+// the PATH.
+func newFFmpegTranscoder() ffmpegTranscoder {
+	return ffmpegTranscoder{ffmpegPath: "ffmpeg", ffprobePath: "ffprobe"}
+}
+
+// Probe runs ffprobe on the file at path.
+func (t ffmpegTranscoder) Probe(path string) (MediaInfo, error) {
+	return probeFileWith(t.ffprobePath, path)
+}
+
+// MeasureLoudness runs ffmpeg's ebur128 filter on the file at path.
+func (t ffmpegTranscoder) MeasureLoudness(path string) (LoudnessMeasurement, error) {
+	return measureLoudnessWith(t.ffmpegPath, path)
+}
+
+// DecodePCM runs ffmpeg to decode the file at path to raw samples.
+func (t ffmpegTranscoder) DecodePCM(path string, sampleRate, seconds int) ([]float64, error) {
+	return decodePCMWith(t.ffmpegPath, path, sampleRate, seconds)
+}
+
+// Transcode runs ffmpeg with its progress written to stdout. The source is
+// probed first, since the progress is only reported as a time.
+func (t ffmpegTranscoder) Transcode(sourcePath, destinationPath string, opts TranscodeOptions, onProgress func(float64)) (float64, error) {
+	var seconds float64
+	if info, err := t.Probe(sourcePath); err == nil {
+		seconds = info.Duration
+	}
+
+	args := ffmpegArgs(sourcePath, destinationPath, opts)
+	opts.debug("running ffmpeg", "args", args)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(t.ffmpegPath, args...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return seconds, err
+	}
+	if err := cmd.Start(); err != nil {
+		return seconds, err
+	}
+
+	readFFmpegProgress(stdout, seconds, onProgress)
+	if err := cmd.Wait(); err != nil {
+		return seconds, newFFmpegError(err, stderr.String())
+	}
+	return seconds, nil
+}
+
+// ffmpegArgs returns the ffmpeg arguments to transcode sourcePath to an MP3
+// at destinationPath. Tags are sorted by name, so that the arguments are the
+// same on every run.
+func ffmpegArgs(sourcePath, destinationPath string, opts TranscodeOptions) []string {
+	args := []string{"-nostdin", "-nostats", "-loglevel", "error", "-progress", "pipe:1", "-y", "-i", sourcePath}
+	if opts.AudioFilter != "" {
+		args = append(args, "-af", opts.AudioFilter)
+	} else if copiesAudio(sourcePath, opts) {
+		// Only the tags change, so keep the MP3 audio as-is
+		args = append(args, "-c:a", "copy")
+	}
+
+	names := make([]string, 0, len(opts.Tags))
+	for name := range opts.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "-metadata", name+"="+opts.Tags[name])
+	}
+
+	return append(args, destinationPath)
+}
+
+// readFFmpegProgress reads the key=value lines that ffmpeg writes with
+// -progress and calls onProgress with the percentage of seconds transcoded.
+// Without a duration, or without a callback, the progress is only drained.
+func readFFmpegProgress(r io.Reader, seconds float64, onProgress func(float64)) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		// out_time_ms is in microseconds too, despite its name
+		if !ok || (key != "out_time_us" && key != "out_time_ms") || onProgress == nil || seconds <= 0 {
+			continue
+		}
+		microseconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || microseconds <= 0 {
+			continue
+		}
+		onProgress(math.Min(microseconds/1e6/seconds*100, 100))
+	}
+	// Keep draining so that ffmpeg never blocks on a full pipe
+	io.Copy(io.Discard, r)
+}
@@ -0,0 +1,56 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFFmpegArgs(t *testing.T) {
+	args := ffmpegArgs("in.m4a", "out.mp3", TranscodeOptions{})
+	assert.Equal(t, []string{"-nostdin", "-nostats", "-loglevel", "error", "-progress", "pipe:1", "-y", "-i", "in.m4a", "out.mp3"}, args)
+
+	args = ffmpegArgs("in.m4a", "out.mp3", TranscodeOptions{AudioFilter: "volume=-3.5dB", Tags: map[string]string{"title": "Song", "album": "Record"}})
+	assert.Equal(t, []string{"-af", "volume=-3.5dB", "-metadata", "album=Record", "-metadata", "title=Song", "out.mp3"}, args[9:])
+
+	// Retagging an MP3 keeps its audio
+	args = ffmpegArgs("in.MP3", "out.mp3", TranscodeOptions{Tags: map[string]string{"title": "Song"}})
+	assert.Equal(t, []string{"-c:a", "copy", "-metadata", "title=Song", "out.mp3"}, args[9:])
+}
+
+func TestReadFFmpegProgress(t *testing.T) {
+	output := "out_time_us=1000000\nprogress=continue\nout_time_us=3000000\nout_time_us=N/A\nout_time_us=5000000\nprogress=end\n"
+
+	var percents []float64
+	readFFmpegProgress(strings.NewReader(output), 4, func(percent float64) {
+		percents = append(percents, percent)
+	})
+	assert.Equal(t, []float64{25, 75, 100}, percents)
+
+	// Without a duration there is no progress
+	percents = nil
+	readFFmpegProgress(strings.NewReader(output), 0, func(percent float64) {
+		percents = append(percents, percent)
+	})
+	assert.Empty(t, percents)
+}
+
+func TestFFmpegTranscoder_FailureKeepsStderr(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-ffmpeg-transcoder")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Stand-ins for ffmpeg and ffprobe that fail like ffmpeg does
+	script := filepath.Join(tempDir, "ffmpeg")
+	os.WriteFile(script, []byte("#!/bin/sh\necho 'in.m4a: Invalid data found when processing input' >&2\nexit 1\n"), 0755)
+
+	trans := ffmpegTranscoder{ffmpegPath: script, ffprobePath: script}
+	_, err = trans.Transcode(filepath.Join(tempDir, "in.m4a"), filepath.Join(tempDir, "out.mp3"), TranscodeOptions{}, nil)
+	assert.Error(t, err)
+	assert.Contains(t, ffmpegStderr(err), "Invalid data found")
+}
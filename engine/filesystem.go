@@ -0,0 +1,535 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing/fstest"
+	"time"
+)
+
+// writableFS is a filesystem that files can be written to and removed from,
+// extending the read-only io/fs interfaces. Like an fs.FS, it is rooted at a
+// directory, and names are slash-separated paths relative to it that satisfy
+// fs.ValidPath; "." is the directory itself.
+type writableFS interface {
+	fs.StatFS
+	fs.ReadDirFS
+
+	// Create creates or truncates the named file for writing.
+	Create(name string) (writableFile, error)
+
+	// Append opens the named file for appending, creating it if needed.
+	Append(name string) (writableFile, error)
+
+	MkdirAll(name string, perm fs.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+}
+
+// writableFile is a file opened for writing. Sync flushes the writes to
+// stable storage.
+type writableFile interface {
+	io.WriteCloser
+	Sync() error
+}
+
+// checkName returns an error for op if name isn't a valid name of a
+// writableFS.
+func checkName(op, name string) error {
+	if !fs.ValidPath(name) || runtime.GOOS == "windows" && strings.ContainsAny(name, `\:`) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// osFS is a writableFS of a directory of the operating system, like
+// os.DirFS.
+type osFS struct {
+	root string
+}
+
+// newOSFS returns the filesystem of the local directory root.
+func newOSFS(root string) osFS {
+	return osFS{root: root}
+}
+
+// path returns the path of the named file on the operating system.
+func (f osFS) path(op, name string) (string, error) {
+	if err := checkName(op, name); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.root, filepath.FromSlash(name)), nil
+}
+
+// Open opens the named file for reading.
+func (f osFS) Open(name string) (fs.File, error) {
+	filePath, err := f.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filePath)
+}
+
+// Stat returns the file information of the named file.
+func (f osFS) Stat(name string) (fs.FileInfo, error) {
+	filePath, err := f.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(filePath)
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (f osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	filePath, err := f.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(filePath)
+}
+
+// Create creates or truncates the named file.
+func (f osFS) Create(name string) (writableFile, error) {
+	filePath, err := f.path("create", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Create(filePath)
+}
+
+// Append opens the named file for appending, creating it if needed.
+func (f osFS) Append(name string) (writableFile, error) {
+	filePath, err := f.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// MkdirAll creates the named directory and any missing parents.
+func (f osFS) MkdirAll(name string, perm fs.FileMode) error {
+	filePath, err := f.path("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(filePath, perm)
+}
+
+// Remove removes the named file or empty directory.
+func (f osFS) Remove(name string) error {
+	filePath, err := f.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filePath)
+}
+
+// RemoveAll removes the named path and everything below it.
+func (f osFS) RemoveAll(name string) error {
+	filePath, err := f.path("removeall", name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(filePath)
+}
+
+// Rename moves the named file or directory.
+func (f osFS) Rename(oldName, newName string) error {
+	oldPath, err := f.path("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := f.path("rename", newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+// memFS is an in-memory writableFS for tests and simulations. Parent
+// directories of files exist implicitly, as in fstest.MapFS.
+type memFS struct {
+	mu    sync.Mutex
+	files fstest.MapFS
+	now   func() time.Time
+}
+
+// newMemFS returns an empty in-memory filesystem.
+func newMemFS() *memFS {
+	return &memFS{files: make(fstest.MapFS), now: time.Now}
+}
+
+// writeFile stores a file with the given contents, creating its parents.
+func (m *memFS) writeFile(name string, data []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = &fstest.MapFile{Data: data, Mode: 0644, ModTime: m.now()}
+}
+
+// Open opens the named file or directory for reading.
+func (m *memFS) Open(name string) (fs.File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files.Open(name)
+}
+
+// Stat returns the file information of the named file or directory.
+func (m *memFS) Stat(name string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files.Stat(name)
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (m *memFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files.ReadDir(name)
+}
+
+// Create returns a file whose contents replace the named file when it's
+// closed.
+func (m *memFS) Create(name string) (writableFile, error) {
+	if err := m.checkParent(name, "create"); err != nil {
+		return nil, err
+	}
+	return &memWriter{fs: m, name: name}, nil
+}
+
+// Append returns a file whose contents are added to the named file when it's
+// closed.
+func (m *memFS) Append(name string) (writableFile, error) {
+	if err := m.checkParent(name, "open"); err != nil {
+		return nil, err
+	}
+	writer := &memWriter{fs: m, name: name}
+	m.mu.Lock()
+	if file, ok := m.files[name]; ok {
+		writer.buf.Write(file.Data)
+	}
+	m.mu.Unlock()
+	return writer, nil
+}
+
+// checkParent returns an error if the parent directory of name doesn't
+// exist, as creating a file on disk would.
+func (m *memFS) checkParent(name, op string) error {
+	if err := checkName(op, name); err != nil {
+		return err
+	}
+	info, err := m.Stat(path.Dir(name))
+	if err != nil || !info.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return nil
+}
+
+// MkdirAll creates the named directory and any missing parents.
+func (m *memFS) MkdirAll(name string, perm fs.FileMode) error {
+	if err := checkName("mkdir", name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir := name; dir != "."; dir = path.Dir(dir) {
+		if file, ok := m.files[dir]; ok {
+			if !file.Mode.IsDir() {
+				return &fs.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+			}
+			continue
+		}
+		m.files[dir] = &fstest.MapFile{Mode: fs.ModeDir | perm, ModTime: m.now()}
+	}
+	return nil
+}
+
+// Remove removes the named file or empty directory.
+func (m *memFS) Remove(name string) error {
+	if err := checkName("remove", name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := name
+	children := m.below(key)
+	if len(children) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	if _, ok := m.files[key]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, key)
+	return nil
+}
+
+// RemoveAll removes the named file or directory and everything below it.
+func (m *memFS) RemoveAll(name string) error {
+	if err := checkName("removeall", name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := name
+	for _, child := range m.below(key) {
+		delete(m.files, child)
+	}
+	delete(m.files, key)
+	return nil
+}
+
+// Rename moves the named file or directory, replacing any file at newName.
+func (m *memFS) Rename(oldName, newName string) error {
+	if err := checkName("rename", oldName); err != nil {
+		return err
+	}
+	if err := m.checkParent(newName, "rename"); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldKey, newKey := oldName, newName
+	children := m.below(oldKey)
+	file, ok := m.files[oldKey]
+	if !ok && len(children) == 0 {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+
+	if ok {
+		delete(m.files, oldKey)
+		m.files[newKey] = file
+	}
+	for _, child := range children {
+		m.files[newKey+strings.TrimPrefix(child, oldKey)] = m.files[child]
+		delete(m.files, child)
+	}
+	return nil
+}
+
+// below returns the names of the entries inside the directory with the
+// given key, sorted.
+func (m *memFS) below(key string) []string {
+	prefix := key + "/"
+	if key == "." {
+		prefix = ""
+	}
+	var names []string
+	for name := range m.files {
+		if strings.HasPrefix(name, prefix) && name != key {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// memWriter buffers the writes to a file of a memFS until it's closed.
+type memWriter struct {
+	fs   *memFS
+	name string
+	buf  bytes.Buffer
+}
+
+// Write adds p to the buffered contents.
+func (w *memWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+
+// Sync does nothing, since there is no stable storage to flush to.
+func (w *memWriter) Sync() error { return nil }
+
+// Close stores the written contents.
+func (w *memWriter) Close() error {
+	w.fs.writeFile(w.name, bytes.Clone(w.buf.Bytes()))
+	return nil
+}
+
+// dryRunFS simulates changes to a filesystem without making them. Reads see
+// the underlying filesystem with the simulated changes applied: written files
+// are kept in memory and take precedence, and removed files of the
+// underlying filesystem are hidden.
+type dryRunFS struct {
+	base    writableFS
+	overlay *memFS
+
+	mu      sync.Mutex
+	removed map[string]bool
+}
+
+// newDryRunFS returns a filesystem that simulates changes to base.
+func newDryRunFS(base writableFS) *dryRunFS {
+	return &dryRunFS{base: base, overlay: newMemFS(), removed: make(map[string]bool)}
+}
+
+// isRemoved reports whether the named path or one of its parents was removed
+// and not created again.
+func (d *dryRunFS) isRemoved(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for key := name; ; key = path.Dir(key) {
+		if d.removed[key] {
+			return true
+		}
+		if key == "." {
+			return false
+		}
+	}
+}
+
+// inOverlay reports whether the named path was written during the dry run.
+func (d *dryRunFS) inOverlay(name string) bool {
+	_, err := d.overlay.Stat(name)
+	return err == nil
+}
+
+// Open opens the named file from the simulated changes or the base.
+func (d *dryRunFS) Open(name string) (fs.File, error) {
+	if err := checkName("open", name); err != nil {
+		return nil, err
+	}
+	if d.inOverlay(name) {
+		return d.overlay.Open(name)
+	}
+	if d.isRemoved(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return d.base.Open(name)
+}
+
+// Stat returns the file information from the simulated changes or the base.
+func (d *dryRunFS) Stat(name string) (fs.FileInfo, error) {
+	if err := checkName("stat", name); err != nil {
+		return nil, err
+	}
+	if info, err := d.overlay.Stat(name); err == nil {
+		return info, nil
+	}
+	if d.isRemoved(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return d.base.Stat(name)
+}
+
+// ReadDir merges the entries of the base that weren't removed with the
+// entries written during the dry run.
+func (d *dryRunFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := checkName("readdir", name); err != nil {
+		return nil, err
+	}
+	merged := make(map[string]fs.DirEntry)
+	baseEntries, baseErr := []fs.DirEntry(nil), error(nil)
+	if !d.isRemoved(name) {
+		baseEntries, baseErr = d.base.ReadDir(name)
+	}
+	for _, entry := range baseEntries {
+		if !d.isRemoved(path.Join(name, entry.Name())) {
+			merged[entry.Name()] = entry
+		}
+	}
+
+	overlayEntries, overlayErr := d.overlay.ReadDir(name)
+	for _, entry := range overlayEntries {
+		merged[entry.Name()] = entry
+	}
+	if baseErr != nil && overlayErr != nil {
+		if d.isRemoved(name) {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+		}
+		return nil, baseErr
+	}
+
+	entries := make([]fs.DirEntry, 0, len(merged))
+	for _, entry := range merged {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Name() < entries[b].Name() })
+	return entries, nil
+}
+
+// Create simulates creating the named file.
+func (d *dryRunFS) Create(name string) (writableFile, error) {
+	if err := d.simulateParents(name); err != nil {
+		return nil, err
+	}
+	return d.overlay.Create(name)
+}
+
+// Append simulates appending to the named file, starting with its current
+// contents.
+func (d *dryRunFS) Append(name string) (writableFile, error) {
+	if err := d.simulateParents(name); err != nil {
+		return nil, err
+	}
+	if !d.inOverlay(name) && !d.isRemoved(name) {
+		if data, err := fs.ReadFile(d.base, name); err == nil {
+			d.overlay.writeFile(name, data)
+		}
+	}
+	return d.overlay.Append(name)
+}
+
+// simulateParents checks that the parent directory of name exists, and
+// creates it in the overlay so the file can be written there.
+func (d *dryRunFS) simulateParents(name string) error {
+	if err := checkName("create", name); err != nil {
+		return err
+	}
+	parent := path.Dir(name)
+	info, err := d.Stat(parent)
+	if err != nil || !info.IsDir() {
+		return &fs.PathError{Op: "create", Path: name, Err: fs.ErrNotExist}
+	}
+	return d.overlay.MkdirAll(parent, 0755)
+}
+
+// MkdirAll simulates creating the named directory.
+func (d *dryRunFS) MkdirAll(name string, perm fs.FileMode) error {
+	return d.overlay.MkdirAll(name, perm)
+}
+
+// Remove simulates removing the named file or empty directory.
+func (d *dryRunFS) Remove(name string) error {
+	if _, err := d.Stat(name); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if entries, err := d.ReadDir(name); err == nil && len(entries) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	return d.RemoveAll(name)
+}
+
+// RemoveAll simulates removing the named path and everything below it.
+func (d *dryRunFS) RemoveAll(name string) error {
+	if err := d.overlay.RemoveAll(name); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.removed[name] = true
+	d.mu.Unlock()
+	return nil
+}
+
+// Rename simulates moving a file by copying it into the overlay and hiding
+// the original.
+func (d *dryRunFS) Rename(oldName, newName string) error {
+	if err := checkName("rename", newName); err != nil {
+		return err
+	}
+	data, err := fs.ReadFile(d, oldName)
+	if err != nil {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	if err := d.simulateParents(newName); err != nil {
+		return err
+	}
+	d.overlay.writeFile(newName, data)
+	return d.RemoveAll(oldName)
+}
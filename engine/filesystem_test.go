@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFS(t *testing.T) {
+	fsys := newMemFS()
+	assert.NoError(t, fsys.MkdirAll("music/Artist", 0755))
+	fsys.writeFile("music/Artist/Song.m4a", []byte("m4a audio"))
+	fsys.writeFile("music/Artist/Song.mp3", []byte("mp3 audio"))
+	assert.NoError(t, fsys.MkdirAll("music/Empty", 0755))
+
+	data, err := fs.ReadFile(fsys, "music/Artist/Song.m4a")
+	assert.NoError(t, err)
+	assert.Equal(t, "m4a audio", string(data))
+	entries, err := fsys.ReadDir("music")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	// Writes need the parent directory, like on disk
+	_, err = fsys.Create("music/Missing/Song.mp3")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	file, err := fsys.Append("music/Artist/Song.mp3")
+	assert.NoError(t, err)
+	file.Write([]byte(" and more"))
+	assert.NoError(t, file.Close())
+	data, _ = fs.ReadFile(fsys, "music/Artist/Song.mp3")
+	assert.Equal(t, "mp3 audio and more", string(data))
+
+	assert.Error(t, fsys.Remove("music/Artist"))
+	assert.NoError(t, fsys.Rename("music/Artist", "music/Band"))
+	names, err := getFilenames(fsys, "music")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/Band/Song.m4a", "/Band/Song.mp3"}, names)
+
+	assert.NoError(t, fsys.RemoveAll("music/Band"))
+	_, err = fsys.Stat("music/Band/Song.mp3")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func TestWritableFS_InvalidNames(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-invalid-names")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Names are relative to the root, as in io/fs, so none lead outside it
+	for _, fsys := range []writableFS{newOSFS(filepath.Join(tempDir, "root")), newMemFS(), newDryRunFS(newMemFS())} {
+		for _, name := range []string{"/absolute.mp3", "../outside.mp3", "Artist/../Song.mp3", "Artist/", ""} {
+			_, err := fsys.Create(name)
+			assert.True(t, errors.Is(err, fs.ErrInvalid), "%T %q", fsys, name)
+			assert.True(t, errors.Is(fsys.MkdirAll(name, 0755), fs.ErrInvalid), "%T %q", fsys, name)
+			assert.True(t, errors.Is(fsys.Rename(".", name), fs.ErrInvalid), "%T %q", fsys, name)
+		}
+	}
+	_, err = os.Stat(filepath.Join(tempDir, "outside.mp3"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestOSFS(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-osfs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	fsys := newOSFS(filepath.Join(tempDir, "usb"))
+	assert.NoError(t, fsys.MkdirAll(".", 0755))
+	assert.NoError(t, copyFile(fstest.MapFS{"Song.mp3": {Data: []byte("mp3 audio")}}, "Song.mp3", fsys, "Artist/Song.mp3"))
+
+	data, err := os.ReadFile(filepath.Join(tempDir, "usb", "Artist", "Song.mp3"))
+	assert.NoError(t, err)
+	assert.Equal(t, "mp3 audio", string(data))
+	names, err := getFilenames(fsys, ".")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/Artist/Song.mp3"}, names)
+}
+
+func TestCopyFile_BetweenFilesystems(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-copy-memfs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "Song.mp3"), []byte("mp3 audio"), 0644)
+
+	fsys := newMemFS()
+	assert.NoError(t, copyFile(newOSFS(tempDir), "Song.mp3", fsys, "usb/Artist/Song.mp3"))
+	data, err := fs.ReadFile(fsys, "usb/Artist/Song.mp3")
+	assert.NoError(t, err)
+	assert.Equal(t, "mp3 audio", string(data))
+}
+
+func TestDryRunFS(t *testing.T) {
+	base := newMemFS()
+	base.MkdirAll("Artist", 0755)
+	base.writeFile("Artist/Song.m4a", []byte("m4a audio"))
+	base.writeFile("Artist/Song.mp3", []byte("mp3 audio"))
+
+	dryRun := newDryRunFS(base)
+	assert.NoError(t, dryRun.MkdirAll(".sync-trash/session/Artist", 0755))
+	assert.NoError(t, dryRun.Rename("Artist/Song.m4a", ".sync-trash/session/Artist/Song.m4a"))
+	file, err := dryRun.Create("Artist/New.mp3")
+	assert.NoError(t, err)
+	file.Write([]byte("new audio"))
+	file.Close()
+
+	data, err := fs.ReadFile(dryRun, ".sync-trash/session/Artist/Song.m4a")
+	assert.NoError(t, err)
+	assert.Equal(t, "m4a audio", string(data))
+	names, err := getFilenames(dryRun, ".")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/Artist/New.mp3", "/Artist/Song.mp3"}, names)
+
+	// The underlying filesystem is unchanged
+	names, err = getFilenames(base, ".")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/Artist/Song.m4a", "/Artist/Song.mp3"}, names)
+
+	// A removed file can't be removed twice
+	assert.NoError(t, dryRun.Remove("Artist/Song.mp3"))
+	assert.True(t, errors.Is(dryRun.Remove("Artist/Song.mp3"), fs.ErrNotExist))
+}
+
+func TestRemoveDuplicateFiles_MemFS(t *testing.T) {
+	r := newRun(nil, nil)
+	fsys := newMemFS()
+	fsys.MkdirAll("Artist", 0755)
+	fsys.writeFile("Artist/Song.m4a", []byte("m4a audio"))
+	fsys.writeFile("Artist/Song.mp3", []byte("mp3 audio"))
+	fsys.writeFile("Artist/Other.mp3", []byte("mp3 audio"))
+
+	// A dry run simulates the moves to the trash without making them
+	err := r.removeDuplicateFiles("/usb", dedupeOptions{trash: newTrash(fsys, "/usb", time.Now()), dryRun: true})
+	assert.NoError(t, err)
+	_, err = fsys.Stat("Artist/Song.m4a")
+	assert.NoError(t, err)
+	_, err = fsys.Stat(TrashDirName)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	err = r.removeDuplicateFiles("/usb", dedupeOptions{trash: newTrash(fsys, "/usb", time.Now())})
+	assert.NoError(t, err)
+	names, err := getFilenames(fsys, ".")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/Artist/Other.mp3", "/Artist/Song.mp3"}, names)
+
+	entries, err := readTrashJournal(fsys, TrashDirName)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "Artist/Song.m4a", entries[0].Original)
+	}
+}
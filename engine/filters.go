@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// matchesFilters reports whether a source file, given by its path relative to
+// the source directory, is synced with the formats and filters of a profile.
+//
+// Patterns use the syntax of path.Match and are matched against the relative
+// path, against each of its leading folders and against the file name, so
+// "Podcasts" and "Podcasts/*" exclude a top-level folder with everything in
+// it, and "*.demo.mp3" excludes matching files anywhere. With include
+// patterns, only files that match one of them are synced; exclude patterns
+// win over include patterns.
+func matchesFilters(relativePath string, prof Profile) bool {
+	name := strings.TrimPrefix(filepath.ToSlash(relativePath), "/")
+
+	if len(prof.Formats) > 0 {
+		extension := strings.TrimPrefix(path.Ext(name), ".")
+		if !stringInSliceFold(extension, prof.Formats) {
+			return false
+		}
+	}
+
+	if len(prof.Include) > 0 && !matchesAnyPattern(name, prof.Include) {
+		return false
+	}
+	return !matchesAnyPattern(name, prof.Exclude)
+}
+
+// matchesAnyPattern reports whether a slash-separated relative path, one of
+// its leading folders or its file name matches one of the patterns. The
+// patterns are checked by validatePatterns when the profile is loaded;
+// invalid patterns match nothing.
+func matchesAnyPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+		for prefix := name; prefix != "."; prefix = path.Dir(prefix) {
+			if ok, _ := path.Match(pattern, prefix); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validatePatterns returns an error for the first pattern that is not valid
+// for path.Match.
+func validatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// filterPlannedFiles returns the planned files whose source passes the
+// formats and filters of the profile.
+func filterPlannedFiles(files []fileToTranscode, prof Profile) []fileToTranscode {
+	if len(prof.Formats) == 0 && len(prof.Include) == 0 && len(prof.Exclude) == 0 {
+		return files
+	}
+
+	var result []fileToTranscode
+	for _, file := range files {
+		if matchesFilters(file.sourcePath, prof) {
+			result = append(result, file)
+		}
+	}
+	return result
+}
@@ -0,0 +1,36 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchesFilters(t *testing.T) {
+	prof := Profile{Formats: []string{"mp3", "m4a"}, Include: []string{"Rock/*", "*.live.mp3"}, Exclude: []string{"*.demo.mp3"}}
+
+	assert.True(t, matchesFilters("/Rock/Song.mp3", prof))
+	assert.True(t, matchesFilters("/Jazz/Concert/Song.live.mp3", prof))
+	assert.True(t, matchesFilters("/Rock/SONG.MP3", prof))
+	assert.False(t, matchesFilters("/Rock/Song.wav", prof))
+	assert.False(t, matchesFilters("/Jazz/Song.mp3", prof))
+	assert.False(t, matchesFilters("/Rock/Song.demo.mp3", prof))
+
+	// Without formats and filters, every file is synced
+	assert.True(t, matchesFilters("/Jazz/Song.wav", Profile{}))
+}
+
+func TestFilterPlannedFiles(t *testing.T) {
+	files := []fileToTranscode{
+		{sourcePath: "/Artist/Song.m4a", destinationPath: "/Artist/Song.mp3"},
+		{sourcePath: "/Podcasts/Episode.mp3", destinationPath: "/Podcasts/Episode.mp3"},
+		{sourcePath: "/Podcasts/Show/Episode.mp3", destinationPath: "/Podcasts/Show/Episode.mp3"},
+	}
+
+	assert.Equal(t, files, filterPlannedFiles(files, Profile{}))
+	assert.Equal(t, files[:1], filterPlannedFiles(files, Profile{Exclude: []string{"Podcasts/*"}}))
+	assert.Equal(t, files[:1], filterPlannedFiles(files, Profile{Exclude: []string{"Podcasts"}}))
+	assert.Equal(t, files[:2], filterPlannedFiles(files, Profile{Exclude: []string{"Podcasts/Show"}}))
+	assert.Equal(t, files[1:], filterPlannedFiles(files, Profile{Include: []string{"Podcasts/*"}}))
+	assert.Equal(t, files[1:], filterPlannedFiles(files, Profile{Formats: []string{"mp3"}}))
+}
@@ -0,0 +1,746 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// finishedCountName is the summary count of each finished sync operation.
+var finishedCountName = map[string]string{"transcode": "transcoded", "copy": "copied"}
+
+type fileToTranscode struct {
+	sourcePath      string
+	destinationPath string
+}
+
+// TranscodeOptions holds extra settings for a single transcode, such as
+// loudness adjustments.
+type TranscodeOptions struct {
+	// AudioFilter is an ffmpeg audio filter, e.g. "volume=-3.5dB"
+	AudioFilter string
+
+	// Tags are written into the output file's metadata
+	Tags map[string]string
+
+	// Logger receives the debug records of the transcode, or is nil
+	Logger *slog.Logger
+}
+
+// debug logs a debug record of the transcode, if it has a logger.
+func (opts TranscodeOptions) debug(msg string, args ...any) {
+	if opts.Logger != nil {
+		opts.Logger.Debug(msg, args...)
+	}
+}
+
+// needsTranscoding reports whether the options change the output, so that
+// even an MP3 file can't simply be copied.
+func (opts TranscodeOptions) needsTranscoding() bool {
+	return opts.AudioFilter != "" || len(opts.Tags) > 0
+}
+
+// findAndTranscodeFiles traverses the specified directory and transcodes music files to .mp3 format.
+// MP3 files will be copied to the destination directory as-is.
+// The destination tree is planned according to the device limits in the profile.
+// Up to jobs files are transcoded or copied at the same time. In mirror mode,
+// destination files that no longer have a source file are moved to the trash.
+func (r *run) findAndTranscodeFiles(ctx context.Context, sourceDir, destinationDir string, prof Profile, jobs int) error {
+	if err := r.syncPaths(ctx, []string{sourceDir}, destinationDir, prof, jobs, nil, false); err != nil {
+		return err
+	}
+	if prof.Mirror {
+		return r.removeOrphanedFiles([]string{sourceDir}, destinationDir, prof, false)
+	}
+	return nil
+}
+
+// syncPaths transcodes or copies the missing files of the source directories,
+// like findAndTranscodeFiles. The sources are planned as one tree, see
+// planSources. If paths is not empty, only files at or below those paths
+// (relative to the source directories, with a leading separator) are synced.
+//
+// Every operation on a local destination is recorded in a journal in the
+// destination, so that unfinished outputs of an interrupted run are detected
+// when the next run starts. A remote destination has no journal; files are
+// uploaded under a temporary name instead, and music files that need
+// transcoding are transcoded to a local temporary file first.
+//
+// A dry run only reports what would be synced. Its changes to the
+// destination, such as removing the unfinished outputs of an interrupted
+// run, are simulated, so that it plans what a real run would do.
+func (r *run) syncPaths(ctx context.Context, sourceDirs []string, destination string, prof Profile, jobs int, paths []string, dryRun bool) error {
+	dev, err := r.openDevice(destination)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		dev.fsys = newDryRunFS(dev.fsys)
+		dev.index = nil
+	}
+
+	if err := dev.fsys.MkdirAll(".", 0755); err != nil {
+		return fmt.Errorf("failed to create destination directory: %v", err)
+	}
+
+	var journal *syncJournal
+	if !dev.remote {
+		if err := r.recoverInterruptedRun(dev.fsys, dev.dir, r.validateOutput); err != nil {
+			return fmt.Errorf("failed to recover interrupted run: %v", err)
+		}
+		if !dryRun {
+			if journal, err = createSyncJournal(dev.fsys); err != nil {
+				return fmt.Errorf("failed to create journal: %v", err)
+			}
+		}
+	}
+	sources := make([]*syncSource, len(sourceDirs))
+	for i, sourceDir := range sourceDirs {
+		sources[i] = &syncSource{dir: sourceDir, index: r.loadSourceIndex(sourceIndexPath(sourceDir, destination), sourceDir, prof.Links)}
+	}
+	return r.syncToDevice(ctx, sources, dev, journal, prof, jobs, paths, dryRun)
+}
+
+// syncSource is a source directory of a sync, with its index.
+type syncSource struct {
+	dir   string
+	index *sourceIndex
+}
+
+// readTags returns the tags of the named file of the source, relative to it
+// with a leading slash, probed with trans. Tags are kept in the index of the
+// source, if it has one, until the file changes.
+func (s *syncSource) readTags(trans Transcoder, name string) (map[string]string, error) {
+	if s.index != nil {
+		if tags, ok := s.index.tags(name); ok {
+			return tags, nil
+		}
+	}
+	tags, err := readTagsWithTranscoder(trans, filepath.Join(s.dir, filepath.FromSlash(name)))
+	if err == nil && s.index != nil {
+		s.index.setTags(name, tags)
+	}
+	return tags, err
+}
+
+// syncItem is a planned file that is synced to the device.
+type syncItem struct {
+	source    *syncSource
+	file      fileToTranscode
+	operation string
+	opts      TranscodeOptions
+	size      int64
+}
+
+// newSyncItem returns how a planned file of a source directory is synced:
+// transcoded if it isn't an MP3 file or the options change it, otherwise
+// copied.
+func newSyncItem(source *syncSource, file fileToTranscode, opts TranscodeOptions) *syncItem {
+	item := &syncItem{source: source, file: file, operation: "copy", opts: opts}
+	if isUntranscodedMusicFile(file.sourcePath) || opts.needsTranscoding() {
+		item.operation = "transcode"
+	}
+	if info, err := os.Stat(filepath.Join(source.dir, file.sourcePath)); err == nil {
+		item.size = info.Size()
+	}
+	return item
+}
+
+// plansFilesOnTheirOwn reports whether the profile plans the destination of
+// each file without looking at the other files, so that files can be synced
+// while the source is still being read. Path templates read tags, and device
+// limits, loudness analysis and skipping linked duplicates need the whole
+// tree.
+func plansFilesOnTheirOwn(prof Profile) bool {
+	return prof.PathTemplate == "" && prof.Limits == (DeviceLimits{}) && !prof.Loudness.enabled() && !prof.Links.SkipDuplicates
+}
+
+// planFilesToSync updates the indexes of the sources and sends the files of
+// the source directories that are missing on the device, or that changed, to
+// items. If paths is not empty, only files at or below those paths are sent.
+//
+// If the profile plans every file on its own, files are sent as soon as
+// their directory is read, in no particular order. Otherwise they are sent
+// after every source is read, in the order of the sources and of
+// getFilenames.
+func (r *run) planFilesToSync(ctx context.Context, sources []*syncSource, existingFiles []string, prof Profile, paths []string, items chan<- *syncItem) error {
+	send := func(item *syncItem) error {
+		select {
+		case items <- item:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if plansFilesOnTheirOwn(prof) {
+		existing := newDestinationNames(existingFiles, prof.CaseInsensitive)
+		for _, source := range sources {
+			var mu sync.Mutex
+			var sendErr error
+			_, err := source.index.update(ctx, func(name string, changed bool) {
+				for _, file := range filesBelowPathsOrAll(r.planSourceFiles(source, []string{name}, prof), paths) {
+					mu.Lock()
+					taken := existing.contains(file.destinationPath)
+					existing.add(file.destinationPath)
+					mu.Unlock()
+					if taken && !changed {
+						continue
+					}
+					if err := send(newSyncItem(source, file, TranscodeOptions{})); err != nil {
+						mu.Lock()
+						sendErr = err
+						mu.Unlock()
+					}
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if sendErr != nil {
+				return sendErr
+			}
+		}
+		return nil
+	}
+
+	planned, err := r.planChangedFiles(ctx, sources, existingFiles, prof)
+	if err != nil {
+		return err
+	}
+	for i, source := range sources {
+		var files []fileToTranscode
+		for _, file := range planned {
+			if file.source == i {
+				files = append(files, file.fileToTranscode)
+			}
+		}
+		files = filesBelowPathsOrAll(files, paths)
+
+		var gains map[string]replayGain
+		if prof.Loudness.enabled() && len(files) > 0 {
+			gains = r.analyzeLoudness(source.dir, files, prof.Loudness)
+		}
+		for _, file := range files {
+			var opts TranscodeOptions
+			if gain, ok := gains[file.sourcePath]; ok {
+				opts = loudnessTranscodeOptions(gain, prof.Loudness)
+			}
+			if err := send(newSyncItem(source, file, opts)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// planChangedFiles updates the indexes of the sources and returns the files
+// of their plan, see planSources, that are missing from the existing files
+// of the device or whose source file changed, in the order of the sources.
+func (r *run) planChangedFiles(ctx context.Context, sources []*syncSource, existingFiles []string, prof Profile) ([]plannedFile, error) {
+	sourceDirs := make([]string, len(sources))
+	files := make([][]string, len(sources))
+	changed := make([][]string, len(sources))
+	for i, source := range sources {
+		diff, err := source.index.update(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+		sourceDirs[i], files[i], changed[i] = source.dir, source.index.files(), diff.changed
+	}
+	planned := r.planSources(sources, files, existingFiles, prof)
+
+	existing := newDestinationNames(existingFiles, prof.CaseInsensitive)
+	var result []plannedFile
+	for i := range sources {
+		var sourceFiles []fileToTranscode
+		for _, file := range planned {
+			if file.source == i {
+				sourceFiles = append(sourceFiles, file.fileToTranscode)
+			}
+		}
+		for _, file := range filesToSync(sourceFiles, existing, changed[i]) {
+			result = append(result, plannedFile{fileToTranscode: file, source: i})
+		}
+	}
+	r.logger.Debug("compared directories", "sources", sourceDirs, "planned", len(planned), "destination_files", len(existingFiles), "to_sync", len(result))
+	return result, nil
+}
+
+// syncToDevice transcodes or copies the files of the source directory that
+// are missing on the device, or that changed since the last sync according
+// to the source index. Files that don't fit in the free space of the device,
+// if it can tell, are skipped with a warning. Operations are recorded in the
+// journal, which may be nil.
+//
+// Files are planned while the source is read, see planFilesToSync, and the
+// first ones are synced before the whole source is read; the total of the
+// progress grows until then.
+//
+// The index is saved when all files were synced, unless only some paths
+// were. When ctx is cancelled, the files that are being transcoded are
+// finished and no new ones are started; the run is then left unfinished in
+// the journal, to be resumed by the next run.
+//
+// A dry run reports each planned file as if it was synced, without syncing
+// it or saving the indexes.
+func (r *run) syncToDevice(ctx context.Context, sources []*syncSource, dev device, journal *syncJournal, prof Profile, jobs int, paths []string, dryRun bool) error {
+	for _, source := range sources {
+		r.reporter.emit(Event{Type: EventStart, Operation: "scan", Path: source.dir})
+	}
+
+	existing, err := dev.list()
+	if err != nil {
+		journal.close()
+		return fmt.Errorf("error: %v", err)
+	}
+
+	planCtx, stopPlanning := context.WithCancel(ctx)
+	defer stopPlanning()
+	items := make(chan *syncItem)
+	planErr := make(chan error, 1)
+	go func() {
+		defer close(items)
+		planErr <- r.planFilesToSync(planCtx, sources, existing, prof, paths, items)
+	}()
+
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	total := 0
+	done := 0
+
+	queue := make(chan *syncItem)
+	var wg sync.WaitGroup
+	for worker := 1; worker <= max(jobs, 1); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range queue {
+				file := item.file
+				sourcePath := filepath.Join(item.source.dir, file.sourcePath)
+				destinationPath := dev.path(file.destinationPath)
+				r.reporter.emit(Event{Type: EventStart, Operation: item.operation, Source: sourcePath, Destination: destinationPath, Worker: worker})
+
+				entry := syncJournalEntry{Action: journalStart, Operation: item.operation, Source: sourcePath, Destination: fsName(file.destinationPath)}
+				err := journal.record(entry)
+				var seconds float64
+				var previous fs.FileInfo
+				started := err == nil
+				if started {
+					previous, _ = dev.stat(file.destinationPath)
+				}
+				if err != nil {
+					err = fmt.Errorf("failed to write journal: %v", err)
+				} else if item.operation == "transcode" {
+					onProgress := func(percent float64) {
+						r.reporter.emit(Event{Type: EventProgress, Operation: "transcode", Source: sourcePath, Worker: worker, Percent: percent})
+					}
+					if dir, ok := localDir(dev); ok {
+						seconds, err = r.transcodeFileAtPath(sourcePath, filepath.Join(dir, filepath.FromSlash(rootedName(file.destinationPath))), item.opts, onProgress)
+					} else {
+						seconds, err = r.transcodeAndPush(sourcePath, dev, file.destinationPath, item.opts, onProgress)
+					}
+				} else {
+					// Copy mp3 from source to destination
+					r.logger.Debug("copying file", "source", sourcePath, "destination", dev.path(file.destinationPath))
+					err = dev.push(sourcePath, file.destinationPath)
+				}
+
+				entry.Action = journalDone
+				if err != nil {
+					entry.Action = journalFailed
+					// A file that this run started writing is a partial output
+					if started && outputChanged(dev, file.destinationPath, previous) {
+						if removeErr := dev.delete(file.destinationPath); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+							r.logger.Debug("failed to remove partial output", "path", destinationPath, "error", removeErr)
+						}
+					}
+				}
+				if journalErr := journal.record(entry); journalErr != nil && err == nil {
+					err = fmt.Errorf("failed to write journal: %v", journalErr)
+				}
+
+				mu.Lock()
+				if err != nil {
+					// TODO: Maybe return error or queue for return
+					r.reporter.emit(Event{Type: EventError, Operation: item.operation, Path: sourcePath, Error: err.Error(), Worker: worker, ffmpegStderr: ffmpegStderr(err)})
+					counts["failed"]++
+					item.source.index.invalidate(file.sourcePath)
+				} else {
+					r.reporter.emit(Event{Type: EventFinished, Operation: item.operation, Source: sourcePath, Destination: destinationPath, Worker: worker, Bytes: item.size, Seconds: seconds})
+					counts[finishedCountName[item.operation]]++
+				}
+				done++
+				r.reporter.emit(Event{Type: EventProgress, Operation: "sync", Done: done, Total: total})
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Planned files wait in pending until a worker is free, so that reading
+	// the source doesn't wait for the transcodes
+	budget := newSpaceBudget(dev, r.transcoder)
+	var pending []*syncItem
+	var journalErr error
+	planned := items
+queueFiles:
+	for planned != nil || len(pending) > 0 {
+		if ctx.Err() != nil {
+			break
+		}
+		var next chan *syncItem
+		if len(pending) > 0 {
+			next = queue
+		}
+		select {
+		case item, ok := <-planned:
+			if !ok {
+				planned = nil
+				continue
+			}
+			sourcePath := filepath.Join(item.source.dir, item.file.sourcePath)
+			if fits, reason := budget.fit(sourcePath, item.operation, item.size); !fits {
+				mu.Lock()
+				item.source.index.invalidate(item.file.sourcePath)
+				r.reporter.warn("sync", sourcePath, reason)
+				counts["skipped"]++
+				mu.Unlock()
+				continue
+			}
+			r.reporter.emit(Event{Type: EventPlan, Operation: item.operation, Source: item.file.sourcePath, Destination: item.file.destinationPath, Bytes: item.size})
+			if dryRun {
+				mu.Lock()
+				r.reporter.emit(Event{Type: EventFinished, Operation: item.operation, Source: sourcePath, Destination: dev.path(item.file.destinationPath), Bytes: item.size, DryRun: true})
+				counts["would_"+item.operation]++
+				mu.Unlock()
+				continue
+			}
+			entry := syncJournalEntry{Action: journalPlan, Operation: item.operation, Source: sourcePath, Destination: fsName(item.file.destinationPath)}
+			if journalErr = journal.record(entry); journalErr != nil {
+				break queueFiles
+			}
+			mu.Lock()
+			total++
+			mu.Unlock()
+			pending = append(pending, item)
+		case next <- pendingHead(pending):
+			pending = pending[1:]
+		case <-ctx.Done():
+			break queueFiles
+		}
+	}
+	close(queue)
+	wg.Wait()
+	stopPlanning()
+	for range items {
+	}
+	err = <-planErr
+
+	if journalErr != nil {
+		journal.close()
+		return fmt.Errorf("failed to write journal: %v", journalErr)
+	}
+	if ctx.Err() != nil {
+		journal.close()
+		r.reporter.emit(Event{Type: EventSummary, Operation: "sync", Counts: counts})
+		return ctx.Err()
+	}
+	if err != nil {
+		journal.close()
+		return fmt.Errorf("error: %v", err)
+	}
+	if dryRun {
+		r.reporter.emit(Event{Type: EventSummary, Operation: "sync", Counts: counts})
+		return nil
+	}
+
+	if err := journal.complete(); err != nil {
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+	if err := saveIndex(dev); err != nil {
+		r.logger.Warn("failed to save the destination index", "destination", dev.path(""), "error", err)
+	}
+	if len(paths) == 0 {
+		for _, source := range sources {
+			if err := source.index.save(); err != nil {
+				r.reporter.warn("scan", source.index.path, fmt.Sprintf("Failed to save the source index, the next run reads the whole source again (%v)", err))
+			}
+		}
+	}
+
+	r.reporter.emit(Event{Type: EventSummary, Operation: "sync", Counts: counts})
+	return nil
+}
+
+// outputChanged reports whether the file name on the device isn't the file
+// that was there before an operation, previous, which is nil if there was
+// none, i.e. whether the operation started writing it.
+func outputChanged(dev device, name string, previous fs.FileInfo) bool {
+	current, err := dev.stat(name)
+	if err != nil {
+		return false
+	}
+	return previous == nil || current.Size() != previous.Size() || !current.ModTime().Equal(previous.ModTime())
+}
+
+// pendingHead returns the first of the pending items, or nil if there are
+// none.
+func pendingHead(pending []*syncItem) *syncItem {
+	if len(pending) == 0 {
+		return nil
+	}
+	return pending[0]
+}
+
+// filesBelowPathsOrAll returns the planned files below paths like
+// filesBelowPaths, or all of them if paths is empty.
+func filesBelowPathsOrAll(files []fileToTranscode, paths []string) []fileToTranscode {
+	if len(paths) == 0 {
+		return files
+	}
+	return filesBelowPaths(files, paths)
+}
+
+// filesBelowPaths returns the planned files whose source path is one of paths
+// or inside one of them. Paths may use the separator of the OS.
+func filesBelowPaths(files []fileToTranscode, paths []string) []fileToTranscode {
+	var result []fileToTranscode
+	for _, file := range files {
+		for _, path := range paths {
+			path = filepath.ToSlash(path)
+			if file.sourcePath == path || strings.HasPrefix(file.sourcePath, strings.TrimSuffix(path, "/")+"/") {
+				result = append(result, file)
+				break
+			}
+		}
+	}
+	return result
+}
+
+// copyFile copies the named source file in sourceFS to the named destination
+// file in destinationFS.
+// It creates any necessary directories in the destination path.
+// If the file cannot be copied for any reason, it returns an error.
+//
+// Example usage:
+//
+//	err := copyFile(newOSFS("/path/to"), "source", newOSFS("/media/usb"), "Artist/destination.mp3")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+func copyFile(sourceFS fs.FS, source string, destinationFS writableFS, destination string) error {
+	if err := destinationFS.MkdirAll(path.Dir(destination), 0755); err != nil {
+		return fmt.Errorf("❗️Failed to create directories: %v", err)
+	}
+
+	// Open the source file for reading
+	sourceFile, err := sourceFS.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	// Create the destination file
+	destinationFile, err := destinationFS.Create(destination)
+	if err != nil {
+		return err
+	}
+	defer destinationFile.Close()
+
+	// Copy the contents of the source file into the destination file
+	_, err = io.Copy(destinationFile, sourceFile)
+	if err != nil {
+		return err
+	}
+
+	// Call Sync to flush writes to stable storage
+	destinationFile.Sync()
+
+	return destinationFile.Close()
+}
+
+// planSourceFiles plans the destination tree of files of one source
+// directory that were already listed, like planSources.
+func (r *run) planSourceFiles(source *syncSource, files []string, prof Profile) []fileToTranscode {
+	return plannedTree(r.planSources([]*syncSource{source}, [][]string{files}, nil, prof))
+}
+
+// plannedFile is a planned file of one of several source directories, by its
+// position in them.
+type plannedFile struct {
+	fileToTranscode
+	source int
+}
+
+// planSources plans the destination tree of several source directories,
+// whose files were already listed, as one tree: every music file that passes
+// the formats and filters of the profile, with the destination path it
+// should have according to the path template and device limits. A
+// file whose destination path is taken by a file of an earlier source, or an
+// earlier file of the same source, is left out. The device limits are then
+// applied to the files of all sources together, with the other music files
+// in deviceFiles counting towards them, unless mirror mode moves those to the
+// trash.
+func (r *run) planSources(sources []*syncSource, files [][]string, deviceFiles []string, prof Profile) []plannedFile {
+	taken := newDestinationNames(nil, prof.CaseInsensitive)
+	var planned []plannedFile
+	for i, source := range sources {
+		sourceFiles := filterPlannedFiles(planDestinationFiles(files[i]), prof)
+		if prof.PathTemplate != "" {
+			readTags := func(name string) (map[string]string, error) { return source.readTags(r.transcoder, name) }
+			sourceFiles = r.applyPathTemplate(sourceFiles, prof.PathTemplate, prof.CaseInsensitive, readTags)
+		}
+		for _, file := range sourceFiles {
+			if taken.contains(file.destinationPath) {
+				r.reporter.warn("plan", filepath.Join(source.dir, file.sourcePath), fmt.Sprintf("Skipping file whose destination path %s is taken by another source file", file.destinationPath))
+				continue
+			}
+			taken.add(file.destinationPath)
+			planned = append(planned, plannedFile{fileToTranscode: file, source: i})
+		}
+	}
+
+	if prof.Mirror {
+		deviceFiles = nil
+	}
+	tree, violations := applyDeviceLimits(plannedTree(planned), deviceFiles, prof.CaseInsensitive, prof.Limits)
+	for _, violation := range violations {
+		r.reporter.warn("plan", violation.path, "Exceeds device limits, "+violation.reason)
+	}
+
+	contained := planned[:0]
+	for i, file := range planned {
+		file.fileToTranscode = tree[i]
+		if escapesRoot(file.destinationPath) {
+			r.reporter.warn("plan", file.sourcePath, fmt.Sprintf("Skipping file whose destination path %s is outside the destination", file.destinationPath))
+			continue
+		}
+		contained = append(contained, file)
+	}
+	return contained
+}
+
+// plannedTree returns the planned files of several sources without their
+// source.
+func plannedTree(planned []plannedFile) []fileToTranscode {
+	files := make([]fileToTranscode, len(planned))
+	for i, file := range planned {
+		files[i] = file.fileToTranscode
+	}
+	return files
+}
+
+// getFilenames returns a list of filenames in the specified directory of fsys,
+// relative to it with a leading slash, in the order of fs.WalkDir. Several
+// directories are read at the same time, see walkFiles. Files in the trash
+// and log directories are skipped.
+func getFilenames(fsys fs.FS, directory string) ([]string, error) {
+	var filenames []string
+	files := make(chan string)
+	collected := make(chan struct{})
+	go func() {
+		for file := range files {
+			filenames = append(filenames, file)
+		}
+		close(collected)
+	}()
+
+	err := walkFiles(context.Background(), fsys, directory, files)
+	close(files)
+	<-collected
+	if err != nil {
+		return nil, err
+	}
+
+	sortWalkOrder(filenames)
+	return filenames, nil
+}
+
+// getExclusiveFiles returns the files exclusive to filesA compared to filesB.
+func getExclusiveFiles(filesA, filesB []string) []fileToTranscode {
+	return excludeExistingFiles(planDestinationFiles(filesA), newDestinationNames(filesB, false))
+}
+
+// planDestinationFiles pairs each music file in the source list with the
+// destination path it will be transcoded or copied to.
+func planDestinationFiles(files []string) []fileToTranscode {
+	// Generate list of filenames that need to be transcoded later
+	var sourceFileOutputNameList []fileToTranscode
+	for _, file := range files {
+		destinationFilename := ""
+		if strings.HasPrefix(filepath.Base(file), "._") {
+			// Skip hidden files
+			continue
+		} else if isMP3File(file) {
+			// Save .mp3 file name verbatim so it can be copied later
+			destinationFilename = file
+		} else if isUntranscodedMusicFile(file) {
+			// Add file to struct so it can be transcoded to .mp3 later
+			destinationFilename = convertSourceToDestinationFilename(file)
+		} else {
+			// Ignore .DS_Store, .txt and other files
+			continue
+		}
+		fileToTranscode := fileToTranscode{
+			sourcePath:      file,
+			destinationPath: destinationFilename,
+		}
+
+		sourceFileOutputNameList = append(sourceFileOutputNameList, fileToTranscode)
+	}
+
+	return sourceFileOutputNameList
+}
+
+// excludeExistingFiles returns the planned files whose destination path is not
+// already one of the existing destination files.
+func excludeExistingFiles(plannedFiles []fileToTranscode, existing *destinationNames) []fileToTranscode {
+	exclusiveFiles := make([]fileToTranscode, 0)
+	for _, file := range plannedFiles {
+		if !existing.contains(file.destinationPath) {
+			exclusiveFiles = append(exclusiveFiles, file)
+		}
+	}
+
+	return exclusiveFiles
+}
+
+// filesToSync returns the planned files that are missing from the existing
+// files of the destination, or whose source file is one of the changed ones.
+// The destinations of the returned files are added to existing, so that a
+// later file with the same destination, e.g. from another source or in
+// another case on a case-insensitive device, isn't synced over it.
+func filesToSync(plannedFiles []fileToTranscode, existing *destinationNames, changed []string) []fileToTranscode {
+	changedSources := make(map[string]bool)
+	for _, file := range changed {
+		changedSources[file] = true
+	}
+
+	var result []fileToTranscode
+	for _, file := range plannedFiles {
+		if !existing.contains(file.destinationPath) || changedSources[file.sourcePath] {
+			result = append(result, file)
+			existing.add(file.destinationPath)
+		}
+	}
+	return result
+}
+
+// convertSourceToDestinationFilename converts the filename by replacing the .m4a suffix with .mp3 and replacing non-ASCII characters with an ASCII equivalent.
+func convertSourceToDestinationFilename(filename string) string {
+	// Replace .m4a suffix with .mp3
+	filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".mp3"
+
+	// Replace non-ASCII characters with an ASCII equivalent
+	filename = removeNonASCII(filename)
+
+	return filename
+}
@@ -1,14 +1,11 @@
-package main
+package engine
 
 import (
+	"context"
 	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"testing"
-
-	"log"
-
 	"time"
 
 	"github.com/stretchr/testify/assert"
@@ -69,6 +66,12 @@ func TestGetExclusiveFiles(t *testing.T) {
 			DestinationList: []string{},
 			ExpectedOutput:  []string{"file1.mp3", "file2.mp3", "file3.mp3"},
 		},
+		{
+			Name:            "Extensions in any case are music files",
+			SourceList:      []string{"TRACK.MP3", "Song.M4A", "Take.Wav"},
+			DestinationList: []string{"TRACK.MP3"},
+			ExpectedOutput:  []string{"Song.mp3", "Take.mp3"},
+		},
 		{
 			Name:            "Ignore non-music files",
 			SourceList:      []string{".DS_Store"},
@@ -147,32 +150,24 @@ func TestConvertSourceToDestinationFilename(t *testing.T) {
 	}
 }
 
-func generateM4aFixtureFileAtPath(path string) error {
+// generateMusicFixtureFileAtPath writes a placeholder music file at path,
+// which the fake transcoder probes by its extension.
+func generateMusicFixtureFileAtPath(t *testing.T, path string) {
+	t.Helper()
 	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
-		return fmt.Errorf("failed to create directories: %v", err)
+		t.Fatalf("failed to create directories: %v", err)
 	}
-	cmd := exec.Command("ffmpeg", "-f", "lavfi", "-i", "sine=frequency=1000:duration=5", path)
-	err := cmd.Run()
-	if err != nil {
-		log.Fatal(err)
-		return err
+	if err := os.WriteFile(path, []byte("audio"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
 	}
-	return nil
 }
 
-func generateTextFileFixtureAtPath(path string) error {
-	if err := os.WriteFile(path, []byte{}, 0644); err != nil {
-		log.Fatal(err)
-		return err
-	}
-	return nil
-}
-
-func setupFixtureFilesInDirectory(tempDir string, numberOfFiles int) error {
+func setupFixtureFilesInDirectory(t *testing.T, tempDir string, numberOfFiles int) {
+	t.Helper()
 	// Create a directory within tempDir named "source"
 	sourceDir := filepath.Join(tempDir, "source")
 	if err := os.Mkdir(sourceDir, 0755); err != nil {
-		return fmt.Errorf("failed to create source directory: %v", err)
+		t.Fatalf("failed to create source directory: %v", err)
 	}
 
 	// Create test files
@@ -188,23 +183,20 @@ func setupFixtureFilesInDirectory(tempDir string, numberOfFiles int) error {
 		"source/.DS_Store",
 	}
 	for _, file := range testFiles[0:numberOfFiles] {
-		filePath := filepath.Join(tempDir, file)
-		if err := generateM4aFixtureFileAtPath(filePath); err != nil {
-			return fmt.Errorf("Failed to create test file: %v", err)
-		}
+		generateMusicFixtureFileAtPath(t, filepath.Join(tempDir, file))
 	}
 
 	// A text file that is not an m4a file
 	testTextFileName := "file3.txt" // Not an .m4a file
-	textFilePath := filepath.Join(tempDir, testTextFileName)
-	if err := generateTextFileFixtureAtPath(textFilePath); err != nil {
-		return fmt.Errorf("failed to create test text file: %v", err)
+	if err := os.WriteFile(filepath.Join(tempDir, testTextFileName), []byte{}, 0644); err != nil {
+		t.Fatalf("failed to create test text file: %v", err)
 	}
-
-	return nil
 }
 
-func setup(t *testing.T, numberOfFiles int) (string, error) {
+// setup returns a temporary directory with numberOfFiles music files in its
+// source directory.
+func setup(t *testing.T, numberOfFiles int) string {
+	t.Helper()
 	// Create a temporary directory for testing
 	tempDir, err := os.MkdirTemp("", "test")
 	if err != nil {
@@ -212,10 +204,8 @@ func setup(t *testing.T, numberOfFiles int) (string, error) {
 	}
 
 	// Set up fixture files in the temporary directory
-	if err := setupFixtureFilesInDirectory(tempDir, numberOfFiles); err != nil {
-		t.Fatalf("failed to set up fixture files: %v", err)
-	}
-	return tempDir, nil
+	setupFixtureFilesInDirectory(t, tempDir, numberOfFiles)
+	return tempDir
 }
 
 func TestFindFiles(t *testing.T) {
@@ -231,14 +221,15 @@ func TestFindFiles(t *testing.T) {
 		// NOTE: Do not list .DS_Store or .txt files since they should not be transcoded
 	}
 
-	tempDir, err := setup(t, len(transcodedFiles))
-	if err != nil {
-		t.Fatalf("failed to set up fixture files: %v", err)
-	}
-
+	tempDir := setup(t, len(transcodedFiles))
 	defer os.RemoveAll(tempDir)
 
-	findAndTranscodeFiles(filepath.Join(tempDir, "source"), filepath.Join(tempDir, "destination"))
+	fake := newFakeTranscoder()
+	err := newRun(nil, fake).findAndTranscodeFiles(context.Background(), filepath.Join(tempDir, "source"), filepath.Join(tempDir, "destination"), DefaultProfile(), 1)
+	assert.NoError(t, err)
+
+	// Every file but the MP3 is transcoded
+	assert.Len(t, fake.transcodedFiles(), len(transcodedFiles)-1)
 
 	for _, file := range transcodedFiles {
 		t.Run(fmt.Sprintf("File %s should be rendered", file), func(t *testing.T) {
@@ -263,32 +254,30 @@ func TestFindFiles(t *testing.T) {
 func TestFindFiles_EmptyDestinationDirectory(t *testing.T) {
 	transcodedFiles := []string{}
 
-	tempDir, err := setup(t, len(transcodedFiles))
+	tempDir := setup(t, len(transcodedFiles))
 	defer os.RemoveAll(tempDir)
 
-	if err != nil {
-		t.Fatalf("❗️ Failed to create temporary directory: %v", err)
-	}
-
 	sourceDir := filepath.Join(tempDir, "source")
 	destinationDir := filepath.Join(tempDir, "destination dir that does not exist")
 
-	err = findAndTranscodeFiles(sourceDir, destinationDir)
+	err := newRun(nil, newFakeTranscoder()).findAndTranscodeFiles(context.Background(), sourceDir, destinationDir, DefaultProfile(), 1)
 	assert.NoError(t, err)
 
 }
 
 // Destination files should not be re-rendered (check file modified time from first render and compare to second render)
 func TestFindFiles_NoReRender(t *testing.T) {
+	fake := newFakeTranscoder()
+	r := newRun(nil, fake)
 	// Generate limited test fixtures with one media file.
-	tempDir, _ := setup(t, 1)
+	tempDir := setup(t, 1)
 	defer os.RemoveAll(tempDir)
 
 	sourceDir := filepath.Join(tempDir, "source")
 	destinationDir := filepath.Join(tempDir, "destination")
 
 	// Run the function for the first time
-	findAndTranscodeFiles(sourceDir, destinationDir)
+	r.findAndTranscodeFiles(context.Background(), sourceDir, destinationDir, DefaultProfile(), 1)
 
 	// Verify that the destination files were not re-rendered
 	file := "source/file1.m4a"
@@ -301,12 +290,13 @@ func TestFindFiles_NoReRender(t *testing.T) {
 		// Wait for a second to ensure the modified time is different
 		time.Sleep(time.Second)
 
-		findAndTranscodeFiles(sourceDir, destinationDir)
+		r.findAndTranscodeFiles(context.Background(), sourceDir, destinationDir, DefaultProfile(), 1)
 
 		info2, _ := os.Stat(destinationPath)
 		assert.FileExistsf(t, destinationPath, "Transcoded file not found: %s", file)
 
 		assert.Equal(t, info1.ModTime(), info2.ModTime(), fmt.Sprintf("file %s was re-rendered", destinationPath))
+		assert.Len(t, fake.transcodedFiles(), 1)
 	})
 }
 
@@ -317,7 +307,7 @@ func TestCopyFile_SourceNotFound(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	err = copyFile(filepath.Join(tempDir, "nonexistent.mp3"), filepath.Join(tempDir, "dest.mp3"))
+	err = copyFile(newOSFS(tempDir), "nonexistent.mp3", newOSFS(tempDir), "dest.mp3")
 	assert.Error(t, err)
 }
 
@@ -328,33 +318,44 @@ func TestCopyFile_Success(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	src := filepath.Join(tempDir, "src.mp3")
-	dst := filepath.Join(tempDir, "subdir", "dst.mp3")
-	os.WriteFile(src, []byte("audio data"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "src.mp3"), []byte("audio data"), 0644)
 
-	err = copyFile(src, dst)
+	err = copyFile(newOSFS(tempDir), "src.mp3", newOSFS(tempDir), "subdir/dst.mp3")
 	assert.NoError(t, err)
-	assert.FileExists(t, dst)
+	assert.FileExists(t, filepath.Join(tempDir, "subdir", "dst.mp3"))
 }
 
-func TestCompareDirectories_InvalidSource(t *testing.T) {
-	_, err := compareDirectories("/nonexistent/source/dir", "/tmp")
-	assert.Error(t, err)
+func TestPlanFilesToSync_InvalidSource(t *testing.T) {
+	r := newRun(nil, newFakeTranscoder())
+	sourceDir := "/nonexistent/source/dir"
+	source := &syncSource{dir: sourceDir, index: r.loadSourceIndex("", sourceDir, LinkSettings{})}
+
+	for _, prof := range []Profile{DefaultProfile(), {PathTemplate: "{artist}/{title}"}} {
+		items := make(chan *syncItem, 1)
+		err := r.planFilesToSync(context.Background(), []*syncSource{source}, nil, prof, nil, items)
+		assert.Error(t, err)
+		assert.Empty(t, items)
+	}
 }
 
-func TestCompareDirectories_InvalidDestination(t *testing.T) {
-	tempDir, err := os.MkdirTemp("", "test-compare")
+func TestSyncPaths_InvalidDestination(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-invalid-destination")
 	if err != nil {
 		t.Fatalf("failed to create temp dir: %v", err)
 	}
 	defer os.RemoveAll(tempDir)
+	setupFixtureFilesInDirectory(t, tempDir, 1)
 
-	_, err = compareDirectories(tempDir, "/nonexistent/destination/dir")
+	// The destination can't be created below a file
+	blocker := filepath.Join(tempDir, "file")
+	os.WriteFile(blocker, []byte("not a folder"), 0644)
+
+	err = newRun(nil, newFakeTranscoder()).syncPaths(context.Background(), []string{filepath.Join(tempDir, "source")}, filepath.Join(blocker, "destination"), DefaultProfile(), 1, nil, false)
 	assert.Error(t, err)
 }
 
 func TestGetFilenames_NonExistentDirectory(t *testing.T) {
-	_, err := getFilenames("/nonexistent/dir")
+	_, err := getFilenames(newOSFS("/nonexistent/dir"), ".")
 	assert.Error(t, err)
 }
 
@@ -366,9 +367,11 @@ func TestGetFilenames_ReturnsRelativePaths(t *testing.T) {
 	defer os.RemoveAll(tempDir)
 
 	os.WriteFile(filepath.Join(tempDir, "a.mp3"), []byte{}, 0644)
+	os.MkdirAll(filepath.Join(tempDir, LogDirName), 0755)
+	os.WriteFile(filepath.Join(tempDir, LogDirName, LogFileName), []byte{}, 0644)
 	os.WriteFile(filepath.Join(tempDir, "b.mp3"), []byte{}, 0644)
 
-	names, err := getFilenames(tempDir)
+	names, err := getFilenames(newOSFS(tempDir), ".")
 	assert.NoError(t, err)
 	assert.Len(t, names, 2)
 	for _, n := range names {
@@ -386,3 +389,32 @@ func getDestinationPaths(files []fileToTranscode) []string {
 	}
 	return sources
 }
+
+func TestGetFilenames_SkipsTrash(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-getfilenames-trash")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.MkdirAll(filepath.Join(tempDir, TrashDirName, "2024-05-01T18-30-00"), 0755)
+	os.WriteFile(filepath.Join(tempDir, TrashDirName, "2024-05-01T18-30-00", "a.mp3"), []byte{}, 0644)
+	os.MkdirAll(filepath.Join(tempDir, LogDirName), 0755)
+	os.WriteFile(filepath.Join(tempDir, LogDirName, LogFileName), []byte{}, 0644)
+	os.WriteFile(filepath.Join(tempDir, "b.mp3"), []byte{}, 0644)
+
+	names, err := getFilenames(newOSFS(tempDir), ".")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/b.mp3"}, names)
+}
+
+func TestFilesBelowPaths(t *testing.T) {
+	files := []fileToTranscode{
+		{sourcePath: "/Artist/Album/01.m4a"},
+		{sourcePath: "/Artist/Album 2/01.m4a"},
+		{sourcePath: "/Other/Song.mp3"},
+	}
+
+	result := filesBelowPaths(files, []string{"/Artist/Album", "/Other/Song.mp3"})
+	assert.Equal(t, []fileToTranscode{{sourcePath: "/Artist/Album/01.m4a"}, {sourcePath: "/Other/Song.mp3"}}, result)
+}
@@ -0,0 +1,7 @@
+//go:build !unix
+
+package engine
+
+// flushWrites does nothing on systems without sync(2). Files are synced
+// individually as they are copied.
+func flushWrites() {}
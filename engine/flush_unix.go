@@ -0,0 +1,11 @@
+//go:build unix
+
+package engine
+
+import "syscall"
+
+// flushWrites asks the kernel to write all buffered data to the devices, so
+// that a USB stick can be unplugged safely.
+func flushWrites() {
+	syscall.Sync()
+}
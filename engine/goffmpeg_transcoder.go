@@ -0,0 +1,71 @@
+package engine
+
+import (
+	"bytes"
+	"os/exec"
+	"strconv"
+
+	"github.com/xfrr/goffmpeg/transcoder"
+)
+
+// goffmpegTranscoder transcodes with the goffmpeg library and probes with
+// ffprobe.
+type goffmpegTranscoder struct{}
+
+// Probe runs ffprobe on the file at path.
+func (goffmpegTranscoder) Probe(path string) (MediaInfo, error) {
+	return probeFile(path)
+}
+
+// MeasureLoudness runs ffmpeg's ebur128 filter on the file at path, since
+// goffmpeg has no filters that only analyze.
+func (goffmpegTranscoder) MeasureLoudness(path string) (LoudnessMeasurement, error) {
+	return measureLoudness(path)
+}
+
+// DecodePCM runs ffmpeg to decode the file at path to raw samples, since
+// goffmpeg only writes files.
+func (goffmpegTranscoder) DecodePCM(path string, sampleRate, seconds int) ([]float64, error) {
+	return decodePCM(path, sampleRate, seconds)
+}
+
+// Transcode runs the ffmpeg command that goffmpeg builds for the source.
+// goffmpeg's own runner only reads ffmpeg's output for progress lines and
+// drops the rest, so the command is run here instead, with the progress
+// written to stdout and the errors kept from stderr, like ffmpegTranscoder.
+func (goffmpegTranscoder) Transcode(sourcePath, destinationPath string, opts TranscodeOptions, onProgress func(float64)) (float64, error) {
+	trans := new(transcoder.Transcoder)
+	if err := trans.Initialize(sourcePath, destinationPath); err != nil {
+		return 0, err
+	}
+	seconds, _ := strconv.ParseFloat(trans.MediaFile().Metadata().Format.Duration, 64)
+	if opts.AudioFilter != "" {
+		trans.MediaFile().SetAudioFilter(opts.AudioFilter)
+	} else if copiesAudio(sourcePath, opts) {
+		// Only the tags change, so keep the MP3 audio as-is
+		trans.MediaFile().SetAudioCodec("copy")
+	}
+	if len(opts.Tags) > 0 {
+		trans.MediaFile().SetTags(opts.Tags)
+	}
+
+	args := append([]string{"-nostdin", "-nostats", "-loglevel", "error", "-progress", "pipe:1"}, trans.GetCommand()...)
+	opts.debug("running ffmpeg", "args", args)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(trans.FFmpegExec(), args...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return seconds, err
+	}
+	if err := cmd.Start(); err != nil {
+		return seconds, err
+	}
+
+	readFFmpegProgress(stdout, seconds, onProgress)
+	if err := cmd.Wait(); err != nil {
+		return seconds, newFFmpegError(err, stderr.String())
+	}
+	return seconds, nil
+}
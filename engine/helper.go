@@ -1,4 +1,4 @@
-package main
+package engine
 
 import (
 	"path/filepath"
@@ -51,10 +51,22 @@ func removeNonASCII(str string) string {
 
 // isUntranscodedMusicFile checks if the path is a source music file of
 // common types that need to be converted to MP3 (but are not themselves MP3),
-// based on its extension.
+// based on its extension in any case, e.g. Song.M4A from a Windows ripper.
 func isUntranscodedMusicFile(path string) bool {
 	extensions := []string{".aif", ".wav", ".m4a"}
-	return stringInSlice(filepath.Ext(path), extensions)
+	return stringInSliceFold(filepath.Ext(path), extensions)
+}
+
+// isMP3File checks if the path is an MP3 file, based on its extension in any
+// case.
+func isMP3File(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".mp3")
+}
+
+// isMusicFile checks if the path is an MP3 file or a music file that can be
+// transcoded to MP3, based on its extension.
+func isMusicFile(path string) bool {
+	return isMP3File(path) || isUntranscodedMusicFile(path)
 }
 
 // stringInSlice returns bool if a string is found in any of a list of other strings.
@@ -72,3 +84,13 @@ func stringInSlice(str string, list []string) bool {
 	}
 	return false
 }
+
+// stringInSliceFold is like stringInSlice, but ignores case.
+func stringInSliceFold(str string, list []string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, str) {
+			return true
+		}
+	}
+	return false
+}
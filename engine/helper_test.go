@@ -0,0 +1,17 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsMusicFile(t *testing.T) {
+	for _, name := range []string{"/a.mp3", "/TRACK.MP3", "/Song.M4A", "/Take.Wav", "/b.aif"} {
+		assert.True(t, isMusicFile(name), name)
+	}
+	assert.False(t, isMusicFile("/cover.JPG"))
+	assert.True(t, isMP3File("/TRACK.Mp3"))
+	assert.False(t, isUntranscodedMusicFile("/TRACK.MP3"))
+	assert.True(t, isUntranscodedMusicFile("/Song.M4A"))
+}
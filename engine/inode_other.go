@@ -0,0 +1,10 @@
+//go:build !unix
+
+package engine
+
+import "io/fs"
+
+// fileID returns 0, since file information has no inode numbers here.
+func fileID(info fs.FileInfo) (device, inode uint64) {
+	return 0, 0
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package engine
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileID returns the device and inode number of a file, so that a file
+// replaced by another one of the same size and time is noticed, and a file
+// that is linked more than once is recognized.
+func fileID(info fs.FileInfo) (device, inode uint64) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev), uint64(stat.Ino)
+	}
+	return 0, 0
+}
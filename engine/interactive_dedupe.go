@@ -0,0 +1,238 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// folderChoice is a review decision that the user applied to the rest of a
+// folder.
+type folderChoice struct {
+	skip      bool
+	accept    bool
+	extension string
+}
+
+// dedupeReviewer lets the user decide by hand which file of each duplicate
+// group to keep. It shows the candidates side by side and proposes the file
+// chosen by selectFileToKeep.
+type dedupeReviewer struct {
+	in      *bufio.Scanner
+	out     io.Writer
+	probe   func(string) (MediaInfo, error)
+	ranking QualityRanking
+	quit    bool
+	folder  map[string]folderChoice
+}
+
+// newDedupeReviewer returns a reviewer that reads answers from in and writes
+// the groups and prompts to out. Candidates are probed with probe for
+// display, and to find the different edits of the file the user keeps with
+// the duration tolerance of ranking; probe may be nil.
+func newDedupeReviewer(in io.Reader, out io.Writer, probe func(string) (MediaInfo, error), ranking QualityRanking) *dedupeReviewer {
+	return &dedupeReviewer{
+		in:      bufio.NewScanner(in),
+		out:     out,
+		probe:   probe,
+		ranking: ranking.withDefaults(),
+		folder:  make(map[string]folderChoice),
+	}
+}
+
+// review asks the user which file of the group to keep. keep, toDelete and
+// differentEdits are the proposed choice. Different edits are never deleted.
+//
+// Returns the files to keep and delete, and false if the group should be
+// skipped.
+func (r *dedupeReviewer) review(candidates []string, keep string, toDelete, differentEdits []string) (string, []string, bool) {
+	if r.quit {
+		return "", nil, false
+	}
+
+	folder := filepath.Dir(keep)
+	if choice, ok := r.folder[folder]; ok {
+		switch {
+		case choice.skip:
+			fmt.Fprintf(r.out, "⏭️  Skipping %s (same choice as earlier in folder)\n", keep)
+			return "", nil, false
+		case choice.accept:
+			return keep, toDelete, true
+		default:
+			for _, f := range candidates {
+				if strings.EqualFold(filepath.Ext(f), choice.extension) {
+					return f, otherFiles(candidates, f, r.editsOf(candidates, keep, f, differentEdits)), true
+				}
+			}
+		}
+	}
+
+	r.printGroup(candidates, keep, differentEdits)
+
+	for {
+		fmt.Fprintf(r.out, "[a]ccept, [s]kip, [1-%d] keep another file, [q]uit; add ! to apply to the rest of this folder > ", len(candidates))
+		if !r.in.Scan() {
+			// End of input: leave the remaining groups alone
+			r.quit = true
+			fmt.Fprintln(r.out)
+			return "", nil, false
+		}
+
+		answer := strings.TrimSpace(r.in.Text())
+		applyToFolder := strings.HasSuffix(answer, "!")
+		answer = strings.TrimSuffix(answer, "!")
+
+		switch answer {
+		case "a", "":
+			if applyToFolder {
+				r.folder[folder] = folderChoice{accept: true}
+			}
+			return keep, toDelete, true
+		case "s":
+			if applyToFolder {
+				r.folder[folder] = folderChoice{skip: true}
+			}
+			return "", nil, false
+		case "q":
+			r.quit = true
+			return "", nil, false
+		}
+
+		if n, err := strconv.Atoi(answer); err == nil && n >= 1 && n <= len(candidates) {
+			chosen := candidates[n-1]
+			if applyToFolder {
+				r.folder[folder] = folderChoice{extension: filepath.Ext(chosen)}
+			}
+			return chosen, otherFiles(candidates, chosen, r.editsOf(candidates, keep, chosen, differentEdits)), true
+		}
+
+		fmt.Fprintf(r.out, "Unknown answer %q\n", answer)
+	}
+}
+
+// editsOf returns the different edits of the group for the file the user
+// chose to keep. The proposed different edits were found against the
+// proposed file, so for another file they are found again from the probed
+// durations. Without them, choosing a different edit keeps every other
+// candidate, as the proposed file is then a different edit of it.
+func (r *dedupeReviewer) editsOf(candidates []string, keep, chosen string, differentEdits []string) []string {
+	if chosen == keep {
+		return differentEdits
+	}
+	if r.probe != nil {
+		infos := make(map[string]MediaInfo)
+		for _, f := range candidates {
+			info, err := r.probe(f)
+			if err != nil {
+				break
+			}
+			infos[f] = info
+		}
+		if len(infos) == len(candidates) {
+			var edits []string
+			for _, f := range candidates {
+				if f != chosen && r.ranking.differentEdit(infos[chosen], infos[f]) {
+					edits = append(edits, f)
+				}
+			}
+			return edits
+		}
+	}
+	if stringInSlice(chosen, differentEdits) {
+		return otherFiles(candidates, chosen, nil)
+	}
+	return differentEdits
+}
+
+// printGroup shows the candidates of a group side by side with their size,
+// format, bit rate, duration and tags, marking the proposed file to keep.
+func (r *dedupeReviewer) printGroup(candidates []string, keep string, differentEdits []string) {
+	fmt.Fprintf(r.out, "\n🔎 Duplicates in %s\n", filepath.Dir(keep))
+
+	table := tabwriter.NewWriter(r.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "\t#\tFile\tSize\tFormat\tBit rate\tDuration\tTags")
+	for i, f := range candidates {
+		marker := ""
+		switch {
+		case f == keep:
+			marker = "keep"
+		case stringInSlice(f, differentEdits):
+			marker = "edit"
+		}
+
+		size := "?"
+		if stat, err := os.Stat(f); err == nil {
+			size = FormatBytes(stat.Size())
+		}
+
+		format, bitRate, duration, tags := strings.TrimPrefix(filepath.Ext(f), "."), "?", "?", ""
+		if r.probe != nil {
+			if info, err := r.probe(f); err == nil {
+				format = info.Codec
+				if info.isLossless() && info.BitsPerSample > 0 {
+					format = fmt.Sprintf("%s %d-bit", info.Codec, info.BitsPerSample)
+				}
+				if info.SampleRate > 0 {
+					format = fmt.Sprintf("%s %.1fkHz", format, float64(info.SampleRate)/1000)
+				}
+				bitRate = fmt.Sprintf("%dk", info.BitRate/1000)
+				if info.VariableBitRate {
+					bitRate += " VBR"
+				}
+				duration = formatDuration(info.Duration)
+				tags = strings.Join(nonEmpty(info.Tags["artist"], info.Tags["album"], info.Tags["title"]), " / ")
+			}
+		}
+
+		fmt.Fprintf(table, "%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\n", marker, i+1, filepath.Base(f), size, format, bitRate, duration, tags)
+	}
+	table.Flush()
+}
+
+// otherFiles returns the candidates other than keep and the different edits.
+func otherFiles(candidates []string, keep string, differentEdits []string) []string {
+	var others []string
+	for _, f := range candidates {
+		if f != keep && !stringInSlice(f, differentEdits) {
+			others = append(others, f)
+		}
+	}
+	return others
+}
+
+// nonEmpty returns the values that are not empty.
+func nonEmpty(values ...string) []string {
+	var result []string
+	for _, value := range values {
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// FormatBytes formats a size in bytes for display, e.g. "4.2 MB".
+func FormatBytes(size int64) string {
+	const unit = 1000
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "kMGTPE"[exp])
+}
+
+// formatDuration formats a duration in seconds as minutes and seconds,
+// e.g. "3:25".
+func formatDuration(seconds float64) string {
+	total := int(seconds + 0.5)
+	return fmt.Sprintf("%d:%02d", total/60, total%60)
+}
@@ -0,0 +1,159 @@
+package engine
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupeReviewer_Answers(t *testing.T) {
+	candidates := []string{"/dest/Album/song.m4a", "/dest/Album/song.mp3"}
+	keep, toDelete := "/dest/Album/song.mp3", []string{"/dest/Album/song.m4a"}
+
+	cases := []struct {
+		Name           string
+		Input          string
+		ExpectedKeep   string
+		ExpectedDelete []string
+		ExpectedOK     bool
+	}{
+		{Name: "Accept", Input: "a\n", ExpectedKeep: keep, ExpectedDelete: toDelete, ExpectedOK: true},
+		{Name: "Empty answer accepts", Input: "\n", ExpectedKeep: keep, ExpectedDelete: toDelete, ExpectedOK: true},
+		{Name: "Pick another keeper", Input: "1\n", ExpectedKeep: "/dest/Album/song.m4a", ExpectedDelete: []string{"/dest/Album/song.mp3"}, ExpectedOK: true},
+		{Name: "Skip", Input: "s\n", ExpectedOK: false},
+		{Name: "Quit", Input: "q\n", ExpectedOK: false},
+		{Name: "End of input skips", Input: "", ExpectedOK: false},
+		{Name: "Unknown answer asks again", Input: "x\n9\na\n", ExpectedKeep: keep, ExpectedDelete: toDelete, ExpectedOK: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			var out bytes.Buffer
+			reviewer := newDedupeReviewer(strings.NewReader(c.Input), &out, nil, QualityRanking{})
+
+			gotKeep, gotDelete, ok := reviewer.review(candidates, keep, toDelete, nil)
+			assert.Equal(t, c.ExpectedOK, ok)
+			if ok {
+				assert.Equal(t, c.ExpectedKeep, gotKeep)
+				assert.Equal(t, c.ExpectedDelete, gotDelete)
+			}
+			assert.Contains(t, out.String(), "song.m4a")
+		})
+	}
+}
+
+func TestDedupeReviewer_ShowsProbedDetails(t *testing.T) {
+	var out bytes.Buffer
+	probe := func(path string) (MediaInfo, error) {
+		if strings.HasSuffix(path, ".mp3") {
+			return MediaInfo{Codec: "mp3", BitRate: 320000, SampleRate: 44100, Duration: 205, VariableBitRate: true,
+				Tags: map[string]string{"artist": "Band", "title": "Song"}}, nil
+		}
+		return MediaInfo{Codec: "alac", BitRate: 2116000, SampleRate: 96000, BitsPerSample: 24, Duration: 205}, nil
+	}
+	reviewer := newDedupeReviewer(strings.NewReader("a\n"), &out, probe, QualityRanking{})
+
+	reviewer.review([]string{"/dest/song.m4a", "/dest/song.mp3"}, "/dest/song.mp3", []string{"/dest/song.m4a"}, nil)
+
+	output := out.String()
+	assert.Contains(t, output, "alac 24-bit 96.0kHz")
+	assert.Contains(t, output, "320k VBR")
+	assert.Contains(t, output, "3:25")
+	assert.Contains(t, output, "Band / Song")
+	assert.Regexp(t, `keep\s+2\s+song.mp3`, output)
+}
+
+func TestDedupeReviewer_ApplyToRestOfFolder(t *testing.T) {
+	var out bytes.Buffer
+	reviewer := newDedupeReviewer(strings.NewReader("1!\ns!\n"), &out, nil, QualityRanking{})
+
+	// Keep the M4A, and keep M4As for the rest of the folder
+	keep, toDelete, ok := reviewer.review([]string{"/dest/A/1.m4a", "/dest/A/1.mp3"}, "/dest/A/1.mp3", []string{"/dest/A/1.m4a"}, nil)
+	assert.True(t, ok)
+	assert.Equal(t, "/dest/A/1.m4a", keep)
+	assert.Equal(t, []string{"/dest/A/1.mp3"}, toDelete)
+
+	keep, toDelete, ok = reviewer.review([]string{"/dest/A/2.m4a", "/dest/A/2.mp3"}, "/dest/A/2.mp3", []string{"/dest/A/2.m4a"}, nil)
+	assert.True(t, ok)
+	assert.Equal(t, "/dest/A/2.m4a", keep)
+	assert.Equal(t, []string{"/dest/A/2.mp3"}, toDelete)
+
+	// Another folder is asked again; skip it and the rest of that folder
+	_, _, ok = reviewer.review([]string{"/dest/B/1.m4a", "/dest/B/1.mp3"}, "/dest/B/1.mp3", []string{"/dest/B/1.m4a"}, nil)
+	assert.False(t, ok)
+	_, _, ok = reviewer.review([]string{"/dest/B/2.m4a", "/dest/B/2.mp3"}, "/dest/B/2.mp3", []string{"/dest/B/2.m4a"}, nil)
+	assert.False(t, ok)
+}
+
+func TestDedupeReviewer_KeepsDifferentEdits(t *testing.T) {
+	var out bytes.Buffer
+	reviewer := newDedupeReviewer(strings.NewReader("2\n"), &out, nil, QualityRanking{})
+
+	candidates := []string{"/dest/song.mp3", "/dest/song.m4a", "/dest/song.wav"}
+	keep, toDelete, ok := reviewer.review(candidates, "/dest/song.mp3", []string{"/dest/song.m4a"}, []string{"/dest/song.wav"})
+	assert.True(t, ok)
+	assert.Equal(t, "/dest/song.m4a", keep)
+	assert.Equal(t, []string{"/dest/song.mp3"}, toDelete)
+}
+
+func TestDedupeReviewer_KeepDifferentEdit(t *testing.T) {
+	candidates := []string{"/dest/song.mp3", "/dest/song.m4a", "/dest/song (live).wav", "/dest/song (live).flac"}
+	durations := map[string]float64{"/dest/song.mp3": 205, "/dest/song.m4a": 205, "/dest/song (live).wav": 312, "/dest/song (live).flac": 312}
+	probe := func(path string) (MediaInfo, error) {
+		return MediaInfo{Codec: "mp3", Duration: durations[path]}, nil
+	}
+
+	// The other live file is deleted, the studio files are different edits
+	var out bytes.Buffer
+	reviewer := newDedupeReviewer(strings.NewReader("3\n"), &out, probe, QualityRanking{})
+	keep, toDelete, ok := reviewer.review(candidates, "/dest/song.mp3", []string{"/dest/song.m4a"}, []string{"/dest/song (live).wav", "/dest/song (live).flac"})
+	assert.True(t, ok)
+	assert.Equal(t, "/dest/song (live).wav", keep)
+	assert.Equal(t, []string{"/dest/song (live).flac"}, toDelete)
+
+	// Same for the edit chosen for the rest of the folder
+	reviewer = newDedupeReviewer(strings.NewReader("3!\n"), &out, probe, QualityRanking{})
+	reviewer.review(candidates, "/dest/song.mp3", []string{"/dest/song.m4a"}, []string{"/dest/song (live).wav", "/dest/song (live).flac"})
+	keep, toDelete, ok = reviewer.review(candidates, "/dest/song.mp3", []string{"/dest/song.m4a"}, []string{"/dest/song (live).wav", "/dest/song (live).flac"})
+	assert.True(t, ok)
+	assert.Equal(t, "/dest/song (live).wav", keep)
+	assert.Equal(t, []string{"/dest/song (live).flac"}, toDelete)
+
+	// Without durations, nothing is deleted
+	reviewer = newDedupeReviewer(strings.NewReader("3\n"), &out, nil, QualityRanking{})
+	keep, toDelete, ok = reviewer.review(candidates, "/dest/song.mp3", []string{"/dest/song.m4a"}, []string{"/dest/song (live).wav", "/dest/song (live).flac"})
+	assert.True(t, ok)
+	assert.Equal(t, "/dest/song (live).wav", keep)
+	assert.Empty(t, toDelete)
+}
+
+func TestRemoveDuplicateFiles_Interactive(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-remove-duplicates-interactive")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	mp3File := filepath.Join(tempDir, "song.mp3")
+	m4aFile := filepath.Join(tempDir, "song.m4a")
+	os.WriteFile(mp3File, make([]byte, 200), 0644)
+	os.WriteFile(m4aFile, make([]byte, 300), 0644)
+
+	// Candidates are listed in path order, so the M4A is #1
+	var out bytes.Buffer
+	err = newRun(nil, nil).removeDuplicateFiles(tempDir, dedupeOptions{reviewer: newDedupeReviewer(strings.NewReader("1\n"), &out, nil, QualityRanking{})})
+	assert.NoError(t, err)
+
+	assert.FileExists(t, m4aFile)
+	assert.NoFileExists(t, mp3File)
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, "999 B", FormatBytes(999))
+	assert.Equal(t, "4.2 MB", FormatBytes(4200000))
+}
@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"io/fs"
+	"path/filepath"
+)
+
+// LinkSettings configures how symbolic links and hard links in a source are
+// handled.
+//
+// Symlinked files are always synced like the files they point to. When
+// FollowDirectories is set, symlinked directories are walked too, e.g. a
+// "Favorites" folder of links into the library; a link to a directory that
+// contains it is skipped, so that the walk ends. When SkipDuplicates is set, a
+// file that is in the source more than once, as hard links or through
+// symlinks, is only synced at its first path in the order of getFilenames.
+type LinkSettings struct {
+	FollowDirectories bool `yaml:"follow_directories"`
+	SkipDuplicates    bool `yaml:"skip_duplicates"`
+}
+
+// fileKey identifies a file or directory independently of the path it is
+// reached by: by device and inode number, or by its path with the symlinks
+// resolved where there are no inode numbers.
+type fileKey struct {
+	device, inode uint64
+	path          string
+}
+
+// fileKeyOf returns the key of the file at fullPath, with the information
+// os.Stat returned for it.
+func fileKeyOf(fullPath string, info fs.FileInfo) fileKey {
+	device, inode := fileID(info)
+	if inode != 0 {
+		return fileKey{device: device, inode: inode}
+	}
+	resolved, err := filepath.EvalSymlinks(fullPath)
+	if err != nil {
+		resolved = fullPath
+	}
+	if abs, err := filepath.Abs(resolved); err == nil {
+		resolved = abs
+	}
+	return fileKey{path: resolved}
+}
+
+// containsKey reports whether keys contains key.
+func containsKey(keys []fileKey, key fileKey) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,261 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// lockFileName is the lock file in the destination root that keeps two
+	// runs from writing to the same destination at once.
+	lockFileName = ".sync.lock"
+
+	// lockPollInterval is how often a run started with -wait checks whether
+	// the destination was unlocked.
+	lockPollInterval = time.Second
+
+	// staleLockAge is how old the lock of a run on another host has to be
+	// before it's considered stale on filesystems without flock support,
+	// where whether that run is still alive can't be checked.
+	staleLockAge = 24 * time.Hour
+
+	// unwrittenLockAge is how long a run may take to write its information
+	// to a lock file it created on filesystems without flock support.
+	unwrittenLockAge = time.Minute
+)
+
+var (
+	// errLocked is returned by tryLock when another process holds the lock.
+	errLocked = errors.New("locked")
+
+	// errLockUnsupported is returned by tryLock when the filesystem doesn't
+	// support advisory locks, as with some network and FUSE filesystems.
+	errLockUnsupported = errors.New("advisory locks not supported")
+
+	// tryLockFile takes the advisory lock on a lock file. Tests replace it
+	// to exercise the fallback for filesystems without flock support.
+	tryLockFile = tryLock
+)
+
+// lockInfo describes the run that holds a lock. It is stored in the lock file
+// for error messages and for detecting stale locks.
+type lockInfo struct {
+	PID     int       `json:"pid"`
+	Host    string    `json:"host"`
+	Started time.Time `json:"started"`
+}
+
+// String describes the run for error messages.
+func (info lockInfo) String() string {
+	return fmt.Sprintf("PID %d on %s since %s", info.PID, info.Host, info.Started.Format(time.DateTime))
+}
+
+// destinationLock is an advisory lock on a destination directory.
+type destinationLock struct {
+	file *os.File
+
+	// path is the lock file if the lock is held by having created it, on
+	// filesystems without flock support, and empty otherwise.
+	path string
+}
+
+// acquireDestinationLock locks the directory dir. If another run holds the
+// lock, it returns an error describing that run, or with wait, waits until
+// the lock is released.
+func (r *run) acquireDestinationLock(dir string, wait bool) (*destinationLock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, lockFileName)
+
+	host, _ := os.Hostname()
+	self := lockInfo{PID: os.Getpid(), Host: host, Started: time.Now()}
+	waiting := false
+	for {
+		lock, previous, err := r.tryDestinationLock(path, self)
+		if err == nil {
+			return lock, nil
+		}
+		if err != errLocked {
+			return nil, fmt.Errorf("failed to lock %s: %v", dir, err)
+		}
+
+		if !wait {
+			return nil, fmt.Errorf("%s is already being synced (%s); pass -wait to wait for it to finish", dir, previous)
+		}
+		if !waiting {
+			r.reporter.emit(Event{Type: EventStart, Operation: "wait-for-lock", Path: dir, Message: previous.String()})
+			waiting = true
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
+
+// tryDestinationLock locks the lock file path for the run self without
+// waiting. If another run holds the lock, it returns errLocked along with the
+// information of that run.
+//
+// Where flock isn't supported, the run that creates the lock file holds the
+// lock until it removes the file again. A stale lock file is moved aside before
+// a new one is created, so that of several runs taking it over at once, only
+// one gets the lock.
+func (r *run) tryDestinationLock(path string, self lockInfo) (*destinationLock, lockInfo, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+		created := err == nil
+		if errors.Is(err, fs.ErrExist) {
+			file, err = os.OpenFile(path, os.O_RDWR, 0644)
+			if errors.Is(err, fs.ErrNotExist) {
+				// Released in between
+				continue
+			}
+		}
+		if err != nil {
+			return nil, lockInfo{}, fmt.Errorf("failed to open lock file: %v", err)
+		}
+
+		previous, _ := readLockInfo(file)
+		lock := &destinationLock{file: file}
+		err = tryLockFile(file)
+		if err == errLockUnsupported {
+			lock.path = path
+			err = nil
+			if !created {
+				stat, statErr := file.Stat()
+				file.Close()
+				if statErr != nil {
+					return nil, previous, statErr
+				}
+				if !isStaleLockFile(previous, stat.ModTime(), self.Host, time.Now()) {
+					return nil, previous, errLocked
+				}
+				aside := fmt.Sprintf("%s.%d.stale", path, self.PID)
+				if err := os.Rename(path, aside); err == nil {
+					r.logger.Warn("taking over stale lock", "path", path, "previous", previous.String())
+					os.Remove(aside)
+				}
+				continue
+			}
+		}
+		if err != nil {
+			file.Close()
+			return nil, previous, err
+		}
+
+		if lock.path == "" && previous.PID != 0 && previous.PID != self.PID {
+			r.logger.Warn("taking over stale lock", "path", path, "previous", previous.String())
+		}
+		if err := writeLockInfo(file, self); err != nil {
+			lock.release()
+			return nil, previous, fmt.Errorf("failed to write lock file: %v", err)
+		}
+		return lock, previous, nil
+	}
+}
+
+// isStaleLock reports whether a lock recorded in a lock file is left over
+// from a run that is no longer running: a process on this host that has
+// exited, or a run on another host that started more than staleLockAge ago.
+func isStaleLock(info lockInfo, host string, now time.Time) bool {
+	if info.Host == host {
+		return !processAlive(info.PID)
+	}
+	return now.Sub(info.Started) > staleLockAge
+}
+
+// isStaleLockFile reports whether a lock file created by another run, which
+// was last modified at modTime, is left over from a run that is no longer
+// running. A file without run information is stale once the run that created
+// it has had time to write the information, since older versions left an
+// empty lock file behind.
+func isStaleLockFile(info lockInfo, modTime time.Time, host string, now time.Time) bool {
+	if info.PID == 0 {
+		return now.Sub(modTime) > unwrittenLockAge
+	}
+	return isStaleLock(info, host, now)
+}
+
+// readLockInfo reads the run information from a lock file. An empty or
+// unreadable file has no information.
+func readLockInfo(file *os.File) (lockInfo, error) {
+	var info lockInfo
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, 1<<16))
+	if err != nil || len(data) == 0 {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// writeLockInfo replaces the contents of a lock file with the run information.
+func writeLockInfo(file *os.File, info lockInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.WriteAt(append(data, '\n'), 0); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// release clears the run information and unlocks the destination. A flock
+// lock file itself is kept, since removing it could let a waiting run lock the
+// removed file while a new run locks a new one. Without flock support, the
+// lock file is removed, which is what releases the lock.
+func (l *destinationLock) release() error {
+	if l.path != "" {
+		l.file.Close()
+		return os.Remove(l.path)
+	}
+	l.file.Truncate(0)
+	unlock(l.file)
+	return l.file.Close()
+}
+
+// withDestinationLock runs fn while holding the lock on dir. Remote
+// destinations aren't locked at all, so fn runs without a lock and two runs
+// syncing the same remote destination at once can interfere.
+func (r *run) withDestinationLock(dir string, wait bool, fn func() error) error {
+	if IsRemote(dir) {
+		r.logger.Debug("not locking remote destination", "destination", dir)
+		return fn()
+	}
+	lock, err := r.acquireDestinationLock(dir, wait)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+	return fn()
+}
+
+// runOnDestination runs fn for an operation on dir with the log of the run
+// open, while holding the lock on dir, see openLog and
+// withDestinationLock. A dry run doesn't change dir, so it runs without the
+// lock and only writes a log if its path is given.
+func (r *run) runOnDestination(dir string, wait, dryRun bool, log *LogOptions, operation string, attrs []any, fn func() error) error {
+	withLog := func() error {
+		closeLog, err := r.openLog(log, dir, operation, attrs...)
+		if err != nil {
+			return err
+		}
+		defer closeLog()
+		return fn()
+	}
+	if !dryRun {
+		return r.withDestinationLock(dir, wait, withLog)
+	}
+	if log != nil && log.Path == "" {
+		log = nil
+	}
+	return withLog()
+}
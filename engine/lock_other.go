@@ -0,0 +1,22 @@
+//go:build !unix
+
+package engine
+
+import "os"
+
+// tryLock reports that advisory locks aren't supported, so that the lock
+// falls back to the run information in the lock file.
+func tryLock(file *os.File) error {
+	return errLockUnsupported
+}
+
+// unlock does nothing, since no lock is taken.
+func unlock(file *os.File) error {
+	return nil
+}
+
+// processAlive assumes that the process is still running, since it can't be
+// checked portably.
+func processAlive(pid int) bool {
+	return true
+}
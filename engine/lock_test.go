@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquireDestinationLock(t *testing.T) {
+	r := newRun(nil, nil)
+	tempDir, err := os.MkdirTemp("", "test-lock")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	lock, err := r.acquireDestinationLock(tempDir, false)
+	assert.NoError(t, err)
+
+	file, _ := os.Open(filepath.Join(tempDir, lockFileName))
+	info, err := readLockInfo(file)
+	file.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, os.Getpid(), info.PID)
+
+	// A second run fails with a description of the run holding the lock
+	_, err = r.acquireDestinationLock(tempDir, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "already being synced")
+		assert.Contains(t, err.Error(), "-wait")
+	}
+
+	// With wait, the second run gets the lock once the first releases it
+	acquired := make(chan error)
+	go func() {
+		second, err := r.acquireDestinationLock(tempDir, true)
+		if err == nil {
+			second.release()
+		}
+		acquired <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, lock.release())
+	assert.NoError(t, <-acquired)
+}
+
+func TestAcquireDestinationLock_StaleInfo(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-lock-stale")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// A crashed run left its information behind, but no longer holds the lock
+	host, _ := os.Hostname()
+	os.WriteFile(filepath.Join(tempDir, lockFileName), []byte(`{"pid":999999999,"host":"`+host+`","started":"2024-05-01T18:30:00Z"}`), 0644)
+
+	lock, err := newRun(nil, nil).acquireDestinationLock(tempDir, false)
+	assert.NoError(t, err)
+	lock.release()
+}
+
+func TestAcquireDestinationLock_WithoutFlock(t *testing.T) {
+	r := newRun(nil, nil)
+	original := tryLockFile
+	tryLockFile = func(*os.File) error { return errLockUnsupported }
+	defer func() { tryLockFile = original }()
+
+	tempDir, err := os.MkdirTemp("", "test-lock-exclusive")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	lockPath := filepath.Join(tempDir, lockFileName)
+
+	lock, err := r.acquireDestinationLock(tempDir, false)
+	assert.NoError(t, err)
+
+	// The run that created the lock file holds the lock, even while another
+	// run hasn't seen its information yet
+	_, err = r.acquireDestinationLock(tempDir, false)
+	assert.Error(t, err)
+	os.Truncate(lockPath, 0)
+	_, err = r.acquireDestinationLock(tempDir, false)
+	assert.Error(t, err)
+
+	// Releasing removes the lock file
+	assert.NoError(t, lock.release())
+	assert.NoFileExists(t, lockPath)
+
+	// A lock file left behind by a crashed run is taken over, as is an empty
+	// one that was left behind long ago
+	host, _ := os.Hostname()
+	os.WriteFile(lockPath, []byte(`{"pid":999999999,"host":"`+host+`","started":"2024-05-01T18:30:00Z"}`), 0644)
+	lock, err = r.acquireDestinationLock(tempDir, false)
+	if assert.NoError(t, err) {
+		lock.release()
+	}
+	os.WriteFile(lockPath, nil, 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(lockPath, old, old)
+	lock, err = r.acquireDestinationLock(tempDir, false)
+	if assert.NoError(t, err) {
+		lock.release()
+	}
+	assert.NoFileExists(t, lockPath)
+}
+
+func TestIsStaleLock(t *testing.T) {
+	now := time.Date(2024, 5, 2, 18, 30, 0, 0, time.UTC)
+
+	assert.False(t, isStaleLock(lockInfo{PID: os.Getpid(), Host: "here"}, "here", now))
+	assert.True(t, isStaleLock(lockInfo{PID: 999999999, Host: "here"}, "here", now))
+	assert.False(t, isStaleLock(lockInfo{PID: 1, Host: "elsewhere", Started: now.Add(-time.Hour)}, "here", now))
+	assert.True(t, isStaleLock(lockInfo{PID: 1, Host: "elsewhere", Started: now.Add(-48 * time.Hour)}, "here", now))
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package engine
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive flock on the file without blocking. The kernel
+// releases it when the process exits, so a crashed run never leaves the
+// destination locked.
+func tryLock(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	switch err {
+	case nil:
+		return nil
+	case syscall.EWOULDBLOCK:
+		return errLocked
+	case syscall.ENOTSUP, syscall.ENOLCK, syscall.EINVAL:
+		return errLockUnsupported
+	}
+	return err
+}
+
+// unlock releases the flock on the file.
+func unlock(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+// processAlive reports whether a process with the PID exists on this host.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,258 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// LogDirName is the directory in the destination root that log files are
+	// written to. It is skipped when scanning the destination.
+	LogDirName = ".sync-logs"
+
+	LogFileName = "sync.log"
+
+	// maxLogFileSize is the size at which the log file is rotated, keeping
+	// maxLogBackups older files as sync.log.1, sync.log.2, etc.
+	maxLogFileSize = 10 << 20
+	maxLogBackups  = 5
+
+	// maxFFmpegStderr limits how much of ffmpeg's output is kept for a
+	// failed file. The end of the output has the actual error.
+	maxFFmpegStderr = 4096
+)
+
+// discardLogger is the logger of a run whose log isn't open.
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// configureLogging writes the debug records of the run to a rotating log
+// file at logPath, or in LogDirName in dir if logPath is empty. With verbose,
+// debug records are also written to stderr.
+//
+// Returns a function that closes the log file and turns logging off again.
+func (r *run) configureLogging(dir, logPath string, verbose bool) (func() error, error) {
+	if logPath == "" {
+		logPath = filepath.Join(dir, LogDirName, LogFileName)
+	}
+
+	file, err := openRotatingFile(logPath, maxLogFileSize, maxLogBackups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+
+	fileHandler := slog.NewJSONHandler(file, &slog.HandlerOptions{Level: slog.LevelDebug})
+	handler := slog.Handler(fileHandler)
+	if verbose {
+		handler = slog.NewMultiHandler(fileHandler, slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	}
+
+	r.logger = slog.New(handler)
+	r.reporter.setLogger(slog.New(fileHandler))
+	return func() error {
+		r.logger = discardLogger
+		r.reporter.setLogger(discardLogger)
+		return file.Close()
+	}, nil
+}
+
+// LogOptions configures the log file of a run of Sync, Watch, Dedupe or
+// RunDaemon.
+type LogOptions struct {
+	// Path is the log file. When it is empty, the log is written to
+	// LogFileName in LogDirName in the destination, or in the user cache
+	// directory for a remote destination.
+	Path string
+
+	// Verbose also writes the debug records to stderr.
+	Verbose bool
+
+	// Attrs are added to the record of the start of the run, e.g. the
+	// version of the program.
+	Attrs []any
+}
+
+// openLog configures logging for the run on the destination dir like
+// configureLogging, if opts isn't nil, and records that the operation
+// started. Runs open their log once the destination is checked and locked,
+// so that a run that is refused doesn't write anything to the destination.
+func (r *run) openLog(opts *LogOptions, dir, operation string, attrs ...any) (func() error, error) {
+	if opts == nil {
+		return func() error { return nil }, nil
+	}
+	if IsRemote(dir) {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(cacheDir, "sync-and-transcode-music-files")
+	}
+
+	closeLog, err := r.configureLogging(dir, opts.Path, opts.Verbose)
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Info("starting "+operation, append(append([]any(nil), opts.Attrs...), attrs...)...)
+	return closeLog, nil
+}
+
+// logEvent records an event in the log file. Plan items and progress are
+// debug records, warnings and errors have their own levels and everything
+// else is informational.
+func logEvent(logger *slog.Logger, e Event) {
+	level := slog.LevelInfo
+	switch e.Type {
+	case EventPlan, EventStart, EventProgress:
+		level = slog.LevelDebug
+	case EventWarning:
+		level = slog.LevelWarn
+	case EventError:
+		level = slog.LevelError
+	}
+
+	attrs := []slog.Attr{slog.String("operation", e.Operation)}
+	for _, field := range [][2]string{{"path", e.Path}, {"source", e.Source}, {"destination", e.Destination}, {"message", e.Message}, {"error", e.Error}, {"ffmpeg_stderr", e.ffmpegStderr}} {
+		if field[1] != "" {
+			attrs = append(attrs, slog.String(field[0], field[1]))
+		}
+	}
+	if e.DryRun {
+		attrs = append(attrs, slog.Bool("dry_run", true))
+	}
+	if e.Total > 0 {
+		attrs = append(attrs, slog.Int("done", e.Done), slog.Int("total", e.Total))
+	}
+	if len(e.Counts) > 0 {
+		attrs = append(attrs, slog.Any("counts", e.Counts))
+	}
+
+	logger.LogAttrs(context.Background(), level, e.Type, attrs...)
+}
+
+// ffmpegError is an error from running ffmpeg or ffprobe, along with the end
+// of what it printed to stderr.
+type ffmpegError struct {
+	err    error
+	stderr string
+}
+
+// newFFmpegError returns an ffmpegError keeping the last maxFFmpegStderr
+// bytes of stderr.
+func newFFmpegError(err error, stderr string) *ffmpegError {
+	stderr = strings.TrimSpace(stderr)
+	if len(stderr) > maxFFmpegStderr {
+		stderr = stderr[len(stderr)-maxFFmpegStderr:]
+	}
+	return &ffmpegError{err: err, stderr: stderr}
+}
+
+// Error returns the message of the underlying error.
+func (e *ffmpegError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ffmpegError) Unwrap() error {
+	return e.err
+}
+
+// ffmpegStderr returns the ffmpeg output attached to an error, if any.
+func ffmpegStderr(err error) string {
+	var ffErr *ffmpegError
+	if errors.As(err, &ffErr) {
+		return ffErr.stderr
+	}
+	return ""
+}
+
+// rotatingFile is a log file that is renamed to a numbered backup when it
+// grows beyond maxSize. The oldest backup is removed.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// openRotatingFile opens the log file at path for appending, creating its
+// directory.
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the current log file and records its size.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write appends to the log file, rotating it first if the write would make
+// it larger than maxSize.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups up by one, moves the current file to the first
+// backup and starts a new file.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.backups))
+	for i := f.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.backups > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+
+	return f.open()
+}
+
+// Close closes the log file.
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
@@ -0,0 +1,117 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigureLogging_WritesEventsToLogFile(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-logging")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	r, events := recordEvents(nil)
+	closeLog, err := r.configureLogging(tempDir, "", false)
+	assert.NoError(t, err)
+
+	r.reporter.emit(Event{Type: EventFinished, Operation: "copy", Destination: "/usb/Song.mp3"})
+	r.reporter.fail("transcode", "/music/Broken.m4a", newFFmpegError(errors.New("exit status 1"), "Invalid data found when processing input\n"))
+	r.logger.Debug("copying file", "source", "/music/Song.mp3")
+	assert.NoError(t, closeLog())
+
+	// The events are still passed to the handler
+	assert.Len(t, events(), 2)
+
+	data, err := os.ReadFile(filepath.Join(tempDir, LogDirName, LogFileName))
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 3)
+
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &record))
+	assert.Equal(t, "ERROR", record["level"])
+	assert.Equal(t, "error", record["msg"])
+	assert.Equal(t, "/music/Broken.m4a", record["path"])
+	assert.Equal(t, "Invalid data found when processing input", record["ffmpeg_stderr"])
+
+	assert.NoError(t, json.Unmarshal([]byte(lines[2]), &record))
+	assert.Equal(t, "DEBUG", record["level"])
+	assert.Equal(t, "copying file", record["msg"])
+}
+
+func TestSync_OpensLogOnceLocked(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-run-log")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	destinationDir := filepath.Join(tempDir, "destination")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "a.mp3"), []byte("audio"), 0644)
+	opts := Options{Sources: []string{sourceDir}, Destination: destinationDir, Transcoder: newFakeTranscoder(), Log: &LogOptions{Attrs: []any{"version", "test"}}}
+
+	// A run that can't lock the destination doesn't log to it
+	lock, err := newRun(nil, nil).acquireDestinationLock(destinationDir, false)
+	assert.NoError(t, err)
+	_, err = Sync(context.Background(), opts)
+	assert.Error(t, err)
+	assert.NoDirExists(t, filepath.Join(destinationDir, LogDirName))
+	lock.release()
+
+	_, err = Sync(context.Background(), opts)
+	assert.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(destinationDir, LogDirName, LogFileName))
+	assert.NoError(t, err)
+	var record map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(strings.SplitN(string(data), "\n", 2)[0]), &record))
+	assert.Equal(t, "starting sync", record["msg"])
+	assert.Equal(t, "test", record["version"])
+}
+
+func TestRotatingFile(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-rotating-file")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "logs", "sync.log")
+	file, err := openRotatingFile(path, 10, 2)
+	assert.NoError(t, err)
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := file.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, file.Close())
+
+	// Each line exceeds the limit together with the previous one, and only
+	// two backups are kept
+	current, _ := os.ReadFile(path)
+	backup1, _ := os.ReadFile(path + ".1")
+	backup2, _ := os.ReadFile(path + ".2")
+	assert.Equal(t, "fourth\n", string(current))
+	assert.Equal(t, "third\n", string(backup1))
+	assert.Equal(t, "second\n", string(backup2))
+	assert.NoFileExists(t, path+".3")
+}
+
+func TestNewFFmpegError(t *testing.T) {
+	err := newFFmpegError(errors.New("exit status 1"), strings.Repeat("x", maxFFmpegStderr)+"the actual error")
+
+	assert.Equal(t, "exit status 1", err.Error())
+	assert.Len(t, err.stderr, maxFFmpegStderr)
+	assert.True(t, strings.HasSuffix(ffmpegStderr(err), "the actual error"))
+	assert.Empty(t, ffmpegStderr(errors.New("other")))
+}
@@ -0,0 +1,280 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/xfrr/goffmpeg/pkg/duration"
+)
+
+// defaultTargetLoudness is the ReplayGain 2.0 reference level in LUFS.
+const defaultTargetLoudness = -18.0
+
+// truePeakHeadroom is the minimum distance in dB kept between the true peak
+// and full scale when gain is applied to the audio.
+const truePeakHeadroom = 1.0
+
+// LoudnessSettings configures loudness normalization for a profile.
+//
+// Mode "tags" writes ReplayGain tags into the output MP3s so that players can
+// adjust the volume. Mode "apply" changes the volume of the audio itself, for
+// players such as car head units that ignore ReplayGain tags. When Album is
+// set, every track of an album gets the same gain so that the relative levels
+// within the album are preserved.
+type LoudnessSettings struct {
+	Mode       string  `yaml:"mode"`
+	Album      bool    `yaml:"album"`
+	TargetLUFS float64 `yaml:"target_lufs"`
+}
+
+// LoudnessMeasurement is the EBU R128 integrated loudness (LUFS), true peak
+// (dBTP) and duration (seconds) of a track or album.
+type LoudnessMeasurement struct {
+	Integrated float64
+	TruePeak   float64
+	Duration   float64
+}
+
+// replayGain is the gain in dB and linear peak to tag or apply for a track.
+type replayGain struct {
+	trackGain float64
+	trackPeak float64
+	albumGain float64
+	albumPeak float64
+	hasAlbum  bool
+}
+
+// enabled reports whether loudness normalization is turned on.
+func (s LoudnessSettings) enabled() bool {
+	return s.Mode == "tags" || s.Mode == "apply"
+}
+
+// validate checks that the mode is "tags", "apply" or unset.
+func (s LoudnessSettings) validate() error {
+	if s.Mode != "" && !s.enabled() {
+		return fmt.Errorf("unknown mode %q, expected tags or apply", s.Mode)
+	}
+	return nil
+}
+
+// target returns the target loudness, using the ReplayGain 2.0 reference
+// level when none is configured.
+func (s LoudnessSettings) target() float64 {
+	if s.TargetLUFS == 0 {
+		return defaultTargetLoudness
+	}
+	return s.TargetLUFS
+}
+
+var (
+	ebur128IntegratedPattern = regexp.MustCompile(`(?s)Integrated loudness:.*?I:\s+(-?[\d.]+|-inf) LUFS`)
+	ebur128TruePeakPattern   = regexp.MustCompile(`(?s)True peak:.*?Peak:\s+(-?[\d.]+|-inf) dBFS`)
+	ffmpegDurationPattern    = regexp.MustCompile(`Duration: (\d+:\d+:[\d.]+)`)
+)
+
+// measureLoudness runs ffmpeg's ebur128 filter on the file at the specified
+// path and returns its integrated loudness, true peak and duration.
+func measureLoudness(path string) (LoudnessMeasurement, error) {
+	return measureLoudnessWith("ffmpeg", path)
+}
+
+// measureLoudnessWith is measureLoudness using the ffmpeg executable at
+// ffmpegPath.
+func measureLoudnessWith(ffmpegPath, path string) (LoudnessMeasurement, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(ffmpegPath, "-hide_banner", "-nostats", "-i", path, "-af", "ebur128=peak=true", "-f", "null", "-")
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return LoudnessMeasurement{}, newFFmpegError(fmt.Errorf("failed to measure loudness of %s: %v", path, err), stderr.String())
+	}
+
+	return parseEBUR128Summary(stderr.String())
+}
+
+// parseEBUR128Summary extracts the loudness measurement from the summary that
+// ffmpeg's ebur128 filter prints to stderr.
+func parseEBUR128Summary(output string) (LoudnessMeasurement, error) {
+	integrated := ebur128IntegratedPattern.FindStringSubmatch(output)
+	truePeak := ebur128TruePeakPattern.FindStringSubmatch(output)
+	if integrated == nil || truePeak == nil {
+		return LoudnessMeasurement{}, fmt.Errorf("ebur128 summary not found in ffmpeg output")
+	}
+
+	measurement := LoudnessMeasurement{
+		Integrated: parseDecibels(integrated[1]),
+		TruePeak:   parseDecibels(truePeak[1]),
+	}
+	if match := ffmpegDurationPattern.FindStringSubmatch(output); match != nil {
+		measurement.Duration = duration.DurToSec(match[1])
+	}
+
+	return measurement, nil
+}
+
+// parseDecibels parses a dB value as printed by ffmpeg, including "-inf" for
+// digital silence.
+func parseDecibels(value string) float64 {
+	if value == "-inf" {
+		return math.Inf(-1)
+	}
+	db, _ := strconv.ParseFloat(value, 64)
+	return db
+}
+
+// albumLoudness combines the measurements of the tracks of an album. The
+// integrated loudness is the duration-weighted energy average of the tracks,
+// and the true peak is the highest track peak.
+func albumLoudness(tracks []LoudnessMeasurement) LoudnessMeasurement {
+	album := LoudnessMeasurement{TruePeak: math.Inf(-1)}
+
+	energy := 0.0
+	for _, track := range tracks {
+		weight := track.Duration
+		if weight <= 0 {
+			weight = 1
+		}
+		energy += weight * math.Pow(10, track.Integrated/10)
+		album.Duration += weight
+		album.TruePeak = math.Max(album.TruePeak, track.TruePeak)
+	}
+
+	album.Integrated = math.Inf(-1)
+	if energy > 0 {
+		album.Integrated = 10 * math.Log10(energy/album.Duration)
+	}
+	return album
+}
+
+// gainForTarget returns the gain in dB that brings a measurement to the target
+// loudness. Silent tracks get no gain.
+func gainForTarget(measurement LoudnessMeasurement, target float64) float64 {
+	if math.IsInf(measurement.Integrated, -1) {
+		return 0
+	}
+	return target - measurement.Integrated
+}
+
+// peakToLinear converts a peak in dB to a linear sample value, as used by the
+// REPLAYGAIN_*_PEAK tags.
+func peakToLinear(peak float64) float64 {
+	return math.Pow(10, peak/20)
+}
+
+// analyzeLoudness measures the loudness of the files that are about to be
+// transcoded and computes their ReplayGain values. In album mode every music
+// file in the source folder of a planned file is measured, including files
+// that were synced in an earlier run, so that the album gain matches for all
+// tracks of the album.
+//
+// Files are measured with the transcoder of the run. Files that can't be
+// measured are reported and left out of the result.
+func (r *run) analyzeLoudness(sourceDir string, files []fileToTranscode, settings LoudnessSettings) map[string]replayGain {
+	r.reporter.emit(Event{Type: EventStart, Operation: "analyze-loudness", Total: len(files)})
+
+	measurements := make(map[string]LoudnessMeasurement)
+	measureOnce := func(path string) (LoudnessMeasurement, bool) {
+		if measurement, ok := measurements[path]; ok {
+			return measurement, true
+		}
+		measurement, err := r.transcoder.MeasureLoudness(path)
+		if err != nil {
+			r.reporter.fail("analyze-loudness", path, err)
+			return measurement, false
+		}
+		measurements[path] = measurement
+		return measurement, true
+	}
+
+	albums := make(map[string]LoudnessMeasurement)
+	if settings.Album {
+		albumDirs := make(map[string]bool)
+		for _, file := range files {
+			albumDirs[filepath.Dir(filepath.Join(sourceDir, file.sourcePath))] = true
+		}
+
+		for _, dir := range sortedKeys(albumDirs) {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				r.reporter.fail("analyze-loudness", dir, err)
+				continue
+			}
+
+			var tracks []LoudnessMeasurement
+			for _, entry := range entries {
+				name := entry.Name()
+				if entry.IsDir() || !isMusicFile(name) {
+					continue
+				}
+				if measurement, ok := measureOnce(filepath.Join(dir, name)); ok {
+					tracks = append(tracks, measurement)
+				}
+			}
+			if len(tracks) > 0 {
+				albums[dir] = albumLoudness(tracks)
+			}
+		}
+	}
+
+	gains := make(map[string]replayGain)
+	sorted := append([]fileToTranscode{}, files...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a].sourcePath < sorted[b].sourcePath })
+	for _, file := range sorted {
+		path := filepath.Join(sourceDir, file.sourcePath)
+		track, ok := measureOnce(path)
+		if !ok {
+			continue
+		}
+
+		gain := replayGain{
+			trackGain: gainForTarget(track, settings.target()),
+			trackPeak: peakToLinear(track.TruePeak),
+		}
+		if album, ok := albums[filepath.Dir(path)]; ok {
+			gain.albumGain = gainForTarget(album, settings.target())
+			gain.albumPeak = peakToLinear(album.TruePeak)
+			gain.hasAlbum = true
+		}
+		gains[file.sourcePath] = gain
+	}
+
+	return gains
+}
+
+// loudnessTranscodeOptions returns the transcoding options that tag or apply
+// the ReplayGain values for a file.
+func loudnessTranscodeOptions(gain replayGain, settings LoudnessSettings) TranscodeOptions {
+	switch settings.Mode {
+	case "tags":
+		tags := map[string]string{
+			"REPLAYGAIN_TRACK_GAIN": fmt.Sprintf("%.2f dB", gain.trackGain),
+			"REPLAYGAIN_TRACK_PEAK": fmt.Sprintf("%.6f", gain.trackPeak),
+		}
+		if gain.hasAlbum {
+			tags["REPLAYGAIN_ALBUM_GAIN"] = fmt.Sprintf("%.2f dB", gain.albumGain)
+			tags["REPLAYGAIN_ALBUM_PEAK"] = fmt.Sprintf("%.6f", gain.albumPeak)
+		}
+		return TranscodeOptions{Tags: tags}
+
+	case "apply":
+		db, peak := gain.trackGain, gain.trackPeak
+		if settings.Album && gain.hasAlbum {
+			db, peak = gain.albumGain, gain.albumPeak
+		}
+
+		// Don't raise the volume so far that the true peak clips
+		if peak > 0 {
+			db = math.Min(db, -20*math.Log10(peak)-truePeakHeadroom)
+		}
+		return TranscodeOptions{AudioFilter: fmt.Sprintf("volume=%.2fdB", db)}
+	}
+
+	return TranscodeOptions{}
+}
@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const ebur128Output = `Input #0, lavfi, from 'sine=frequency=1000:duration=5':
+  Duration: 00:03:25.12, start: 0.000000, bitrate: N/A
+[Parsed_ebur128_0 @ 0x600003a1c000] Summary:
+
+  Integrated loudness:
+    I:         -16.3 LUFS
+    Threshold: -26.6 LUFS
+
+  Loudness range:
+    LRA:         5.3 LU
+    Threshold: -36.6 LUFS
+    LRA low:   -20.5 LUFS
+    LRA high:  -15.2 LUFS
+
+  True peak:
+    Peak:       -0.4 dBFS
+`
+
+func TestParseEBUR128Summary(t *testing.T) {
+	measurement, err := parseEBUR128Summary(ebur128Output)
+	assert.NoError(t, err)
+	assert.Equal(t, -16.3, measurement.Integrated)
+	assert.Equal(t, -0.4, measurement.TruePeak)
+	assert.InDelta(t, 205.12, measurement.Duration, 0.001)
+}
+
+func TestParseEBUR128Summary_Silence(t *testing.T) {
+	measurement, err := parseEBUR128Summary("Integrated loudness:\n    I:         -inf LUFS\n  True peak:\n    Peak:       -inf dBFS\n")
+	assert.NoError(t, err)
+	assert.True(t, math.IsInf(measurement.Integrated, -1))
+	assert.Equal(t, 0.0, gainForTarget(measurement, defaultTargetLoudness))
+}
+
+func TestParseEBUR128Summary_MissingSummary(t *testing.T) {
+	_, err := parseEBUR128Summary("Error opening input file")
+	assert.Error(t, err)
+}
+
+func TestAlbumLoudness(t *testing.T) {
+	album := albumLoudness([]LoudnessMeasurement{
+		{Integrated: -10, TruePeak: -1, Duration: 100},
+		{Integrated: -20, TruePeak: -3, Duration: 100},
+	})
+
+	// Energy average of -10 and -20 LUFS is dominated by the louder track
+	assert.InDelta(t, -12.6, album.Integrated, 0.01)
+	assert.Equal(t, -1.0, album.TruePeak)
+	assert.Equal(t, 200.0, album.Duration)
+}
+
+func TestAnalyzeLoudness_AlbumMode(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-loudness")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	albumDir := filepath.Join(tempDir, "Album")
+	os.MkdirAll(albumDir, 0755)
+	for _, name := range []string{"01.m4a", "02.m4a", "cover.jpg"} {
+		os.WriteFile(filepath.Join(albumDir, name), []byte{}, 0644)
+	}
+
+	fake := newFakeTranscoder()
+	fake.setLoudness(filepath.Join(albumDir, "01.m4a"), LoudnessMeasurement{Integrated: -14, TruePeak: -1, Duration: 60})
+	fake.setLoudness(filepath.Join(albumDir, "02.m4a"), LoudnessMeasurement{Integrated: -14, TruePeak: -2, Duration: 60})
+
+	// Only the first track is new, but the album gain must include both
+	files := []fileToTranscode{{sourcePath: "/Album/01.m4a", destinationPath: "/Album/01.mp3"}}
+	gains := newRun(nil, fake).analyzeLoudness(tempDir, files, LoudnessSettings{Mode: "tags", Album: true})
+
+	assert.Len(t, gains, 1)
+	gain := gains["/Album/01.m4a"]
+	assert.InDelta(t, -4.0, gain.trackGain, 0.001)
+	assert.True(t, gain.hasAlbum)
+	assert.InDelta(t, -4.0, gain.albumGain, 0.001)
+	assert.InDelta(t, peakToLinear(-1), gain.albumPeak, 0.0001)
+
+	// Each file is measured only once
+	assert.ElementsMatch(t, []string{filepath.Join(albumDir, "01.m4a"), filepath.Join(albumDir, "02.m4a")}, fake.measuredFiles())
+}
+
+func TestLoudnessTranscodeOptions(t *testing.T) {
+	gain := replayGain{trackGain: -4.5, trackPeak: 0.9, albumGain: 6, albumPeak: peakToLinear(-3), hasAlbum: true}
+
+	t.Run("Tags mode writes ReplayGain tags", func(t *testing.T) {
+		opts := loudnessTranscodeOptions(gain, LoudnessSettings{Mode: "tags"})
+		assert.Equal(t, map[string]string{
+			"REPLAYGAIN_TRACK_GAIN": "-4.50 dB",
+			"REPLAYGAIN_TRACK_PEAK": "0.900000",
+			"REPLAYGAIN_ALBUM_GAIN": "6.00 dB",
+			"REPLAYGAIN_ALBUM_PEAK": "0.707946",
+		}, opts.Tags)
+		assert.Empty(t, opts.AudioFilter)
+	})
+
+	t.Run("Apply mode uses the track gain", func(t *testing.T) {
+		opts := loudnessTranscodeOptions(gain, LoudnessSettings{Mode: "apply"})
+		assert.Equal(t, "volume=-4.50dB", opts.AudioFilter)
+	})
+
+	t.Run("Apply mode in album mode limits gain to avoid clipping", func(t *testing.T) {
+		opts := loudnessTranscodeOptions(gain, LoudnessSettings{Mode: "apply", Album: true})
+		assert.Equal(t, "volume=2.00dB", opts.AudioFilter)
+	})
+
+	t.Run("Off does nothing", func(t *testing.T) {
+		assert.False(t, loudnessTranscodeOptions(gain, LoudnessSettings{}).needsTranscoding())
+	})
+}
@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// findOrphanedFiles returns the music files in the destination list that are
+// not the destination of any planned file, i.e. whose source file was renamed
+// or deleted. When foldCase is set, names are compared regardless of case.
+func findOrphanedFiles(plannedFiles []fileToTranscode, destinationFiles []string, foldCase bool) []string {
+	planned := newDestinationNames(nil, foldCase)
+	for _, file := range plannedFiles {
+		planned.add(file.destinationPath)
+	}
+
+	var orphans []string
+	for _, file := range destinationFiles {
+		if strings.HasPrefix(filepath.Base(file), "._") || !isMusicFile(file) {
+			continue
+		}
+		if !planned.contains(file) {
+			orphans = append(orphans, file)
+		}
+	}
+	return orphans
+}
+
+// removeOrphanedFiles moves the music files in the destination directory that
+// no longer have a file in any of the source directories to the trash. As a
+// safeguard against an unmounted or empty source, nothing is removed when a
+// source directory has no music files at all.
+//
+// A dry run only reports what would be moved to the trash; the moves are
+// made on a simulation of the destination.
+func (r *run) removeOrphanedFiles(sourceDirs []string, destination string, prof Profile, dryRun bool) error {
+	destinationFS, destinationDir, err := r.openDestination(destination)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		// The destination of a dry run may not have been created yet
+		destinationFS = newDryRunFS(destinationFS)
+		if err := destinationFS.MkdirAll(".", 0755); err != nil {
+			return err
+		}
+	}
+
+	sources := make([]*syncSource, len(sourceDirs))
+	files := make([][]string, len(sourceDirs))
+	for i, sourceDir := range sourceDirs {
+		if sources[i], err = r.listSource(sourceDir, destination, prof.Links); err != nil {
+			return err
+		}
+		files[i] = sources[i].index.files()
+	}
+	plannedFiles := plannedTree(r.planSources(sources, files, nil, prof))
+
+	// A source without music files has nothing that passes the filters
+	emptySource := ""
+	for i, sourceDir := range sourceDirs {
+		if len(filterPlannedFiles(planDestinationFiles(files[i]), prof)) == 0 {
+			emptySource = sourceDir
+		}
+	}
+
+	destinationFiles, err := getFilenames(destinationFS, ".")
+	if err != nil {
+		return err
+	}
+
+	orphans := findOrphanedFiles(plannedFiles, destinationFiles, prof.CaseInsensitive)
+	if len(orphans) == 0 {
+		return nil
+	}
+	if emptySource != "" {
+		return fmt.Errorf("source directory %s has no music files, not removing %d files from the destination", emptySource, len(orphans))
+	}
+
+	trash := newTrash(destinationFS, destinationDir, time.Now())
+	counts := make(map[string]int)
+	for _, orphan := range orphans {
+		path := filepath.Join(destinationDir, orphan)
+		if trashed, err := trash.remove(path); err != nil {
+			r.reporter.fail("remove-orphan", path, err)
+			counts["failed"]++
+		} else if dryRun {
+			r.reporter.emit(Event{Type: EventFinished, Operation: "remove-orphan", Path: path, Destination: trashed, DryRun: true})
+			counts["would_remove"]++
+		} else {
+			r.reporter.emit(Event{Type: EventFinished, Operation: "remove-orphan", Path: path, Destination: trashed})
+			counts["removed"]++
+		}
+	}
+
+	r.reporter.emit(Event{Type: EventSummary, Operation: "mirror", Counts: counts})
+	return nil
+}
@@ -0,0 +1,70 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindOrphanedFiles(t *testing.T) {
+	planned := []fileToTranscode{
+		{sourcePath: "/Artist/Song.m4a", destinationPath: "/Artist/Song.mp3"},
+		{sourcePath: "/Artist/Other.mp3", destinationPath: "/Artist/Other.mp3"},
+	}
+	destination := []string{"/Artist/Song.mp3", "/Artist/Other.mp3", "/Artist/Renamed.mp3", "/Artist/cover.jpg", "/Artist/._Song.mp3"}
+
+	assert.Equal(t, []string{"/Artist/Renamed.mp3"}, findOrphanedFiles(planned, destination, false))
+
+	// On a case-insensitive device, a file in another case isn't an orphan
+	destination = []string{"/artist/song.mp3", "/Artist/OTHER.MP3"}
+	assert.Equal(t, []string{"/artist/song.mp3", "/Artist/OTHER.MP3"}, findOrphanedFiles(planned, destination, false))
+	assert.Empty(t, findOrphanedFiles(planned, destination, true))
+}
+
+func TestRemoveOrphanedFiles(t *testing.T) {
+	r := newRun(nil, nil)
+	tempDir, err := os.MkdirTemp("", "test-mirror")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	destinationDir := filepath.Join(tempDir, "destination")
+	for _, path := range []string{"source/Artist/Song.mp3", "destination/Artist/Song.mp3", "destination/Artist/Old Name.mp3"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(tempDir, path)), 0755)
+		os.WriteFile(filepath.Join(tempDir, path), []byte("audio"), 0644)
+	}
+
+	err = r.removeOrphanedFiles([]string{sourceDir}, destinationDir, DefaultProfile(), false)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(destinationDir, "Artist", "Song.mp3"))
+	assert.NoFileExists(t, filepath.Join(destinationDir, "Artist", "Old Name.mp3"))
+
+	// The removed file can be restored from the trash
+	restored, err := r.restoreTrashSession(newTrash(newOSFS(destinationDir), destinationDir, time.Now()), "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored)
+}
+
+func TestRemoveOrphanedFiles_EmptySource(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-mirror-empty")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	destinationDir := filepath.Join(tempDir, "destination")
+	os.MkdirAll(sourceDir, 0755)
+	os.MkdirAll(destinationDir, 0755)
+	os.WriteFile(filepath.Join(destinationDir, "Song.mp3"), []byte("audio"), 0644)
+
+	// An empty source, e.g. an unmounted drive, doesn't wipe the destination
+	err = newRun(nil, nil).removeOrphanedFiles([]string{sourceDir}, destinationDir, DefaultProfile(), false)
+	assert.Error(t, err)
+	assert.FileExists(t, filepath.Join(destinationDir, "Song.mp3"))
+}
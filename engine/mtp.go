@@ -0,0 +1,264 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// gioCommand runs the gio tool of GLib, which reaches MTP devices through
+// GVfs.
+var gioCommand = []string{"gio"}
+
+// mtpFS is a writableFS on a phone or player that is attached by USB and
+// speaks MTP instead of being mounted, e.g. an Android phone. It runs gio,
+// so GVfs has to be running, as it is in most Linux desktops. It is rooted at
+// a directory on the device, whose path starts with the storage, e.g.
+// "/Internal shared storage/Music".
+type mtpFS struct {
+	// device is the host of mtp:// URIs for the device, as listed by
+	// `gio mount -li`
+	device string
+	root   string
+	logger *slog.Logger
+}
+
+// newMTPFS returns the filesystem of an mtp:// URL, rooted at the directory
+// root on the device, which logs the commands it runs to logger.
+func newMTPFS(u *url.URL, root string, logger *slog.Logger) *mtpFS {
+	return &mtpFS{device: u.Host, root: root, logger: logger}
+}
+
+// uri returns the URI of a name on the device.
+func (m *mtpFS) uri(name string) string {
+	return (&url.URL{Scheme: "mtp", Host: m.device, Path: remotePath(m.root, name)}).String()
+}
+
+// run runs a gio subcommand for a name and returns its output.
+func (m *mtpFS) run(op, name string, args ...string) (string, error) {
+	if err := checkName(op, name); err != nil {
+		return "", err
+	}
+	args = append(append([]string(nil), gioCommand[1:]...), args...)
+	cmd := exec.Command(gioCommand[0], args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	m.logger.Debug("running gio", "device", m.device, "args", args)
+
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if strings.Contains(message, "No such file") || strings.Contains(message, "not found") {
+			return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if message == "" {
+			message = err.Error()
+		}
+		return "", &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("gio on mtp://%s: %s", m.device, message)}
+	}
+	return stdout.String(), nil
+}
+
+// info returns the attributes that `gio info` prints for a name, keyed by
+// attribute name.
+func (m *mtpFS) info(op, name string, args ...string) (map[string]string, error) {
+	output, err := m.run(op, name, append(append([]string{"info"}, args...), m.uri(name))...)
+	if err != nil {
+		return nil, err
+	}
+	return parseGioAttributes(output), nil
+}
+
+// parseGioAttributes returns the "  name: value" lines in the attributes
+// section of `gio info` output.
+func parseGioAttributes(output string) map[string]string {
+	attributes := make(map[string]string)
+	inAttributes := false
+	for _, line := range strings.Split(output, "\n") {
+		if line == "attributes:" {
+			inAttributes = true
+			continue
+		}
+		if !inAttributes || !strings.HasPrefix(line, "  ") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ": ")
+		if ok {
+			attributes[key] = value
+		}
+	}
+	return attributes
+}
+
+// parseGioList returns the entries of `gio list -l` output, which has a line
+// "name<TAB>size<TAB>(type)" for every file.
+func parseGioList(output string) []fs.DirEntry {
+	var entries []fs.DirEntry
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		info := remoteFileInfo{name: fields[0], dir: fields[2] == "(directory)"}
+		info.size, _ = strconv.ParseInt(fields[1], 10, 64)
+		entries = append(entries, info)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+// Stat returns the file information of the named file.
+func (m *mtpFS) Stat(name string) (fs.FileInfo, error) {
+	attributes, err := m.info("stat", name, "-a", "standard::type,standard::size")
+	if err != nil {
+		return nil, err
+	}
+	// Type 2 is G_FILE_TYPE_DIRECTORY
+	info := remoteFileInfo{name: path.Base(remotePath(m.root, name)), dir: attributes["standard::type"] == "2"}
+	info.size, _ = strconv.ParseInt(attributes["standard::size"], 10, 64)
+	return info, nil
+}
+
+// readDirConcurrency lists one directory at a time, because MTP devices
+// handle one request at a time anyway.
+func (m *mtpFS) readDirConcurrency() int {
+	return 1
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (m *mtpFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	output, err := m.run("readdir", name, "list", "-l", m.uri(name))
+	if err != nil {
+		return nil, err
+	}
+	return parseGioList(output), nil
+}
+
+// Open copies the named file to a temporary file and opens that for
+// reading. The temporary file is removed when it is closed.
+func (m *mtpFS) Open(name string) (fs.File, error) {
+	temp, err := os.CreateTemp("", "mtp-download-*")
+	if err != nil {
+		return nil, err
+	}
+	temp.Close()
+	if _, err := m.run("open", name, "copy", "-T", m.uri(name), temp.Name()); err != nil {
+		os.Remove(temp.Name())
+		return nil, err
+	}
+
+	file, err := os.Open(temp.Name())
+	if err != nil {
+		os.Remove(temp.Name())
+		return nil, err
+	}
+	return &tempDownload{File: file}, nil
+}
+
+// upload returns a function that copies a temporary file to the named path on
+// the device.
+func (m *mtpFS) upload(name string) func(string) error {
+	return func(temp string) error {
+		_, err := m.run("create", name, "copy", "-T", temp, m.uri(name))
+		return err
+	}
+}
+
+// Create creates or replaces the named file. The contents are written to a
+// temporary file, which is copied to the device when it is closed.
+func (m *mtpFS) Create(name string) (writableFile, error) {
+	temp, err := os.CreateTemp("", "mtp-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	return &stagedUpload{File: temp, upload: m.upload(name)}, nil
+}
+
+// Append opens the named file for appending. The file is copied from the
+// device, if it exists, and copied back with the new contents when it is
+// closed.
+func (m *mtpFS) Append(name string) (writableFile, error) {
+	existing, err := fs.ReadFile(m, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	file, err := m.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(existing); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// MkdirAll creates the named directory and any missing parents.
+func (m *mtpFS) MkdirAll(name string, perm fs.FileMode) error {
+	if info, err := m.Stat(name); err == nil && info.IsDir() {
+		return nil
+	}
+	_, err := m.run("mkdir", name, "mkdir", "-p", m.uri(name))
+	return err
+}
+
+// Remove removes the named file or empty directory.
+func (m *mtpFS) Remove(name string) error {
+	_, err := m.run("remove", name, "remove", m.uri(name))
+	return err
+}
+
+// RemoveAll removes the named file or directory with everything in it. A
+// missing name is not an error.
+func (m *mtpFS) RemoveAll(name string) error {
+	info, err := m.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		entries, err := m.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := m.RemoveAll(path.Join(name, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return m.Remove(name)
+}
+
+// Rename moves a file, replacing any file at the new name.
+func (m *mtpFS) Rename(oldName, newName string) error {
+	if err := m.Remove(newName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	_, err := m.run("rename", oldName, "move", "-T", m.uri(oldName), m.uri(newName))
+	return err
+}
+
+// freeSpace returns the free space of the storage that dir is on.
+func (m *mtpFS) freeSpace(dir string) (int64, error) {
+	attributes, err := m.info("freespace", dir, "-f", "-a", "filesystem::free")
+	if err != nil {
+		return 0, err
+	}
+	free, err := strconv.ParseInt(attributes["filesystem::free"], 10, 64)
+	if err != nil {
+		return 0, errFreeSpaceUnknown
+	}
+	return free, nil
+}
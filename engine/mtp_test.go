@@ -0,0 +1,206 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFakeGioProcess isn't a real test. It runs as a fake gio for the other
+// tests when FAKE_GIO_ROOT is set, serving the files in that directory as
+// the MTP device.
+func TestFakeGioProcess(t *testing.T) {
+	root := os.Getenv("FAKE_GIO_ROOT")
+	if root == "" {
+		return
+	}
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	os.Exit(runFakeGio(root, args, os.Stdout, os.Stderr))
+}
+
+// useFakeGio makes mtp destinations run the fake gio on root, with the given
+// free space. Returns a function that restores the real gio.
+func useFakeGio(root string, free int64) func() {
+	original := gioCommand
+	gioCommand = []string{os.Args[0], "-test.run=^TestFakeGioProcess$", "--"}
+	os.Setenv("FAKE_GIO_ROOT", root)
+	os.Setenv("FAKE_GIO_FREE", fmt.Sprint(free))
+	return func() {
+		gioCommand = original
+		os.Unsetenv("FAKE_GIO_ROOT")
+		os.Unsetenv("FAKE_GIO_FREE")
+	}
+}
+
+// runFakeGio runs a gio subcommand like gio does for MTP devices, with the
+// paths of mtp:// URIs inside root.
+func runFakeGio(root string, args []string, stdout, stderr io.Writer) int {
+	local := func(location string) string {
+		if u, err := url.Parse(location); err == nil && u.Scheme == "mtp" {
+			return filepath.Join(root, filepath.FromSlash(u.Path))
+		}
+		return location
+	}
+	var operands []string
+	var flags []string
+	for i := 1; i < len(args); i++ {
+		switch {
+		case args[i] == "-a":
+			i++
+		case strings.HasPrefix(args[i], "-"):
+			flags = append(flags, args[i])
+		default:
+			operands = append(operands, local(args[i]))
+		}
+	}
+
+	var err error
+	switch args[0] {
+	case "info":
+		var info os.FileInfo
+		if info, err = os.Stat(operands[0]); err == nil {
+			fmt.Fprintf(stdout, "uri: %s\nattributes:\n", args[len(args)-1])
+			if stringInSlice("-f", flags) {
+				fmt.Fprintf(stdout, "  filesystem::free: %s\n", os.Getenv("FAKE_GIO_FREE"))
+			} else {
+				fileType := 1
+				if info.IsDir() {
+					fileType = 2
+				}
+				fmt.Fprintf(stdout, "  standard::type: %d\n  standard::size: %d\n", fileType, info.Size())
+			}
+		}
+	case "list":
+		var entries []os.DirEntry
+		if entries, err = os.ReadDir(operands[0]); err == nil {
+			for _, entry := range entries {
+				info, _ := entry.Info()
+				fileType := "regular"
+				if entry.IsDir() {
+					fileType = "directory"
+				}
+				fmt.Fprintf(stdout, "%s\t%d\t(%s)\n", entry.Name(), info.Size(), fileType)
+			}
+		}
+	case "copy":
+		var data []byte
+		if data, err = os.ReadFile(operands[0]); err == nil {
+			err = os.WriteFile(operands[1], data, 0644)
+		}
+	case "mkdir":
+		err = os.MkdirAll(operands[0], 0755)
+	case "remove":
+		err = os.Remove(operands[0])
+	case "move":
+		err = os.Rename(operands[0], operands[1])
+	default:
+		err = fmt.Errorf("Unknown command %s", args[0])
+	}
+
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("%s: No such file or directory", args[len(args)-1])
+		}
+		fmt.Fprintf(stderr, "gio: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func TestParseGioList(t *testing.T) {
+	entries := parseGioList("Song Title.mp3\t4096\t(regular)\nAlbum\t0\t(directory)\n")
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, "Album", entries[0].Name())
+		assert.True(t, entries[0].IsDir())
+		info, _ := entries[1].Info()
+		assert.Equal(t, "Song Title.mp3", info.Name())
+		assert.Equal(t, int64(4096), info.Size())
+	}
+}
+
+func TestParseGioAttributes(t *testing.T) {
+	output := "uri: mtp://Pixel/Music\nattributes:\n  standard::type: 2\n  filesystem::free: 1024\n"
+	assert.Equal(t, map[string]string{"standard::type": "2", "filesystem::free": "1024"}, parseGioAttributes(output))
+}
+
+func TestMTPFS(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-mtp")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	defer useFakeGio(filepath.Join(tempDir, "phone"), 5000000)()
+
+	fsys, dir, err := newRun(nil, nil).openDestination("mtp://Google_Pixel_7/Internal shared storage/Music")
+	assert.NoError(t, err)
+	assert.Equal(t, "/Internal shared storage/Music", dir)
+	assert.Equal(t, "mtp://Google_Pixel_7/Internal%20shared%20storage/Music", fsys.(*mtpFS).uri("."))
+
+	// Upload creates the missing directories
+	os.WriteFile(filepath.Join(tempDir, "Song Title.mp3"), []byte("audio"), 0644)
+	assert.NoError(t, uploadFile(newOSFS(tempDir), "Song Title.mp3", fsys, "Artist/Song Title.mp3"))
+	data, err := os.ReadFile(filepath.Join(tempDir, "phone", "Internal shared storage", "Music", "Artist", "Song Title.mp3"))
+	assert.NoError(t, err)
+	assert.Equal(t, "audio", string(data))
+
+	names, err := getFilenames(fsys, ".")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/Artist/Song Title.mp3"}, names)
+
+	info, err := fsys.Stat("Artist/Song Title.mp3")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+	assert.False(t, info.IsDir())
+
+	data, err = fs.ReadFile(fsys, "Artist/Song Title.mp3")
+	assert.NoError(t, err)
+	assert.Equal(t, "audio", string(data))
+
+	free, err := fsys.(*mtpFS).freeSpace(".")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5000000), free)
+
+	_, err = fsys.Stat("missing.mp3")
+	assert.True(t, os.IsNotExist(err))
+	assert.NoError(t, fsys.RemoveAll("Artist"))
+	assert.NoDirExists(t, filepath.Join(tempDir, "phone", "Internal shared storage", "Music", "Artist"))
+}
+
+func TestSync_MTP(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-mtp-sync")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	phoneDir := filepath.Join(tempDir, "phone")
+	defer useFakeGio(phoneDir, 100000)()
+
+	sourceDir := filepath.Join(tempDir, "source")
+	for path, size := range map[string]int{"source/Artist/a.mp3": 60000, "source/Artist/b.mp3": 60000, "phone/Music/Old/c.mp3": 5} {
+		os.MkdirAll(filepath.Dir(filepath.Join(tempDir, path)), 0755)
+		os.WriteFile(filepath.Join(tempDir, path), []byte(strings.Repeat("x", size)), 0644)
+	}
+
+	// Only one of the files fits in the free space of the phone
+	report, err := Sync(context.Background(), Options{Sources: []string{sourceDir}, Destination: "mtp://Pixel/Music", Transcoder: newFakeTranscoder()})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"copied": 1, "skipped": 1}, report.Counts["sync"])
+	assert.Len(t, report.Warnings, 1)
+	assert.FileExists(t, filepath.Join(phoneDir, "Music", "Artist", "a.mp3"))
+	assert.NoFileExists(t, filepath.Join(phoneDir, "Music", "Artist", "b.mp3"))
+	assert.FileExists(t, filepath.Join(phoneDir, "Music", "Old", "c.mp3"))
+}
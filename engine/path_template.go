@@ -0,0 +1,211 @@
+package engine
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// templatePlaceholder matches placeholders such as {title}, {track:02} or
+// {albumartist|artist}.
+var templatePlaceholder = regexp.MustCompile(`\{([^{}:]+)(?::(\d+))?\}`)
+
+// repeatedSeparators matches separators left behind by empty placeholders,
+// such as "Artist -  - Album".
+var repeatedSeparators = regexp.MustCompile(`(\s*-\s*){2,}`)
+
+// leadingYear matches the year at the start of a date tag such as
+// "2019-04-12".
+var leadingYear = regexp.MustCompile(`^\d{4}`)
+
+// unsafePathCharacters matches characters that can't be used in filenames on
+// FAT32 and exFAT devices.
+var unsafePathCharacters = regexp.MustCompile(`[/\\<>:"|?*]`)
+
+// renderPathTemplate computes a destination path from tag metadata using a
+// template such as "{albumartist}/{year} - {album}/{disc}-{track:02} {title}".
+//
+// Supported placeholders are albumartist, artist, album, title, year, track,
+// disc, genre and composer. A number after a colon zero-pads the value to
+// that width. Alternatives separated by "|" are tried in order, and the last
+// alternative is used literally if it isn't a known placeholder, e.g.
+// {genre|Misc}.
+//
+// Missing tags fall back to sensible defaults: albumartist to artist, album
+// to the name of the source folder and title to the source filename. Separators
+// left behind by empty values are removed.
+//
+// sourcePath is slash-separated. The returned path has an .mp3 extension, is
+// normalized to ASCII and is slash-separated too. It keeps the leading slash
+// of sourcePath, if any, so it can be compared with paths from getFilenames.
+func renderPathTemplate(template string, tags map[string]string, sourcePath string) string {
+	var segments []string
+	for _, segment := range strings.Split(template, "/") {
+		rendered := templatePlaceholder.ReplaceAllStringFunc(segment, func(placeholder string) string {
+			match := templatePlaceholder.FindStringSubmatch(placeholder)
+			value := ""
+			alternatives := strings.Split(match[1], "|")
+			for i, name := range alternatives {
+				value = templateFieldValue(name, tags, sourcePath)
+				if value == "" && i == len(alternatives)-1 && !isTemplateField(name) {
+					value = name
+				}
+				if value != "" {
+					break
+				}
+			}
+			return padTemplateValue(value, match[2])
+		})
+
+		rendered = repeatedSeparators.ReplaceAllString(rendered, " - ")
+		rendered = strings.Trim(rendered, " -.")
+		if rendered != "" {
+			segments = append(segments, rendered)
+		}
+	}
+
+	if len(segments) == 0 {
+		segments = []string{strings.TrimSuffix(path.Base(sourcePath), path.Ext(sourcePath))}
+	}
+
+	rendered := path.Join(segments...)
+	if strings.HasPrefix(sourcePath, "/") {
+		rendered = "/" + rendered
+	}
+	return convertSourceToDestinationFilename(rendered + ".mp3")
+}
+
+// templateFields lists the placeholders that renderPathTemplate understands.
+var templateFields = []string{"albumartist", "artist", "album", "title", "year", "track", "disc", "genre", "composer"}
+
+// isTemplateField reports whether name is a known placeholder.
+func isTemplateField(name string) bool {
+	return stringInSlice(name, templateFields)
+}
+
+// templateFieldValue returns the value for a placeholder from the tags,
+// including the built-in fallbacks for missing tags. Path separators and
+// characters that are invalid on FAT32 are replaced.
+func templateFieldValue(name string, tags map[string]string, sourcePath string) string {
+	value := ""
+	switch name {
+	case "albumartist":
+		value = firstTag(tags, "album_artist", "albumartist", "album artist", "artist")
+		if value == "" {
+			value = "Unknown Artist"
+		}
+	case "artist":
+		value = firstTag(tags, "artist", "album_artist", "albumartist")
+		if value == "" {
+			value = "Unknown Artist"
+		}
+	case "album":
+		value = firstTag(tags, "album")
+		if value == "" {
+			value = path.Base(path.Dir(sourcePath))
+		}
+		if value == "" || value == "." || value == "/" {
+			value = "Unknown Album"
+		}
+	case "title":
+		value = firstTag(tags, "title")
+		if value == "" {
+			value = strings.TrimSuffix(path.Base(sourcePath), path.Ext(sourcePath))
+		}
+	case "year":
+		value = firstTag(tags, "date", "year", "originaldate")
+		if year := leadingYear.FindString(value); year != "" {
+			value = year
+		}
+	case "track":
+		value = leadingNumber(firstTag(tags, "track", "tracknumber"))
+	case "disc":
+		value = leadingNumber(firstTag(tags, "disc", "discnumber"))
+		if value == "" {
+			value = "1"
+		}
+	case "genre", "composer":
+		value = firstTag(tags, name)
+	}
+
+	return strings.TrimSpace(unsafePathCharacters.ReplaceAllString(value, "-"))
+}
+
+// firstTag returns the first non-empty tag value among the given names.
+func firstTag(tags map[string]string, names ...string) string {
+	for _, name := range names {
+		if value := strings.TrimSpace(tags[name]); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// leadingNumber returns the number before a slash in values such as "3/12".
+func leadingNumber(value string) string {
+	number, _, _ := strings.Cut(value, "/")
+	return strings.TrimSpace(number)
+}
+
+// padTemplateValue zero-pads numeric values to the specified width.
+func padTemplateValue(value, width string) string {
+	if width == "" {
+		return value
+	}
+	n, err := strconv.Atoi(value)
+	w, _ := strconv.Atoi(width)
+	if err != nil {
+		return value
+	}
+	return fmt.Sprintf("%0*d", w, n)
+}
+
+// applyPathTemplate replaces the destination paths of planned files with
+// paths computed from each source file's tags. Tags are read with readTags,
+// by the source path of the file; files whose tags can't be read use the
+// fallbacks of renderPathTemplate.
+//
+// When several source files render to the same destination path, the later
+// ones (in source path order) get a " (2)", " (3)", etc. suffix so that every
+// run assigns the same paths. With foldCase, paths that only differ in case
+// are the same, as on FAT32 and exFAT devices.
+func (r *run) applyPathTemplate(files []fileToTranscode, template string, foldCase bool, readTags func(string) (map[string]string, error)) []fileToTranscode {
+	planned := make([]fileToTranscode, len(files))
+	copy(planned, files)
+	sort.Slice(planned, func(a, b int) bool {
+		return planned[a].sourcePath < planned[b].sourcePath
+	})
+
+	names := newDestinationNames(nil, foldCase)
+	used := make(map[string]int)
+	for i, file := range planned {
+		tags, err := readTags(file.sourcePath)
+		if err != nil {
+			r.reporter.warn("plan", file.sourcePath, fmt.Sprintf("Could not read tags, using fallbacks (%v)", err))
+		}
+
+		destinationPath := renderPathTemplate(template, tags, file.sourcePath)
+		key := names.key(destinationPath)
+		used[key]++
+		if count := used[key]; count > 1 {
+			extension := path.Ext(destinationPath)
+			destinationPath = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(destinationPath, extension), count, extension)
+		}
+		planned[i].destinationPath = destinationPath
+	}
+
+	return planned
+}
+
+// readTagsWithTranscoder returns the tags of a music file, probed with
+// trans.
+func readTagsWithTranscoder(trans Transcoder, path string) (map[string]string, error) {
+	info, err := trans.Probe(path)
+	if err != nil {
+		return nil, err
+	}
+	return info.Tags, nil
+}
@@ -0,0 +1,132 @@
+package engine
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderPathTemplate(t *testing.T) {
+	fullTags := map[string]string{
+		"album_artist": "Alexandra Stréliski",
+		"artist":       "Alexandra Stréliski, Guest",
+		"album":        "Néo-Romance",
+		"date":         "2023-09-01",
+		"disc":         "1/2",
+		"track":        "2/12",
+		"title":        "Lumières",
+	}
+
+	cases := []struct {
+		Name           string
+		Template       string
+		Tags           map[string]string
+		SourcePath     string
+		ExpectedOutput string
+	}{
+		{
+			Name:           "All tags present",
+			Template:       "{albumartist}/{year} - {album}/{disc}-{track:02} {title}",
+			Tags:           fullTags,
+			SourcePath:     "/messy/folder/track.m4a",
+			ExpectedOutput: "/Alexandra Streliski/2023 - Neo-Romance/1-02 Lumieres.mp3",
+		},
+		{
+			Name:           "Missing tags fall back to source path",
+			Template:       "{albumartist}/{year} - {album}/{disc}-{track:02} {title}",
+			Tags:           nil,
+			SourcePath:     "Some Album/Some Song.wav",
+			ExpectedOutput: "Unknown Artist/Some Album/1- Some Song.mp3",
+		},
+		{
+			Name:           "Album artist falls back to artist",
+			Template:       "{albumartist}/{title}",
+			Tags:           map[string]string{"artist": "Solo", "title": "Song"},
+			SourcePath:     "a.m4a",
+			ExpectedOutput: "Solo/Song.mp3",
+		},
+		{
+			Name:           "Year only from a leading number",
+			Template:       "{year|No Year}/{title}",
+			Tags:           map[string]string{"date": "Summer '69", "title": "Song"},
+			SourcePath:     "a.m4a",
+			ExpectedOutput: "Summer '69/Song.mp3",
+		},
+		{
+			Name:           "Short year",
+			Template:       "{year} - {title}",
+			Tags:           map[string]string{"date": "99", "title": "Song"},
+			SourcePath:     "a.m4a",
+			ExpectedOutput: "99 - Song.mp3",
+		},
+		{
+			Name:           "Literal fallback",
+			Template:       "{genre|Misc}/{title}",
+			Tags:           map[string]string{"title": "Song"},
+			SourcePath:     "a.m4a",
+			ExpectedOutput: "Misc/Song.mp3",
+		},
+		{
+			Name:           "Slashes in tags do not create folders",
+			Template:       "{artist}/{title}",
+			Tags:           map[string]string{"artist": "AC/DC", "title": "Song?"},
+			SourcePath:     "a.m4a",
+			ExpectedOutput: "AC-DC/Song.mp3",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			assert.Equal(t, c.ExpectedOutput, renderPathTemplate(c.Template, c.Tags, c.SourcePath))
+		})
+	}
+}
+
+func TestApplyPathTemplate(t *testing.T) {
+	r := newRun(nil, nil)
+	tags := map[string]map[string]string{
+		"/b.m4a": {"artist": "Band", "title": "Song"},
+		"/a.mp3": {"artist": "Band", "title": "Song"},
+		"/c.wav": {"artist": "Band", "title": "Other"},
+	}
+	readTags := func(name string) (map[string]string, error) {
+		if name == "/d.wav" {
+			return nil, fmt.Errorf("unreadable")
+		}
+		return tags[name], nil
+	}
+
+	files := planDestinationFiles([]string{"/b.m4a", "/a.mp3", "/c.wav", "/d.wav"})
+	planned := r.applyPathTemplate(files, "{artist}/{title}", false, readTags)
+
+	assert.Equal(t, []fileToTranscode{
+		{sourcePath: "/a.mp3", destinationPath: "/Band/Song.mp3"},
+		{sourcePath: "/b.m4a", destinationPath: "/Band/Song (2).mp3"},
+		{sourcePath: "/c.wav", destinationPath: "/Band/Other.mp3"},
+		{sourcePath: "/d.wav", destinationPath: "/Unknown Artist/d.mp3"},
+	}, planned)
+
+	// A second run assigns the same destination paths
+	assert.Equal(t, planned, r.applyPathTemplate(files, "{artist}/{title}", false, readTags))
+}
+
+func TestApplyPathTemplate_CaseInsensitive(t *testing.T) {
+	tags := map[string]map[string]string{
+		"/a.mp3": {"artist": "Band", "title": "Song"},
+		"/b.mp3": {"artist": "BAND", "title": "song"},
+	}
+	readTags := func(name string) (map[string]string, error) { return tags[name], nil }
+	files := planDestinationFiles([]string{"/a.mp3", "/b.mp3"})
+
+	// On FAT32, the second file would overwrite the first one
+	assert.Equal(t, []fileToTranscode{
+		{sourcePath: "/a.mp3", destinationPath: "/Band/Song.mp3"},
+		{sourcePath: "/b.mp3", destinationPath: "/BAND/song (2).mp3"},
+	}, newRun(nil, nil).applyPathTemplate(files, "{artist}/{title}", true, readTags))
+	assert.Equal(t, []fileToTranscode{
+		{sourcePath: "/a.mp3", destinationPath: "/Band/Song.mp3"},
+		{sourcePath: "/b.mp3", destinationPath: "/BAND/song.mp3"},
+	}, newRun(nil, nil).applyPathTemplate(files, "{artist}/{title}", false, readTags))
+}
@@ -0,0 +1,140 @@
+package engine
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// resolvedPath returns the cleaned absolute path of p with symlinks resolved,
+// so that different spellings of the same directory, e.g. "./music/",
+// "music" or a symlink to it, compare equal. If p doesn't exist yet, the
+// symlinks of its nearest existing parent are resolved.
+func resolvedPath(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+
+	var missing []string
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		if filepath.Dir(dir) == dir {
+			return abs, nil
+		}
+		missing = append([]string{filepath.Base(dir)}, missing...)
+	}
+}
+
+// isWithin reports whether the cleaned absolute path p is dir or inside it.
+func isWithin(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkSeparateDirectories returns an error if a local destination is the
+// source directory, inside it or contains it: the sync would then read its
+// own output as source files, and mirror mode would trash the source.
+func checkSeparateDirectories(sourceDir, destination string) error {
+	if IsRemote(destination) {
+		return nil
+	}
+	source, err := resolvedPath(sourceDir)
+	if err != nil {
+		return err
+	}
+	dest, err := resolvedPath(destination)
+	if err != nil {
+		return err
+	}
+
+	if isWithin(dest, source) {
+		return fmt.Errorf("destination %s is inside the source directory %s", destination, sourceDir)
+	}
+	if isWithin(source, dest) {
+		return fmt.Errorf("source directory %s is inside the destination %s", sourceDir, destination)
+	}
+	return nil
+}
+
+// relativeName returns the path of a file relative to root, with a leading
+// slash and slash-separated like the names from getFilenames. Both are made
+// absolute and cleaned first, so root may be given with a trailing slash or
+// as e.g. "./source". If the file isn't inside root as spelled, the symlinks
+// of root and of the folder of the file are resolved like in
+// checkSeparateDirectories, e.g. for a root given through a symlink; the file
+// itself is never resolved, since it may be a symlink to a file elsewhere, and
+// doesn't have to exist anymore. Returns an error if the file isn't inside
+// root.
+func relativeName(root, p string) (string, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	absPath, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	if !isWithin(absPath, absRoot) {
+		if absRoot, err = resolvedPath(absRoot); err != nil {
+			return "", err
+		}
+		dir, err := resolvedPath(filepath.Dir(absPath))
+		if err != nil {
+			return "", err
+		}
+		absPath = filepath.Join(dir, filepath.Base(absPath))
+	}
+	if !isWithin(absPath, absRoot) {
+		return "", fmt.Errorf("%s is not inside %s", p, root)
+	}
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil {
+		return "", err
+	}
+	return rootedName(rel), nil
+}
+
+// rootedName cleans a name relative to a destination into a slash-separated
+// path with a leading slash. ".." can't lead above the root, so joining the
+// result to the destination always stays inside it.
+func rootedName(name string) string {
+	return path.Clean("/" + filepath.ToSlash(name))
+}
+
+// fsName returns the name of a file in the writableFS of a destination, for
+// a name relative to the destination as in rootedName, e.g. "Artist/a.mp3"
+// for "/Artist/a.mp3" and "." for the destination itself.
+func fsName(name string) string {
+	if name = strings.TrimPrefix(rootedName(name), "/"); name == "" {
+		return "."
+	}
+	return name
+}
+
+// nameInDir returns the name of the file at p in a writableFS rooted at dir,
+// or an error if it isn't inside dir.
+func nameInDir(dir, p string) (string, error) {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil || escapesRoot(rel) {
+		return "", fmt.Errorf("%s is not inside %s", p, dir)
+	}
+	return fsName(rel), nil
+}
+
+// escapesRoot reports whether a name relative to a destination would lead
+// outside it through "..", or names another volume.
+func escapesRoot(name string) bool {
+	if filepath.VolumeName(name) != "" {
+		return true
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return true
+		}
+	}
+	return false
+}
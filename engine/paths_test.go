@@ -0,0 +1,123 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelativeName(t *testing.T) {
+	cases := []struct {
+		root, path, expected string
+	}{
+		{"/music", "/music/Artist/a.mp3", "/Artist/a.mp3"},
+		{"/music/", "/music/Artist/a.mp3", "/Artist/a.mp3"},
+		{"./source", "source/Artist/a.mp3", "/Artist/a.mp3"},
+		{"source/", "./source/./Artist/../Artist/a.mp3", "/Artist/a.mp3"},
+	}
+	for _, c := range cases {
+		name, err := relativeName(filepath.FromSlash(c.root), filepath.FromSlash(c.path))
+		assert.NoError(t, err, c.root)
+		assert.Equal(t, c.expected, name, c.root)
+	}
+
+	_, err := relativeName("/music", "/musical/a.mp3")
+	assert.Error(t, err)
+	_, err = relativeName("/music", "/music/../a.mp3")
+	assert.Error(t, err)
+}
+
+func TestRelativeName_Symlinks(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-relative-symlinks")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	music := filepath.Join(tempDir, "music")
+	link := filepath.Join(tempDir, "link")
+	os.MkdirAll(filepath.Join(music, "Artist"), 0755)
+	os.WriteFile(filepath.Join(tempDir, "elsewhere.mp3"), []byte("audio"), 0644)
+	if err := os.Symlink(music, link); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	os.Symlink(filepath.Join(tempDir, "elsewhere.mp3"), filepath.Join(music, "Artist", "linked.mp3"))
+
+	// The root and the file may be spelled with or without the symlink, and
+	// the file may be gone
+	for _, c := range [][2]string{{link, music}, {music, link}, {link, link}} {
+		name, err := relativeName(c[0], filepath.Join(c[1], "Artist", "removed.mp3"))
+		assert.NoError(t, err)
+		assert.Equal(t, "/Artist/removed.mp3", name)
+	}
+
+	// A symlinked file keeps its own name
+	name, err := relativeName(link, filepath.Join(music, "Artist", "linked.mp3"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/Artist/linked.mp3", name)
+}
+
+func TestRootedName(t *testing.T) {
+	assert.Equal(t, "/Artist/a.mp3", rootedName("Artist/a.mp3"))
+	assert.Equal(t, "/a.mp3", rootedName("/../../a.mp3"))
+	assert.Equal(t, "/Artist/a.mp3", rootedName(filepath.Join("/Artist", ".", "a.mp3")))
+
+	assert.False(t, escapesRoot("/Artist/..Song.mp3"))
+	assert.True(t, escapesRoot("/../Song.mp3"))
+	assert.True(t, escapesRoot("/Artist/../../Song.mp3"))
+
+	// A device never writes outside its directory
+	dev := &dirDevice{fsys: newOSFS(filepath.FromSlash("/media/usb")), dir: filepath.FromSlash("/media/usb")}
+	assert.Equal(t, filepath.FromSlash("/media/usb/etc/passwd"), dev.path("/../../etc/passwd"))
+}
+
+func TestCheckSeparateDirectories(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-separate-dirs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	source := filepath.Join(tempDir, "music")
+	os.MkdirAll(source, 0755)
+
+	assert.NoError(t, checkSeparateDirectories(source, filepath.Join(tempDir, "usb")))
+	assert.NoError(t, checkSeparateDirectories(source, filepath.Join(tempDir, "music-usb")))
+	assert.NoError(t, checkSeparateDirectories(source, "sftp://pi/music"))
+
+	for _, destination := range []string{source, source + string(filepath.Separator), filepath.Join(source, "usb"), filepath.Join(source, "missing", "..", "usb")} {
+		err := checkSeparateDirectories(source, destination)
+		if assert.Error(t, err, destination) {
+			assert.Contains(t, err.Error(), "is inside the source directory")
+		}
+	}
+	err = checkSeparateDirectories(filepath.Join(source, "Artist"), source)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is inside the destination")
+	}
+
+	// A destination reached through a symlink is found too
+	if runtime.GOOS != "windows" {
+		os.Symlink(source, filepath.Join(tempDir, "link"))
+		assert.Error(t, checkSeparateDirectories(source, filepath.Join(tempDir, "link", "usb")))
+	}
+}
+
+func TestSync_DestinationInsideSource(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-sync-nested")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "a.mp3"), []byte("audio"), 0644)
+	destination := filepath.Join(tempDir, "usb")
+
+	_, err = Sync(context.Background(), Options{Sources: []string{tempDir + string(filepath.Separator)}, Destination: destination, Transcoder: newFakeTranscoder(), Log: &LogOptions{}})
+	assert.Error(t, err)
+	assert.NoDirExists(t, destination)
+}
@@ -0,0 +1,107 @@
+package engine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// MediaInfo holds the stream properties and tags of a music file as reported
+// by ffprobe. Tag names are lowercased.
+type MediaInfo struct {
+	Codec         string
+	BitRate       int64
+	SampleRate    int
+	BitsPerSample int
+	Channels      int
+	Duration      float64
+	Tags          map[string]string
+
+	// VariableBitRate is only detected for MP3 files, see probeWithVBR
+	VariableBitRate bool
+}
+
+// probeOutput mirrors the subset of ffprobe's JSON output that we use.
+type probeOutput struct {
+	Streams []struct {
+		CodecType        string            `json:"codec_type"`
+		CodecName        string            `json:"codec_name"`
+		SampleRate       string            `json:"sample_rate"`
+		Channels         int               `json:"channels"`
+		BitRate          string            `json:"bit_rate"`
+		BitsPerSample    int               `json:"bits_per_sample"`
+		BitsPerRawSample string            `json:"bits_per_raw_sample"`
+		Tags             map[string]string `json:"tags"`
+	} `json:"streams"`
+	Format struct {
+		Duration string            `json:"duration"`
+		BitRate  string            `json:"bit_rate"`
+		Tags     map[string]string `json:"tags"`
+	} `json:"format"`
+}
+
+// probeFile runs ffprobe on the file at the specified path and returns its
+// audio properties and tags.
+func probeFile(path string) (MediaInfo, error) {
+	return probeFileWith("ffprobe", path)
+}
+
+// probeFileWith is probeFile using the ffprobe executable at ffprobePath.
+func probeFileWith(ffprobePath, path string) (MediaInfo, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(ffprobePath, "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return MediaInfo{}, newFFmpegError(fmt.Errorf("failed to probe %s: %v", path, err), stderr.String())
+	}
+
+	return parseProbeOutput(stdout.Bytes())
+}
+
+// parseProbeOutput converts ffprobe's JSON output into a MediaInfo. The first
+// audio stream provides the stream properties. Tags from the container take
+// precedence over tags on the stream.
+func parseProbeOutput(data []byte) (MediaInfo, error) {
+	var output probeOutput
+	if err := json.Unmarshal(data, &output); err != nil {
+		return MediaInfo{}, fmt.Errorf("failed to parse ffprobe output: %v", err)
+	}
+
+	info := MediaInfo{Tags: make(map[string]string)}
+	for _, stream := range output.Streams {
+		if stream.CodecType != "audio" {
+			continue
+		}
+		info.Codec = stream.CodecName
+		info.SampleRate, _ = strconv.Atoi(stream.SampleRate)
+		info.Channels = stream.Channels
+		info.BitRate, _ = strconv.ParseInt(stream.BitRate, 10, 64)
+		info.BitsPerSample = stream.BitsPerSample
+		if rawBits, err := strconv.Atoi(stream.BitsPerRawSample); err == nil {
+			info.BitsPerSample = rawBits
+		}
+		for key, value := range stream.Tags {
+			info.Tags[strings.ToLower(key)] = value
+		}
+		break
+	}
+
+	if info.Codec == "" {
+		return MediaInfo{}, fmt.Errorf("no audio stream found")
+	}
+
+	info.Duration, _ = strconv.ParseFloat(output.Format.Duration, 64)
+	if info.BitRate == 0 {
+		info.BitRate, _ = strconv.ParseInt(output.Format.BitRate, 10, 64)
+	}
+	for key, value := range output.Format.Tags {
+		info.Tags[strings.ToLower(key)] = value
+	}
+
+	return info, nil
+}
@@ -0,0 +1,44 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseProbeOutput(t *testing.T) {
+	output := []byte(`{
+		"streams": [
+			{"codec_type": "video", "codec_name": "mjpeg"},
+			{"codec_type": "audio", "codec_name": "alac", "sample_rate": "96000", "channels": 2,
+			 "bits_per_raw_sample": "24", "tags": {"TITLE": "Stream title", "ENCODER": "Lavf"}}
+		],
+		"format": {"duration": "245.120000", "bit_rate": "4201000",
+			"tags": {"TITLE": "Lumières", "ARTIST": "Alexandra Stréliski", "track": "2/12"}}
+	}`)
+
+	info, err := parseProbeOutput(output)
+	assert.NoError(t, err)
+	assert.Equal(t, "alac", info.Codec)
+	assert.Equal(t, 96000, info.SampleRate)
+	assert.Equal(t, 2, info.Channels)
+	assert.Equal(t, 24, info.BitsPerSample)
+	assert.Equal(t, int64(4201000), info.BitRate)
+	assert.InDelta(t, 245.12, info.Duration, 0.001)
+	assert.Equal(t, map[string]string{
+		"title":   "Lumières",
+		"artist":  "Alexandra Stréliski",
+		"track":   "2/12",
+		"encoder": "Lavf",
+	}, info.Tags)
+}
+
+func TestParseProbeOutput_NoAudioStream(t *testing.T) {
+	_, err := parseProbeOutput([]byte(`{"streams": [{"codec_type": "video"}], "format": {}}`))
+	assert.Error(t, err)
+}
+
+func TestParseProbeOutput_InvalidJSON(t *testing.T) {
+	_, err := parseProbeOutput([]byte(`not json`))
+	assert.Error(t, err)
+}
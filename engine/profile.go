@@ -0,0 +1,124 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Profile holds the settings for one sync target, such as the USB stick for a
+// particular car. Profiles are stored as YAML so that each device can be
+// configured once and reused.
+//
+// Example profile:
+//
+//	name: car
+//	volume_label: CARMUSIC
+//	limits:
+//	  max_files_per_folder: 255
+//	  max_folder_depth: 8
+//	  max_folders: 999
+//	  restructure: true
+//	path_template: "{albumartist}/{year} - {album}/{disc}-{track:02} {title}"
+//	loudness:
+//	  mode: apply
+//	  album: true
+//	quality:
+//	  tiers: [mp3, lossless, high-bitrate, low-bitrate]
+//	  duration_tolerance_seconds: 2
+//	mirror: true
+//	case_insensitive: true
+//	links:
+//	  follow_directories: true
+//	  skip_duplicates: true
+//	formats: [mp3, m4a]
+//	exclude: ["Podcasts/*", "*.demo.*"]
+type Profile struct {
+	Name string `yaml:"name"`
+
+	// VolumeLabel identifies the device in daemon mode: the profile is
+	// synced to any mounted volume with this label.
+	VolumeLabel string `yaml:"volume_label"`
+
+	Limits DeviceLimits `yaml:"limits"`
+
+	// PathTemplate computes destination paths from tags instead of mirroring
+	// the source layout. See renderPathTemplate for the syntax.
+	PathTemplate string `yaml:"path_template"`
+
+	// Loudness turns on ReplayGain tagging or volume normalization.
+	Loudness LoudnessSettings `yaml:"loudness"`
+
+	// Quality ranks duplicates when deciding which copy to keep.
+	Quality QualityRanking `yaml:"quality"`
+
+	// Mirror moves music files in the destination that no longer have a
+	// source file, e.g. after a rename or deletion, to the trash.
+	Mirror bool `yaml:"mirror"`
+
+	// CaseInsensitive compares destination file names regardless of case,
+	// for FAT32 and exFAT devices, where Song.mp3 and song.mp3 are the same
+	// file. A file whose destination only differs in case from one that is
+	// already there is taken to be on the device.
+	CaseInsensitive bool `yaml:"case_insensitive"`
+
+	// Links configures how symlinks and hard links in the source are
+	// synced.
+	Links LinkSettings `yaml:"links"`
+
+	// Formats limits the synced source files to these extensions, without
+	// the dot, in any case. By default every supported music file is synced.
+	Formats []string `yaml:"formats"`
+
+	// Include and Exclude filter the synced source files with glob
+	// patterns, see matchesFilters.
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// DefaultProfile returns the profile used when no profile file is given.
+// It imposes no device limits. Since car stereos typically only play MP3s,
+// duplicates in MP3 format are kept over any other format.
+func DefaultProfile() Profile {
+	return Profile{
+		Name: "default",
+		Quality: QualityRanking{
+			Tiers: append([]string{"mp3"}, defaultQualityTiers...),
+		},
+	}
+}
+
+// LoadProfile reads a YAML profile from the specified path. Settings that are
+// missing from the file keep the values from DefaultProfile.
+func LoadProfile(path string) (Profile, error) {
+	prof := DefaultProfile()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return prof, fmt.Errorf("failed to read profile: %v", err)
+	}
+
+	if err := yaml.UnmarshalStrict(data, &prof); err != nil {
+		return prof, fmt.Errorf("failed to parse profile %s: %v", path, err)
+	}
+	if err := prof.validate(); err != nil {
+		return prof, fmt.Errorf("invalid profile %s: %v", path, err)
+	}
+
+	return prof, nil
+}
+
+// validate checks the settings of a profile that YAML doesn't check.
+func (prof Profile) validate() error {
+	if err := prof.Loudness.validate(); err != nil {
+		return fmt.Errorf("loudness: %v", err)
+	}
+	if err := validatePatterns(prof.Include); err != nil {
+		return fmt.Errorf("include: %v", err)
+	}
+	if err := validatePatterns(prof.Exclude); err != nil {
+		return fmt.Errorf("exclude: %v", err)
+	}
+	return nil
+}
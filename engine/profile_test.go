@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadProfile(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-profile")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	profilePath := filepath.Join(tempDir, "car.yaml")
+	os.WriteFile(profilePath, []byte(`name: car
+limits:
+  max_files_per_folder: 255
+  max_folder_depth: 8
+  max_folders: 999
+  restructure: true
+`), 0644)
+
+	prof, err := LoadProfile(profilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "car", prof.Name)
+	assert.Equal(t, DeviceLimits{MaxFilesPerFolder: 255, MaxFolderDepth: 8, MaxFolders: 999, Restructure: true}, prof.Limits)
+}
+
+func TestLoadProfile_UnknownSetting(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-profile-unknown")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	profilePath := filepath.Join(tempDir, "car.yaml")
+	os.WriteFile(profilePath, []byte("max_files: 255\n"), 0644)
+
+	_, err = LoadProfile(profilePath)
+	assert.Error(t, err)
+}
+
+func TestLoadProfile_InvalidPattern(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-profile-pattern")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	profilePath := filepath.Join(tempDir, "car.yaml")
+	os.WriteFile(profilePath, []byte("exclude: [\"Podcasts/[\"]\n"), 0644)
+
+	_, err = LoadProfile(profilePath)
+	assert.ErrorContains(t, err, `exclude: invalid pattern "Podcasts/["`)
+}
+
+func TestLoadProfile_UnknownLoudnessMode(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-profile-loudness")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	profilePath := filepath.Join(tempDir, "car.yaml")
+	os.WriteFile(profilePath, []byte("loudness:\n  mode: tag\n"), 0644)
+
+	_, err = LoadProfile(profilePath)
+	assert.ErrorContains(t, err, `loudness: unknown mode "tag"`)
+}
+
+func TestLoadProfile_MissingFile(t *testing.T) {
+	_, err := LoadProfile("/nonexistent/profile.yaml")
+	assert.Error(t, err)
+}
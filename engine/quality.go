@@ -0,0 +1,190 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultHighBitrateKbps   = 256
+	defaultDurationTolerance = 2.0
+)
+
+// defaultQualityTiers ranks lossless files above high bit rate lossy files
+// above low bit rate lossy files.
+var defaultQualityTiers = []string{"lossless", "high-bitrate", "low-bitrate"}
+
+// losslessCodecs lists the ffprobe codec names of lossless formats. PCM
+// codecs such as pcm_s16le are matched by prefix.
+var losslessCodecs = []string{"flac", "alac", "wavpack", "ape", "tta", "mlp", "truehd"}
+
+// QualityRanking configures how duplicates are ranked by their probed audio
+// quality when choosing which copy to keep.
+//
+// Tiers lists tiers from most to least preferred. A tier is "lossless",
+// "lossy", "high-bitrate", "low-bitrate" or an ffprobe codec name such as
+// "mp3" or "aac". Each file belongs to the first tier it matches; within a
+// tier, higher bit rate, sample rate and bit depth win, and VBR wins over CBR
+// at the same bit rate. For a device that only plays MP3s, list "mp3" first.
+//
+// Candidates whose duration differs from the chosen file by more than
+// DurationToleranceSeconds are different edits (e.g. a live version or radio
+// edit) and are never deleted.
+type QualityRanking struct {
+	Tiers                    []string `yaml:"tiers"`
+	HighBitrateKbps          int      `yaml:"high_bitrate_kbps"`
+	DurationToleranceSeconds float64  `yaml:"duration_tolerance_seconds"`
+}
+
+// withDefaults fills in unset ranking settings with their defaults.
+func (r QualityRanking) withDefaults() QualityRanking {
+	if len(r.Tiers) == 0 {
+		r.Tiers = defaultQualityTiers
+	}
+	if r.HighBitrateKbps == 0 {
+		r.HighBitrateKbps = defaultHighBitrateKbps
+	}
+	if r.DurationToleranceSeconds == 0 {
+		r.DurationToleranceSeconds = defaultDurationTolerance
+	}
+	return r
+}
+
+// isLossless reports whether the probed codec is lossless.
+func (info MediaInfo) isLossless() bool {
+	return strings.HasPrefix(info.Codec, "pcm_") || stringInSlice(info.Codec, losslessCodecs)
+}
+
+// tier returns the index of the first tier in the ranking that the file
+// matches, or the number of tiers if it matches none.
+func (r QualityRanking) tier(info MediaInfo) int {
+	highBitrate := info.BitRate >= int64(r.HighBitrateKbps)*1000
+	for i, tier := range r.Tiers {
+		matches := false
+		switch tier {
+		case "lossless":
+			matches = info.isLossless()
+		case "lossy":
+			matches = !info.isLossless()
+		case "high-bitrate":
+			matches = !info.isLossless() && highBitrate
+		case "low-bitrate":
+			matches = !info.isLossless() && !highBitrate
+		default:
+			matches = strings.EqualFold(info.Codec, tier)
+		}
+		if matches {
+			return i
+		}
+	}
+	return len(r.Tiers)
+}
+
+// betterQuality reports whether a ranks above b.
+func (r QualityRanking) betterQuality(a, b MediaInfo) bool {
+	if tierA, tierB := r.tier(a), r.tier(b); tierA != tierB {
+		return tierA < tierB
+	}
+	if a.BitRate != b.BitRate {
+		return a.BitRate > b.BitRate
+	}
+	if a.SampleRate != b.SampleRate {
+		return a.SampleRate > b.SampleRate
+	}
+	if a.BitsPerSample != b.BitsPerSample {
+		return a.BitsPerSample > b.BitsPerSample
+	}
+	return a.VariableBitRate && !b.VariableBitRate
+}
+
+// selectPreferredFileByQuality returns the file to keep and the files to
+// delete from a group of duplicates, using the probed audio quality of each
+// candidate. Candidates whose duration doesn't match the kept file within
+// the ranking's tolerance are returned as different edits rather than
+// deleted.
+//
+// Returns (fileToKeep, filesToDelete, differentEdits, error). An error is
+// returned if any candidate can't be probed.
+func selectPreferredFileByQuality(candidates []string, ranking QualityRanking, probe func(string) (MediaInfo, error)) (string, []string, []string, error) {
+	if len(candidates) == 0 {
+		return "", nil, nil, fmt.Errorf("no candidates provided")
+	}
+	ranking = ranking.withDefaults()
+
+	infos := make(map[string]MediaInfo)
+	for _, f := range candidates {
+		info, err := probe(f)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		infos[f] = info
+	}
+
+	sorted := append([]string{}, candidates...)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return ranking.betterQuality(infos[sorted[a]], infos[sorted[b]])
+	})
+
+	keep := sorted[0]
+	var toDelete, differentEdits []string
+	for _, f := range sorted[1:] {
+		if ranking.differentEdit(infos[keep], infos[f]) {
+			differentEdits = append(differentEdits, f)
+		} else {
+			toDelete = append(toDelete, f)
+		}
+	}
+
+	return keep, toDelete, differentEdits, nil
+}
+
+// differentEdit reports whether two files are different edits of a song:
+// their durations are both known and don't match within the tolerance.
+func (q QualityRanking) differentEdit(a, b MediaInfo) bool {
+	return a.Duration > 0 && b.Duration > 0 && math.Abs(a.Duration-b.Duration) > q.DurationToleranceSeconds
+}
+
+// probeWithVBR probes a file with the transcoder of the run and, for MP3
+// files, detects whether it is encoded with a variable bit rate.
+func (r *run) probeWithVBR(path string) (MediaInfo, error) {
+	info, err := r.transcoder.Probe(path)
+	if err != nil {
+		return info, err
+	}
+	if info.Codec == "mp3" {
+		info.VariableBitRate = isVariableBitRateMP3(path)
+	}
+	return info, nil
+}
+
+// isVariableBitRateMP3 reports whether an MP3 file has a Xing or VBRI header,
+// which encoders write in the first frame of VBR files. LAME writes an "Info"
+// header instead for CBR files.
+func isVariableBitRateMP3(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	start, end, err := audioPayloadRange(file, info.Size())
+	if err != nil {
+		return false
+	}
+
+	// The VBR header is within the first frame
+	header := make([]byte, min(end-start, 2048))
+	if _, err := file.ReadAt(header, start); err != nil {
+		return false
+	}
+	return bytes.Contains(header, []byte("Xing")) || bytes.Contains(header, []byte("VBRI"))
+}
@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQualityRanking_Tier(t *testing.T) {
+	ranking := QualityRanking{}.withDefaults()
+
+	assert.Equal(t, 0, ranking.tier(MediaInfo{Codec: "flac", BitRate: 900000}))
+	assert.Equal(t, 0, ranking.tier(MediaInfo{Codec: "pcm_s16le", BitRate: 1411000}))
+	assert.Equal(t, 1, ranking.tier(MediaInfo{Codec: "mp3", BitRate: 320000}))
+	assert.Equal(t, 2, ranking.tier(MediaInfo{Codec: "aac", BitRate: 128000}))
+
+	mp3First := QualityRanking{Tiers: []string{"mp3", "lossless"}}
+	assert.Equal(t, 0, mp3First.tier(MediaInfo{Codec: "mp3", BitRate: 128000}))
+	assert.Equal(t, 1, mp3First.tier(MediaInfo{Codec: "alac"}))
+	assert.Equal(t, 2, mp3First.tier(MediaInfo{Codec: "aac", BitRate: 256000}))
+}
+
+func TestSelectPreferredFileByQuality(t *testing.T) {
+	infos := map[string]MediaInfo{
+		"studio-320.mp3":   {Codec: "mp3", BitRate: 320000, SampleRate: 44100, Duration: 215},
+		"studio-128.mp3":   {Codec: "mp3", BitRate: 128000, SampleRate: 44100, Duration: 216},
+		"live-128.mp3":     {Codec: "mp3", BitRate: 128000, SampleRate: 44100, Duration: 412},
+		"studio-vbr.mp3":   {Codec: "mp3", BitRate: 128000, SampleRate: 44100, Duration: 215, VariableBitRate: true},
+		"studio.flac":      {Codec: "flac", BitRate: 1000000, SampleRate: 96000, BitsPerSample: 24, Duration: 215},
+		"studio-16bit.m4a": {Codec: "alac", BitRate: 1000000, SampleRate: 96000, BitsPerSample: 16, Duration: 215},
+	}
+	probe := func(path string) (MediaInfo, error) {
+		info, ok := infos[path]
+		if !ok {
+			return MediaInfo{}, fmt.Errorf("cannot probe %s", path)
+		}
+		return info, nil
+	}
+
+	cases := []struct {
+		Name                   string
+		Candidates             []string
+		Ranking                QualityRanking
+		ExpectedKeep           string
+		ExpectedDelete         []string
+		ExpectedDifferentEdits []string
+	}{
+		{
+			Name:                   "Higher bit rate wins over larger live version",
+			Candidates:             []string{"live-128.mp3", "studio-320.mp3", "studio-128.mp3"},
+			ExpectedKeep:           "studio-320.mp3",
+			ExpectedDelete:         []string{"studio-128.mp3"},
+			ExpectedDifferentEdits: []string{"live-128.mp3"},
+		},
+		{
+			Name:           "Lossless wins by default",
+			Candidates:     []string{"studio-320.mp3", "studio.flac"},
+			ExpectedKeep:   "studio.flac",
+			ExpectedDelete: []string{"studio-320.mp3"},
+		},
+		{
+			Name:           "MP3 wins when ranked first",
+			Candidates:     []string{"studio-128.mp3", "studio.flac"},
+			Ranking:        QualityRanking{Tiers: []string{"mp3", "lossless"}},
+			ExpectedKeep:   "studio-128.mp3",
+			ExpectedDelete: []string{"studio.flac"},
+		},
+		{
+			Name:           "Bit depth breaks ties between lossless files",
+			Candidates:     []string{"studio-16bit.m4a", "studio.flac"},
+			ExpectedKeep:   "studio.flac",
+			ExpectedDelete: []string{"studio-16bit.m4a"},
+		},
+		{
+			Name:           "VBR wins over CBR at the same bit rate",
+			Candidates:     []string{"studio-128.mp3", "studio-vbr.mp3"},
+			ExpectedKeep:   "studio-vbr.mp3",
+			ExpectedDelete: []string{"studio-128.mp3"},
+		},
+		{
+			Name:                   "Duration tolerance can be widened",
+			Candidates:             []string{"studio-128.mp3", "studio-320.mp3"},
+			Ranking:                QualityRanking{DurationToleranceSeconds: 0.5},
+			ExpectedKeep:           "studio-320.mp3",
+			ExpectedDifferentEdits: []string{"studio-128.mp3"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.Name, func(t *testing.T) {
+			t.Parallel()
+			keep, toDelete, differentEdits, err := selectPreferredFileByQuality(c.Candidates, c.Ranking, probe)
+			assert.NoError(t, err)
+			assert.Equal(t, c.ExpectedKeep, keep)
+			assert.ElementsMatch(t, c.ExpectedDelete, toDelete)
+			assert.ElementsMatch(t, c.ExpectedDifferentEdits, differentEdits)
+		})
+	}
+
+	t.Run("Probe errors are returned", func(t *testing.T) {
+		_, _, _, err := selectPreferredFileByQuality([]string{"studio-320.mp3", "unknown.mp3"}, QualityRanking{}, probe)
+		assert.Error(t, err)
+	})
+}
+
+func TestIsVariableBitRateMP3(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-vbr")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	frame := func(header string) []byte {
+		b := append([]byte("\xff\xfb\x90\x00"), make([]byte, 32)...)
+		return append(append(b, header...), make([]byte, 400)...)
+	}
+	vbr := filepath.Join(tempDir, "vbr.mp3")
+	cbr := filepath.Join(tempDir, "cbr.mp3")
+	os.WriteFile(vbr, concat(id3v2Tag("tags"), frame("Xing")), 0644)
+	os.WriteFile(cbr, concat(id3v2Tag("tags mentioning Xing"), frame("Info")), 0644)
+
+	assert.True(t, isVariableBitRateMP3(vbr))
+	assert.False(t, isVariableBitRateMP3(cbr))
+	assert.False(t, isVariableBitRateMP3(filepath.Join(tempDir, "missing.mp3")))
+}
+
+func TestRemoveDuplicateFiles_ByQuality(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-remove-duplicates-quality")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// The AAC copy is larger, but the MP3 ranks first in the default profile
+	studio := filepath.Join(tempDir, "Song.mp3")
+	studioCopy := filepath.Join(tempDir, "Song.m4a")
+	os.WriteFile(studio, make([]byte, 2000), 0644)
+	os.WriteFile(studioCopy, make([]byte, 5000), 0644)
+
+	infos := map[string]MediaInfo{
+		studio:     {Codec: "mp3", BitRate: 320000, Duration: 200},
+		studioCopy: {Codec: "aac", BitRate: 256000, Duration: 200},
+	}
+	probe := func(path string) (MediaInfo, error) { return infos[path], nil }
+
+	err = newRun(nil, nil).removeDuplicateFiles(tempDir, dedupeOptions{ranking: DefaultProfile().Quality, probe: probe})
+	assert.NoError(t, err)
+
+	assert.FileExists(t, studio)
+	assert.NoFileExists(t, studioCopy)
+}
@@ -0,0 +1,156 @@
+package engine
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// remoteSchemes are the URL schemes of destinations that aren't local
+// directories: sftp://[user@]host[:port]/path, webdav:// or webdavs:// for
+// WebDAV shares over HTTP or HTTPS, and mtp://device/storage/path for phones
+// attached by USB.
+var remoteSchemes = []string{"sftp", "webdav", "webdavs", "mtp"}
+
+// IsRemote reports whether a destination is a remote URL rather than a local
+// directory.
+func IsRemote(destination string) bool {
+	scheme, _, ok := strings.Cut(destination, "://")
+	return ok && stringInSlice(scheme, remoteSchemes)
+}
+
+// openDestination returns the filesystem of a destination, rooted at the
+// directory to sync to, and where that directory is, for messages. Local
+// directories use an osFS; remote URLs get a filesystem that talks to the
+// server, rooted at the path of the URL. A remote destination is opened once
+// per run, and closed with it, see close.
+func (r *run) openDestination(destination string) (writableFS, string, error) {
+	if !IsRemote(destination) {
+		return newOSFS(destination), destination, nil
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid destination URL: %v", err)
+	}
+	if u.Host == "" {
+		return nil, "", fmt.Errorf("destination URL %s has no host", destination)
+	}
+	dir := path.Clean("/" + u.Path)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if fsys, ok := r.remotes[destination]; ok {
+		return fsys, dir, nil
+	}
+	var fsys writableFS
+	switch u.Scheme {
+	case "sftp":
+		fsys = newSFTPFS(u, dir, r.logger)
+	case "mtp":
+		fsys = newMTPFS(u, dir, r.logger)
+	default:
+		fsys = newWebDAVFS(u, dir)
+	}
+	if r.remotes == nil {
+		r.remotes = make(map[string]writableFS)
+	}
+	r.remotes[destination] = fsys
+	return fsys, dir, nil
+}
+
+// remotePath returns the path on the server of a name of a remote
+// filesystem that is rooted at root.
+func remotePath(root, name string) string {
+	return path.Join(root, name)
+}
+
+// uploadFile copies a file to a remote filesystem under a temporary name,
+// then renames it, so that an interrupted upload never leaves a partial file
+// at the destination path for the next run to skip.
+func uploadFile(sourceFS fs.FS, source string, destinationFS writableFS, destination string) error {
+	partial := path.Join(path.Dir(destination), "."+path.Base(destination)+".part")
+	if err := copyFile(sourceFS, source, destinationFS, partial); err != nil {
+		destinationFS.Remove(partial)
+		return err
+	}
+	return destinationFS.Rename(partial, destination)
+}
+
+// tempDownload is a downloaded copy of a remote file that is removed when it
+// is closed.
+type tempDownload struct {
+	*os.File
+}
+
+// Close closes and removes the temporary file.
+func (f *tempDownload) Close() error {
+	err := f.File.Close()
+	os.Remove(f.File.Name())
+	return err
+}
+
+// stagedUpload is a temporary file that is uploaded to a remote filesystem
+// when it is closed, for servers that can't take a stream of writes.
+type stagedUpload struct {
+	*os.File
+	upload func(localPath string) error
+	closed bool
+	err    error
+}
+
+// Close uploads the file and removes the temporary file.
+func (f *stagedUpload) Close() error {
+	if f.closed {
+		return f.err
+	}
+	f.closed = true
+	defer os.Remove(f.File.Name())
+
+	if f.err = f.File.Close(); f.err == nil {
+		f.err = f.upload(f.File.Name())
+	}
+	return f.err
+}
+
+// remoteFileInfo describes a file on a remote filesystem. It is both the
+// fs.FileInfo and the fs.DirEntry of the file.
+type remoteFileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+// Name returns the base name of the file.
+func (i remoteFileInfo) Name() string { return i.name }
+
+// Size returns the size of the file in bytes.
+func (i remoteFileInfo) Size() int64 { return i.size }
+
+// Mode returns fs.ModeDir for directories. Remote permissions aren't read.
+func (i remoteFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ModTime returns the modification time, if the server reported one.
+func (i remoteFileInfo) ModTime() time.Time { return i.modTime }
+
+// IsDir reports whether the file is a directory.
+func (i remoteFileInfo) IsDir() bool { return i.dir }
+
+// Sys returns nil.
+func (i remoteFileInfo) Sys() any { return nil }
+
+// Type returns the type bits of Mode.
+func (i remoteFileInfo) Type() fs.FileMode { return i.Mode().Type() }
+
+// Info returns the file information itself.
+func (i remoteFileInfo) Info() (fs.FileInfo, error) { return i, nil }
@@ -0,0 +1,283 @@
+package engine
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dedupeOptions controls how removeDuplicateFiles finds and removes duplicates.
+type dedupeOptions struct {
+	// trash moves removed duplicates out of the scanned directory, whose
+	// filesystem are its files. When it is nil, the scanned directory is a
+	// local directory, and duplicates are moved to TrashDirName in it.
+	trash *trash
+
+	// dryRun only prints what would be deleted. The removals are simulated,
+	// so the output is exactly what a real run would do.
+	dryRun bool
+
+	// byContent finds files with identical audio anywhere in the directory,
+	// instead of files that share a base path
+	byContent bool
+
+	// acoustic finds files that sound like the same recording anywhere in
+	// the directory, using acoustic fingerprints with the given similarity
+	// threshold
+	acoustic            bool
+	similarityThreshold float64
+
+	// fingerprintCache is the file in which acoustic fingerprints are
+	// cached, or empty to not cache them
+	fingerprintCache string
+
+	// ranking decides which copy to keep based on probed audio quality
+	ranking QualityRanking
+
+	// probe reads the audio quality of a file. When it is nil or fails for
+	// any candidate, the largest MP3 is kept instead.
+	probe func(string) (MediaInfo, error)
+
+	// reviewer, if set, asks the user to confirm or change the choice for
+	// each group
+	reviewer *dedupeReviewer
+}
+
+// withTrash returns the options with the default trash of the scanned
+// directory dir if they have none.
+func (opts dedupeOptions) withTrash(dir string) dedupeOptions {
+	if opts.trash == nil {
+		opts.trash = newTrash(newOSFS(dir), dir, time.Now())
+	}
+	return opts
+}
+
+// groupFilesByBasePath groups file paths by their path without the file extension.
+// The key is the full path minus the extension; the value is every file that
+// shares that base path (potentially across different extensions).
+func groupFilesByBasePath(files []string) map[string][]string {
+	groups := make(map[string][]string)
+	for _, f := range files {
+		basePath := strings.TrimSuffix(f, filepath.Ext(f))
+		groups[basePath] = append(groups[basePath], f)
+	}
+	return groups
+}
+
+// selectPreferredFile returns the file to keep and the files to delete from a
+// group of candidates that share the same base path.
+//
+// Selection rules (in order):
+//  1. Files ending in .mp3 (case-insensitive) are preferred over all other formats.
+//  2. When multiple .mp3 files are present, the largest file (by byte size) is
+//     kept as a proxy for higher bit rate.
+//
+// The candidates are paths in dir, which fsys is rooted at.
+//
+// Returns (fileToKeep, filesToDelete, error).
+func selectPreferredFile(fsys fs.FS, dir string, candidates []string) (string, []string, error) {
+	if len(candidates) == 0 {
+		return "", nil, fmt.Errorf("no candidates provided")
+	}
+	if len(candidates) == 1 {
+		return candidates[0], nil, nil
+	}
+
+	// Partition candidates into MP3 files and everything else.
+	var mp3Files []string
+	var otherFiles []string
+	for _, f := range candidates {
+		if isMP3File(f) {
+			mp3Files = append(mp3Files, f)
+		} else {
+			otherFiles = append(otherFiles, f)
+		}
+	}
+
+	// Decide which pool to pick the best file from.
+	pickFrom := candidates
+	deleteAll := []string(nil)
+	if len(mp3Files) > 0 {
+		pickFrom = mp3Files
+		deleteAll = otherFiles
+	}
+
+	// Among the chosen pool, keep the largest file (highest bit-rate proxy).
+	bestFile := ""
+	bestSize := int64(-1)
+	for _, f := range pickFrom {
+		name, err := nameInDir(dir, f)
+		if err != nil {
+			return "", nil, err
+		}
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to stat %s: %v", f, err)
+		}
+		if info.Size() > bestSize {
+			bestSize = info.Size()
+			bestFile = f
+		}
+	}
+
+	// Every other file in the chosen pool is also a duplicate to delete.
+	for _, f := range pickFrom {
+		if f != bestFile {
+			deleteAll = append(deleteAll, f)
+		}
+	}
+
+	return bestFile, deleteAll, nil
+}
+
+// selectFileToKeep chooses which file of a group of duplicates to keep. It
+// ranks the candidates by probed audio quality when possible, and otherwise
+// falls back to selectPreferredFile.
+//
+// Returns (fileToKeep, filesToDelete, differentEdits, error).
+func (r *run) selectFileToKeep(candidates []string, opts dedupeOptions) (string, []string, []string, error) {
+	if opts.probe != nil {
+		keep, toDelete, differentEdits, err := selectPreferredFileByQuality(candidates, opts.ranking, opts.probe)
+		if err == nil {
+			return keep, toDelete, differentEdits, nil
+		}
+		r.reporter.warn("dedupe", "", fmt.Sprintf("Could not probe duplicates, keeping the largest MP3 (%v)", err))
+		r.logger.Debug("probe failed", "candidates", candidates, "ffmpeg_stderr", ffmpegStderr(err))
+	}
+
+	keep, toDelete, err := selectPreferredFile(opts.trash.files, opts.trash.filesDir, candidates)
+	return keep, toDelete, nil, err
+}
+
+// preferredFile returns the file that selectFileToKeep would keep of a group
+// of candidates, without reporting anything, or "" if it can't tell.
+func preferredFile(candidates []string, opts dedupeOptions) string {
+	if opts.probe != nil {
+		if keep, _, _, err := selectPreferredFileByQuality(candidates, opts.ranking, opts.probe); err == nil {
+			return keep
+		}
+	}
+	keep, _, err := selectPreferredFile(opts.trash.files, opts.trash.filesDir, candidates)
+	if err != nil {
+		return ""
+	}
+	return keep
+}
+
+// findDuplicates scans fsys, which is rooted at dir, and returns groups of
+// files in dir that share the same base path (full path without extension)
+// and have more than one member.
+func findDuplicates(fsys fs.FS, dir string) (map[string][]string, error) {
+	relPaths, err := getFilenames(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	var absPaths []string
+	for _, rel := range relPaths {
+		absPaths = append(absPaths, filepath.Join(dir, rel))
+	}
+
+	groups := groupFilesByBasePath(absPaths)
+	duplicates := make(map[string][]string)
+	for basePath, group := range groups {
+		if len(group) > 1 {
+			duplicates[basePath] = group
+		}
+	}
+	return duplicates, nil
+}
+
+// removeDuplicateFiles scans the destination directory for duplicate files
+// (same base path, different extensions or multiple MP3s) and moves the
+// lower-quality copies to the trash. With opts.byContent, files with identical audio are
+// treated as duplicates instead, wherever they are in the directory, and with
+// opts.acoustic, files that sound like the same recording.
+// When opts.dryRun is true it only prints what would be deleted without
+// removing anything.
+func (r *run) removeDuplicateFiles(dir string, opts dedupeOptions) error {
+	opts = opts.withTrash(dir)
+	fsys := opts.trash.files
+	find := func(dir string) (map[string][]string, error) {
+		return findDuplicates(fsys, dir)
+	}
+	switch {
+	case opts.acoustic:
+		threshold := opts.similarityThreshold
+		if threshold <= 0 {
+			threshold = DefaultSimilarityThreshold
+		}
+		fingerprint := func(path string) ([]uint32, error) { return fingerprintFile(r.transcoder, path) }
+		find = func(dir string) (map[string][]string, error) {
+			r.reporter.emit(Event{Type: EventStart, Operation: "fingerprint", Path: dir})
+			return r.findAcousticDuplicates(dir, threshold, opts.fingerprintCache, fingerprint, func(candidates []string) string {
+				return preferredFile(candidates, opts)
+			})
+		}
+	case opts.byContent:
+		find = func(dir string) (map[string][]string, error) {
+			return r.findContentDuplicates(fsys, dir)
+		}
+	}
+
+	r.logger.Debug("finding duplicates", "dir", dir, "by_content", opts.byContent, "acoustic", opts.acoustic, "dry_run", opts.dryRun)
+	duplicates, err := find(dir)
+	if err != nil {
+		return fmt.Errorf("error finding duplicates: %v", err)
+	}
+	r.logger.Debug("found duplicates", "groups", len(duplicates))
+
+	r.removeDuplicateGroups(duplicates, opts)
+	return nil
+}
+
+// removeDuplicateGroups keeps the preferred file of each group of duplicates
+// and moves the others to the trash of opts. When opts.dryRun is true the
+// moves are made on a simulation of the filesystems, and only printed.
+func (r *run) removeDuplicateGroups(duplicates map[string][]string, opts dedupeOptions) {
+	trash := *opts.trash
+	if opts.dryRun {
+		trash.simulate()
+	}
+	counts := make(map[string]int)
+	for _, key := range sortedKeys(duplicates) {
+		candidates := duplicates[key]
+		keep, toDelete, differentEdits, err := r.selectFileToKeep(candidates, opts)
+		if err != nil {
+			r.reporter.fail("dedupe", key, err)
+			counts["failed"]++
+			continue
+		}
+
+		if opts.reviewer != nil {
+			var ok bool
+			if keep, toDelete, ok = opts.reviewer.review(candidates, keep, toDelete, differentEdits); !ok {
+				counts["skipped"]++
+				continue
+			}
+		}
+
+		r.reporter.emit(Event{Type: EventFinished, Operation: "keep", Path: keep})
+		counts["kept"]++
+		for _, f := range differentEdits {
+			r.reporter.emit(Event{Type: EventFinished, Operation: "keep-different-edit", Path: f})
+			counts["kept"]++
+		}
+		for _, f := range toDelete {
+			if trashed, err := trash.remove(f); err != nil {
+				r.reporter.fail("delete", f, err)
+				counts["failed"]++
+			} else if opts.dryRun {
+				r.reporter.emit(Event{Type: EventFinished, Operation: "delete", Path: f, Destination: trashed, DryRun: true})
+				counts["would_delete"]++
+			} else {
+				r.reporter.emit(Event{Type: EventFinished, Operation: "delete", Path: f, Destination: trashed})
+				counts["deleted"]++
+			}
+		}
+	}
+
+	r.reporter.emit(Event{Type: EventSummary, Operation: "dedupe", Counts: counts})
+}
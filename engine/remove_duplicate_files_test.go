@@ -1,4 +1,4 @@
-package main
+package engine
 
 import (
 	"os"
@@ -119,7 +119,7 @@ func TestSelectPreferredFile(t *testing.T) {
 
 	for _, c := range cases {
 		t.Run(c.Name, func(t *testing.T) {
-			keep, toDelete, err := selectPreferredFile(c.Candidates)
+			keep, toDelete, err := selectPreferredFile(newOSFS(tempDir), tempDir, c.Candidates)
 			assert.NoError(t, err)
 			assert.Equal(t, c.ExpectedKeep, keep)
 			assert.ElementsMatch(t, c.ExpectedDelete, toDelete)
@@ -139,7 +139,7 @@ func TestFindDuplicates(t *testing.T) {
 	os.WriteFile(filepath.Join(tempDir, "song.m4a"), make([]byte, 400), 0644)
 	os.WriteFile(filepath.Join(tempDir, "other.mp3"), make([]byte, 300), 0644)
 
-	duplicates, err := findDuplicates(tempDir)
+	duplicates, err := findDuplicates(newOSFS(tempDir), tempDir)
 	assert.NoError(t, err)
 
 	// Only "song" should appear as a duplicate group; "other" has no duplicate
@@ -164,7 +164,7 @@ func TestRemoveDuplicateFiles_DryRun(t *testing.T) {
 	os.WriteFile(mp3File, make([]byte, 200), 0644)
 	os.WriteFile(m4aFile, make([]byte, 300), 0644)
 
-	err = removeDuplicateFiles(tempDir, true)
+	err = newRun(nil, nil).removeDuplicateFiles(tempDir, dedupeOptions{dryRun: true})
 	assert.NoError(t, err)
 
 	// Dry run must not delete anything
@@ -184,7 +184,7 @@ func TestRemoveDuplicateFiles_DeletesNonMP3Duplicate(t *testing.T) {
 	os.WriteFile(mp3File, make([]byte, 200), 0644)
 	os.WriteFile(m4aFile, make([]byte, 300), 0644)
 
-	err = removeDuplicateFiles(tempDir, false)
+	err = newRun(nil, nil).removeDuplicateFiles(tempDir, dedupeOptions{})
 	assert.NoError(t, err)
 
 	// MP3 should be kept, M4A should be deleted
@@ -210,24 +210,24 @@ func TestSelectPreferredFile_KeepsLargerMP3(t *testing.T) {
 	os.WriteFile(smallMP3, make([]byte, 500), 0644)
 	os.WriteFile(largeMP3, make([]byte, 2000), 0644)
 
-	keep, toDelete, err := selectPreferredFile([]string{smallMP3, largeMP3})
+	keep, toDelete, err := selectPreferredFile(newOSFS(tempDir), tempDir, []string{smallMP3, largeMP3})
 	assert.NoError(t, err)
 	assert.Equal(t, largeMP3, keep)
 	assert.ElementsMatch(t, []string{smallMP3}, toDelete)
 }
 
 func TestSelectPreferredFile_EmptyCandidates(t *testing.T) {
-	_, _, err := selectPreferredFile([]string{})
+	_, _, err := selectPreferredFile(newOSFS("/music"), "/music", []string{})
 	assert.Error(t, err)
 }
 
 func TestFindDuplicates_NonExistentDirectory(t *testing.T) {
-	_, err := findDuplicates("/nonexistent/dir")
+	_, err := findDuplicates(newOSFS("/nonexistent/dir"), "/nonexistent/dir")
 	assert.Error(t, err)
 }
 
 func TestRemoveDuplicateFiles_NonExistentDirectory(t *testing.T) {
-	err := removeDuplicateFiles("/nonexistent/dir", false)
+	err := newRun(nil, nil).removeDuplicateFiles("/nonexistent/dir", dedupeOptions{})
 	assert.Error(t, err)
 }
 
@@ -238,7 +238,7 @@ func TestRemoveDuplicateFiles_NoFilesInDirectory(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	err = removeDuplicateFiles(tempDir, false)
+	err = newRun(nil, nil).removeDuplicateFiles(tempDir, dedupeOptions{})
 	assert.NoError(t, err)
 }
 
@@ -257,7 +257,7 @@ func TestRemoveDuplicateFiles_InSubdirectory(t *testing.T) {
 	os.WriteFile(mp3File, make([]byte, 300), 0644)
 	os.WriteFile(m4aFile, make([]byte, 600), 0644)
 
-	err = removeDuplicateFiles(tempDir, false)
+	err = newRun(nil, nil).removeDuplicateFiles(tempDir, dedupeOptions{})
 	assert.NoError(t, err)
 
 	assert.FileExists(t, mp3File)
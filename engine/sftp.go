@@ -0,0 +1,313 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpKeyFiles are the private keys in ~/.ssh that are tried when logging in,
+// after the keys of the SSH agent.
+var sftpKeyFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// sftpDial connects to the SFTP server of an sftp:// URL.
+var sftpDial = dialSFTP
+
+// sftpFS is a writableFS on an SFTP server, e.g. a Raspberry Pi. It keeps
+// one SSH connection with one SFTP session for all its operations, which is
+// opened by the first one and closed by Close. It is rooted at a directory
+// on the server.
+type sftpFS struct {
+	u        *url.URL
+	root     string
+	location string
+	logger   *slog.Logger
+
+	mu     sync.Mutex
+	client *sftp.Client
+}
+
+// newSFTPFS returns the filesystem of an sftp:// URL, rooted at the
+// directory root on the server, which logs its session to logger.
+func newSFTPFS(u *url.URL, root string, logger *slog.Logger) *sftpFS {
+	return &sftpFS{u: u, root: root, location: u.Redacted(), logger: logger}
+}
+
+// dialSFTP logs in to the SSH server of an sftp:// URL and starts an SFTP
+// session. Logging in has to work without a prompt: with the password of the
+// URL, the SSH agent, or a key in ~/.ssh without a passphrase. The server
+// has to be in ~/.ssh/known_hosts.
+func dialSFTP(u *url.URL) (*sftp.Client, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	hostKeys, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %v", err)
+	}
+
+	config := &ssh.ClientConfig{User: u.User.Username(), HostKeyCallback: hostKeys}
+	if config.User == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		config.User = current.Username
+	}
+	if password, ok := u.User.Password(); ok {
+		config.Auth = append(config.Auth, ssh.Password(password))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			defer conn.Close()
+			config.Auth = append(config.Auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	var signers []ssh.Signer
+	for _, name := range sftpKeyFiles {
+		if key, err := os.ReadFile(filepath.Join(home, ".ssh", name)); err == nil {
+			if signer, err := ssh.ParsePrivateKey(key); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+	if len(signers) > 0 {
+		config.Auth = append(config.Auth, ssh.PublicKeys(signers...))
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "22"
+	}
+	conn, err := ssh.Dial("tcp", net.JoinHostPort(u.Hostname(), port), config)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go func() {
+		// The SSH connection ends with the session
+		client.Wait()
+		conn.Close()
+	}()
+	return client, nil
+}
+
+// session returns the SFTP session with the server, connecting on first use.
+// Errors are reported for op on name.
+func (s *sftpFS) session(op, name string) (*sftp.Client, error) {
+	if err := checkName(op, name); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		s.logger.Debug("connecting to sftp server", "location", s.location)
+		client, err := sftpDial(s.u)
+		if err != nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("sftp on %s: %v", s.location, err)}
+		}
+		s.client = client
+	}
+	return s.client, nil
+}
+
+// Close ends the session with the server, if there is one.
+func (s *sftpFS) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client == nil {
+		return nil
+	}
+	err := s.client.Close()
+	s.client = nil
+	return err
+}
+
+// path returns the path on the server of a name.
+func (s *sftpFS) path(name string) string {
+	return remotePath(s.root, name)
+}
+
+// pathError returns the error of op on name for an error of the server.
+func (s *sftpFS) pathError(op, name string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("sftp on %s: %v", s.location, err)}
+}
+
+// Stat returns the file information of the named file.
+func (s *sftpFS) Stat(name string) (fs.FileInfo, error) {
+	client, err := s.session("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := client.Stat(s.path(name))
+	if err != nil {
+		return nil, s.pathError("stat", name, err)
+	}
+	return info, nil
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (s *sftpFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	client, err := s.session("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := client.ReadDir(s.path(name))
+	if err != nil {
+		return nil, s.pathError("readdir", name, err)
+	}
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Open opens the named file for reading, which is read from the server as
+// it is read.
+func (s *sftpFS) Open(name string) (fs.File, error) {
+	client, err := s.session("open", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := client.Open(s.path(name))
+	if err != nil {
+		return nil, s.pathError("open", name, err)
+	}
+	return file, nil
+}
+
+// Create creates or truncates the named file, which is written to the server
+// as it is written.
+func (s *sftpFS) Create(name string) (writableFile, error) {
+	client, err := s.session("create", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := client.OpenFile(s.path(name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return nil, s.pathError("create", name, err)
+	}
+	return &sftpFile{File: file}, nil
+}
+
+// Append opens the named file for appending, creating it if needed. Writes
+// go to the end of the file as it was when it was opened.
+func (s *sftpFS) Append(name string) (writableFile, error) {
+	client, err := s.session("append", name)
+	if err != nil {
+		return nil, err
+	}
+	file, err := client.OpenFile(s.path(name), os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return nil, s.pathError("append", name, err)
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		file.Close()
+		return nil, s.pathError("append", name, err)
+	}
+	return &sftpFile{File: file}, nil
+}
+
+// sftpFile is a file on an SFTP server that is open for writing.
+type sftpFile struct {
+	*sftp.File
+}
+
+// Sync flushes the writes to stable storage, if the server supports it.
+func (f *sftpFile) Sync() error {
+	var status *sftp.StatusError
+	if err := f.File.Sync(); err != nil && !(errors.As(err, &status) && status.FxCode() == sftp.ErrSSHFxOpUnsupported) {
+		return err
+	}
+	return nil
+}
+
+// MkdirAll creates the named directory and any missing parents.
+func (s *sftpFS) MkdirAll(name string, perm fs.FileMode) error {
+	client, err := s.session("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if err := client.MkdirAll(s.path(name)); err != nil {
+		return s.pathError("mkdir", name, err)
+	}
+	return nil
+}
+
+// Remove removes the named file or empty directory.
+func (s *sftpFS) Remove(name string) error {
+	client, err := s.session("remove", name)
+	if err != nil {
+		return err
+	}
+	if err := client.Remove(s.path(name)); err != nil {
+		return s.pathError("remove", name, err)
+	}
+	return nil
+}
+
+// RemoveAll removes the named file or directory with everything in it. A
+// missing name is not an error.
+func (s *sftpFS) RemoveAll(name string) error {
+	client, err := s.session("removeall", name)
+	if err != nil {
+		return err
+	}
+	if err := client.RemoveAll(s.path(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return s.pathError("removeall", name, err)
+	}
+	return nil
+}
+
+// Rename moves a file, replacing any file at the new name.
+func (s *sftpFS) Rename(oldName, newName string) error {
+	client, err := s.session("rename", oldName)
+	if err != nil {
+		return err
+	}
+	if err := checkName("rename", newName); err != nil {
+		return err
+	}
+	if err := client.PosixRename(s.path(oldName), s.path(newName)); err != nil {
+		return s.pathError("rename", oldName, err)
+	}
+	return nil
+}
+
+// freeSpace returns the space available to the user in dir, if the server
+// supports the statvfs extension of OpenSSH.
+func (s *sftpFS) freeSpace(dir string) (int64, error) {
+	client, err := s.session("freespace", dir)
+	if err != nil {
+		return 0, err
+	}
+	stat, err := client.StatVFS(s.path(dir))
+	if err != nil {
+		return 0, errFreeSpaceUnknown
+	}
+	return int64(stat.Bavail * stat.Frsize), nil
+}
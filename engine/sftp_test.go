@@ -0,0 +1,154 @@
+package engine
+
+import (
+	"context"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+)
+
+// useSFTPServer makes sftp destinations connect to an SFTP server in the
+// test process, over an in-memory pipe, which serves the local filesystem.
+// Returns a function that returns how many sessions were started, and one
+// that restores the real connection.
+func useSFTPServer() (func() int, func()) {
+	original := sftpDial
+	var mu sync.Mutex
+	sessions := 0
+	sftpDial = func(u *url.URL) (*sftp.Client, error) {
+		clientConn, serverConn := net.Pipe()
+		server, err := sftp.NewServer(serverConn)
+		if err != nil {
+			return nil, err
+		}
+		go server.Serve()
+
+		mu.Lock()
+		sessions++
+		mu.Unlock()
+		return sftp.NewClientPipe(clientConn, clientConn)
+	}
+	count := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return sessions
+	}
+	return count, func() { sftpDial = original }
+}
+
+func TestSFTPFS(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-sftp")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	sessions, restore := useSFTPServer()
+	defer restore()
+
+	serverDir := filepath.ToSlash(filepath.Join(tempDir, "music"))
+	r := newRun(nil, nil)
+	fsys, dir, err := r.openDestination("sftp://pi@raspberrypi:2222" + serverDir)
+	assert.NoError(t, err)
+	assert.Equal(t, serverDir, dir)
+	assert.Equal(t, 0, sessions())
+
+	// Upload creates the missing directories
+	source := filepath.Join(tempDir, "Song [Live].mp3")
+	os.WriteFile(source, []byte("audio"), 0644)
+	assert.NoError(t, uploadFile(newOSFS(tempDir), filepath.Base(source), fsys, "Artist/Song [Live].mp3"))
+	data, err := os.ReadFile(filepath.Join(tempDir, "music", "Artist", "Song [Live].mp3"))
+	assert.NoError(t, err)
+	assert.Equal(t, "audio", string(data))
+
+	names, err := getFilenames(fsys, ".")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/Artist/Song [Live].mp3"}, names)
+
+	info, err := fsys.Stat("Artist/Song [Live].mp3")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+
+	data, err = fs.ReadFile(fsys, "Artist/Song [Live].mp3")
+	assert.NoError(t, err)
+	assert.Equal(t, "audio", string(data))
+
+	// Appending writes at the end of the file
+	for _, line := range []string{"first\n", "second\n"} {
+		file, err := fsys.Append("journal.txt")
+		assert.NoError(t, err)
+		file.Write([]byte(line))
+		assert.NoError(t, file.Sync())
+		assert.NoError(t, file.Close())
+	}
+	data, _ = os.ReadFile(filepath.Join(tempDir, "music", "journal.txt"))
+	assert.Equal(t, "first\nsecond\n", string(data))
+
+	_, err = fsys.Stat("missing.mp3")
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, os.IsNotExist(fsys.Remove("missing.mp3")))
+	assert.Equal(t, fs.ErrInvalid, fsys.Remove("../outside.mp3").(*fs.PathError).Err)
+
+	free, err := fsys.(*sftpFS).freeSpace(".")
+	assert.NoError(t, err)
+	assert.Greater(t, free, int64(0))
+
+	assert.NoError(t, fsys.RemoveAll("Artist"))
+	assert.NoDirExists(t, filepath.Join(tempDir, "music", "Artist"))
+	assert.NoError(t, fsys.RemoveAll("Artist"))
+
+	// Every operation of the run uses the same session, until the run ends
+	same, _, err := r.openDestination("sftp://pi@raspberrypi:2222" + serverDir)
+	assert.NoError(t, err)
+	assert.Same(t, fsys, same)
+	assert.Equal(t, 1, sessions())
+	r.close()
+	assert.Nil(t, fsys.(*sftpFS).client)
+}
+
+func TestSync_SFTP(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-sftp-sync")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	serverDir := filepath.Join(tempDir, "server")
+	sessions, restore := useSFTPServer()
+	defer restore()
+
+	sourceDir := filepath.Join(tempDir, "source")
+	for _, path := range []string{"source/Artist/a.m4a", "source/Artist/b.mp3", "server/music/Artist/Renamed.mp3"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(tempDir, path)), 0755)
+		os.WriteFile(filepath.Join(tempDir, path), []byte("audio"), 0644)
+	}
+
+	destination := "sftp://raspberrypi" + filepath.ToSlash(filepath.Join(serverDir, "music"))
+	opts := Options{Sources: []string{sourceDir}, Destination: destination, Mirror: true, Transcoder: newFakeTranscoder()}
+	planned, err := Plan(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Len(t, planned, 2)
+	assert.Equal(t, filepath.ToSlash(filepath.Join(serverDir, "music", "Artist", "a.mp3")), planned[0].Destination)
+
+	report, err := Sync(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"copied": 1, "transcoded": 1}, report.Counts["sync"])
+	assert.Equal(t, map[string]int{"removed": 1}, report.Counts["mirror"])
+	assert.FileExists(t, filepath.Join(serverDir, "music", "Artist", "a.mp3"))
+	assert.FileExists(t, filepath.Join(serverDir, "music", "Artist", "b.mp3"))
+	assert.NoFileExists(t, filepath.Join(serverDir, "music", "Artist", "Renamed.mp3"))
+
+	// The orphan can be restored from the trash on the server
+	restored, err := RestoreTrash(destination, "", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored)
+	assert.FileExists(t, filepath.Join(serverDir, "music", "Artist", "Renamed.mp3"))
+
+	// One session each for the plan, the sync and the restore
+	assert.Equal(t, 3, sessions())
+}
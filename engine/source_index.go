@@ -0,0 +1,663 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// sourceIndexVersion is the format of the source index. An index of
+	// another version is ignored.
+	sourceIndexVersion = 3
+
+	// destinationIndexName is the index in the root of a local destination
+	// that caches its file listing, so that a run only lists the folders of
+	// the destination whose modification time changed.
+	destinationIndexName = ".sync-index-destination.db"
+
+	// sourceIndexTimeout is how long opening the database of a source index
+	// waits for another process that has it open.
+	sourceIndexTimeout = 5 * time.Second
+
+	// racyModTimeWindow is how recently a directory may have changed for its
+	// modification time not to be trusted on the next run, because changes
+	// within the timestamp granularity (2s on FAT) keep the same time.
+	racyModTimeWindow = 2 * time.Second
+)
+
+var (
+	// sourceIndexHeader is the key and bucket of the sourceIndexData of a
+	// source index in its database.
+	sourceIndexHeader = []byte("header")
+
+	// sourceIndexDirs is the bucket of a source index database that holds
+	// the indexedDir of each directory, keyed by its relative path with a
+	// trailing slash, so that the source itself is "/".
+	sourceIndexDirs = []byte("dirs")
+)
+
+// indexedFile is a file in the source index. Hash is the SHA-256 of the
+// contents of the file, which is only computed once the size or modification
+// time of the file change, so that a file that was only touched isn't synced
+// again. Tags are the tags of the file, if they were probed for the path
+// template since the file last changed.
+type indexedFile struct {
+	Size    int64             `json:"size"`
+	ModTime int64             `json:"mod_time"`
+	Device  uint64            `json:"device,omitempty"`
+	Inode   uint64            `json:"inode,omitempty"`
+	Hash    string            `json:"hash,omitempty"`
+	Probed  bool              `json:"probed,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// sameStat reports whether the file information of f and other is the same.
+func (f indexedFile) sameStat(other indexedFile) bool {
+	return f.Size == other.Size && f.ModTime == other.ModTime && f.Device == other.Device && f.Inode == other.Inode
+}
+
+// indexedDir is a directory in the source index, with the names of the files
+// and subdirectories in it as of its modification time.
+type indexedDir struct {
+	ModTime int64                  `json:"mod_time"`
+	Files   map[string]indexedFile `json:"files"`
+	Dirs    []string               `json:"dirs,omitempty"`
+}
+
+// sourceIndexData describes a source index in its database, next to its
+// directories.
+type sourceIndexData struct {
+	Version           int    `json:"version"`
+	Source            string `json:"source"`
+	FollowDirectories bool   `json:"follow_directories,omitempty"`
+}
+
+// sourceIndex caches the file listing of a source directory between runs.
+// Adding, removing or renaming a file changes the modification time of its
+// directory, so only directories whose modification time changed are read
+// again; for the others, only the files in the index are stat'ed. Directories are keyed by their
+// path relative to the source with a leading slash, and the source itself by
+// "". The index is saved in a bbolt database, where only the directories
+// that changed are written.
+//
+// The file listing of a local destination is cached the same way, see
+// loadDestinationIndex.
+type sourceIndex struct {
+	// path is the file the index is saved in, or empty for an index that
+	// is only kept in memory
+	path  string
+	root  string
+	links LinkSettings
+
+	// namesOnly keeps the index from checking the files of directories
+	// that didn't change and from hashing files, for an index that only
+	// lists the files
+	namesOnly bool
+
+	// mu guards dirs, which an update replaces when it is done; files that
+	// are invalidated during an update are kept in invalid until then.
+	// dirty holds the directories that changed since the index was saved.
+	mu       sync.Mutex
+	dirs     map[string]*indexedDir
+	dirty    map[string]bool
+	updating bool
+	invalid  []string
+
+	// run receives the warnings and debug records of the index
+	run *run
+}
+
+// indexDiff lists the files that were added, changed or removed since the
+// index was last updated, relative to the source with a leading slash.
+type indexDiff struct {
+	added, changed, removed []string
+}
+
+// sourceIndexPath returns the file in which the index of a source directory
+// is kept for a destination: in the destination, like the journal, so that
+// every device sees the changes since it was last synced. Remote
+// destinations don't keep an index.
+func sourceIndexPath(sourceDir, destination string) string {
+	if IsRemote(destination) {
+		return ""
+	}
+	source, err := filepath.Abs(sourceDir)
+	if err != nil {
+		source = sourceDir
+	}
+	sum := sha256.Sum256([]byte(source))
+	return filepath.Join(destination, ".sync-index-"+hex.EncodeToString(sum[:8])+".db")
+}
+
+// loadDestinationIndex reads the index that caches the file listing of the
+// local destination directory dir, see destinationIndexName.
+func (r *run) loadDestinationIndex(dir string) *sourceIndex {
+	index := r.loadSourceIndex(filepath.Join(dir, destinationIndexName), dir, LinkSettings{})
+	index.namesOnly = true
+	return index
+}
+
+// loadSourceIndex reads the index of the source directory root saved at path,
+// for the given link settings. A missing or unreadable index, or one of
+// another source or that followed symlinked directories differently, starts
+// out empty, so that the whole source is read.
+func (r *run) loadSourceIndex(path, root string, links LinkSettings) *sourceIndex {
+	index := &sourceIndex{path: path, root: root, links: links, dirs: make(map[string]*indexedDir), dirty: make(map[string]bool), run: r}
+	if path == "" {
+		return index
+	}
+	if _, err := os.Stat(path); err != nil {
+		return index
+	}
+
+	dirs := make(map[string]*indexedDir)
+	err := index.withDatabase(func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			header, bucket := tx.Bucket(sourceIndexHeader), tx.Bucket(sourceIndexDirs)
+			if header == nil || bucket == nil {
+				return nil
+			}
+			var saved sourceIndexData
+			if err := json.Unmarshal(header.Get(sourceIndexHeader), &saved); err != nil {
+				return err
+			}
+			if saved.Version != sourceIndexVersion || saved.Source != root || saved.FollowDirectories != links.FollowDirectories {
+				return nil
+			}
+			return bucket.ForEach(func(key, value []byte) error {
+				var dir indexedDir
+				if err := json.Unmarshal(value, &dir); err != nil {
+					return err
+				}
+				dirs[strings.TrimSuffix(string(key), "/")] = &dir
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		r.reporter.warn("scan", path, fmt.Sprintf("Ignoring unreadable source index (%v)", err))
+		return index
+	}
+	index.dirs = dirs
+	return index
+}
+
+// withDatabase runs fn with the database of the index open.
+func (idx *sourceIndex) withDatabase(fn func(db *bolt.DB) error) error {
+	db, err := bolt.Open(idx.path, 0644, &bolt.Options{Timeout: sourceIndexTimeout})
+	if err != nil {
+		return err
+	}
+	err = fn(db)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// update reads the directories of the source that changed since the index
+// was last updated, several at the same time, and returns the differences.
+// A directory that is also one of the directories it is in, through a
+// symlink, is skipped with a warning.
+//
+// The update stops when ctx is canceled. If onFile isn't nil, it is called with every file of the source and
+// whether it changed, as soon as its directory is known. It may be called
+// from several goroutines at the same time.
+func (idx *sourceIndex) update(ctx context.Context, onFile func(name string, changed bool)) (indexDiff, error) {
+	var mu sync.Mutex
+	var diff indexDiff
+	idx.mu.Lock()
+	previous := idx.dirs
+	idx.updating = true
+	idx.mu.Unlock()
+	dirs := make(map[string]*indexedDir)
+	ancestors := make(map[string][]fileKey)
+	started := time.Now()
+
+	err := walkDirs(ctx, defaultWalkConcurrency, func(ctx context.Context, dirPath string) ([]string, error) {
+		fullPath := filepath.Join(idx.root, filepath.FromSlash(dirPath))
+		info, err := os.Stat(fullPath)
+		if errors.Is(err, fs.ErrNotExist) && dirPath != "" {
+			// The directory was removed after its parent was read
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		key := fileKeyOf(fullPath, info)
+		mu.Lock()
+		above := ancestors[dirPath]
+		mu.Unlock()
+		if containsKey(above, key) {
+			idx.run.reporter.warn("scan", fullPath, "Skipping symlink to a folder that contains it")
+			return nil, nil
+		}
+
+		dir, dirDiff, err := idx.scanDir(dirPath, info, previous[dirPath], started)
+		if errors.Is(err, fs.ErrNotExist) && dirPath != "" {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		dirs[dirPath] = dir
+		diff.added = append(diff.added, dirDiff.added...)
+		diff.changed = append(diff.changed, dirDiff.changed...)
+		diff.removed = append(diff.removed, dirDiff.removed...)
+		mu.Unlock()
+
+		if onFile != nil {
+			changed := make(map[string]bool)
+			for _, name := range dirDiff.changed {
+				changed[name] = true
+			}
+			names := make([]string, 0, len(dir.Files))
+			for name := range dir.Files {
+				names = append(names, dirPath+"/"+name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				onFile(name, changed[name])
+			}
+		}
+
+		subdirs := make([]string, len(dir.Dirs))
+		mu.Lock()
+		for i, name := range dir.Dirs {
+			subdirs[i] = dirPath + "/" + name
+			ancestors[subdirs[i]] = append(above[:len(above):len(above)], key)
+		}
+		mu.Unlock()
+		return subdirs, nil
+	})
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.updating = false
+	if err != nil {
+		idx.invalid = nil
+		return indexDiff{}, err
+	}
+	idx.dirs = dirs
+	for dirPath, dir := range dirs {
+		if dir != previous[dirPath] {
+			idx.dirty[dirPath] = true
+		}
+	}
+	for _, name := range idx.invalid {
+		idx.invalidateLocked(name)
+	}
+	idx.invalid = nil
+
+	// The files of directories that are gone are removed too
+	for dirPath, dir := range previous {
+		if _, ok := dirs[dirPath]; !ok {
+			for name := range dir.Files {
+				diff.removed = append(diff.removed, dirPath+"/"+name)
+			}
+		}
+	}
+
+	sort.Strings(diff.added)
+	sort.Strings(diff.changed)
+	sort.Strings(diff.removed)
+	idx.run.logger.Debug("updated source index", "source", idx.root, "directories", len(dirs), "added", len(diff.added), "changed", len(diff.changed), "removed", len(diff.removed))
+	return diff, nil
+}
+
+// scanDir returns the directory at the relative path dirPath, whose
+// information is info, and the differences to old. If its modification time
+// is the same as in old, the names of its files and subdirectories are taken
+// from old, and only its files are stat'ed, since a file that is changed in
+// place doesn't change the time of its directory. The directories below it
+// aren't scanned.
+//
+// Symlinked files are indexed like the files they point to, and symlinked
+// directories are only listed if the link settings follow them. Broken links
+// are left out.
+func (idx *sourceIndex) scanDir(dirPath string, info fs.FileInfo, old *indexedDir, started time.Time) (*indexedDir, indexDiff, error) {
+	var diff indexDiff
+	fullPath := filepath.Join(idx.root, filepath.FromSlash(dirPath))
+	modTime := info.ModTime().UnixNano()
+	if old != nil && old.ModTime != 0 && old.ModTime == modTime {
+		if idx.namesOnly {
+			return old, diff, nil
+		}
+		return idx.statFiles(dirPath, old)
+	}
+
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return nil, diff, err
+	}
+	dir := &indexedDir{ModTime: modTime, Files: make(map[string]indexedFile)}
+	if started.Sub(info.ModTime()) < racyModTimeWindow {
+		dir.ModTime = 0
+	}
+
+	for _, entry := range entries {
+		isDir := entry.IsDir()
+		var fileInfo fs.FileInfo
+		if entry.Type()&fs.ModeSymlink != 0 {
+			fileInfo, err = os.Stat(filepath.Join(fullPath, entry.Name()))
+			if err != nil {
+				idx.run.logger.Debug("skipping broken symlink", "path", filepath.Join(fullPath, entry.Name()), "error", err)
+				continue
+			}
+			isDir = fileInfo.IsDir()
+			if isDir && !idx.links.FollowDirectories {
+				continue
+			}
+		}
+		if isDir {
+			if entry.Name() != TrashDirName && entry.Name() != LogDirName {
+				dir.Dirs = append(dir.Dirs, entry.Name())
+			}
+			continue
+		}
+
+		if fileInfo == nil {
+			if fileInfo, err = entry.Info(); err != nil {
+				// The file was removed while the directory was read
+				continue
+			}
+		}
+		file := indexedFile{Size: fileInfo.Size(), ModTime: fileInfo.ModTime().UnixNano()}
+		file.Device, file.Inode = fileID(fileInfo)
+
+		var oldFile indexedFile
+		var known bool
+		if old != nil {
+			oldFile, known = old.Files[entry.Name()]
+		}
+		if !known {
+			diff.added = append(diff.added, dirPath+"/"+entry.Name())
+		} else {
+			changed := !file.sameStat(oldFile)
+			if !idx.namesOnly {
+				file, changed = idx.compareIndexedFile(filepath.Join(fullPath, entry.Name()), file, oldFile)
+			}
+			if changed {
+				diff.changed = append(diff.changed, dirPath+"/"+entry.Name())
+			}
+		}
+		dir.Files[entry.Name()] = file
+	}
+	if old != nil {
+		for name := range old.Files {
+			if _, ok := dir.Files[name]; !ok {
+				diff.removed = append(diff.removed, dirPath+"/"+name)
+			}
+		}
+	}
+	return dir, diff, nil
+}
+
+// statFiles returns the directory at the relative path dirPath, whose names
+// didn't change since old, with the current information of its files, and
+// the files that changed. A file that is gone is left out, as removed.
+func (idx *sourceIndex) statFiles(dirPath string, old *indexedDir) (*indexedDir, indexDiff, error) {
+	var diff indexDiff
+	fullPath := filepath.Join(idx.root, filepath.FromSlash(dirPath))
+	var dir *indexedDir
+	for name, oldFile := range old.Files {
+		info, err := os.Stat(filepath.Join(fullPath, name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, diff, err
+		}
+
+		var file indexedFile
+		if err == nil {
+			file = indexedFile{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+			file.Device, file.Inode = fileID(info)
+			if file.sameStat(oldFile) {
+				continue
+			}
+		}
+		if dir == nil {
+			dir = &indexedDir{ModTime: old.ModTime, Files: maps.Clone(old.Files), Dirs: old.Dirs}
+		}
+		if err != nil {
+			delete(dir.Files, name)
+			diff.removed = append(diff.removed, dirPath+"/"+name)
+			continue
+		}
+		var changed bool
+		file, changed = idx.compareIndexedFile(filepath.Join(fullPath, name), file, oldFile)
+		dir.Files[name] = file
+		if changed {
+			diff.changed = append(diff.changed, dirPath+"/"+name)
+		}
+	}
+	if dir == nil {
+		return old, diff, nil
+	}
+	return dir, diff, nil
+}
+
+// compareIndexedFile returns the index entry of the file at fullPath, whose
+// information is file, and whether it changed since its previous entry old.
+// A file whose information changed is hashed, and is only considered changed
+// if it wasn't hashed before or its contents are different.
+func (idx *sourceIndex) compareIndexedFile(fullPath string, file, old indexedFile) (indexedFile, bool) {
+	if file.sameStat(old) {
+		return old, false
+	}
+	hash, err := hashFile(fullPath)
+	if err != nil {
+		idx.run.logger.Debug("failed to hash source file", "path", fullPath, "error", err)
+		return file, true
+	}
+	file.Hash = hash
+	return file, old.Hash == "" || old.Hash != hash
+}
+
+// hashFile returns the SHA-256 of the contents of the file at fullPath.
+func hashFile(fullPath string) (string, error) {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// files returns the files of the source relative to it, with a leading
+// slash, in the order that getFilenames returns them. If the link settings
+// skip duplicates, only the first path of each file is returned.
+func (idx *sourceIndex) files() []string {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	var files []string
+	for dirPath, dir := range idx.dirs {
+		for name := range dir.Files {
+			files = append(files, dirPath+"/"+name)
+		}
+	}
+	sortWalkOrder(files)
+	if !idx.links.SkipDuplicates {
+		return files
+	}
+
+	first := make(map[fileKey]string)
+	distinct := files[:0]
+	for _, name := range files {
+		file := idx.dirs[strings.TrimSuffix(path.Dir(name), "/")].Files[path.Base(name)]
+		key := fileKey{device: file.Device, inode: file.Inode}
+		if file.Inode != 0 {
+			if original, ok := first[key]; ok {
+				idx.run.logger.Debug("skipping linked duplicate", "path", name, "original", original)
+				continue
+			}
+			first[key] = name
+		}
+		distinct = append(distinct, name)
+	}
+	return distinct
+}
+
+// tags returns the tags of the named file that were kept by setTags, if the
+// file didn't change since. Tags aren't kept during an update.
+func (idx *sourceIndex) tags(name string) (map[string]string, bool) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	dir := idx.dirs[strings.TrimSuffix(path.Dir(name), "/")]
+	if idx.updating || dir == nil {
+		return nil, false
+	}
+	file := dir.Files[path.Base(name)]
+	return file.Tags, file.Probed
+}
+
+// setTags keeps the tags of the named file in the index, until the file
+// changes.
+func (idx *sourceIndex) setTags(name string, tags map[string]string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	dirPath := strings.TrimSuffix(path.Dir(name), "/")
+	dir := idx.dirs[dirPath]
+	if idx.updating || dir == nil {
+		return
+	}
+	if file, ok := dir.Files[path.Base(name)]; ok {
+		file.Probed, file.Tags = true, tags
+		dir.Files[path.Base(name)] = file
+		idx.dirty[dirPath] = true
+	}
+}
+
+// invalidate makes the next update report a file as changed, e.g. because
+// syncing its change failed. A file that is invalidated during an update is
+// invalidated when the update is done.
+func (idx *sourceIndex) invalidate(name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.updating {
+		idx.invalid = append(idx.invalid, name)
+		return
+	}
+	idx.invalidateLocked(name)
+}
+
+// invalidateLocked invalidates a file like invalidate, with mu held.
+func (idx *sourceIndex) invalidateLocked(name string) {
+	dir := idx.dirs[strings.TrimSuffix(path.Dir(name), "/")]
+	if dir == nil {
+		return
+	}
+	if file, ok := dir.Files[path.Base(name)]; ok {
+		file.Size, file.Hash = -1, ""
+		dir.Files[path.Base(name)] = file
+		dir.ModTime = 0
+		idx.dirty[strings.TrimSuffix(path.Dir(name), "/")] = true
+	}
+}
+
+// save writes the directories that changed since the index was loaded or
+// last saved to its database, and removes the ones that are gone, in one
+// transaction so that an interrupted save doesn't leave a broken index.
+func (idx *sourceIndex) save() error {
+	if idx.path == "" {
+		return nil
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	header, err := json.Marshal(sourceIndexData{Version: sourceIndexVersion, Source: idx.root, FollowDirectories: idx.links.FollowDirectories})
+	if err != nil {
+		return err
+	}
+
+	err = idx.withDatabase(func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			headerBucket, err := tx.CreateBucketIfNotExists(sourceIndexHeader)
+			if err != nil {
+				return err
+			}
+			previous := headerBucket.Get(sourceIndexHeader)
+			if previous != nil && string(previous) != string(header) {
+				// The index was started over, e.g. for other link settings
+				if err := tx.DeleteBucket(sourceIndexDirs); err != nil && err != bolt.ErrBucketNotFound {
+					return err
+				}
+			}
+			if err := headerBucket.Put(sourceIndexHeader, header); err != nil {
+				return err
+			}
+			bucket, err := tx.CreateBucketIfNotExists(sourceIndexDirs)
+			if err != nil {
+				return err
+			}
+
+			var gone [][]byte
+			err = bucket.ForEach(func(key, _ []byte) error {
+				if _, ok := idx.dirs[strings.TrimSuffix(string(key), "/")]; !ok {
+					gone = append(gone, slices.Clone(key))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, key := range gone {
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+			}
+			for dirPath, dir := range idx.dirs {
+				key := []byte(dirPath + "/")
+				if !idx.dirty[dirPath] && bucket.Get(key) != nil {
+					continue
+				}
+				value, err := json.Marshal(dir)
+				if err != nil {
+					return err
+				}
+				if err := bucket.Put(key, value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	clear(idx.dirty)
+	// Older versions kept the index in a JSON file
+	os.Remove(strings.TrimSuffix(idx.path, ".db") + ".json")
+	return nil
+}
+
+// listSource returns a source directory with its files listed in its index
+// like getFilenames, with the link settings of the sync, using the index that
+// the sync keeps for the destination. The index isn't saved, so that the next
+// sync still sees the changes.
+func (r *run) listSource(sourceDir, destination string, links LinkSettings) (*syncSource, error) {
+	index := r.loadSourceIndex(sourceIndexPath(sourceDir, destination), sourceDir, links)
+	if _, err := index.update(context.Background(), nil); err != nil {
+		return nil, err
+	}
+	return &syncSource{dir: sourceDir, index: index}, nil
+}
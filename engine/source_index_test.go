@@ -0,0 +1,247 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// backdate sets the modification time of paths to a fixed time in the past,
+// so that the source index trusts them.
+func backdate(paths ...string) {
+	past := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, path := range paths {
+		os.Chtimes(path, past, past)
+	}
+}
+
+func TestSourceIndex(t *testing.T) {
+	r := newRun(nil, nil)
+	tempDir, err := os.MkdirTemp("", "test-source-index")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	source := filepath.Join(tempDir, "source")
+	for _, path := range []string{"A/x.mp3", "A b/y.mp3", "A.mp3", "C/D/z.m4a", TrashDirName + "/old.mp3"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(source, path)), 0755)
+		os.WriteFile(filepath.Join(source, path), []byte("audio"), 0644)
+	}
+	backdate(source, filepath.Join(source, "A"), filepath.Join(source, "A b"), filepath.Join(source, "C"), filepath.Join(source, "C", "D"))
+	indexPath := filepath.Join(tempDir, "index.db")
+
+	index := r.loadSourceIndex(indexPath, source, LinkSettings{})
+	diff, err := index.update(context.Background(), nil)
+	assert.NoError(t, err)
+	expected, _ := getFilenames(newOSFS(source), ".")
+	assert.Equal(t, expected, index.files())
+	assert.ElementsMatch(t, expected, diff.added)
+	assert.Empty(t, diff.changed)
+	assert.NoError(t, index.save())
+
+	// A directory whose time didn't change isn't read again, but a file
+	// that was changed in place is noticed
+	os.WriteFile(filepath.Join(source, "A", "x.mp3"), []byte("new audio"), 0644)
+	os.WriteFile(filepath.Join(source, "A", "unseen.mp3"), []byte("audio"), 0644)
+	backdate(filepath.Join(source, "A"))
+	index = r.loadSourceIndex(indexPath, source, LinkSettings{})
+	diff, err = index.update(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, indexDiff{changed: []string{"/A/x.mp3"}}, diff)
+	assert.Equal(t, expected, index.files())
+	assert.NoError(t, index.save())
+
+	// A file that was only touched since its contents were hashed didn't
+	// change
+	touched := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(source, "A", "x.mp3"), touched, touched)
+	index = r.loadSourceIndex(indexPath, source, LinkSettings{})
+	diff, err = index.update(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, indexDiff{}, diff)
+	assert.NotEmpty(t, index.dirs["/A"].Files["x.mp3"].Hash)
+	assert.NoError(t, index.save())
+
+	// Directories that changed are read again
+	os.Chtimes(filepath.Join(source, "A"), time.Now().Add(-time.Minute), time.Now().Add(-time.Minute))
+	os.WriteFile(filepath.Join(source, "C", "new.mp3"), []byte("audio"), 0644)
+	os.RemoveAll(filepath.Join(source, "C", "D"))
+	index = r.loadSourceIndex(indexPath, source, LinkSettings{})
+	diff, err = index.update(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/A/unseen.mp3", "/C/new.mp3"}, diff.added)
+	assert.Empty(t, diff.changed)
+	assert.Equal(t, []string{"/C/D/z.m4a"}, diff.removed)
+
+	// An index of another source is ignored
+	index = r.loadSourceIndex(indexPath, tempDir, LinkSettings{})
+	assert.Empty(t, index.dirs)
+
+	// So is an unreadable index
+	os.WriteFile(indexPath, []byte("not a database"), 0644)
+	assert.Empty(t, r.loadSourceIndex(indexPath, source, LinkSettings{}).dirs)
+
+	_, err = r.loadSourceIndex("", filepath.Join(tempDir, "missing"), LinkSettings{}).update(context.Background(), nil)
+	assert.Error(t, err)
+}
+
+func TestSourceIndex_Invalidate(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-source-index-invalidate")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.WriteFile(filepath.Join(tempDir, "a.mp3"), []byte("audio"), 0644)
+	backdate(tempDir)
+	index := newRun(nil, nil).loadSourceIndex("", tempDir, LinkSettings{})
+	_, err = index.update(context.Background(), nil)
+	assert.NoError(t, err)
+
+	name := "/a.mp3"
+	index.invalidate(name)
+	diff, err := index.update(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{name}, diff.changed)
+}
+
+func TestFilesToSync(t *testing.T) {
+	planned := []fileToTranscode{{"/a.m4a", "/a.mp3"}, {"/b.mp3", "/b.mp3"}, {"/c.mp3", "/c.mp3"}}
+	assert.Equal(t, []fileToTranscode{{"/a.m4a", "/a.mp3"}, {"/c.mp3", "/c.mp3"}}, filesToSync(planned, newDestinationNames([]string{"/a.mp3", "/b.mp3"}, false), []string{"/a.m4a"}))
+}
+
+func TestSync_ChangedSource(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-sync-changed")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	destinationDir := filepath.Join(tempDir, "destination")
+	os.MkdirAll(filepath.Join(sourceDir, "Artist"), 0755)
+	os.WriteFile(filepath.Join(sourceDir, "Artist", "a.mp3"), []byte("audio"), 0644)
+	os.WriteFile(filepath.Join(sourceDir, "Artist", "b.mp3"), []byte("audio"), 0644)
+	backdate(sourceDir, filepath.Join(sourceDir, "Artist"))
+
+	opts := Options{Sources: []string{sourceDir}, Destination: destinationDir, Transcoder: newFakeTranscoder()}
+	report, err := Sync(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"copied": 2}, report.Counts["sync"])
+	assert.FileExists(t, sourceIndexPath(sourceDir, destinationDir))
+
+	// A file that was saved with new tags is copied again
+	temp := filepath.Join(sourceDir, "Artist", ".b.mp3.tmp")
+	os.WriteFile(temp, []byte("retagged audio"), 0644)
+	os.Rename(temp, filepath.Join(sourceDir, "Artist", "b.mp3"))
+	planned, err := Plan(context.Background(), opts)
+	assert.NoError(t, err)
+	if assert.Len(t, planned, 1) {
+		assert.Equal(t, filepath.Join(destinationDir, "Artist", "b.mp3"), planned[0].Destination)
+	}
+
+	report, err = Sync(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"copied": 1}, report.Counts["sync"])
+	data, _ := os.ReadFile(filepath.Join(destinationDir, "Artist", "b.mp3"))
+	assert.Equal(t, "retagged audio", string(data))
+
+	// So is a file whose tags were edited in place, which doesn't change
+	// the time of its folder
+	os.WriteFile(filepath.Join(sourceDir, "Artist", "a.mp3"), []byte("edited audio"), 0644)
+	backdate(filepath.Join(sourceDir, "Artist"))
+	report, err = Sync(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"copied": 1}, report.Counts["sync"])
+	data, _ = os.ReadFile(filepath.Join(destinationDir, "Artist", "a.mp3"))
+	assert.Equal(t, "edited audio", string(data))
+
+	report, err = Sync(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Counts["sync"])
+}
+
+func TestSourceIndex_Links(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need special permissions on Windows")
+	}
+	tempDir, err := os.MkdirTemp("", "test-source-index-links")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	os.MkdirAll(filepath.Join(tempDir, "Artist", "Album"), 0755)
+	os.WriteFile(filepath.Join(tempDir, "Artist", "Album", "song.mp3"), []byte("audio"), 0644)
+	os.Link(filepath.Join(tempDir, "Artist", "Album", "song.mp3"), filepath.Join(tempDir, "Artist", "hardlink.mp3"))
+	os.Symlink(filepath.Join(tempDir, "Artist", "Album"), filepath.Join(tempDir, "Favorites"))
+	os.Symlink(filepath.Join("Album", "song.mp3"), filepath.Join(tempDir, "Artist", "symlink.mp3"))
+	os.Symlink(tempDir, filepath.Join(tempDir, "Artist", "Album", "loop"))
+	os.Symlink(filepath.Join(tempDir, "missing.mp3"), filepath.Join(tempDir, "broken.mp3"))
+
+	// Symlinked files are indexed like the files they point to
+	r, events := recordEvents(nil)
+	index := r.loadSourceIndex("", tempDir, LinkSettings{})
+	_, err = index.update(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/Artist/Album/song.mp3", "/Artist/hardlink.mp3", "/Artist/symlink.mp3"}, index.files())
+	assert.Equal(t, int64(5), index.dirs["/Artist"].Files["symlink.mp3"].Size)
+
+	// Symlinked directories are followed, up to links to a directory above
+	index = r.loadSourceIndex("", tempDir, LinkSettings{FollowDirectories: true})
+	_, err = index.update(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/Artist/Album/song.mp3", "/Artist/hardlink.mp3", "/Artist/symlink.mp3", "/Favorites/song.mp3"}, index.files())
+	var warnings []string
+	for _, e := range events() {
+		if e.Type == EventWarning {
+			warnings = append(warnings, e.Path)
+		}
+	}
+	assert.ElementsMatch(t, []string{filepath.Join(tempDir, "Artist", "Album", "loop"), filepath.Join(tempDir, "Favorites", "loop")}, warnings)
+
+	// Every file is synced once, at its first path
+	index = r.loadSourceIndex("", tempDir, LinkSettings{FollowDirectories: true, SkipDuplicates: true})
+	_, err = index.update(context.Background(), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/Artist/Album/song.mp3"}, index.files())
+
+	// An index that followed other links is read again
+	indexPath := filepath.Join(tempDir, "index.db")
+	index = r.loadSourceIndex(indexPath, tempDir, LinkSettings{})
+	index.update(context.Background(), nil)
+	assert.NoError(t, index.save())
+	assert.NotEmpty(t, r.loadSourceIndex(indexPath, tempDir, LinkSettings{}).dirs)
+	assert.Empty(t, r.loadSourceIndex(indexPath, tempDir, LinkSettings{FollowDirectories: true}).dirs)
+}
+
+func TestSync_SkipLinkedDuplicates(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hard links have no inode numbers on Windows")
+	}
+	tempDir, err := os.MkdirTemp("", "test-sync-links")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	os.MkdirAll(filepath.Join(sourceDir, "Artist"), 0755)
+	os.WriteFile(filepath.Join(sourceDir, "Artist", "a.mp3"), []byte("audio"), 0644)
+	os.Link(filepath.Join(sourceDir, "Artist", "a.mp3"), filepath.Join(sourceDir, "Artist", "b.mp3"))
+
+	opts := Options{Sources: []string{sourceDir}, Destination: filepath.Join(tempDir, "destination"), Transcoder: newFakeTranscoder(), SkipLinkedDuplicates: true}
+	report, err := Sync(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"copied": 1}, report.Counts["sync"])
+
+	missing, err := Verify(context.Background(), opts)
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+}
@@ -0,0 +1,261 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// syncJournalName is the write-ahead journal of the current or last sync,
+// stored in the destination root.
+const syncJournalName = ".sync-journal.jsonl"
+
+// Journal actions. Every planned file is recorded before any work starts,
+// and each file is marked as started before its output is written, so a
+// journal without a "complete" entry tells which outputs may be unfinished.
+const (
+	journalPlan     = "plan"
+	journalStart    = "start"
+	journalDone     = "done"
+	journalFailed   = "failed"
+	journalComplete = "complete"
+)
+
+// syncJournalEntry is one line of the sync journal. Source is the path of
+// the source file, and Destination the name of the output in the
+// destination, e.g. "Artist/a.mp3", so that the journal is still valid when
+// the destination is mounted somewhere else.
+type syncJournalEntry struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Operation   string    `json:"operation,omitempty"` // "transcode" or "copy"
+	Source      string    `json:"source,omitempty"`
+	Destination string    `json:"destination,omitempty"`
+}
+
+// syncJournal appends entries to the journal of a run and flushes each one
+// to the device before the work it describes begins.
+type syncJournal struct {
+	mu   sync.Mutex
+	file writableFile
+}
+
+// createSyncJournal starts a new journal in the root of the filesystem of
+// the destination, replacing the journal of the previous run.
+func createSyncJournal(fsys writableFS) (*syncJournal, error) {
+	file, err := fsys.Create(syncJournalName)
+	if err != nil {
+		return nil, err
+	}
+	return &syncJournal{file: file}, nil
+}
+
+// record appends an entry and syncs it to stable storage. A nil journal,
+// for a destination without one, records nothing.
+func (j *syncJournal) record(entry syncJournalEntry) error {
+	if j == nil {
+		return nil
+	}
+	entry.Time = time.Now()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// complete marks the run as finished and closes the journal.
+func (j *syncJournal) complete() error {
+	if j == nil {
+		return nil
+	}
+	if err := j.record(syncJournalEntry{Action: journalComplete}); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
+
+// close closes the journal without marking the run as finished, leaving it
+// to be recovered by the next run.
+func (j *syncJournal) close() {
+	if j != nil {
+		j.file.Close()
+	}
+}
+
+// readSyncJournal returns the entries of the journal in the root of the
+// filesystem of the destination. A missing journal has no entries. A partly
+// written last line, e.g. from a power cut, is ignored.
+func readSyncJournal(fsys fs.FS) ([]syncJournalEntry, error) {
+	file, err := fsys.Open(syncJournalName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []syncJournalEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry syncJournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// unfinishedRun summarizes the journal of a run that didn't complete: the
+// number of planned and finished files, and the operations that were started
+// but never finished.
+type unfinishedRun struct {
+	planned    int
+	done       int
+	inProgress []syncJournalEntry
+}
+
+// findUnfinishedRun returns the state of the run in the journal, or false if
+// there is no journal or the run completed.
+func findUnfinishedRun(entries []syncJournalEntry) (unfinishedRun, bool) {
+	if len(entries) == 0 || entries[len(entries)-1].Action == journalComplete {
+		return unfinishedRun{}, false
+	}
+
+	var run unfinishedRun
+	started := make(map[string]syncJournalEntry)
+	var order []string
+	for _, entry := range entries {
+		switch entry.Action {
+		case journalPlan:
+			run.planned++
+		case journalStart:
+			started[entry.Destination] = entry
+			order = append(order, entry.Destination)
+		case journalDone:
+			run.done++
+			delete(started, entry.Destination)
+		case journalFailed:
+			delete(started, entry.Destination)
+		}
+	}
+
+	for _, destination := range order {
+		if entry, ok := started[destination]; ok {
+			run.inProgress = append(run.inProgress, entry)
+			delete(started, destination)
+		}
+	}
+	return run, true
+}
+
+// recoverInterruptedRun checks the journal of a destination directory, whose
+// filesystem is fsys, for a run that was interrupted. Outputs that were being
+// written when it stopped are checked with validate and removed if they're
+// incomplete, so that the planner syncs them again; finished outputs are
+// kept.
+func (r *run) recoverInterruptedRun(fsys writableFS, destinationDir string, validate func(fsys fs.FS, entry syncJournalEntry, output fs.FileInfo) error) error {
+	entries, err := readSyncJournal(fsys)
+	if err != nil {
+		return err
+	}
+	run, ok := findUnfinishedRun(entries)
+	if !ok {
+		return nil
+	}
+
+	r.reporter.emit(Event{Type: EventStart, Operation: "resume", Path: destinationDir, Done: run.done, Total: run.planned})
+	counts := map[string]int{"finished": run.done}
+	for _, entry := range run.inProgress {
+		outputPath := filepath.Join(destinationDir, filepath.FromSlash(entry.Destination))
+		output, err := fsys.Stat(entry.Destination)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			r.reporter.fail("resume", outputPath, err)
+			continue
+		}
+		if err := validate(fsys, entry, output); err != nil {
+			if err := fsys.Remove(entry.Destination); err != nil {
+				r.reporter.fail("resume", outputPath, err)
+				continue
+			}
+			r.reporter.warn("resume", outputPath, fmt.Sprintf("Removed unfinished output (%v)", err))
+			counts["removed"]++
+		} else {
+			counts["validated"]++
+		}
+	}
+
+	r.reporter.emit(Event{Type: EventSummary, Operation: "resume", Counts: counts})
+	return nil
+}
+
+// validateOutput checks that an output in fsys whose operation was
+// interrupted is complete: a copy must have the size of its source, and a
+// transcoded file must have the duration of its source.
+func (r *run) validateOutput(fsys fs.FS, entry syncJournalEntry, output fs.FileInfo) error {
+	if entry.Operation == "copy" {
+		source, err := os.Stat(entry.Source)
+		if err != nil {
+			return err
+		}
+		if source.Size() != output.Size() {
+			return fmt.Errorf("size %d of %d bytes", output.Size(), source.Size())
+		}
+		return nil
+	}
+
+	source, err := r.transcoder.Probe(entry.Source)
+	if err != nil {
+		return err
+	}
+	destination, err := r.probeInFS(fsys, entry.Destination)
+	if err != nil {
+		return err
+	}
+	if math.Abs(source.Duration-destination.Duration) > 1 {
+		return fmt.Errorf("duration %.1fs of %.1fs", destination.Duration, source.Duration)
+	}
+	return nil
+}
+
+// probeInFS probes the named file in fsys with the transcoder of the run.
+// Files that aren't in a local directory are probed from a temporary copy.
+func (r *run) probeInFS(fsys fs.FS, name string) (MediaInfo, error) {
+	if local, ok := fsys.(osFS); ok {
+		filePath, err := local.path("probe", name)
+		if err != nil {
+			return MediaInfo{}, err
+		}
+		return r.transcoder.Probe(filePath)
+	}
+
+	tempDir, err := os.MkdirTemp("", "sync-probe-")
+	if err != nil {
+		return MediaInfo{}, err
+	}
+	defer os.RemoveAll(tempDir)
+	if err := copyFile(fsys, name, newOSFS(tempDir), path.Base(name)); err != nil {
+		return MediaInfo{}, err
+	}
+	return r.transcoder.Probe(filepath.Join(tempDir, path.Base(name)))
+}
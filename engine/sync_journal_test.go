@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSyncJournal writes journal entries to the destination directory, as
+// left behind by an interrupted run.
+func writeSyncJournal(t *testing.T, destinationDir string, entries ...syncJournalEntry) {
+	file, err := os.Create(filepath.Join(destinationDir, syncJournalName))
+	if err != nil {
+		t.Fatalf("failed to create journal: %v", err)
+	}
+	defer file.Close()
+	for _, entry := range entries {
+		data, _ := json.Marshal(entry)
+		file.Write(append(data, '\n'))
+	}
+}
+
+func TestFindUnfinishedRun(t *testing.T) {
+	entries := []syncJournalEntry{
+		{Action: journalPlan, Destination: "a.mp3"},
+		{Action: journalPlan, Destination: "b.mp3"},
+		{Action: journalPlan, Destination: "c.mp3"},
+		{Action: journalStart, Destination: "a.mp3"},
+		{Action: journalStart, Destination: "b.mp3"},
+		{Action: journalDone, Destination: "a.mp3"},
+	}
+
+	run, ok := findUnfinishedRun(entries)
+	assert.True(t, ok)
+	assert.Equal(t, 3, run.planned)
+	assert.Equal(t, 1, run.done)
+	assert.Equal(t, []syncJournalEntry{{Action: journalStart, Destination: "b.mp3"}}, run.inProgress)
+
+	_, ok = findUnfinishedRun(append(entries, syncJournalEntry{Action: journalComplete}))
+	assert.False(t, ok)
+	_, ok = findUnfinishedRun(nil)
+	assert.False(t, ok)
+}
+
+func TestFindAndTranscodeFiles_ResumesInterruptedRun(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-resume")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	destinationDir := filepath.Join(tempDir, "destination")
+	os.MkdirAll(sourceDir, 0755)
+	os.MkdirAll(destinationDir, 0755)
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		os.WriteFile(filepath.Join(sourceDir, name), []byte("complete audio of "+name), 0644)
+	}
+
+	// The previous run finished a, was interrupted while copying b and
+	// never started c
+	os.WriteFile(filepath.Join(destinationDir, "a.mp3"), []byte("complete audio of a.mp3"), 0644)
+	os.WriteFile(filepath.Join(destinationDir, "b.mp3"), []byte("comp"), 0644)
+	entries := []syncJournalEntry{}
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		entries = append(entries, syncJournalEntry{Action: journalPlan, Operation: "copy", Source: filepath.Join(sourceDir, name), Destination: name})
+	}
+	entries = append(entries,
+		syncJournalEntry{Action: journalStart, Operation: "copy", Source: filepath.Join(sourceDir, "a.mp3"), Destination: "a.mp3"},
+		syncJournalEntry{Action: journalDone, Operation: "copy", Source: filepath.Join(sourceDir, "a.mp3"), Destination: "a.mp3"},
+		syncJournalEntry{Action: journalStart, Operation: "copy", Source: filepath.Join(sourceDir, "b.mp3"), Destination: "b.mp3"},
+	)
+	writeSyncJournal(t, destinationDir, entries...)
+
+	err = newRun(nil, nil).findAndTranscodeFiles(context.Background(), sourceDir, destinationDir, DefaultProfile(), 1)
+	assert.NoError(t, err)
+
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		data, _ := os.ReadFile(filepath.Join(destinationDir, name))
+		assert.Equal(t, "complete audio of "+name, string(data))
+	}
+
+	// The new run planned only the unfinished files and completed
+	journal, err := readSyncJournal(newOSFS(destinationDir))
+	assert.NoError(t, err)
+	_, unfinished := findUnfinishedRun(journal)
+	assert.False(t, unfinished)
+	var planned []string
+	for _, entry := range journal {
+		if entry.Action == journalPlan {
+			planned = append(planned, entry.Destination)
+		}
+	}
+	assert.ElementsMatch(t, []string{"b.mp3", "c.mp3"}, planned)
+}
+
+func TestRecoverInterruptedRun_KeepsValidOutput(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-resume-valid")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	output := filepath.Join(tempDir, "a.mp3")
+	os.WriteFile(output, []byte("audio"), 0644)
+	writeSyncJournal(t, tempDir,
+		syncJournalEntry{Action: journalPlan, Operation: "transcode", Destination: "a.mp3"},
+		syncJournalEntry{Action: journalStart, Operation: "transcode", Destination: "a.mp3"},
+	)
+
+	var validated []string
+	err = newRun(nil, nil).recoverInterruptedRun(newOSFS(tempDir), tempDir, func(fsys fs.FS, entry syncJournalEntry, output fs.FileInfo) error {
+		validated = append(validated, entry.Destination)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.mp3"}, validated)
+	assert.FileExists(t, output)
+}
+
+func TestRecoverInterruptedRun_MemFS(t *testing.T) {
+	fsys := newMemFS()
+	fsys.writeFile("a.mp3", []byte("comp"))
+	journal, err := createSyncJournal(fsys)
+	assert.NoError(t, err)
+	journal.record(syncJournalEntry{Action: journalPlan, Operation: "copy", Destination: "a.mp3"})
+	journal.record(syncJournalEntry{Action: journalStart, Operation: "copy", Destination: "a.mp3"})
+	journal.close()
+
+	// The unfinished output is removed through the filesystem
+	err = newRun(nil, nil).recoverInterruptedRun(fsys, "/usb", func(fsys fs.FS, entry syncJournalEntry, output fs.FileInfo) error {
+		assert.Equal(t, int64(4), output.Size())
+		return errors.New("size 4 of 10 bytes")
+	})
+	assert.NoError(t, err)
+	_, err = fsys.Stat("a.mp3")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func TestRecoverInterruptedRun_MovedDestination(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-resume-moved")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	os.MkdirAll(filepath.Join(sourceDir, "Artist"), 0755)
+	os.WriteFile(filepath.Join(sourceDir, "Artist", "a.mp3"), []byte("complete audio"), 0644)
+
+	// The stick was mounted at another path when the run was interrupted
+	destinationDir := filepath.Join(tempDir, "stick")
+	os.MkdirAll(filepath.Join(destinationDir, "Artist"), 0755)
+	os.WriteFile(filepath.Join(destinationDir, "Artist", "a.mp3"), []byte("comp"), 0644)
+	source := filepath.Join(sourceDir, "Artist", "a.mp3")
+	writeSyncJournal(t, destinationDir,
+		syncJournalEntry{Action: journalPlan, Operation: "copy", Source: source, Destination: "Artist/a.mp3"},
+		syncJournalEntry{Action: journalStart, Operation: "copy", Source: source, Destination: "Artist/a.mp3"},
+	)
+
+	r := newRun(nil, newFakeTranscoder())
+	err = r.recoverInterruptedRun(newOSFS(destinationDir), destinationDir, r.validateOutput)
+	assert.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(destinationDir, "Artist", "a.mp3"))
+}
+
+func TestValidateOutput_MemFS(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-validate-output")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	source := filepath.Join(tempDir, "a.flac")
+	os.WriteFile(source, []byte("audio"), 0644)
+
+	fake := newFakeTranscoder()
+	fake.setMedia(source, MediaInfo{Codec: "flac", Duration: 200})
+	fsys := newMemFS()
+	fsys.writeFile("Artist/a.mp3", []byte("transcoded"))
+	output, _ := fsys.Stat("Artist/a.mp3")
+
+	// The output is probed from the filesystem of the destination; the fake
+	// transcoder reports no duration for it
+	err = newRun(nil, fake).validateOutput(fsys, syncJournalEntry{Operation: "transcode", Source: source, Destination: "Artist/a.mp3"}, output)
+	assert.EqualError(t, err, "duration 0.0s of 200.0s")
+	err = newRun(nil, fake).validateOutput(fsys, syncJournalEntry{Operation: "transcode", Source: source, Destination: "Artist/b.mp3"}, output)
+	assert.Error(t, err)
+}
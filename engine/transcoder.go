@@ -0,0 +1,60 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Transcoder probes music files and transcodes them to MP3.
+type Transcoder interface {
+	// Probe returns the audio properties and tags of the file at path.
+	Probe(path string) (MediaInfo, error)
+
+	// Transcode writes the music file at sourcePath to destinationPath as an
+	// MP3, applying any audio filter and tags from opts. onProgress, if not
+	// nil, is called with the percentage transcoded so far. It returns the
+	// duration of the audio in seconds.
+	Transcode(sourcePath, destinationPath string, opts TranscodeOptions, onProgress func(float64)) (float64, error)
+
+	// MeasureLoudness returns the EBU R128 integrated loudness, true peak
+	// and duration of the file at path.
+	MeasureLoudness(path string) (LoudnessMeasurement, error)
+
+	// DecodePCM decodes up to seconds of the file at path to mono samples
+	// at sampleRate, between -1 and 1.
+	DecodePCM(path string, sampleRate, seconds int) ([]float64, error)
+}
+
+// NewTranscoder returns a transcoder by name: "goffmpeg" for the goffmpeg
+// library, or "ffmpeg" to run the ffmpeg and ffprobe commands directly.
+func NewTranscoder(name string) (Transcoder, error) {
+	switch name {
+	case "goffmpeg":
+		return goffmpegTranscoder{}, nil
+	case "ffmpeg":
+		return newFFmpegTranscoder(), nil
+	default:
+		return nil, fmt.Errorf("unknown transcoder %q, expected goffmpeg or ffmpeg", name)
+	}
+}
+
+// transcodeFileAtPath transcodes the music file at sourcePath to .mp3 format
+// with the transcoder of the run and writes it to destinationPath, creating
+// any missing directories.
+//
+// Returns the duration of the audio in seconds.
+func (r *run) transcodeFileAtPath(sourcePath, destinationPath string, opts TranscodeOptions, onProgress func(float64)) (float64, error) {
+	if err := os.MkdirAll(filepath.Dir(destinationPath), 0755); err != nil {
+		return 0, fmt.Errorf("❗️Failed to create directories: %v", err)
+	}
+	opts.Logger = r.logger
+	return r.transcoder.Transcode(sourcePath, destinationPath, opts, onProgress)
+}
+
+// copiesAudio reports whether a transcode only rewrites the tags of an MP3
+// file, so that its audio can be copied as-is.
+func copiesAudio(sourcePath string, opts TranscodeOptions) bool {
+	return opts.AudioFilter == "" && strings.EqualFold(filepath.Ext(sourcePath), ".mp3")
+}
@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewTranscoder(t *testing.T) {
+	trans, err := NewTranscoder("ffmpeg")
+	assert.NoError(t, err)
+	assert.Equal(t, newFFmpegTranscoder(), trans)
+
+	trans, err = NewTranscoder("goffmpeg")
+	assert.NoError(t, err)
+	assert.Equal(t, goffmpegTranscoder{}, trans)
+
+	_, err = NewTranscoder("sox")
+	assert.Error(t, err)
+}
+
+func TestFindAndTranscodeFiles_FakeTranscoder(t *testing.T) {
+	fake := newFakeTranscoder()
+	r, events := recordEvents(fake)
+
+	tempDir, err := os.MkdirTemp("", "test-fake-transcoder")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	destinationDir := filepath.Join(tempDir, "destination")
+	for _, path := range []string{"a.m4a", "b.aif", "Artist/c.mp3", "broken.wav", "notes.txt"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(sourceDir, path)), 0755)
+		os.WriteFile(filepath.Join(sourceDir, path), []byte("audio"), 0644)
+	}
+	fake.setMedia(filepath.Join(sourceDir, "a.m4a"), MediaInfo{Codec: "aac", Duration: 180, Tags: map[string]string{"title": "A"}})
+	fake.fail(filepath.Join(sourceDir, "broken.wav"), errors.New("invalid data found when processing input"))
+
+	err = r.findAndTranscodeFiles(context.Background(), sourceDir, destinationDir, DefaultProfile(), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"copied": 1, "failed": 1, "transcoded": 2}, summaryCounts(events(), "sync"))
+
+	assert.ElementsMatch(t, []string{filepath.Join(sourceDir, "a.m4a"), filepath.Join(sourceDir, "b.aif"), filepath.Join(sourceDir, "broken.wav")}, fake.transcodedFiles())
+	assert.FileExists(t, filepath.Join(destinationDir, "a.mp3"))
+	assert.FileExists(t, filepath.Join(destinationDir, "b.mp3"))
+	assert.FileExists(t, filepath.Join(destinationDir, "Artist", "c.mp3"))
+	assert.NoFileExists(t, filepath.Join(destinationDir, "broken.mp3"))
+	assert.NoFileExists(t, filepath.Join(destinationDir, "notes.mp3"))
+
+	// The output has the source's properties as an MP3
+	info, err := fake.Probe(filepath.Join(destinationDir, "a.mp3"))
+	assert.NoError(t, err)
+	assert.Equal(t, "mp3", info.Codec)
+	assert.Equal(t, 180.0, info.Duration)
+
+	// The failed file is retried on the next run, the others are up to date
+	err = r.findAndTranscodeFiles(context.Background(), sourceDir, destinationDir, DefaultProfile(), 1)
+	assert.NoError(t, err)
+	assert.Len(t, fake.transcodedFiles(), 4)
+}
+
+func TestFindAndTranscodeFiles_KeepsOutputNotWrittenByFailedRun(t *testing.T) {
+	fake := newFakeTranscoder()
+	r := newRun(nil, fake)
+
+	tempDir, err := os.MkdirTemp("", "test-failed-output")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	destinationDir := filepath.Join(tempDir, "destination")
+	source := filepath.Join(sourceDir, "a.m4a")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(source, []byte("audio"), 0644)
+	assert.NoError(t, r.findAndTranscodeFiles(context.Background(), sourceDir, destinationDir, DefaultProfile(), 1))
+	output, err := os.ReadFile(filepath.Join(destinationDir, "a.mp3"))
+	assert.NoError(t, err)
+
+	// The changed source fails before anything is written, so the output of
+	// the earlier run stays until the next run replaces it
+	os.WriteFile(source, []byte("changed audio"), 0644)
+	fake.fail(source, errors.New("invalid data found when processing input"))
+	assert.NoError(t, r.findAndTranscodeFiles(context.Background(), sourceDir, destinationDir, DefaultProfile(), 1))
+	assert.Len(t, fake.transcodedFiles(), 2)
+	kept, err := os.ReadFile(filepath.Join(destinationDir, "a.mp3"))
+	assert.NoError(t, err)
+	assert.Equal(t, output, kept)
+}
+
+func TestFindAndTranscodeFiles_FakeTranscoderPathTemplate(t *testing.T) {
+	fake := newFakeTranscoder()
+	r := newRun(nil, fake)
+
+	tempDir, err := os.MkdirTemp("", "test-fake-transcoder-template")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	destinationDir := filepath.Join(tempDir, "destination")
+	os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "01.m4a"), []byte("audio"), 0644)
+	fake.setMedia(filepath.Join(sourceDir, "01.m4a"), MediaInfo{Codec: "aac", Tags: map[string]string{"albumartist": "Band", "title": "Opener"}})
+
+	prof := DefaultProfile()
+	prof.PathTemplate = "{albumartist}/{title}"
+	err = r.findAndTranscodeFiles(context.Background(), sourceDir, destinationDir, prof, 2)
+	assert.NoError(t, err)
+	assert.FileExists(t, filepath.Join(destinationDir, "Band", "Opener.mp3"))
+
+	// The tags are kept in the source index until the file changes
+	fake.setMedia(filepath.Join(sourceDir, "01.m4a"), MediaInfo{Codec: "aac", Tags: map[string]string{"albumartist": "Band", "title": "Retitled"}})
+	assert.NoError(t, r.findAndTranscodeFiles(context.Background(), sourceDir, destinationDir, prof, 2))
+	assert.NoFileExists(t, filepath.Join(destinationDir, "Band", "Retitled.mp3"))
+	os.WriteFile(filepath.Join(sourceDir, "01.m4a"), []byte("retitled audio"), 0644)
+	assert.NoError(t, r.findAndTranscodeFiles(context.Background(), sourceDir, destinationDir, prof, 2))
+	assert.FileExists(t, filepath.Join(destinationDir, "Band", "Retitled.mp3"))
+}
@@ -0,0 +1,361 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// TrashDirName is the directory in the destination root that removed
+	// files are moved to. It is skipped when scanning the destination.
+	TrashDirName = ".sync-trash"
+
+	// trashJournalName is the journal of every removal, restore and purge,
+	// stored in the trash directory.
+	trashJournalName = "journal.jsonl"
+
+	// trashSessionLayout names the per-run subdirectories of the trash.
+	trashSessionLayout = "2006-01-02T15-04-05"
+)
+
+// trashJournalEntry is one line of the trash journal. Original is the name
+// of a removed file in the directory it was removed from, and Trashed its
+// name in the trash directory.
+type trashJournalEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"` // "remove", "restore" or "purge"
+	Session  string    `json:"session"`
+	Original string    `json:"original,omitempty"`
+	Trashed  string    `json:"trashed,omitempty"`
+}
+
+// trash moves removed files into a timestamped session directory instead of
+// deleting them, preserving their names relative to the directory they were
+// removed from, so that they can be restored with restoreTrashSession.
+type trash struct {
+	// files is the filesystem of the directory that files are removed
+	// from, which is filesDir
+	files    writableFS
+	filesDir string
+
+	// fsys is the filesystem that the trash directory is root in, which is
+	// dir
+	fsys writableFS
+	root string
+	dir  string
+
+	session string
+}
+
+// newTrash returns a trash for the files of files, which is rooted at
+// filesDir, that moves them to TrashDirName in it.
+func newTrash(files writableFS, filesDir string, now time.Time) *trash {
+	return &trash{
+		files:    files,
+		filesDir: filesDir,
+		fsys:     files,
+		root:     TrashDirName,
+		dir:      filepath.Join(filesDir, TrashDirName),
+		session:  now.Format(trashSessionLayout),
+	}
+}
+
+// openTrash opens a destination directory or URL and returns the trash of
+// its files. Files are moved to trashDir, which is a local path or a path on
+// the server of a remote destination, or to TrashDirName in the destination
+// if trashDir is empty. A trash directory outside the destination is opened
+// as a filesystem of its own.
+func (r *run) openTrash(destination, trashDir string, now time.Time) (*trash, error) {
+	files, dir, err := r.openDestination(destination)
+	if err != nil {
+		return nil, err
+	}
+	t := newTrash(files, dir, now)
+	if trashDir == "" {
+		return t, nil
+	}
+
+	t.dir = trashDir
+	if name, err := nameInDir(dir, trashDir); err == nil {
+		t.root = name
+		return t, nil
+	}
+	t.root = "."
+	if !IsRemote(destination) {
+		t.fsys = newOSFS(trashDir)
+		return t, nil
+	}
+
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Clean("/" + filepath.ToSlash(trashDir))
+	if t.fsys, t.dir, err = r.openDestination(u.String()); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// simulate makes the trash move files on simulations of its filesystems, see
+// dryRunFS, so that nothing is changed.
+func (t *trash) simulate() {
+	shared := t.fsys == t.files
+	t.files = newDryRunFS(t.files)
+	if shared {
+		t.fsys = t.files
+	} else {
+		t.fsys = newDryRunFS(t.fsys)
+	}
+}
+
+// path returns where a name in the trash directory is, for messages.
+func (t *trash) path(name string) string {
+	return filepath.Join(t.dir, filepath.FromSlash(name))
+}
+
+// filePath returns where a name in the directory that files are removed
+// from is, for messages.
+func (t *trash) filePath(name string) string {
+	return filepath.Join(t.filesDir, filepath.FromSlash(name))
+}
+
+// remove moves the file at filePath, which is in the directory that files
+// are removed from, into the trash and records it in the journal. It returns
+// where the file was moved to.
+func (t *trash) remove(filePath string) (string, error) {
+	name, err := nameInDir(t.filesDir, filePath)
+	if err != nil {
+		return "", err
+	}
+
+	trashed := path.Join(t.session, name)
+	if err := moveFile(t.files, name, t.fsys, path.Join(t.root, trashed)); err != nil {
+		return "", err
+	}
+
+	entry := trashJournalEntry{Time: time.Now(), Action: "remove", Session: t.session, Original: name, Trashed: trashed}
+	if err := appendTrashJournal(t.fsys, t.root, entry); err != nil {
+		return t.path(trashed), fmt.Errorf("moved %s to trash but failed to write journal: %v", filePath, err)
+	}
+	return t.path(trashed), nil
+}
+
+// moveFile moves the named source file of from to the named destination of
+// to, creating the destination directories. If the file can't be renamed,
+// e.g. because the trash is on another device, it is copied and then
+// removed.
+func moveFile(from writableFS, source string, to writableFS, destination string) error {
+	if err := to.MkdirAll(path.Dir(destination), 0755); err != nil {
+		return fmt.Errorf("failed to create directories: %v", err)
+	}
+
+	if err := renameFile(from, source, to, destination); err == nil {
+		return nil
+	}
+
+	if err := copyFile(from, source, to, destination); err != nil {
+		return err
+	}
+	return from.Remove(source)
+}
+
+// renameFile renames a file from one filesystem to another, which works if
+// they are the same filesystem or both local.
+func renameFile(from writableFS, source string, to writableFS, destination string) error {
+	if from == to {
+		return from.Rename(source, destination)
+	}
+	fromOS, ok := from.(osFS)
+	toOS, ok2 := to.(osFS)
+	if !ok || !ok2 {
+		return &fs.PathError{Op: "rename", Path: source, Err: errors.New("not on the same filesystem")}
+	}
+	sourcePath, err := fromOS.path("rename", source)
+	if err != nil {
+		return err
+	}
+	destinationPath, err := toOS.path("rename", destination)
+	if err != nil {
+		return err
+	}
+	return os.Rename(sourcePath, destinationPath)
+}
+
+// appendTrashJournal adds an entry to the journal in the trash directory.
+func appendTrashJournal(fsys writableFS, trashDir string, entry trashJournalEntry) error {
+	if err := fsys.MkdirAll(trashDir, 0755); err != nil {
+		return err
+	}
+
+	file, err := fsys.Append(path.Join(trashDir, trashJournalName))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// readTrashJournal returns every entry of the journal in the trash directory.
+// A missing journal has no entries.
+func readTrashJournal(fsys fs.FS, trashDir string) ([]trashJournalEntry, error) {
+	file, err := fsys.Open(path.Join(trashDir, trashJournalName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []trashJournalEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry trashJournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid trash journal entry %q: %v", scanner.Text(), err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// restoreTrashSession moves the files removed in a session back to their
+// original paths. When session is empty, the most recent session that still
+// has files in the trash is restored. Files whose original path exists again
+// are left in the trash and reported.
+//
+// Returns the number of restored files.
+func (r *run) restoreTrashSession(t *trash, session string) (int, error) {
+	entries, err := readTrashJournal(t.fsys, t.root)
+	if err != nil {
+		return 0, err
+	}
+
+	// Files that are still in the trash, by session
+	pending := make(map[string][]trashJournalEntry)
+	for _, entry := range entries {
+		switch entry.Action {
+		case "remove":
+			pending[entry.Session] = append(pending[entry.Session], entry)
+		case "restore":
+			pending[entry.Session] = removeJournalEntry(pending[entry.Session], entry.Trashed)
+		case "purge":
+			delete(pending, entry.Session)
+		}
+	}
+
+	if session == "" {
+		for _, candidate := range sortedKeys(pending) {
+			if len(pending[candidate]) > 0 {
+				session = candidate
+			}
+		}
+	}
+	if len(pending[session]) == 0 {
+		return 0, fmt.Errorf("nothing to restore from %s", t.dir)
+	}
+
+	restored := 0
+	for _, entry := range pending[session] {
+		original := t.filePath(entry.Original)
+		if _, err := t.files.Stat(entry.Original); err == nil {
+			r.reporter.fail("restore", original, fmt.Errorf("file already exists"))
+			continue
+		}
+
+		if err := moveFile(t.fsys, path.Join(t.root, entry.Trashed), t.files, entry.Original); err != nil {
+			r.reporter.fail("restore", original, err)
+			continue
+		}
+		restored++
+		r.reporter.emit(Event{Type: EventFinished, Operation: "restore", Path: original, Source: t.path(entry.Trashed)})
+
+		restore := trashJournalEntry{Time: time.Now(), Action: "restore", Session: session, Original: entry.Original, Trashed: entry.Trashed}
+		if err := appendTrashJournal(t.fsys, t.root, restore); err != nil {
+			return restored, err
+		}
+	}
+
+	return restored, nil
+}
+
+// removeJournalEntry returns the entries without the one for the trashed path.
+func removeJournalEntry(entries []trashJournalEntry, trashed string) []trashJournalEntry {
+	var result []trashJournalEntry
+	for _, entry := range entries {
+		if entry.Trashed != trashed {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
+
+// purgeTrash permanently deletes trash sessions that are older than the
+// specified age. Returns the purged sessions.
+func (r *run) purgeTrash(t *trash, olderThan time.Duration, now time.Time) ([]string, error) {
+	entries, err := t.fsys.ReadDir(t.root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		started, err := time.ParseInLocation(trashSessionLayout, entry.Name(), time.Local)
+		if err != nil || now.Sub(started) < olderThan {
+			continue
+		}
+
+		if err := t.fsys.RemoveAll(path.Join(t.root, entry.Name())); err != nil {
+			return purged, err
+		}
+		purged = append(purged, entry.Name())
+		r.reporter.emit(Event{Type: EventFinished, Operation: "purge", Path: entry.Name()})
+
+		purge := trashJournalEntry{Time: now, Action: "purge", Session: entry.Name()}
+		if err := appendTrashJournal(t.fsys, t.root, purge); err != nil {
+			return purged, err
+		}
+	}
+
+	sort.Strings(purged)
+	return purged, nil
+}
+
+// ParseAge parses a duration such as "720h" or "30d". Days are not supported
+// by time.ParseDuration but are the natural unit for trash retention.
+func ParseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
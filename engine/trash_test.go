@@ -0,0 +1,181 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrash_RemoveAndRestore(t *testing.T) {
+	r := newRun(nil, nil)
+	tempDir, err := os.MkdirTemp("", "test-trash")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	song := filepath.Join(tempDir, "Artist", "Album", "01 - Song.m4a")
+	os.MkdirAll(filepath.Dir(song), 0755)
+	os.WriteFile(song, []byte("audio"), 0644)
+
+	now := time.Date(2024, 5, 1, 18, 30, 0, 0, time.Local)
+	trash := newTrash(newOSFS(tempDir), tempDir, now)
+	trashed, err := trash.remove(song)
+	assert.NoError(t, err)
+
+	// The relative path is preserved under the session directory
+	assert.Equal(t, filepath.Join(tempDir, TrashDirName, "2024-05-01T18-30-00", "Artist", "Album", "01 - Song.m4a"), trashed)
+	assert.NoFileExists(t, song)
+	assert.FileExists(t, trashed)
+
+	entries, err := readTrashJournal(newOSFS(tempDir), TrashDirName)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "remove", entries[0].Action)
+	assert.Equal(t, "Artist/Album/01 - Song.m4a", entries[0].Original)
+	assert.Equal(t, "2024-05-01T18-30-00/Artist/Album/01 - Song.m4a", entries[0].Trashed)
+
+	restored, err := r.restoreTrashSession(trash, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored)
+	assert.FileExists(t, song)
+	assert.NoFileExists(t, trashed)
+
+	// Nothing is left to restore
+	_, err = r.restoreTrashSession(trash, "")
+	assert.Error(t, err)
+}
+
+func TestRestoreTrashSession_RestoresMostRecentSession(t *testing.T) {
+	r := newRun(nil, nil)
+	tempDir, err := os.MkdirTemp("", "test-trash-sessions")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	older := filepath.Join(tempDir, "older.mp3")
+	newer := filepath.Join(tempDir, "newer.mp3")
+	existing := filepath.Join(tempDir, "existing.mp3")
+	for _, path := range []string{older, newer, existing} {
+		os.WriteFile(path, []byte("audio"), 0644)
+	}
+
+	first := time.Date(2024, 5, 1, 18, 30, 0, 0, time.Local)
+	newTrash(newOSFS(tempDir), tempDir, first).remove(older)
+	secondTrash := newTrash(newOSFS(tempDir), tempDir, first.Add(time.Hour))
+	secondTrash.remove(newer)
+	secondTrash.remove(existing)
+
+	// A new file now exists where one of the removed files was
+	os.WriteFile(existing, []byte("new audio"), 0644)
+
+	restored, err := r.restoreTrashSession(secondTrash, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored)
+	assert.FileExists(t, newer)
+	assert.NoFileExists(t, older)
+
+	data, _ := os.ReadFile(existing)
+	assert.Equal(t, "new audio", string(data))
+
+	// The older session can still be restored explicitly
+	restored, err = r.restoreTrashSession(secondTrash, "2024-05-01T18-30-00")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored)
+	assert.FileExists(t, older)
+}
+
+func TestTrash_CustomDirectory(t *testing.T) {
+	r := newRun(nil, nil)
+	tempDir, err := os.MkdirTemp("", "test-trash-custom")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	dir := filepath.Join(tempDir, "destination")
+	trashDir := filepath.Join(tempDir, "trash")
+	song := filepath.Join(dir, "song.m4a")
+	os.MkdirAll(dir, 0755)
+	os.WriteFile(song, []byte("audio"), 0644)
+
+	// The trash is outside the destination, so it has a filesystem of its own
+	trash, err := r.openTrash(dir, trashDir, time.Now())
+	assert.NoError(t, err)
+	trashed, err := trash.remove(song)
+	assert.NoError(t, err)
+	assert.True(t, filepath.Dir(filepath.Dir(trashed)) == trashDir)
+	assert.FileExists(t, trashed)
+	assert.FileExists(t, filepath.Join(trashDir, trashJournalName))
+
+	restored, err := r.restoreTrashSession(trash, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored)
+	assert.FileExists(t, song)
+
+	// A trash directory inside the destination shares its filesystem
+	trash, err = r.openTrash(dir, filepath.Join(dir, "Removed"), time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, "Removed", trash.root)
+	trashed, err = trash.remove(song)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "Removed"), filepath.Dir(filepath.Dir(trashed)))
+	assert.FileExists(t, trashed)
+}
+
+func TestTrash_RemoveOutsideBaseDir(t *testing.T) {
+	_, err := newTrash(newOSFS("/destination"), "/destination", time.Now()).remove("/elsewhere/song.mp3")
+	assert.Error(t, err)
+}
+
+func TestPurgeTrash(t *testing.T) {
+	r := newRun(nil, nil)
+	tempDir, err := os.MkdirTemp("", "test-trash-purge")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	for _, age := range []time.Duration{40 * 24 * time.Hour, 2 * 24 * time.Hour} {
+		song := filepath.Join(tempDir, "song.mp3")
+		os.WriteFile(song, []byte("audio"), 0644)
+		newTrash(newOSFS(tempDir), tempDir, now.Add(-age)).remove(song)
+	}
+
+	trash := newTrash(newOSFS(tempDir), tempDir, now)
+	trashDir := filepath.Join(tempDir, TrashDirName)
+	purged, err := r.purgeTrash(trash, 30*24*time.Hour, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2024-04-22T12-00-00"}, purged)
+	assert.NoDirExists(t, filepath.Join(trashDir, "2024-04-22T12-00-00"))
+	assert.DirExists(t, filepath.Join(trashDir, "2024-05-30T12-00-00"))
+
+	// Purged sessions can't be restored; the most recent one still can
+	restored, err := r.restoreTrashSession(trash, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored)
+}
+
+func TestPurgeTrash_NoTrash(t *testing.T) {
+	purged, err := newRun(nil, nil).purgeTrash(newTrash(newOSFS("/nonexistent"), "/nonexistent", time.Now()), time.Hour, time.Now())
+	assert.NoError(t, err)
+	assert.Empty(t, purged)
+}
+
+func TestParseAge(t *testing.T) {
+	age, err := ParseAge("30d")
+	assert.NoError(t, err)
+	assert.Equal(t, 30*24*time.Hour, age)
+
+	age, err = ParseAge("12h")
+	assert.NoError(t, err)
+	assert.Equal(t, 12*time.Hour, age)
+
+	_, err = ParseAge("xd")
+	assert.Error(t, err)
+}
@@ -0,0 +1,324 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// syncProfileMarker is a profile stored at the root of a volume. A
+	// volume with this file is synced with it in daemon mode.
+	syncProfileMarker = ".sync-profile.yaml"
+
+	MountInfoPath = "/proc/self/mountinfo"
+	byLabelDir    = "/dev/disk/by-label"
+
+	DefaultMountPollInterval = 2 * time.Second
+)
+
+// volume is a mounted filesystem.
+type volume struct {
+	device     string
+	mountPoint string
+	label      string
+}
+
+// parseMountInfo parses the mount table in the format of /proc/self/mountinfo.
+// Each line has the mount point in the fifth field and the mount source after
+// the " - " separator and filesystem type.
+func parseMountInfo(r io.Reader) ([]volume, error) {
+	var volumes []volume
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 5 || separator < 0 || separator+2 >= len(fields) {
+			return nil, fmt.Errorf("invalid mountinfo line %q", scanner.Text())
+		}
+
+		volumes = append(volumes, volume{
+			device:     unescapeMountField(fields[separator+2]),
+			mountPoint: unescapeMountField(fields[4]),
+		})
+	}
+	return volumes, scanner.Err()
+}
+
+// unescapeMountField decodes the octal escapes such as \040 for a space that
+// the kernel uses in mount table fields.
+func unescapeMountField(field string) string {
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if n, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// unescapeLabel decodes the \x20-style hex escapes that udev uses in the
+// names of /dev/disk/by-label links.
+func unescapeLabel(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if strings.HasPrefix(name[i:], `\x`) && i+3 < len(name) {
+			if n, err := strconv.ParseUint(name[i+2:i+4], 16, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(name[i])
+	}
+	return b.String()
+}
+
+// deviceLabels maps device paths to volume labels using the symlinks in a
+// directory like /dev/disk/by-label. A missing directory has no labels.
+func deviceLabels(dir string) map[string]string {
+	labels := make(map[string]string)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return labels
+	}
+	for _, entry := range entries {
+		device, err := filepath.EvalSymlinks(filepath.Join(dir, entry.Name()))
+		if err == nil {
+			labels[device] = unescapeLabel(entry.Name())
+		}
+	}
+	return labels
+}
+
+// mountedVolumes returns the mounted volumes from the mount table at
+// mountInfo, with labels from the links in labelDir.
+func mountedVolumes(mountInfo, labelDir string) ([]volume, error) {
+	file, err := os.Open(mountInfo)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	volumes, err := parseMountInfo(file)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := deviceLabels(labelDir)
+	for i := range volumes {
+		device, err := filepath.EvalSymlinks(volumes[i].device)
+		if err != nil {
+			device = volumes[i].device
+		}
+		volumes[i].label = labels[device]
+	}
+	return volumes, nil
+}
+
+// volumesInDir returns each directory in a mounts directory such as
+// /media/username as a volume, labelled with the directory name.
+func volumesInDir(dir string) ([]volume, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []volume
+	for _, entry := range entries {
+		if entry.IsDir() {
+			volumes = append(volumes, volume{mountPoint: filepath.Join(dir, entry.Name()), label: entry.Name()})
+		}
+	}
+	return volumes, nil
+}
+
+// loadProfiles reads every YAML profile in a directory.
+func loadProfiles(dir string) ([]Profile, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var profiles []Profile
+	for _, path := range paths {
+		prof, err := LoadProfile(path)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, prof)
+	}
+	return profiles, nil
+}
+
+// profileForVolume returns the profile to sync a volume with: the marker
+// profile at its root if there is one, or otherwise the first profile whose
+// volume label matches.
+func profileForVolume(v volume, profiles []Profile) (Profile, bool, error) {
+	marker := filepath.Join(v.mountPoint, syncProfileMarker)
+	if _, err := os.Stat(marker); err == nil {
+		prof, err := LoadProfile(marker)
+		return prof, err == nil, err
+	}
+
+	for _, prof := range profiles {
+		if prof.VolumeLabel != "" && prof.VolumeLabel == v.label {
+			return prof, true, nil
+		}
+	}
+	return Profile{}, false, nil
+}
+
+// volumeWatcher reports volumes that were mounted since the last check.
+type volumeWatcher struct {
+	list    func() ([]volume, error)
+	mounted map[string]bool
+}
+
+// newVolumes returns the volumes that weren't mounted at the previous check.
+// On the first check every mounted volume is new. A volume that is unmounted
+// and mounted again is new again.
+func (w *volumeWatcher) newVolumes() ([]volume, error) {
+	volumes, err := w.list()
+	if err != nil {
+		return nil, err
+	}
+
+	mounted := make(map[string]bool)
+	var added []volume
+	for _, v := range volumes {
+		mounted[v.mountPoint] = true
+		if !w.mounted[v.mountPoint] {
+			added = append(added, v)
+		}
+	}
+	w.mounted = mounted
+	return added, nil
+}
+
+// syncVolume syncs the source directory to a volume, verifies that every
+// planned file arrived and flushes the writes to the device, then reports
+// that the volume can be unplugged. The volume is locked while it is synced.
+func (r *run) syncVolume(ctx context.Context, sourceDir string, v volume, prof Profile, jobs int) error {
+	if err := checkSeparateDirectories(sourceDir, v.mountPoint); err != nil {
+		return err
+	}
+	err := r.withDestinationLock(v.mountPoint, false, func() error {
+		r.reporter.emit(Event{Type: EventStart, Operation: "sync-volume", Path: v.mountPoint, Message: prof.Name})
+
+		if err := r.findAndTranscodeFiles(ctx, sourceDir, v.mountPoint, prof, jobs); err != nil {
+			return err
+		}
+
+		missing, err := r.verifySync([]string{sourceDir}, v.mountPoint, prof)
+		if err != nil {
+			return err
+		}
+		for _, path := range missing {
+			r.reporter.warn("verify", path, "Missing or empty after sync")
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("%d files are missing on %s", len(missing), v.mountPoint)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Flush after releasing the lock, which writes to the volume too
+	flushWrites()
+	r.reporter.emit(Event{Type: EventFinished, Operation: "sync-volume", Path: v.mountPoint})
+	r.logger.Info("safe to unplug", "mount_point", v.mountPoint, "label", v.label, "profile", prof.Name)
+	return nil
+}
+
+// verifySync returns the planned destination files of the source
+// directories that are missing or empty in the destination directory.
+func (r *run) verifySync(sourceDirs []string, destination string, prof Profile) ([]string, error) {
+	dev, err := r.openDevice(destination)
+	if err != nil {
+		return nil, err
+	}
+	deviceFiles, err := dev.list()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	sources := make([]*syncSource, len(sourceDirs))
+	files := make([][]string, len(sourceDirs))
+	for i, sourceDir := range sourceDirs {
+		if sources[i], err = r.listSource(sourceDir, destination, prof.Links); err != nil {
+			return nil, err
+		}
+		files[i] = sources[i].index.files()
+	}
+	plannedFiles := r.planSources(sources, files, deviceFiles, prof)
+
+	var missing []string
+	for _, file := range plannedFiles {
+		if info, err := dev.stat(file.destinationPath); err != nil || info.Size() == 0 {
+			missing = append(missing, dev.path(file.destinationPath))
+		}
+	}
+	return missing, nil
+}
+
+// runVolumeDaemon checks for newly mounted volumes every interval until ctx is
+// done, and syncs each volume that has a matching profile.
+func (r *run) runVolumeDaemon(ctx context.Context, sourceDir string, profiles []Profile, jobs int, list func() ([]volume, error), interval time.Duration) error {
+	watcher := &volumeWatcher{list: list}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	r.reporter.emit(Event{Type: EventStart, Operation: "daemon", Path: sourceDir})
+	for {
+		added, err := watcher.newVolumes()
+		if err != nil {
+			return err
+		}
+
+		for _, v := range added {
+			prof, ok, err := profileForVolume(v, profiles)
+			if err != nil {
+				r.reporter.fail("sync-volume", v.mountPoint, err)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			// A started sync runs to the end when the daemon is stopped,
+			// so the volume is left safe to unplug
+			if err := r.syncVolume(context.WithoutCancel(ctx), sourceDir, v, prof, jobs); err != nil {
+				r.reporter.fail("sync-volume", v.mountPoint, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const mountInfoFixture = `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+98 22 8:17 / /media/me/CAR\040MUSIC rw,nosuid,nodev,relatime shared:52 - vfat /dev/sdb1 rw,uid=1000
+99 22 0:45 / /run/user/1000 rw,nosuid,nodev shared:60 - tmpfs tmpfs rw,size=1620944k
+`
+
+func TestParseMountInfo(t *testing.T) {
+	volumes, err := parseMountInfo(strings.NewReader(mountInfoFixture))
+	assert.NoError(t, err)
+	assert.Equal(t, []volume{
+		{device: "/dev/sda1", mountPoint: "/"},
+		{device: "/dev/sdb1", mountPoint: "/media/me/CAR MUSIC"},
+		{device: "tmpfs", mountPoint: "/run/user/1000"},
+	}, volumes)
+
+	_, err = parseMountInfo(strings.NewReader("not a mountinfo line\n"))
+	assert.Error(t, err)
+}
+
+func TestMountedVolumes_Labels(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-volumes")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	device := filepath.Join(tempDir, "sdb1")
+	os.WriteFile(device, []byte{}, 0644)
+	labelDir := filepath.Join(tempDir, "by-label")
+	os.MkdirAll(labelDir, 0755)
+	os.Symlink(device, filepath.Join(labelDir, `CAR\x20MUSIC`))
+
+	mountInfo := filepath.Join(tempDir, "mountinfo")
+	os.WriteFile(mountInfo, []byte("98 22 8:17 / /media/stick rw - vfat "+device+" rw\n"), 0644)
+
+	volumes, err := mountedVolumes(mountInfo, labelDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []volume{{device: device, mountPoint: "/media/stick", label: "CAR MUSIC"}}, volumes)
+}
+
+func TestProfileForVolume(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-volume-profile")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	profiles := []Profile{{Name: "car", VolumeLabel: "CARMUSIC"}, {Name: "unlabelled"}}
+
+	prof, ok, err := profileForVolume(volume{mountPoint: tempDir, label: "CARMUSIC"}, profiles)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "car", prof.Name)
+
+	_, ok, err = profileForVolume(volume{mountPoint: tempDir, label: "OTHER"}, profiles)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// A marker profile at the root of the volume wins
+	os.WriteFile(filepath.Join(tempDir, syncProfileMarker), []byte("name: stick\n"), 0644)
+	prof, ok, err = profileForVolume(volume{mountPoint: tempDir, label: "CARMUSIC"}, profiles)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "stick", prof.Name)
+}
+
+func TestVolumeWatcher(t *testing.T) {
+	mounted := []volume{{mountPoint: "/"}}
+	w := &volumeWatcher{list: func() ([]volume, error) { return mounted, nil }}
+
+	added, _ := w.newVolumes()
+	assert.Equal(t, []volume{{mountPoint: "/"}}, added)
+
+	mounted = append(mounted, volume{mountPoint: "/media/stick"})
+	added, _ = w.newVolumes()
+	assert.Equal(t, []volume{{mountPoint: "/media/stick"}}, added)
+
+	// Unplugging and plugging in again syncs again
+	mounted = mounted[:1]
+	added, _ = w.newVolumes()
+	assert.Empty(t, added)
+	mounted = append(mounted, volume{mountPoint: "/media/stick"})
+	added, _ = w.newVolumes()
+	assert.Equal(t, []volume{{mountPoint: "/media/stick"}}, added)
+}
+
+func TestRunVolumeDaemon(t *testing.T) {
+	r := newRun(nil, nil)
+	tempDir, err := os.MkdirTemp("", "test-daemon")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	mountsDir := filepath.Join(tempDir, "media")
+	os.MkdirAll(filepath.Join(sourceDir, "Artist"), 0755)
+	os.WriteFile(filepath.Join(sourceDir, "Artist", "Song.mp3"), []byte("audio"), 0644)
+	os.MkdirAll(filepath.Join(mountsDir, "CARMUSIC"), 0755)
+	os.MkdirAll(filepath.Join(mountsDir, "BACKUP"), 0755)
+
+	// The context is already done, so the daemon checks once and returns
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	list := func() ([]volume, error) { return volumesInDir(mountsDir) }
+	err = r.runVolumeDaemon(ctx, sourceDir, []Profile{{Name: "car", VolumeLabel: "CARMUSIC"}}, 1, list, DefaultMountPollInterval)
+	assert.NoError(t, err)
+
+	assert.FileExists(t, filepath.Join(mountsDir, "CARMUSIC", "Artist", "Song.mp3"))
+	assert.NoFileExists(t, filepath.Join(mountsDir, "BACKUP", "Artist", "Song.mp3"))
+
+	missing, err := r.verifySync([]string{sourceDir}, filepath.Join(mountsDir, "CARMUSIC"), DefaultProfile())
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	missing, err = r.verifySync([]string{sourceDir}, filepath.Join(mountsDir, "BACKUP"), DefaultProfile())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(mountsDir, "BACKUP", "Artist", "Song.mp3")}, missing)
+}
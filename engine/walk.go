@@ -0,0 +1,131 @@
+package engine
+
+import (
+	"context"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultWalkConcurrency is how many directories are read at the same time,
+// which hides the latency of each listing on network shares.
+const defaultWalkConcurrency = 16
+
+// readDirConcurrency is implemented by filesystems that can't take as many
+// directory listings at the same time as defaultWalkConcurrency.
+type readDirConcurrency interface {
+	readDirConcurrency() int
+}
+
+// walkConcurrency returns how many directories of fsys are read at the same
+// time.
+func walkConcurrency(fsys fs.FS) int {
+	if limited, ok := fsys.(readDirConcurrency); ok {
+		return limited.readDirConcurrency()
+	}
+	return defaultWalkConcurrency
+}
+
+// walkDirs calls visit for the root, "", and for every directory that visit
+// returns below it, from a fixed number of workers that take the
+// directories from a queue. Directories are relative paths with a leading
+// slash. The walk stops at the first error of visit, or when ctx is
+// canceled, and returns that error; the context passed to visit is canceled
+// then.
+func walkDirs(ctx context.Context, workers int, visit func(ctx context.Context, dir string) ([]string, error)) error {
+	g, ctx := errgroup.WithContext(ctx)
+	var mu sync.Mutex
+	ready := sync.NewCond(&mu)
+	queue := []string{""}
+	// pending counts the directories that are queued or being visited; the
+	// walk is done when it drops to zero
+	pending := 1
+	stop := context.AfterFunc(ctx, func() {
+		mu.Lock()
+		ready.Broadcast()
+		mu.Unlock()
+	})
+	defer stop()
+
+	for range max(workers, 1) {
+		g.Go(func() error {
+			for {
+				mu.Lock()
+				for len(queue) == 0 && pending > 0 && ctx.Err() == nil {
+					ready.Wait()
+				}
+				if pending == 0 || ctx.Err() != nil {
+					mu.Unlock()
+					return ctx.Err()
+				}
+				// Take the most recently found directory, so that the queue
+				// stays as short as the tree is deep
+				dir := queue[len(queue)-1]
+				queue = queue[:len(queue)-1]
+				mu.Unlock()
+
+				subdirs, err := visit(ctx, dir)
+				if err != nil {
+					return err
+				}
+
+				mu.Lock()
+				queue = append(queue, subdirs...)
+				pending += len(subdirs) - 1
+				ready.Broadcast()
+				mu.Unlock()
+			}
+		})
+	}
+	return g.Wait()
+}
+
+// walkFiles lists the files below dir of fsys, reading several directories
+// at the same time, and sends their names to files as soon as their
+// directory is read, in no particular order. Names are relative to dir, with
+// a leading slash. Only ReadDir is used, so files aren't stat'ed one by one.
+// The trash and log directories are skipped.
+//
+// Returns when the walk is done or ctx is canceled, with the first error.
+func walkFiles(ctx context.Context, fsys fs.FS, dir string, files chan<- string) error {
+	return walkDirs(ctx, walkConcurrency(fsys), func(ctx context.Context, relativeDir string) ([]string, error) {
+		entries, err := fs.ReadDir(fsys, path.Join(dir, relativeDir))
+		if err != nil {
+			return nil, err
+		}
+
+		var subdirs []string
+		for _, entry := range entries {
+			name := relativeDir + "/" + entry.Name()
+			if !entry.IsDir() {
+				select {
+				case files <- name:
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				}
+			} else if entry.Name() != TrashDirName && entry.Name() != LogDirName {
+				subdirs = append(subdirs, name)
+			}
+		}
+		return subdirs, nil
+	})
+}
+
+// sortWalkOrder sorts relative file names the way fs.WalkDir visits them:
+// the entries of each directory by name, with the files below a directory
+// right where the directory is.
+func sortWalkOrder(names []string) {
+	sort.Slice(names, func(i, j int) bool {
+		a, b := strings.Split(names[i], "/"), strings.Split(names[j], "/")
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+}
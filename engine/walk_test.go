@@ -0,0 +1,169 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWalkFiles(t *testing.T) {
+	fsys := fstest.MapFS{
+		"music/A/B/song.mp3":                 {},
+		"music/A b/song.mp3":                 {},
+		"music/A.mp3":                        {},
+		"music/" + TrashDirName + "/old.mp3": {},
+		"music/" + LogDirName + "/sync.log":  {},
+		"music/C/D/E/F/G/deep.m4a":           {},
+		"other/song.mp3":                     {},
+	}
+
+	var mu sync.Mutex
+	var names []string
+	files := make(chan string)
+	collected := make(chan struct{})
+	go func() {
+		for name := range files {
+			mu.Lock()
+			names = append(names, name)
+			mu.Unlock()
+		}
+		close(collected)
+	}()
+	assert.NoError(t, walkFiles(context.Background(), fsys, "music", files))
+	close(files)
+	<-collected
+	assert.ElementsMatch(t, []string{"/A/B/song.mp3", "/A b/song.mp3", "/A.mp3", "/C/D/E/F/G/deep.m4a"}, names)
+
+	// getFilenames returns them in the order of fs.WalkDir
+	sorted, err := getFilenames(fsys, "music")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/A/B/song.mp3", "/A b/song.mp3", "/A.mp3", "/C/D/E/F/G/deep.m4a"}, sorted)
+
+	_, err = getFilenames(fsys, "missing")
+	assert.Error(t, err)
+}
+
+func TestWalkDirs(t *testing.T) {
+	tree := map[string][]string{"": {"/a", "/b"}, "/a": {"/a/c"}, "/b": nil, "/a/c": nil}
+	var mu sync.Mutex
+	var visited []string
+	err := walkDirs(context.Background(), 2, func(ctx context.Context, dir string) ([]string, error) {
+		mu.Lock()
+		visited = append(visited, dir)
+		mu.Unlock()
+		return tree[dir], nil
+	})
+	assert.NoError(t, err)
+	sort.Strings(visited)
+	assert.Equal(t, []string{"", "/a", "/a/c", "/b"}, visited)
+
+	// The directories below one that failed aren't visited
+	failed := errors.New("permission denied")
+	visited = nil
+	err = walkDirs(context.Background(), 2, func(ctx context.Context, dir string) ([]string, error) {
+		mu.Lock()
+		visited = append(visited, dir)
+		mu.Unlock()
+		if dir == "/a" {
+			return nil, failed
+		}
+		return tree[dir], nil
+	})
+	assert.Equal(t, failed, err)
+	assert.NotContains(t, visited, "/a/c")
+}
+
+func TestWalkDirs_Workers(t *testing.T) {
+	// A wide tree is visited by no more than the given number of workers
+	var mu sync.Mutex
+	running, most := 0, 0
+	err := walkDirs(context.Background(), 3, func(ctx context.Context, dir string) ([]string, error) {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+
+		var subdirs []string
+		if strings.Count(dir, "/") < 2 {
+			for i := range 10 {
+				subdirs = append(subdirs, fmt.Sprintf("%s/%d", dir, i))
+			}
+		}
+		return subdirs, nil
+	})
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, most, 3)
+
+	// Canceling the context stops the walk
+	ctx, cancel := context.WithCancel(context.Background())
+	visited := 0
+	err = walkDirs(ctx, 3, func(ctx context.Context, dir string) ([]string, error) {
+		mu.Lock()
+		visited++
+		if visited == 5 {
+			cancel()
+		}
+		mu.Unlock()
+		return []string{dir + "/a", dir + "/b"}, nil
+	})
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestSortWalkOrder(t *testing.T) {
+	names := []string{"/A.mp3", "/A b/song.mp3", "/A/B/song.mp3", "/a.mp3", "/A/song.mp3"}
+	sortWalkOrder(names)
+	assert.Equal(t, []string{"/A/B/song.mp3", "/A/song.mp3", "/A b/song.mp3", "/A.mp3", "/a.mp3"}, names)
+}
+
+func TestSyncToDevice_Streaming(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-sync-streaming")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	for _, path := range []string{"A/1.mp3", "A/2.mp3", "B/C/3.mp3", "D/4.txt", "Old/5.mp3"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(tempDir, path)), 0755)
+		os.WriteFile(filepath.Join(tempDir, path), []byte("audio"), 0644)
+	}
+	r, events := recordEvents(nil)
+
+	// Files stream to the workers while the source is read
+	dev := newFakeDevice(1 << 30)
+	dev.addFile("/Old/5.mp3", 5)
+	assert.NoError(t, r.syncToDevice(context.Background(), []*syncSource{{dir: tempDir, index: r.loadSourceIndex("", tempDir, LinkSettings{})}}, dev, nil, DefaultProfile(), 2, nil, false))
+	pushed := dev.pushedFiles()
+	sort.Strings(pushed)
+	assert.Equal(t, []string{"/A/1.mp3", "/A/2.mp3", "/B/C/3.mp3"}, pushed)
+	assert.Equal(t, map[string]int{"copied": 3}, summaryCounts(events(), "sync"))
+
+	var last Event
+	for _, e := range events() {
+		if e.Type == EventProgress && e.Operation == "sync" {
+			last = e
+		}
+	}
+	assert.Equal(t, 3, last.Done)
+	assert.Equal(t, 3, last.Total)
+
+	// A cancelled sync starts no files
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dev = newFakeDevice(1 << 30)
+	assert.Equal(t, context.Canceled, r.syncToDevice(ctx, []*syncSource{{dir: tempDir, index: r.loadSourceIndex("", tempDir, LinkSettings{})}}, dev, nil, DefaultProfile(), 1, nil, false))
+	assert.Empty(t, dev.pushedFiles())
+}
@@ -0,0 +1,157 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"sort"
+	"time"
+)
+
+// DefaultSettleTime is how long a changed file's size has to stay the same
+// before it is synced, so that files that are still being copied into the
+// source folder aren't transcoded half-written.
+const DefaultSettleTime = 5 * time.Second
+
+// fileChange is a file or directory in the watched tree that was created,
+// modified, or (if removed is set) deleted or moved away.
+type fileChange struct {
+	path    string
+	removed bool
+}
+
+// pendingFile is a changed file that is waiting to become stable.
+type pendingFile struct {
+	size  int64
+	since time.Time
+}
+
+// changeBatch collects changes until the changed files are stable.
+type changeBatch struct {
+	pending map[string]*pendingFile
+	removed bool
+}
+
+// newChangeBatch returns an empty batch.
+func newChangeBatch() *changeBatch {
+	return &changeBatch{pending: make(map[string]*pendingFile)}
+}
+
+// add records a change. Changed files restart their settle time.
+func (b *changeBatch) add(change fileChange, now time.Time) {
+	if change.removed {
+		b.removed = true
+		delete(b.pending, change.path)
+		return
+	}
+	b.pending[change.path] = &pendingFile{size: -1, since: now}
+}
+
+// stable returns the files whose size hasn't changed for at least settle and
+// removes them from the batch. Files that no longer exist are dropped, since
+// their removal is reported separately.
+func (b *changeBatch) stable(now time.Time, settle time.Duration, stat func(string) (int64, error)) []string {
+	var ready []string
+	for path, file := range b.pending {
+		size, err := stat(path)
+		if err != nil {
+			delete(b.pending, path)
+			continue
+		}
+		if size != file.size {
+			file.size = size
+			file.since = now
+			continue
+		}
+		if now.Sub(file.since) >= settle {
+			ready = append(ready, path)
+			delete(b.pending, path)
+		}
+	}
+	sort.Strings(ready)
+	return ready
+}
+
+// fileSize returns the size of the file at path.
+func fileSize(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// watchLoop receives changes in the source directory and calls sync once the
+// changed files are stable, with their paths relative to sourceDir. Removals
+// are passed on once no other files are pending, so that a rename is handled
+// after its new name is synced. It returns when ctx is done or changes is
+// closed.
+func (r *run) watchLoop(ctx context.Context, sourceDir string, changes <-chan fileChange, tick <-chan time.Time, settle time.Duration, now func() time.Time, stat func(string) (int64, error), sync func(paths []string, removed bool)) {
+	batch := newChangeBatch()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			batch.add(change, now())
+
+		case <-tick:
+			ready := batch.stable(now(), settle, stat)
+			removed := batch.removed && len(batch.pending) == 0
+			if len(ready) == 0 && !removed {
+				continue
+			}
+
+			paths := make([]string, 0, len(ready))
+			for _, path := range ready {
+				name, err := relativeName(sourceDir, path)
+				if err != nil {
+					r.logger.Debug("ignoring change outside the source", "path", path, "error", err)
+					continue
+				}
+				paths = append(paths, name)
+			}
+			if removed {
+				batch.removed = false
+			}
+			sync(paths, removed)
+		}
+	}
+}
+
+// watchAndSync syncs the source directory to the destination, then keeps
+// syncing new and changed files until ctx is done. In mirror mode, files that
+// are deleted or renamed in the source are also removed from the destination.
+func (r *run) watchAndSync(ctx context.Context, sourceDir, destinationDir string, prof Profile, jobs int, settle time.Duration) error {
+	watcher, err := newSourceWatcher(sourceDir, r.reporter)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := r.findAndTranscodeFiles(ctx, sourceDir, destinationDir, prof, jobs); err != nil {
+		return err
+	}
+
+	r.reporter.emit(Event{Type: EventStart, Operation: "watch", Path: sourceDir})
+	ticker := time.NewTicker(settle / 2)
+	defer ticker.Stop()
+
+	r.watchLoop(ctx, sourceDir, watcher.changes, ticker.C, settle, time.Now, fileSize, func(paths []string, removed bool) {
+		if len(paths) > 0 {
+			r.logger.Debug("syncing changed files", "paths", paths)
+			if err := r.syncPaths(ctx, []string{sourceDir}, destinationDir, prof, jobs, paths, false); err != nil {
+				r.reporter.fail("watch", sourceDir, err)
+			}
+		}
+		if removed && prof.Mirror {
+			if err := r.removeOrphanedFiles([]string{sourceDir}, destinationDir, prof, false); err != nil {
+				r.reporter.fail("watch", sourceDir, err)
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,172 @@
+//go:build linux
+
+package engine
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask is the set of inotify events that mark a file as changed, created
+// or removed.
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// sourceWatcher reports changes below a directory using inotify. inotify
+// watches aren't recursive, so every directory of the tree is watched, and
+// new directories are added as they appear.
+type sourceWatcher struct {
+	fd      int
+	file    *os.File
+	changes chan fileChange
+
+	// done is closed by Close, so that sends on changes that nobody
+	// receives anymore give up
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	dirs map[int]string
+
+	// reporter receives the errors of new directories that can't be watched
+	reporter *eventReporter
+}
+
+// newSourceWatcher starts watching the directory tree at root, reporting
+// errors to reporter.
+func newSourceWatcher(root string, reporter *eventReporter) (*sourceWatcher, error) {
+	// Non-blocking, so that reads go through the runtime poller and Close
+	// interrupts them
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &sourceWatcher{fd: fd, file: os.NewFile(uintptr(fd), "inotify"), changes: make(chan fileChange, 256), done: make(chan struct{}), dirs: make(map[int]string), reporter: reporter}
+	if err := w.addTree(root, false); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	go w.readEvents()
+	return w, nil
+}
+
+// addTree watches dir and every directory below it. When report is set, the
+// files that are already in the tree are reported as changed, e.g. when an
+// album folder is moved into the source.
+func (w *sourceWatcher) addTree(dir string, report bool) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			if report && !w.send(fileChange{path: path}) {
+				return filepath.SkipAll
+			}
+			return nil
+		}
+		if entry.Name() == TrashDirName || entry.Name() == LogDirName {
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			return err
+		}
+		w.mu.Lock()
+		w.dirs[wd] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// readEvents turns inotify events into changes until the watcher is closed.
+func (w *sourceWatcher) readEvents() {
+	defer close(w.changes)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil || n <= 0 {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(raw.Len)]), "\x00")
+			offset = nameStart + int(raw.Len)
+
+			w.mu.Lock()
+			dir, ok := w.dirs[int(raw.Wd)]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, int(raw.Wd))
+			}
+			w.mu.Unlock()
+			if !ok || name == "" {
+				continue
+			}
+
+			if !w.handle(filepath.Join(dir, name), raw.Mask) {
+				return
+			}
+		}
+	}
+}
+
+// handle reports the change described by an inotify event mask. Returns
+// false if the watcher was closed.
+func (w *sourceWatcher) handle(path string, mask uint32) bool {
+	isDir := mask&syscall.IN_ISDIR != 0
+	switch {
+	case mask&(syscall.IN_DELETE|syscall.IN_MOVED_FROM) != 0:
+		return w.send(fileChange{path: path, removed: true})
+
+	case isDir && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+		if err := w.addTree(path, true); err != nil && !w.closed() {
+			w.reporter.fail("watch", path, err)
+		}
+		return !w.closed()
+
+	case !isDir:
+		return w.send(fileChange{path: path})
+	}
+	return true
+}
+
+// send reports a change, unless the watcher is closed first. Returns false
+// if it was closed.
+func (w *sourceWatcher) send(change fileChange) bool {
+	select {
+	case w.changes <- change:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// closed reports whether Close was called.
+func (w *sourceWatcher) closed() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops watching.
+func (w *sourceWatcher) Close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.done)
+		err = w.file.Close()
+	})
+	return err
+}
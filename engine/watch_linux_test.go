@@ -0,0 +1,90 @@
+//go:build linux
+
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// nextChange waits for the next change from a watcher.
+func nextChange(t *testing.T, w *sourceWatcher) fileChange {
+	select {
+	case change := <-w.changes:
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no change reported")
+		return fileChange{}
+	}
+}
+
+func TestSourceWatcher(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-watch")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	w, err := newSourceWatcher(tempDir, newRun(nil, nil).reporter)
+	assert.NoError(t, err)
+	defer w.Close()
+
+	song := filepath.Join(tempDir, "Song.m4a")
+	os.WriteFile(song, []byte("audio"), 0644)
+	assert.Equal(t, fileChange{path: song}, nextChange(t, w))
+
+	// Files in a folder that is moved into the tree are reported, and the
+	// folder is watched from then on
+	album := filepath.Join(tempDir, "..", filepath.Base(tempDir)+"-album")
+	os.MkdirAll(album, 0755)
+	os.WriteFile(filepath.Join(album, "01.m4a"), []byte("audio"), 0644)
+	os.Rename(album, filepath.Join(tempDir, "Album"))
+
+	for change := nextChange(t, w); change.path != filepath.Join(tempDir, "Album", "01.m4a"); change = nextChange(t, w) {
+		assert.Equal(t, song, change.path)
+	}
+
+	removed := filepath.Join(tempDir, "Album", "01.m4a")
+	os.Remove(removed)
+	change := nextChange(t, w)
+	for !change.removed {
+		change = nextChange(t, w)
+	}
+	assert.Equal(t, removed, change.path)
+}
+
+func TestSourceWatcher_CloseWithoutReader(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-watch-close")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	w, err := newSourceWatcher(tempDir, newRun(nil, nil).reporter)
+	assert.NoError(t, err)
+
+	// More changes than the watcher buffers, which nobody receives
+	for i := 0; i < 2*cap(w.changes); i++ {
+		os.WriteFile(filepath.Join(tempDir, fmt.Sprintf("%03d.m4a", i)), []byte("audio"), 0644)
+	}
+	for len(w.changes) < cap(w.changes) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NoError(t, w.Close())
+
+	// The watcher stops instead of waiting for a receiver: only the
+	// buffered changes are left
+	for i := 0; ; i++ {
+		if _, ok := <-w.changes; !ok {
+			break
+		}
+		if i == cap(w.changes) {
+			t.Fatalf("watcher still sends changes after Close")
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package engine
+
+import "fmt"
+
+// sourceWatcher reports changes below a directory. It is only implemented on
+// Linux, using inotify.
+type sourceWatcher struct {
+	changes chan fileChange
+}
+
+// newSourceWatcher returns an error, since watching needs inotify.
+func newSourceWatcher(root string, reporter *eventReporter) (*sourceWatcher, error) {
+	return nil, fmt.Errorf("watch mode needs inotify, which is only available on Linux")
+}
+
+// Close does nothing.
+func (w *sourceWatcher) Close() error {
+	return nil
+}
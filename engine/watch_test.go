@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangeBatch_Stable(t *testing.T) {
+	sizes := map[string]int64{"/music/a.m4a": 100, "/music/b.m4a": 100}
+	stat := func(path string) (int64, error) {
+		size, ok := sizes[path]
+		if !ok {
+			return 0, fmt.Errorf("not found")
+		}
+		return size, nil
+	}
+
+	start := time.Date(2024, 5, 1, 18, 30, 0, 0, time.UTC)
+	batch := newChangeBatch()
+	batch.add(fileChange{path: "/music/a.m4a"}, start)
+	batch.add(fileChange{path: "/music/b.m4a"}, start)
+	batch.add(fileChange{path: "/music/gone.m4a"}, start)
+
+	// The first check records the sizes
+	assert.Empty(t, batch.stable(start.Add(time.Second), 5*time.Second, stat))
+	assert.Len(t, batch.pending, 2)
+
+	// b is still being written
+	sizes["/music/b.m4a"] = 200
+	assert.Equal(t, []string{"/music/a.m4a"}, batch.stable(start.Add(7*time.Second), 5*time.Second, stat))
+	assert.Empty(t, batch.stable(start.Add(10*time.Second), 5*time.Second, stat))
+	assert.Equal(t, []string{"/music/b.m4a"}, batch.stable(start.Add(12*time.Second), 5*time.Second, stat))
+	assert.Empty(t, batch.pending)
+}
+
+func TestWatchLoop(t *testing.T) {
+	changes := make(chan fileChange)
+	tick := make(chan time.Time)
+	// The clock is read by the loop's goroutine while the test advances it
+	var clockMu sync.Mutex
+	now := time.Date(2024, 5, 1, 18, 30, 0, 0, time.UTC)
+	clock := func() time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) time.Time {
+		clockMu.Lock()
+		defer clockMu.Unlock()
+		now = now.Add(d)
+		return now
+	}
+	stat := func(path string) (int64, error) { return 100, nil }
+
+	type syncCall struct {
+		paths   []string
+		removed bool
+	}
+	calls := make(chan syncCall, 10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go newRun(nil, nil).watchLoop(ctx, "/music", changes, tick, 5*time.Second, clock, stat, func(paths []string, removed bool) {
+		calls <- syncCall{paths, removed}
+	})
+
+	// A rename is a removal of the old name and a new file
+	changes <- fileChange{path: "/music/Artist/Old.m4a", removed: true}
+	changes <- fileChange{path: "/music/Artist/New.m4a"}
+	tick <- clock()
+	tick <- advance(6 * time.Second)
+
+	call := <-calls
+	assert.Equal(t, []string{"/Artist/New.m4a"}, call.paths)
+	assert.True(t, call.removed)
+
+	// Nothing is pending, so further ticks don't sync
+	tick <- advance(6 * time.Second)
+	close(changes)
+	assert.Empty(t, calls)
+}
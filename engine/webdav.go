@@ -0,0 +1,355 @@
+package engine
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// webdavPropfind asks for the properties needed to list and stat files.
+const webdavPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/></D:prop></D:propfind>`
+
+// webdavQuota asks for the free space of a collection (RFC 4331).
+const webdavQuota = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:quota-available-bytes/></D:prop></D:propfind>`
+
+// webdavFS is a writableFS on a WebDAV share, e.g. a NAS or a media box. It
+// is rooted at a directory on the server.
+type webdavFS struct {
+	// base is the scheme and host of the server, without user info
+	base     url.URL
+	root     string
+	user     *url.Userinfo
+	client   *http.Client
+	location string
+}
+
+// newWebDAVFS returns the filesystem of a webdav:// or webdavs:// URL, rooted
+// at the directory root on the server. The user and password of the URL are
+// sent with basic authentication.
+func newWebDAVFS(u *url.URL, root string) *webdavFS {
+	base := url.URL{Scheme: "http", Host: u.Host}
+	if u.Scheme == "webdavs" {
+		base.Scheme = "https"
+	}
+	return &webdavFS{base: base, root: root, user: u.User, client: http.DefaultClient, location: u.Redacted()}
+}
+
+// path returns the path on the server of a name.
+func (w *webdavFS) path(name string) string {
+	return remotePath(w.root, name)
+}
+
+// url returns the URL of a path on the server.
+func (w *webdavFS) url(filePath string) string {
+	u := w.base
+	u.Path = filePath
+	return u.String()
+}
+
+// do sends a request for a name and returns the response if its status is
+// one of ok. A 404 returns an error wrapping fs.ErrNotExist.
+func (w *webdavFS) do(method, name string, header http.Header, body io.Reader, ok ...int) (*http.Response, error) {
+	if err := checkName(strings.ToLower(method), name); err != nil {
+		return nil, err
+	}
+	return w.send(method, w.path(name), name, header, body, ok...)
+}
+
+// send sends a request for a path on the server like do, reporting errors
+// for name.
+func (w *webdavFS) send(method, filePath, name string, header http.Header, body io.Reader, ok ...int) (*http.Response, error) {
+	req, err := http.NewRequest(method, w.url(filePath), body)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if w.user != nil {
+		password, _ := w.user.Password()
+		req.SetBasicAuth(w.user.Username(), password)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, &fs.PathError{Op: strings.ToLower(method), Path: name, Err: err}
+	}
+	for _, status := range ok {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &fs.PathError{Op: strings.ToLower(method), Path: name, Err: fs.ErrNotExist}
+	}
+	return nil, &fs.PathError{Op: strings.ToLower(method), Path: name, Err: fmt.Errorf("%s on %s", resp.Status, w.location)}
+}
+
+// webdavMultistatus is the response to PROPFIND.
+type webdavMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength  string `xml:"getcontentlength"`
+				LastModified   string `xml:"getlastmodified"`
+				QuotaAvailable string `xml:"quota-available-bytes"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// multistatus sends a PROPFIND request with the given body and decodes the
+// response.
+func (w *webdavFS) multistatus(name string, depth int, body string) (*webdavMultistatus, error) {
+	header := http.Header{"Depth": {strconv.Itoa(depth)}, "Content-Type": {"application/xml; charset=utf-8"}}
+	resp, err := w.do("PROPFIND", name, header, strings.NewReader(body), http.StatusMultiStatus)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var status webdavMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, &fs.PathError{Op: "propfind", Path: name, Err: fmt.Errorf("invalid response: %v", err)}
+	}
+	return &status, nil
+}
+
+// propfind returns the file information of a name, and with depth 1 of the
+// files in it, keyed by their path on the server.
+func (w *webdavFS) propfind(name string, depth int) (map[string]remoteFileInfo, error) {
+	status, err := w.multistatus(name, depth, webdavPropfind)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make(map[string]remoteFileInfo)
+	for _, response := range status.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			continue
+		}
+		filePath := path.Clean("/" + href.Path)
+		info := remoteFileInfo{name: path.Base(filePath)}
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200") {
+				continue
+			}
+			prop := propstat.Prop
+			info.dir = prop.ResourceType.Collection != nil
+			info.size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+			info.modTime, _ = http.ParseTime(prop.LastModified)
+		}
+		infos[filePath] = info
+	}
+	return infos, nil
+}
+
+// Stat returns the file information of the named file.
+func (w *webdavFS) Stat(name string) (fs.FileInfo, error) {
+	infos, err := w.propfind(name, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, ok := infos[w.path(name)]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return info, nil
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (w *webdavFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := w.propfind(name, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := w.path(name)
+	if info, ok := infos[dir]; ok && !info.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	var entries []fs.DirEntry
+	for filePath, info := range infos {
+		if filePath != dir && path.Dir(filePath) == dir {
+			entries = append(entries, info)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Open opens the named file for reading, streaming it from the server.
+func (w *webdavFS) Open(name string) (fs.File, error) {
+	resp, err := w.do(http.MethodGet, name, nil, nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	info := remoteFileInfo{name: path.Base(w.path(name)), size: resp.ContentLength}
+	info.modTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &webdavFile{ReadCloser: resp.Body, info: info}, nil
+}
+
+// webdavFile is a file being downloaded from a WebDAV server.
+type webdavFile struct {
+	io.ReadCloser
+	info remoteFileInfo
+}
+
+// Stat returns the file information from the response headers.
+func (f *webdavFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+// Create creates or replaces the named file. The contents are uploaded
+// while they are written; Close waits for the server to store them.
+func (w *webdavFS) Create(name string) (writableFile, error) {
+	if err := checkName("create", name); err != nil {
+		return nil, err
+	}
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		resp, err := w.do(http.MethodPut, name, nil, reader, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+		if err == nil {
+			resp.Body.Close()
+		}
+		// Unblock writes if the upload failed
+		reader.CloseWithError(err)
+		done <- err
+	}()
+	return &webdavWriter{writer: writer, done: done}, nil
+}
+
+// Append opens the named file for appending. WebDAV can't append, so the
+// file is downloaded and uploaded again with the new contents.
+func (w *webdavFS) Append(name string) (writableFile, error) {
+	existing, err := fs.ReadFile(w, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	file, err := w.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write(existing); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// webdavWriter is a file being uploaded to a WebDAV server.
+type webdavWriter struct {
+	writer *io.PipeWriter
+	done   chan error
+	closed bool
+	err    error
+}
+
+// Write uploads data.
+func (f *webdavWriter) Write(data []byte) (int, error) { return f.writer.Write(data) }
+
+// Sync does nothing; the server stores the file when it is closed.
+func (f *webdavWriter) Sync() error { return nil }
+
+// Close finishes the upload and returns its error.
+func (f *webdavWriter) Close() error {
+	if !f.closed {
+		f.closed = true
+		f.writer.Close()
+		f.err = <-f.done
+	}
+	return f.err
+}
+
+// MkdirAll creates the named directory and any missing parents.
+func (w *webdavFS) MkdirAll(name string, perm fs.FileMode) error {
+	if err := checkName("mkdir", name); err != nil {
+		return err
+	}
+	if info, err := w.Stat(name); err == nil && info.IsDir() {
+		return nil
+	}
+
+	dir := "/"
+	for _, part := range strings.Split(strings.TrimPrefix(w.path(name), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		dir = path.Join(dir, part)
+		// 405 Method Not Allowed means the directory already exists
+		resp, err := w.send("MKCOL", dir, name, nil, nil, http.StatusCreated, http.StatusMethodNotAllowed)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Remove removes the named file or directory.
+func (w *webdavFS) Remove(name string) error {
+	resp, err := w.do(http.MethodDelete, name, nil, nil, http.StatusOK, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// RemoveAll removes the named file or directory with everything in it. A
+// missing name is not an error.
+func (w *webdavFS) RemoveAll(name string) error {
+	if err := w.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Rename moves a file, replacing any file at the new name.
+func (w *webdavFS) Rename(oldName, newName string) error {
+	if err := checkName("rename", newName); err != nil {
+		return err
+	}
+	header := http.Header{"Destination": {w.url(w.path(newName))}, "Overwrite": {"T"}}
+	resp, err := w.do("MOVE", oldName, header, nil, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// freeSpace returns the quota that is available in dir, if the server
+// reports one.
+func (w *webdavFS) freeSpace(dir string) (int64, error) {
+	status, err := w.multistatus(dir, 0, webdavQuota)
+	if err != nil {
+		return 0, err
+	}
+	for _, response := range status.Responses {
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200") {
+				continue
+			}
+			if free, err := strconv.ParseInt(propstat.Prop.QuotaAvailable, 10, 64); err == nil && free >= 0 {
+				return free, nil
+			}
+		}
+	}
+	return 0, errFreeSpaceUnknown
+}
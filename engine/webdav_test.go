@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"context"
+	"io/fs"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+// newWebDAVTestServer starts a WebDAV server that serves the files in root.
+func newWebDAVTestServer(root string) *httptest.Server {
+	return httptest.NewServer(&webdav.Handler{FileSystem: webdav.Dir(root), LockSystem: webdav.NewMemLS()})
+}
+
+func TestWebDAVFS(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-webdav")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	server := newWebDAVTestServer(tempDir)
+	defer server.Close()
+
+	fsys, dir, err := newRun(nil, nil).openDestination(strings.Replace(server.URL, "http://", "webdav://", 1) + "/music")
+	assert.NoError(t, err)
+	assert.Equal(t, "/music", dir)
+
+	// Upload creates the missing directories
+	source := filepath.Join(tempDir, "Song Title.mp3")
+	os.WriteFile(source, []byte("audio"), 0644)
+	assert.NoError(t, uploadFile(newOSFS(tempDir), filepath.Base(source), fsys, "Artist/Song Title.mp3"))
+	data, err := os.ReadFile(filepath.Join(tempDir, "music", "Artist", "Song Title.mp3"))
+	assert.NoError(t, err)
+	assert.Equal(t, "audio", string(data))
+	assert.NoFileExists(t, filepath.Join(tempDir, "music", "Artist", ".Song Title.mp3.part"))
+
+	names, err := getFilenames(fsys, ".")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/Artist/Song Title.mp3"}, names)
+
+	info, err := fsys.Stat("Artist/Song Title.mp3")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), info.Size())
+	assert.False(t, info.IsDir())
+
+	data, err = fs.ReadFile(fsys, "Artist/Song Title.mp3")
+	assert.NoError(t, err)
+	assert.Equal(t, "audio", string(data))
+
+	// Appending uploads the file again with the new contents
+	file, err := fsys.Append("journal.txt")
+	assert.NoError(t, err)
+	file.Write([]byte("first\n"))
+	assert.NoError(t, file.Close())
+	file, err = fsys.Append("journal.txt")
+	assert.NoError(t, err)
+	file.Write([]byte("second\n"))
+	assert.NoError(t, file.Close())
+	data, _ = os.ReadFile(filepath.Join(tempDir, "music", "journal.txt"))
+	assert.Equal(t, "first\nsecond\n", string(data))
+
+	assert.NoError(t, fsys.Remove("journal.txt"))
+	_, err = fsys.Stat("journal.txt")
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, os.IsNotExist(fsys.Remove("journal.txt")))
+	assert.NoError(t, fsys.RemoveAll("journal.txt"))
+}
+
+func TestSync_WebDAV(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test-webdav-sync")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	sourceDir := filepath.Join(tempDir, "source")
+	serverDir := filepath.Join(tempDir, "server")
+	for _, path := range []string{"source/Artist/a.m4a", "source/Artist/b.mp3", "server/music/Old/c.mp3", "server/music/Old/c.m4a"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(tempDir, path)), 0755)
+		os.WriteFile(filepath.Join(tempDir, path), []byte("audio"), 0644)
+	}
+
+	server := newWebDAVTestServer(serverDir)
+	defer server.Close()
+	destination := strings.Replace(server.URL, "http://", "webdav://", 1) + "/music"
+
+	fake := newFakeTranscoder()
+	report, err := Sync(context.Background(), Options{Sources: []string{sourceDir}, Destination: destination, Jobs: 2, Transcoder: fake})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"copied": 1, "transcoded": 1}, report.Counts["sync"])
+	assert.FileExists(t, filepath.Join(serverDir, "music", "Artist", "a.mp3"))
+	assert.FileExists(t, filepath.Join(serverDir, "music", "Artist", "b.mp3"))
+
+	missing, err := Verify(context.Background(), Options{Sources: []string{sourceDir}, Destination: destination})
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+
+	// Duplicates are moved to the trash on the server
+	report, err = Dedupe(context.Background(), DedupeOptions{Dir: destination})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"kept": 1, "deleted": 1}, report.Counts["dedupe"])
+	assert.FileExists(t, filepath.Join(serverDir, "music", "Old", "c.mp3"))
+	assert.NoFileExists(t, filepath.Join(serverDir, "music", "Old", "c.m4a"))
+	assert.DirExists(t, filepath.Join(serverDir, "music", TrashDirName))
+
+	_, err = Dedupe(context.Background(), DedupeOptions{Dir: destination, ByContent: true})
+	assert.Error(t, err)
+}
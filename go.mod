@@ -3,12 +3,20 @@ module sync-and-transcode-music-files
 go 1.26
 
 require (
-	github.com/stretchr/testify v1.5.1
+	github.com/pkg/sftp v1.13.9
+	github.com/stretchr/testify v1.10.0
 	github.com/xfrr/goffmpeg v1.0.0
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.25.0
+	golang.org/x/sync v0.17.0
+	gopkg.in/yaml.v2 v2.2.2
 )
 
 require (
-	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	gopkg.in/yaml.v2 v2.2.2 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
 )
@@ -9,22 +8,17 @@ import (
 var version = "dev"
 
 func main() {
-	sourcePtr := flag.String("source", "source", "Directory in which to find original music files")
-	destinationPtr := flag.String("destination", "destination", "Output directory for transcoded files")
-	dryRunPtr := flag.Bool("dry-run", false, "Show which duplicate files would be deleted without deleting them")
-
-	flag.Parse()
-
-	sourceDir := *sourcePtr
-	destinationDir := *destinationPtr
-	dryRun := *dryRunPtr
-
-	if err := findAndTranscodeFiles(sourceDir, destinationDir); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
 	}
 
-	if err := removeDuplicateFiles(destinationDir, dryRun); err != nil {
+	if err := runSyncCommand(os.Args[1:]); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
 	}
@@ -57,6 +57,7 @@ func TestMainFunction_DryRunFlag(t *testing.T) {
 
 	sourceDir := filepath.Join(tempDir, "source")
 	_ = os.MkdirAll(sourceDir, 0755)
+	os.WriteFile(filepath.Join(sourceDir, "new.mp3"), make([]byte, 100), 0644)
 	destinationDir := filepath.Join(tempDir, "destination")
 	_ = os.MkdirAll(destinationDir, 0755)
 
@@ -71,7 +72,31 @@ func TestMainFunction_DryRunFlag(t *testing.T) {
 
 	main()
 
-	// Dry run must not delete anything
+	// Dry run must not sync or delete anything, nor write a lock or log
 	assert.FileExists(t, mp3File)
 	assert.FileExists(t, m4aFile)
+	entries, err := os.ReadDir(destinationDir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestMainFunction_DedupeCommand(t *testing.T) {
+	oldArgs := os.Args
+	tempDir, _ := setupMainTest(t)
+	defer func() {
+		os.Args = oldArgs
+		os.RemoveAll(tempDir)
+	}()
+
+	mp3File := filepath.Join(tempDir, "song.mp3")
+	m4aFile := filepath.Join(tempDir, "song.m4a")
+	os.WriteFile(mp3File, make([]byte, 100), 0644)
+	os.WriteFile(m4aFile, make([]byte, 200), 0644)
+
+	os.Args = []string{"cmd", "dedupe", "-dir=" + tempDir}
+
+	main()
+
+	assert.FileExists(t, mp3File)
+	assert.NoFileExists(t, m4aFile)
 }
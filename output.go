@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"sync-and-transcode-music-files/engine"
+)
+
+// eventPrinter writes the events of a run either as human-friendly lines
+// with emoji (the default) or as NDJSON for scripts. In quiet human mode only
+// warnings and errors are shown.
+type eventPrinter struct {
+	json   bool
+	quiet  bool
+	stdout io.Writer
+	stderr io.Writer
+	mu     sync.Mutex
+
+	// progress, if set, shows a live progress display in human mode
+	progress *progressDisplay
+}
+
+// newEventPrinter returns a printer for the output mode "human" or "json".
+// In JSON mode every event goes to stdout; in human mode warnings and errors
+// go to stderr.
+func newEventPrinter(mode string, stdout, stderr io.Writer) *eventPrinter {
+	return &eventPrinter{json: mode == "json", stdout: stdout, stderr: stderr}
+}
+
+// outputFromFlags returns the printer for the output mode given with -output
+// and the -v and -q flags. Interactive review prompts on stdout, so it can't
+// be combined with JSON output.
+func outputFromFlags(mode string, interactive, verbose, quiet bool) (*eventPrinter, error) {
+	if mode != "human" && mode != "json" {
+		return nil, fmt.Errorf("unknown output mode %q, expected human or json", mode)
+	}
+	if mode == "json" && interactive {
+		return nil, fmt.Errorf("-interactive can't be used with -output json")
+	}
+	if verbose && quiet {
+		return nil, fmt.Errorf("-v and -q can't be used together")
+	}
+
+	printer := newEventPrinter(mode, os.Stdout, os.Stderr)
+	printer.quiet = quiet
+	return printer, nil
+}
+
+// handle writes an event. It is passed to the engine as the event callback.
+func (p *eventPrinter) handle(e engine.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.json {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return
+		}
+		p.stdout.Write(append(data, '\n'))
+		return
+	}
+
+	line := humanReadableEvent(e)
+	if line != "" {
+		if e.Type == engine.EventWarning || e.Type == engine.EventError {
+			p.println(p.stderr, line)
+		} else if !p.quiet {
+			p.println(p.stdout, line)
+		}
+	}
+
+	if p.progress != nil && !p.quiet {
+		p.progress.update(e)
+	}
+}
+
+// println writes a line of human-readable output, above the progress
+// display if there is one.
+func (p *eventPrinter) println(w io.Writer, line string) {
+	if p.progress != nil {
+		p.progress.println(w, line)
+		return
+	}
+	fmt.Fprintln(w, line)
+}
+
+// humanReadableEvent formats an event as a line of human-friendly output.
+// Events that aren't interesting to people, such as plan items and per-file
+// progress, return an empty string.
+func humanReadableEvent(e engine.Event) string {
+	switch e.Type {
+	case engine.EventStart:
+		switch e.Operation {
+		case "scan":
+			return fmt.Sprintf("🔍 Finding files in source directory %s", e.Path)
+		case "analyze-loudness":
+			return fmt.Sprintf("📈 Analyzing loudness of %d files", e.Total)
+		case "fingerprint":
+			return fmt.Sprintf("🎧 Fingerprinting music files in %s", e.Path)
+		case "resume":
+			return fmt.Sprintf("⏯️  Resuming interrupted sync of %s (%d of %d files were finished)", e.Path, e.Done, e.Total)
+		case "wait-for-lock":
+			return fmt.Sprintf("🔒 Waiting for the run syncing %s to finish (%s)", e.Path, e.Message)
+		case "watch":
+			return fmt.Sprintf("👀 Watching %s for new music", e.Path)
+		case "daemon":
+			return fmt.Sprintf("🔌 Waiting for devices to sync from %s", e.Path)
+		case "sync-volume":
+			return fmt.Sprintf("💾 Syncing %s with profile %s", e.Path, e.Message)
+		}
+
+	case engine.EventFinished:
+		switch e.Operation {
+		case "transcode":
+			if e.DryRun {
+				return fmt.Sprintf("🔍 [dry-run] Would transcode: %s ➡️  %s", e.Source, e.Destination)
+			}
+			return fmt.Sprintf("🔊 Transcoded: %s ➡️  %s", e.Source, e.Destination)
+		case "copy":
+			if e.DryRun {
+				return fmt.Sprintf("🔍 [dry-run] Would copy MP3: %s", e.Destination)
+			}
+			return fmt.Sprintf("📂 Copied MP3: %s", e.Destination)
+		case "keep":
+			return fmt.Sprintf("✅ Keeping: %s", e.Path)
+		case "keep-different-edit":
+			return fmt.Sprintf("🎼 Keeping different edit: %s", e.Path)
+		case "delete":
+			if e.DryRun {
+				return fmt.Sprintf("🔍 [dry-run] Would delete duplicate: %s", e.Path)
+			}
+			return fmt.Sprintf("🗑️  Deleted duplicate: %s (moved to %s)", e.Path, e.Destination)
+		case "sync-volume":
+			return fmt.Sprintf("✅ Safe to unplug %s", e.Path)
+		case "remove-orphan":
+			if e.DryRun {
+				return fmt.Sprintf("🔍 [dry-run] Would remove file no longer in source: %s", e.Path)
+			}
+			return fmt.Sprintf("🗑️  Removed file no longer in source: %s (moved to %s)", e.Path, e.Destination)
+		case "restore":
+			return fmt.Sprintf("♻️  Restored: %s", e.Path)
+		case "purge":
+			return fmt.Sprintf("🔥 Purged trash from %s", e.Path)
+		}
+
+	case engine.EventWarning:
+		if e.Path != "" {
+			return fmt.Sprintf("⚠️  %s: %s", e.Message, e.Path)
+		}
+		return fmt.Sprintf("⚠️  %s", e.Message)
+
+	case engine.EventError:
+		if e.Path != "" {
+			return fmt.Sprintf("❗️ Error during %s of %s: %s", e.Operation, e.Path, e.Error)
+		}
+		return fmt.Sprintf("❗️ Error during %s: %s", e.Operation, e.Error)
+
+	case engine.EventSummary:
+		return fmt.Sprintf("✨ Finished %s: %s", e.Operation, formatCounts(e.Counts))
+	}
+
+	return ""
+}
+
+// formatCounts formats summary counts as "copied 2, transcoded 5".
+func formatCounts(counts map[string]int) string {
+	if len(counts) == 0 {
+		return "nothing to do"
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, fmt.Sprintf("%s %d", strings.ReplaceAll(key, "_", " "), counts[key]))
+	}
+	return strings.Join(parts, ", ")
+}
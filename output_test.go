@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"sync-and-transcode-music-files/engine"
+)
+
+func TestEventPrinter_JSON(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	p := newEventPrinter("json", &stdout, &stderr)
+
+	p.handle(engine.Event{Version: engine.EventSchemaVersion, Time: time.Now(), Type: engine.EventFinished, Operation: "transcode", Source: "/music/Song.m4a", Destination: "/usb/Song.mp3"})
+	p.handle(engine.Event{Version: engine.EventSchemaVersion, Time: time.Now(), Type: engine.EventError, Operation: "copy", Path: "/music/Other.mp3", Error: "disk full"})
+
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Empty(t, stderr.String())
+
+	var decoded map[string]any
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &decoded))
+	assert.Equal(t, float64(engine.EventSchemaVersion), decoded["v"])
+	assert.Equal(t, "finished", decoded["type"])
+	assert.Equal(t, "transcode", decoded["operation"])
+	assert.Equal(t, "/usb/Song.mp3", decoded["destination"])
+	assert.NotEmpty(t, decoded["time"])
+	assert.NotContains(t, decoded, "error")
+
+	assert.NoError(t, json.Unmarshal([]byte(lines[1]), &decoded))
+	assert.Equal(t, "error", decoded["type"])
+	assert.Equal(t, "disk full", decoded["error"])
+}
+
+func TestEventPrinter_Human(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	p := newEventPrinter("human", &stdout, &stderr)
+
+	p.handle(engine.Event{Type: engine.EventPlan, Operation: "copy", Source: "/music/Song.mp3"})
+	p.handle(engine.Event{Type: engine.EventFinished, Operation: "copy", Destination: "/usb/Song.mp3"})
+	p.handle(engine.Event{Type: engine.EventWarning, Operation: "plan", Path: "/usb/Artist", Message: "Exceeds device limits, too many files"})
+	p.handle(engine.Event{Type: engine.EventSummary, Operation: "sync", Counts: map[string]int{"copied": 1, "would_delete": 2}})
+
+	assert.Equal(t, "📂 Copied MP3: /usb/Song.mp3\n✨ Finished sync: copied 1, would delete 2\n", stdout.String())
+	assert.Equal(t, "⚠️  Exceeds device limits, too many files: /usb/Artist\n", stderr.String())
+}
+
+func TestEventPrinter_Quiet(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	p := newEventPrinter("human", &stdout, &stderr)
+	p.quiet = true
+
+	p.handle(engine.Event{Type: engine.EventFinished, Operation: "copy", Destination: "/usb/Song.mp3"})
+	p.handle(engine.Event{Type: engine.EventError, Operation: "transcode", Path: "/music/Broken.m4a", Error: "exit status 1"})
+
+	assert.Empty(t, stdout.String())
+	assert.Equal(t, "❗️ Error during transcode of /music/Broken.m4a: exit status 1\n", stderr.String())
+}
+
+func TestOutputFromFlags(t *testing.T) {
+	printer, err := outputFromFlags("json", false, false, false)
+	assert.NoError(t, err)
+	assert.True(t, printer.json)
+	assert.Nil(t, printer.progress)
+
+	_, err = outputFromFlags("xml", false, false, false)
+	assert.Error(t, err)
+	_, err = outputFromFlags("json", true, false, false)
+	assert.Error(t, err)
+	_, err = outputFromFlags("human", false, true, true)
+	assert.Error(t, err)
+}
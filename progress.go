@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"sync-and-transcode-music-files/engine"
+)
+
+const (
+	// progressRedrawInterval limits how often the terminal display is redrawn.
+	progressRedrawInterval = 200 * time.Millisecond
+
+	// progressLineInterval is how often a plain progress line is printed when
+	// the output is not a terminal, e.g. when it is redirected to a file.
+	progressLineInterval = 30 * time.Second
+)
+
+// workerStatus is the file a worker is currently transcoding or copying.
+type workerStatus struct {
+	path    string
+	percent float64
+}
+
+// progressDisplay shows how far along a sync is: files and bytes done, audio
+// minutes transcoded, what each worker is doing, throughput and ETA. On a
+// terminal it is redrawn in place below the regular output; otherwise a plain
+// line is printed every progressLineInterval.
+//
+// It is fed the events of the run by the eventPrinter.
+type progressDisplay struct {
+	out      io.Writer
+	terminal bool
+	now      func() time.Time
+
+	started      time.Time
+	totalFiles   int
+	doneFiles    int
+	totalBytes   int64
+	doneBytes    int64
+	audioSeconds float64
+	workers      map[int]workerStatus
+
+	lastDrawn time.Time
+	lines     int
+}
+
+// newProgressDisplay returns a display writing to out. On a terminal the
+// display is redrawn in place.
+func newProgressDisplay(out io.Writer, terminal bool, now func() time.Time) *progressDisplay {
+	return &progressDisplay{out: out, terminal: terminal, now: now, workers: make(map[int]workerStatus)}
+}
+
+// isTerminal reports whether the file is a terminal rather than a pipe or a
+// regular file.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// update records an event and redraws the display if enough time has passed.
+func (d *progressDisplay) update(e engine.Event) {
+	switch {
+	case e.Type == engine.EventPlan:
+		if d.started.IsZero() {
+			d.started = d.now()
+		}
+		d.totalFiles++
+		d.totalBytes += e.Bytes
+
+	case e.Type == engine.EventStart && e.Worker > 0:
+		d.workers[e.Worker] = workerStatus{path: e.Source}
+
+	case e.Type == engine.EventProgress && e.Worker > 0:
+		d.workers[e.Worker] = workerStatus{path: e.Source, percent: e.Percent}
+
+	case e.Type == engine.EventProgress && e.Operation == "sync":
+		d.doneFiles = e.Done
+
+	case e.Type == engine.EventFinished && e.Worker > 0:
+		d.doneBytes += e.Bytes
+		d.audioSeconds += e.Seconds
+		delete(d.workers, e.Worker)
+
+	case e.Type == engine.EventError && e.Worker > 0:
+		delete(d.workers, e.Worker)
+
+	case e.Type == engine.EventSummary && e.Operation == "sync":
+		d.clear()
+		d.totalFiles = 0
+		return
+
+	default:
+		return
+	}
+
+	if d.totalFiles == 0 {
+		return
+	}
+	interval := progressRedrawInterval
+	if !d.terminal {
+		interval = progressLineInterval
+	}
+	if d.now().Sub(d.lastDrawn) >= interval {
+		d.draw()
+	}
+}
+
+// println prints a line of regular output to w above the display.
+func (d *progressDisplay) println(w io.Writer, line string) {
+	if !d.terminal || d.lines == 0 {
+		fmt.Fprintln(w, line)
+		return
+	}
+	d.clear()
+	fmt.Fprintln(w, line)
+	d.draw()
+}
+
+// clear removes the display from the terminal.
+func (d *progressDisplay) clear() {
+	if d.terminal && d.lines > 0 {
+		fmt.Fprintf(d.out, "\x1b[%dA\x1b[J", d.lines)
+		d.lines = 0
+	}
+}
+
+// draw prints the display, replacing the previous one on a terminal.
+func (d *progressDisplay) draw() {
+	d.lastDrawn = d.now()
+	if !d.terminal {
+		fmt.Fprintln(d.out, "⏳ "+d.summary())
+		return
+	}
+
+	d.clear()
+	lines := append([]string{"⏳ " + d.summary()}, d.workerLines()...)
+	for _, line := range lines {
+		fmt.Fprintln(d.out, line)
+	}
+	d.lines = len(lines)
+}
+
+// summary formats the overall progress as a single line.
+func (d *progressDisplay) summary() string {
+	elapsed := d.now().Sub(d.started)
+	parts := []string{
+		fmt.Sprintf("%d/%d files", d.doneFiles, d.totalFiles),
+		fmt.Sprintf("%s/%s", engine.FormatBytes(d.doneBytes), engine.FormatBytes(d.totalBytes)),
+		fmt.Sprintf("%.0f audio min", d.audioSeconds/60),
+	}
+
+	if elapsed > 0 && d.doneBytes > 0 {
+		rate := float64(d.doneBytes) / elapsed.Seconds()
+		parts = append(parts, engine.FormatBytes(int64(rate))+"/s")
+		remaining := time.Duration(float64(d.totalBytes-d.doneBytes) / rate * float64(time.Second))
+		parts = append(parts, "ETA "+formatETA(remaining))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// workerLines formats the file and ffmpeg progress of each busy worker.
+func (d *progressDisplay) workerLines() []string {
+	ids := make([]int, 0, len(d.workers))
+	for id := range d.workers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	lines := make([]string, 0, len(ids))
+	for _, id := range ids {
+		status := d.workers[id]
+		lines = append(lines, fmt.Sprintf("   [%d] %3.0f%% %s", id, status.percent, status.path))
+	}
+	return lines
+}
+
+// formatETA formats a remaining duration rounded to seconds or minutes.
+func formatETA(remaining time.Duration) string {
+	if remaining < time.Hour {
+		return remaining.Round(time.Second).String()
+	}
+	return remaining.Round(time.Minute).String()
+}
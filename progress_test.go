@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"sync-and-transcode-music-files/engine"
+)
+
+// fakeClock returns a clock for tests that starts at a fixed time and is
+// advanced by hand.
+func fakeClock() (func() time.Time, func(time.Duration)) {
+	now := time.Date(2024, 5, 1, 18, 30, 0, 0, time.UTC)
+	return func() time.Time { return now }, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestProgressDisplay_PlainLines(t *testing.T) {
+	var out bytes.Buffer
+	now, advance := fakeClock()
+	d := newProgressDisplay(&out, false, now)
+
+	d.update(engine.Event{Type: engine.EventPlan, Operation: "transcode", Bytes: 30_000_000})
+	d.update(engine.Event{Type: engine.EventPlan, Operation: "copy", Bytes: 10_000_000})
+	out.Reset()
+
+	advance(10 * time.Second)
+	d.update(engine.Event{Type: engine.EventStart, Operation: "transcode", Source: "/music/a.m4a", Worker: 1})
+	d.update(engine.Event{Type: engine.EventFinished, Operation: "transcode", Source: "/music/a.m4a", Worker: 1, Bytes: 30_000_000, Seconds: 240})
+	d.update(engine.Event{Type: engine.EventProgress, Operation: "sync", Done: 1, Total: 2})
+
+	// Not a terminal, so nothing is printed until the line interval passed
+	assert.Empty(t, out.String())
+
+	advance(progressLineInterval)
+	d.update(engine.Event{Type: engine.EventStart, Operation: "copy", Source: "/music/b.mp3", Worker: 1})
+	assert.Equal(t, "⏳ 1/2 files, 30.0 MB/40.0 MB, 4 audio min, 750.0 kB/s, ETA 13s\n", out.String())
+}
+
+func TestProgressDisplay_Terminal(t *testing.T) {
+	var out bytes.Buffer
+	now, advance := fakeClock()
+	d := newProgressDisplay(&out, true, now)
+
+	d.update(engine.Event{Type: engine.EventPlan, Operation: "transcode", Bytes: 1000})
+	d.update(engine.Event{Type: engine.EventPlan, Operation: "transcode", Bytes: 1000})
+	advance(time.Second)
+	d.update(engine.Event{Type: engine.EventStart, Operation: "transcode", Source: "/music/a.m4a", Worker: 1})
+	advance(time.Second)
+	d.update(engine.Event{Type: engine.EventProgress, Operation: "transcode", Source: "/music/b.m4a", Worker: 2, Percent: 42})
+
+	// The display shows each worker and is erased before it is redrawn
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	assert.Contains(t, lines[len(lines)-3], "0/2 files")
+	assert.Equal(t, "   [1]   0% /music/a.m4a", lines[len(lines)-2])
+	assert.Equal(t, "   [2]  42% /music/b.m4a", lines[len(lines)-1])
+	assert.Contains(t, out.String(), "\x1b[2A\x1b[J")
+
+	// Regular output is printed above the display
+	out.Reset()
+	d.println(&out, "🔊 Transcoded: a")
+	assert.True(t, strings.HasPrefix(out.String(), "\x1b[3A\x1b[J🔊 Transcoded: a\n⏳ "))
+
+	// The display is removed when the sync finishes
+	out.Reset()
+	d.update(engine.Event{Type: engine.EventSummary, Operation: "sync"})
+	assert.Equal(t, "\x1b[3A\x1b[J", out.String())
+}